@@ -9,6 +9,10 @@ import (
 	"github.com/wajidp/micro-payment-gateway/internal/http"
 	"github.com/wajidp/micro-payment-gateway/internal/logger"
 	"github.com/wajidp/micro-payment-gateway/internal/service"
+	"github.com/wajidp/micro-payment-gateway/internal/service/currency"
+	"github.com/wajidp/micro-payment-gateway/internal/service/database"
+	"github.com/wajidp/micro-payment-gateway/internal/service/fx"
+	"github.com/wajidp/micro-payment-gateway/internal/service/gateway"
 	"github.com/wajidp/micro-payment-gateway/internal/service/model"
 	"github.com/wajidp/micro-payment-gateway/internal/tcp"
 )
@@ -25,12 +29,52 @@ func main() {
 	//inits default gin router
 	router := gin.Default()
 	//create service
-	service := service.NewPaymentProcessor(model.PgRoutingMasters)
+	if err := configureCurrencies(); err != nil {
+		log.Fatalf("%v - %v", "Cannot Configure Currencies", err.Error())
+	}
+	processor := service.NewPaymentProcessor(model.PgRoutingMasters).(*service.PaymentProcessor)
+	processor.Idempotency = service.NewIdempotencyStore(config.AppConfig.IdempotencyTTL)
+	if err := configureWalletStore(processor); err != nil {
+		log.Fatalf("%v - %v", "Cannot Open Wallet Store", err.Error())
+	}
+	if err := configureGateways(processor); err != nil {
+		log.Fatalf("%v - %v", "Cannot Configure Gateways", err.Error())
+	}
+	if err := configureRouting(processor); err != nil {
+		log.Fatalf("%v - %v", "Cannot Configure Routing", err.Error())
+	}
+	if err := configureRates(processor); err != nil {
+		log.Fatalf("%v - %v", "Cannot Configure Exchange Rates", err.Error())
+	}
+	if path := config.AppConfig.TransactionFeesFile; path != "" {
+		fees, err := service.LoadTransactionFees(path)
+		if err != nil {
+			log.Fatalf("%v - %v", "Cannot Load Transaction Fees", err.Error())
+		}
+		processor.Fees = fees
+	}
 	//register routes
-	http.RegisterRoutes(router, service)
+	http.RegisterRoutes(router, processor, processor)
+
+	//poll gateways for transactions whose callback never arrived
+	if config.AppConfig.ReconInterval > 0 {
+		processor.ExpireAfter = config.AppConfig.ReconExpireAfter
+		processor.StartReconciler(config.AppConfig.ReconInterval, config.AppConfig.ReconMaxAge)
+	}
 
 	//start the tcp server for iso8583 implementation
-	go tcp.NewTCPServer(service).Start(config.AppConfig.TcpPort)
+	tcpServer, err := tcp.NewTCPServer(processor, tcp.Options{
+		Framing:        config.AppConfig.TcpFraming,
+		Encoding:       config.AppConfig.TcpEncoding,
+		MaxMessageSize: config.AppConfig.TcpMaxMessageSize,
+		MaxConcurrent:  config.AppConfig.TcpMaxConcurrent,
+		IdleTimeout:    config.AppConfig.TcpIdleTimeout,
+		ReversalWindow: config.AppConfig.TcpReversalWindow,
+	})
+	if err != nil {
+		log.Fatalf("%v - %v", "Cannot Create TCP Server", err.Error())
+	}
+	go tcpServer.Start(config.AppConfig.TcpPort)
 
 	logger.Infof("Starting HTTP Server %s", config.AppConfig.ServerAddress)
 	//run the server
@@ -39,3 +83,117 @@ func main() {
 	}
 
 }
+
+// configureCurrencies applies the currency config file to the currency registry
+func configureCurrencies() error {
+	path := config.AppConfig.CurrencyConfigFile
+	if path == "" {
+		return nil
+	}
+	settings, err := currency.LoadSettings(path)
+	if err != nil {
+		return err
+	}
+	if err := currency.Default().Configure(settings); err != nil {
+		return err
+	}
+	logger.Infof("Currency config loaded from %s with %d currencies", path, len(settings))
+	return nil
+}
+
+// configureWalletStore sets the wallet repository of the processor from config
+func configureWalletStore(processor *service.PaymentProcessor) error {
+	switch config.AppConfig.WalletStore {
+	case "memory", "":
+		return nil
+	case "sqlite":
+		db, err := database.OpenSQLite(config.AppConfig.DatabaseDSN)
+		if err != nil {
+			return err
+		}
+		walletRepo, err := database.NewSQLWalletRepo(db)
+		if err != nil {
+			return err
+		}
+		processor.WalletRepo = walletRepo
+		logger.Infof("Wallets stored in %s", config.AppConfig.DatabaseDSN)
+		return nil
+	default:
+		return fmt.Errorf("unknown wallet store %q", config.AppConfig.WalletStore)
+	}
+}
+
+// configureGateways builds the gateway clients from the gateway config file
+func configureGateways(processor *service.PaymentProcessor) error {
+	path := config.AppConfig.GatewayConfigFile
+	if path == "" {
+		return nil
+	}
+	configs, err := gateway.LoadGatewayConfigs(path)
+	if err != nil {
+		return err
+	}
+	factory, err := gateway.NewConfiguredGatewayFactory(configs)
+	if err != nil {
+		return err
+	}
+	processor.Factory = factory
+	logger.Infof("Gateway config loaded from %s with %d gateways", path, len(configs))
+	return nil
+}
+
+// configureRouting loads the routing table and sets the routing strategy of the processor from config
+func configureRouting(processor *service.PaymentProcessor) error {
+	if path := config.AppConfig.RoutingFile; path != "" {
+		pgms, err := service.LoadRoutingFile(path)
+		if err != nil {
+			return err
+		}
+		// set first, the IDs assigned to routes without one are saved to the file
+		processor.RoutingFile = path
+		if err := processor.SetRoutingMasters(pgms); err != nil {
+			return err
+		}
+		service.WatchRoutingFile(path, processor.SetRoutingMasters)
+		logger.Infof("Routing table loaded from %s with %d routes", path, len(pgms))
+	}
+
+	switch config.AppConfig.RoutingStrategy {
+	case service.StrategyPriority, "":
+		return nil
+	case service.StrategySmart:
+		fees := model.FeeSchedule{}
+		if config.AppConfig.FeeScheduleFile != "" {
+			var err error
+			if fees, err = service.LoadFeeSchedule(config.AppConfig.FeeScheduleFile); err != nil {
+				return err
+			}
+		}
+		processor.Strategy = service.NewSmartRouting(processor, fees)
+		return nil
+	default:
+		return fmt.Errorf("unknown routing strategy %q", config.AppConfig.RoutingStrategy)
+	}
+}
+
+// configureRates sets the exchange rate provider of the processor from config,
+// the rate service is preferred over the rates file
+func configureRates(processor *service.PaymentProcessor) error {
+	switch {
+	case config.AppConfig.FxRatesURL != "":
+		client, err := gateway.NewHTTPClient(gateway.GatewayConfig{BaseURL: config.AppConfig.FxRatesURL})
+		if err != nil {
+			return err
+		}
+		processor.Rates = fx.NewHTTPProvider(client, config.AppConfig.FxRatesURL)
+		logger.Infof("Exchange rates quoted by %s", config.AppConfig.FxRatesURL)
+	case config.AppConfig.FxRatesFile != "":
+		rates, err := fx.NewFileProvider(config.AppConfig.FxRatesFile, config.AppConfig.FxRatesMaxAge)
+		if err != nil {
+			return err
+		}
+		processor.Rates = rates
+		logger.Infof("Exchange rates loaded from %s", config.AppConfig.FxRatesFile)
+	}
+	return nil
+}
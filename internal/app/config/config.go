@@ -1,6 +1,8 @@
 package config
 
 import (
+	"time"
+
 	"github.com/spf13/viper"
 )
 
@@ -9,6 +11,57 @@ type Env struct {
 	ServerAddress string `mapstructure:"SERVER_ADDRESS"`
 	TcpPort       string `mapstructure:"TCP_PORT"`
 	LogEncoding   string
+
+	// ISO8583 over TCP wire format
+	TcpFraming        string `mapstructure:"TCP_FRAMING"`
+	TcpEncoding       string `mapstructure:"TCP_ENCODING"`
+	TcpMaxMessageSize int    `mapstructure:"TCP_MAX_MESSAGE_SIZE"`
+	// TcpMaxConcurrent limits the messages processed at once per connection,
+	// connections without a frame for TcpIdleTimeout are closed
+	TcpMaxConcurrent int           `mapstructure:"TCP_MAX_CONCURRENT"`
+	TcpIdleTimeout   time.Duration `mapstructure:"TCP_IDLE_TIMEOUT"`
+	// TcpReversalWindow is how long an ISO8583 transaction can be reversed
+	TcpReversalWindow time.Duration `mapstructure:"TCP_REVERSAL_WINDOW"`
+
+	// Gateway routing
+	RoutingStrategy string `mapstructure:"ROUTING_STRATEGY"`
+	FeeScheduleFile string `mapstructure:"FEE_SCHEDULE_FILE"`
+	RoutingFile     string `mapstructure:"ROUTING_FILE"`
+
+	// GatewayConfigFile holds the endpoints, timeouts and TLS settings of the gateways
+	GatewayConfigFile string `mapstructure:"GATEWAY_CONFIG_FILE"`
+
+	// Reconciliation of transactions whose callback never arrived, disabled when the interval is 0
+	ReconInterval time.Duration `mapstructure:"RECON_INTERVAL"`
+	ReconMaxAge   time.Duration `mapstructure:"RECON_MAX_AGE"`
+	// ReconExpireAfter is the age at which a transaction still without a final state expires, 0 never expires
+	ReconExpireAfter time.Duration `mapstructure:"RECON_EXPIRE_AFTER"`
+
+	// IdempotencyTTL is how long idempotency keys of deposits and withdrawals are kept
+	IdempotencyTTL time.Duration `mapstructure:"IDEMPOTENCY_TTL"`
+
+	// CurrencyConfigFile enables currencies and sets their amount limits, USD, EUR and AED are enabled without it
+	CurrencyConfigFile string `mapstructure:"CURRENCY_CONFIG_FILE"`
+
+	// Exchange rates of cross-currency deposits and withdrawals, from a rates file or a
+	// rate service; conversions are disabled when neither is set
+	FxRatesFile string `mapstructure:"FX_RATES_FILE"`
+	FxRatesURL  string `mapstructure:"FX_RATES_URL"`
+	// FxRatesMaxAge is how long the rates of the file can be used after they were updated
+	FxRatesMaxAge time.Duration `mapstructure:"FX_RATES_MAX_AGE"`
+
+	// TransactionFeesFile holds the fees charged to users per currency, no fees are charged without it
+	TransactionFeesFile string `mapstructure:"TRANSACTION_FEES_FILE"`
+
+	// WalletStore keeps wallets, transactions, holds and the ledger in "memory" or in a "sqlite" database at DatabaseDSN
+	WalletStore string `mapstructure:"WALLET_STORE"`
+	DatabaseDSN string `mapstructure:"DATABASE_DSN"`
+
+	// AdminAPIKeys lists the user:token pairs of the admin endpoints, the user of a token
+	// is recorded in the audit trail. AdminAPIKey is a token of the user "admin".
+	// The endpoints are disabled when neither is set.
+	AdminAPIKeys string `mapstructure:"ADMIN_API_KEYS"`
+	AdminAPIKey  string `mapstructure:"ADMIN_API_KEY"`
 }
 
 // AppConfig holding env
@@ -20,6 +73,20 @@ func InitConfig() error {
 	//  current path
 	viper.AddConfigPath(".")
 	viper.SetConfigFile(".env")
+	viper.SetDefault("TCP_FRAMING", "binary2")
+	viper.SetDefault("TCP_ENCODING", "ascii")
+	viper.SetDefault("TCP_MAX_MESSAGE_SIZE", 8192)
+	viper.SetDefault("TCP_MAX_CONCURRENT", 16)
+	viper.SetDefault("TCP_IDLE_TIMEOUT", 5*time.Minute)
+	viper.SetDefault("TCP_REVERSAL_WINDOW", 24*time.Hour)
+	viper.SetDefault("ROUTING_STRATEGY", "priority")
+	viper.SetDefault("RECON_INTERVAL", time.Minute)
+	viper.SetDefault("RECON_MAX_AGE", 15*time.Minute)
+	viper.SetDefault("RECON_EXPIRE_AFTER", 24*time.Hour)
+	viper.SetDefault("IDEMPOTENCY_TTL", 24*time.Hour)
+	viper.SetDefault("FX_RATES_MAX_AGE", 24*time.Hour)
+	viper.SetDefault("WALLET_STORE", "memory")
+	viper.SetDefault("DATABASE_DSN", "file:wallets.db")
 	viper.ReadInConfig()
 	//using viper for reading env
 	err := viper.Unmarshal(&AppConfig)
@@ -0,0 +1,226 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/wajidp/micro-payment-gateway/internal/logger"
+	"github.com/wajidp/micro-payment-gateway/internal/service"
+	"github.com/wajidp/micro-payment-gateway/internal/service/model"
+)
+
+// adminActorKey holds the admin user of an authenticated request in the gin context
+const adminActorKey = "adminActor"
+
+// AdminKeys maps the bearer tokens of the admin endpoints to the admin user
+// recorded in the audit trail for requests carrying them
+type AdminKeys map[string]string
+
+// AdminHandler serves the routing and transaction administration endpoints
+type AdminHandler struct {
+	admin    service.RoutingAdminRepo
+	payments service.PaymentProcessorRepo
+}
+
+// ReorderRequest lists route IDs in their new priority order
+type ReorderRequest struct {
+	IDs []string `json:"ids" binding:"required"`
+}
+
+// DryRunRequest is a sample payment used to preview routing
+type DryRunRequest struct {
+	UserID      string `json:"userId"`
+	Currency    string `json:"currency" binding:"required"`
+	CountryCode string `json:"country_code"`
+	Amount      int64  `json:"amount"`
+}
+
+// NewAdminHandler create the admin handler
+func NewAdminHandler(admin service.RoutingAdminRepo, payments service.PaymentProcessorRepo) *AdminHandler {
+	return &AdminHandler{admin: admin, payments: payments}
+}
+
+// ParseAdminKeys reads a comma separated list of user:token pairs, e.g.
+// "alice:s3cret,bob:t0ken". Users and tokens must not be empty and a token
+// belongs to one user.
+func ParseAdminKeys(spec string) (AdminKeys, error) {
+	keys := make(AdminKeys)
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		user, token, found := strings.Cut(pair, ":")
+		if !found || user == "" || token == "" {
+			return nil, fmt.Errorf("admin key %q is not user:token", pair)
+		}
+		if _, exists := keys[token]; exists {
+			return nil, fmt.Errorf("admin key of %s is used twice", user)
+		}
+		keys[token] = user
+	}
+	return keys, nil
+}
+
+// AdminAuth accepts requests carrying "Authorization: Bearer <token>" with one
+// of the tokens of keys, the user of the token is the actor of the request
+func AdminAuth(keys AdminKeys) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		var user string
+		for key, name := range keys {
+			if key != "" && subtle.ConstantTimeCompare([]byte(token), []byte(key)) == 1 {
+				user = name
+			}
+		}
+		if user == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "Unauthorized"})
+			return
+		}
+		c.Set(adminActorKey, user)
+		c.Next()
+	}
+}
+
+// actor returns the admin user for the audit trail, as authenticated by AdminAuth
+func actor(c *gin.Context) string {
+	return c.GetString(adminActorKey)
+}
+
+// ListRoutes returns the routing table
+func (h *AdminHandler) ListRoutes(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"routes": h.admin.ListRoutes()})
+}
+
+// CreateRoute adds a routing entry
+func (h *AdminHandler) CreateRoute(c *gin.Context) {
+	var route model.PgRoutingMaster
+	if err := c.ShouldBindJSON(&route); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"details": err.Error(), "message": "Bad Request"})
+		return
+	}
+
+	created, err := h.admin.CreateRoute(actor(c), &route)
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, created)
+}
+
+// UpdateRoute replaces a routing entry
+func (h *AdminHandler) UpdateRoute(c *gin.Context) {
+	var route model.PgRoutingMaster
+	if err := c.ShouldBindJSON(&route); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"details": err.Error(), "message": "Bad Request"})
+		return
+	}
+
+	updated, err := h.admin.UpdateRoute(actor(c), c.Param("id"), &route)
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, updated)
+}
+
+// DeactivateRoute marks a routing entry inactive
+func (h *AdminHandler) DeactivateRoute(c *gin.Context) {
+	updated, err := h.admin.DeactivateRoute(actor(c), c.Param("id"))
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, updated)
+}
+
+// ReorderRoutes sets the priorities of routing entries
+func (h *AdminHandler) ReorderRoutes(c *gin.Context) {
+	var req ReorderRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"details": err.Error(), "message": "Bad Request"})
+		return
+	}
+
+	routes, err := h.admin.ReorderRoutes(actor(c), req.IDs)
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"routes": routes})
+}
+
+// DryRun returns the gateways that would be tried for a sample payment
+func (h *AdminHandler) DryRun(c *gin.Context) {
+	var req DryRunRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"details": err.Error(), "message": "Bad Request"})
+		return
+	}
+
+	routes, err := h.admin.DryRun(&model.PaymentRequest{
+		UserID:      req.UserID,
+		Currency:    strings.ToUpper(req.Currency),
+		CountryCode: strings.ToUpper(req.CountryCode),
+		Amount:      req.Amount,
+	})
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"routes": routes})
+}
+
+// Audit returns the routing audit trail
+func (h *AdminHandler) Audit(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"audit": h.admin.RoutingAudit()})
+}
+
+// Gateways returns the registered gateway types
+func (h *AdminHandler) Gateways(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"gateways": h.admin.Gateways()})
+}
+
+// VoidTransaction cancels an authorized transaction on behalf of operations
+func (h *AdminHandler) VoidTransaction(c *gin.Context) {
+	txn, err := h.payments.Void(c.Param("id"), service.SourceAdmin)
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+	logger.Infof("Transaction %s voided by %s", txn.ID, actor(c))
+	c.JSON(http.StatusOK, txn)
+}
+
+// LedgerEntries returns the balance and the entries of a ledger account, e.g. wallet:123:USD
+func (h *AdminHandler) LedgerEntries(c *gin.Context) {
+	account := c.Param("account")
+	entries, err := h.payments.LedgerEntries(account)
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+	var balance int64
+	if len(entries) > 0 {
+		balance = entries[len(entries)-1].Balance
+	}
+	c.JSON(http.StatusOK, gin.H{"account": account, "balance": balance, "entries": entries})
+}
+
+// adminError maps service errors to HTTP responses
+func adminError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, model.ErrNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found", "details": err.Error()})
+	case errors.Is(err, model.ErrValidation):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Validation failed", "details": err.Error()})
+	case errors.Is(err, model.ErrConflict):
+		c.JSON(http.StatusConflict, gin.H{"error": "Conflict", "details": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process request", "details": err.Error()})
+	}
+}
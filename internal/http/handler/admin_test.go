@@ -0,0 +1,285 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/h2non/gock"
+	"github.com/stretchr/testify/assert"
+	"github.com/wajidp/micro-payment-gateway/internal/service"
+	"github.com/wajidp/micro-payment-gateway/internal/service/gateway"
+	"github.com/wajidp/micro-payment-gateway/internal/service/ledger"
+	"github.com/wajidp/micro-payment-gateway/internal/service/model"
+)
+
+const testAdminKey = "secret"
+
+// testAdminKeys authenticates alice with testAdminKey and bob with another key
+var testAdminKeys = AdminKeys{testAdminKey: "alice", "other": "bob"}
+
+// newAdminTestServer initializes a Gin server with the admin endpoints.
+func newAdminTestServer() *gin.Engine {
+	processor := service.NewPaymentProcessor(testRoutingMasters).(*service.PaymentProcessor)
+	admin := NewAdminHandler(processor, processor)
+
+	router := gin.Default()
+	group := router.Group("/admin", AdminAuth(testAdminKeys))
+	group.GET("/routes", admin.ListRoutes)
+	group.POST("/routes", admin.CreateRoute)
+	group.PUT("/routes/:id", admin.UpdateRoute)
+	group.POST("/routes/:id/deactivate", admin.DeactivateRoute)
+	group.POST("/routes/reorder", admin.ReorderRoutes)
+	group.POST("/routes/dry-run", admin.DryRun)
+	group.GET("/audit", admin.Audit)
+	group.GET("/gateways", admin.Gateways)
+	group.POST("/transactions/:id/void", admin.VoidTransaction)
+	group.GET("/ledger/:account", admin.LedgerEntries)
+	return router
+}
+
+// performAdminRequest performs an admin request authenticated as alice, claiming to be mallory.
+func performAdminRequest(router *gin.Engine, method, path string, body interface{}) *httptest.ResponseRecorder {
+	reqBody, _ := json.Marshal(body)
+	req, _ := http.NewRequest(method, path, bytes.NewBuffer(reqBody))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+testAdminKey)
+	req.Header.Set("X-Admin-User", "mallory")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+// dryRunGateways returns the gateways of a dry-run response, in order.
+func dryRunGateways(t *testing.T, w *httptest.ResponseRecorder) []string {
+	var response struct {
+		Routes []*model.PgRoutingMaster `json:"routes"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	var names []string
+	for _, r := range response.Routes {
+		names = append(names, r.PaymentGateway)
+	}
+	return names
+}
+
+// TestAdmin_Unauthorized verifies that the admin endpoints require the API key.
+func TestAdmin_Unauthorized(t *testing.T) {
+	router := newAdminTestServer()
+
+	w := performRequest(router, "GET", "/admin/routes", nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	req, _ := http.NewRequest("GET", "/admin/routes", nil)
+	req.Header.Set("Authorization", "Bearer wrong")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+// TestAdmin_ManageRoutes verifies that routes can be created, updated, reordered and
+// deactivated, that dry-run reflects the changes and that they are audited.
+func TestAdmin_ManageRoutes(t *testing.T) {
+	router := newAdminTestServer()
+	sample := DryRunRequest{UserID: "123", Currency: "usd", CountryCode: "ae", Amount: 1000}
+
+	w := performAdminRequest(router, "POST", "/admin/routes/dry-run", sample)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, []string{"PGA", "PGB"}, dryRunGateways(t, w))
+
+	// list
+	w = performAdminRequest(router, "GET", "/admin/routes", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var list struct {
+		Routes []*model.PgRoutingMaster `json:"routes"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	assert.Len(t, list.Routes, len(testRoutingMasters))
+	var pga, pgb string
+	for _, r := range list.Routes {
+		if r.Currency == "USD" && r.CountryCode == "AE" {
+			if r.PaymentGateway == "PGA" {
+				pga = r.ID
+			} else {
+				pgb = r.ID
+			}
+		}
+	}
+	assert.NotEmpty(t, pga)
+	assert.NotEmpty(t, pgb)
+
+	// reorder so that PGB is tried first
+	w = performAdminRequest(router, "POST", "/admin/routes/reorder", ReorderRequest{IDs: []string{pgb, pga}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = performAdminRequest(router, "POST", "/admin/routes/dry-run", sample)
+	assert.Equal(t, []string{"PGB", "PGA"}, dryRunGateways(t, w))
+
+	// deactivate PGB
+	w = performAdminRequest(router, "POST", "/admin/routes/"+pgb+"/deactivate", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = performAdminRequest(router, "POST", "/admin/routes/dry-run", sample)
+	assert.Equal(t, []string{"PGA"}, dryRunGateways(t, w))
+
+	// create a route for a new country
+	w = performAdminRequest(router, "POST", "/admin/routes", model.PgRoutingMaster{
+		Currency: "EUR", CountryCode: "de", PaymentGateway: "PGB", Active: true,
+	})
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var created model.PgRoutingMaster
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	assert.NotEmpty(t, created.ID)
+	assert.Equal(t, "DE", created.CountryCode)
+
+	// update it to another gateway
+	created.PaymentGateway = "PGA"
+	w = performAdminRequest(router, "PUT", "/admin/routes/"+created.ID, created)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = performAdminRequest(router, "POST", "/admin/routes/dry-run", DryRunRequest{Currency: "EUR", CountryCode: "DE"})
+	assert.Equal(t, []string{"PGA"}, dryRunGateways(t, w))
+
+	// audit trail
+	w = performAdminRequest(router, "GET", "/admin/audit", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var audit struct {
+		Audit []model.RoutingAudit `json:"audit"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &audit))
+	var actions []string
+	for _, a := range audit.Audit {
+		assert.Equal(t, "alice", a.Actor, "Expected the actor of the key, not the one claimed by the client")
+		actions = append(actions, a.Action)
+	}
+	assert.Equal(t, []string{"reorder", "reorder", "deactivate", "create", "update"}, actions)
+}
+
+// TestParseAdminKeys verifies that admin keys are read as user:token pairs and that malformed
+// or shared tokens are rejected.
+func TestParseAdminKeys(t *testing.T) {
+	keys, err := ParseAdminKeys(" alice:s3cret, bob:t0k:en ,")
+	assert.NoError(t, err)
+	assert.Equal(t, AdminKeys{"s3cret": "alice", "t0k:en": "bob"}, keys)
+
+	keys, err = ParseAdminKeys("")
+	assert.NoError(t, err)
+	assert.Empty(t, keys)
+
+	for _, spec := range []string{"alice", "alice:", ":s3cret", "alice:s3cret,bob:s3cret"} {
+		_, err = ParseAdminKeys(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+// TestAdmin_InvalidChanges verifies that invalid changes are rejected and leave the table untouched.
+func TestAdmin_InvalidChanges(t *testing.T) {
+	router := newAdminTestServer()
+
+	w := performAdminRequest(router, "POST", "/admin/routes", model.PgRoutingMaster{
+		Currency: "USD", PaymentGateway: "PGX", Active: true,
+	})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = performAdminRequest(router, "PUT", "/admin/routes/missing", model.PgRoutingMaster{
+		Currency: "USD", PaymentGateway: "PGA", Active: true,
+	})
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = performAdminRequest(router, "POST", "/admin/routes/missing/deactivate", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = performAdminRequest(router, "POST", "/admin/routes/dry-run", DryRunRequest{Currency: "JPY"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = performAdminRequest(router, "GET", "/admin/routes", nil)
+	var list struct {
+		Routes []*model.PgRoutingMaster `json:"routes"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	assert.Len(t, list.Routes, len(testRoutingMasters))
+
+	// PGA does not support JPY
+	w = performAdminRequest(router, "POST", "/admin/routes", model.PgRoutingMaster{
+		Currency: "JPY", PaymentGateway: "PGA", Active: true,
+	})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+// TestAdmin_Gateways verifies that the registered gateway types are listed with their capabilities.
+func TestAdmin_Gateways(t *testing.T) {
+	router := newAdminTestServer()
+
+	w := performAdminRequest(router, "GET", "/admin/gateways", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var response struct {
+		Gateways []gateway.Registration `json:"gateways"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	gateways := map[string]gateway.Registration{}
+	for _, r := range response.Gateways {
+		gateways[r.Name] = r
+	}
+	assert.Contains(t, gateways, "PGB")
+	assert.True(t, gateways["PGA"].Capabilities.Deposit)
+	assert.Contains(t, gateways["PGA"].Capabilities.Currencies, "USD")
+}
+
+// TestAdmin_VoidTransaction verifies that operations can void a transaction and that the
+// transition is recorded as an admin change.
+func TestAdmin_VoidTransaction(t *testing.T) {
+	defer gock.Off()
+	initGock()
+	gock.New("http://pgsa.com").
+		Post("/cancel").
+		Reply(200).
+		JSON(map[string]string{"status": "success"})
+
+	processor := service.NewPaymentProcessor(testRoutingMasters).(*service.PaymentProcessor)
+	router := gin.Default()
+	router.POST("/admin/transactions/:id/void", AdminAuth(testAdminKeys), NewAdminHandler(processor, processor).VoidTransaction)
+
+	response, err := processor.Deposit(&model.PaymentRequest{UserID: "123", Amount: 100, Currency: "USD", CountryCode: "US"})
+	assert.NoError(t, err)
+
+	w := performAdminRequest(router, "POST", "/admin/transactions/"+response.TransactionID+"/void", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var txn model.Transaction
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &txn))
+	assert.Equal(t, model.StateVoided, txn.State)
+	assert.Equal(t, service.SourceAdmin, txn.Transitions[len(txn.Transitions)-1].Source)
+
+	w = performAdminRequest(router, "POST", "/admin/transactions/missing/void", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+// TestAdmin_LedgerEntries verifies that the entries of an approved deposit are returned
+// for the wallet account and that unknown account kinds are rejected.
+func TestAdmin_LedgerEntries(t *testing.T) {
+	defer gock.Off()
+	initGock()
+
+	processor := service.NewPaymentProcessor(testRoutingMasters).(*service.PaymentProcessor)
+	router := gin.Default()
+	router.GET("/admin/ledger/:account", AdminAuth(testAdminKeys), NewAdminHandler(processor, processor).LedgerEntries)
+
+	response, err := processor.Deposit(&model.PaymentRequest{UserID: "123", Amount: 100, Currency: "USD", CountryCode: "US"})
+	assert.NoError(t, err)
+	assert.NoError(t, processor.HandleCallback(&model.CallbackRequest{TransactionID: response.TransactionID, State: model.StateApproved}))
+
+	w := performAdminRequest(router, "GET", "/admin/ledger/wallet:123:USD", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var body struct {
+		Account string         `json:"account"`
+		Balance int64          `json:"balance"`
+		Entries []ledger.Entry `json:"entries"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, "wallet:123:USD", body.Account)
+	assert.Equal(t, int64(100), body.Balance)
+	assert.Len(t, body.Entries, 1)
+	assert.Equal(t, response.TransactionID, body.Entries[0].TransactionID)
+
+	w = performAdminRequest(router, "GET", "/admin/ledger/bank:123:USD", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
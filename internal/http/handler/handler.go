@@ -9,6 +9,9 @@ import (
 	"github.com/wajidp/micro-payment-gateway/internal/service/model"
 )
 
+// IdempotencyKeyHeader carries the client chosen key which makes a deposit or withdrawal safe to retry
+const IdempotencyKeyHeader = "Idempotency-Key"
+
 // Handler which holds the processor repo
 type Handler struct {
 	service service.PaymentProcessorRepo
@@ -21,6 +24,25 @@ type HandlerRequest struct {
 	Amount      int64  `json:"amount"`
 	Exponent    int    `json:"exponent"`
 	CountryCode string `json:"country_code"`
+	// WalletCurrency is the wallet credited or debited, the request currency when empty
+	WalletCurrency string `json:"wallet_currency"`
+}
+
+// WalletsResponse lists the wallets of a user, one per currency
+type WalletsResponse struct {
+	UserID  string           `json:"userId"`
+	Wallets []WalletResponse `json:"wallets"`
+}
+
+// WalletResponse exposes the balances of a wallet, in the minor unit of its currency
+type WalletResponse struct {
+	Currency string `json:"currency"`
+	Exponent int    `json:"exponent"`
+	// LedgerBalance holds the settled funds
+	LedgerBalance int64 `json:"ledger_balance"`
+	// AvailableBalance is the ledger balance less the funds held for pending debits
+	AvailableBalance int64 `json:"available_balance"`
+	Held             int64 `json:"held"`
 }
 
 // NewHandler create the handler
@@ -46,6 +68,10 @@ func (h *Handler) handleRequest(c *gin.Context, reqType model.RequestType) {
 		Exponent:    req.Exponent,
 		CountryCode: req.CountryCode,
 		Type:        reqType,
+
+		WalletCurrency: req.WalletCurrency,
+
+		IdempotencyKey: c.GetHeader(IdempotencyKeyHeader),
 	}
 
 	var (
@@ -69,6 +95,23 @@ func (h *Handler) handleRequest(c *gin.Context, reqType model.RequestType) {
 				"error":   "Validation failed",
 				"details": err.Error(),
 			})
+		//the idempotency key is still in use or was used for another request
+		case errors.Is(err, model.ErrConflict):
+			c.JSON(http.StatusConflict, gin.H{
+				"error":   "Request in progress",
+				"details": err.Error(),
+			})
+		case errors.Is(err, model.ErrIdempotencyMismatch):
+			c.JSON(http.StatusUnprocessableEntity, gin.H{
+				"error":   "Idempotency key reused",
+				"details": err.Error(),
+			})
+		//the gateway declined the payment
+		case errors.Is(err, model.ErrDeclined):
+			c.JSON(http.StatusPaymentRequired, gin.H{
+				"error":   "Payment declined",
+				"details": err.Error(),
+			})
 		default:
 			c.JSON(http.StatusInternalServerError, gin.H{
 				"error":   "Failed to process request",
@@ -103,9 +146,139 @@ func (h *Handler) HandleCallback(c *gin.Context) {
 
 	err := h.service.HandleCallback(callbackReq)
 	if err != nil {
+		//a callback for an unknown state or a transaction which ended otherwise is rejected
+		if errors.Is(err, model.ErrValidation) {
+			c.JSON(http.StatusBadRequest, gin.H{"details": err.Error(), "message": "Bad Request"})
+			return
+		}
+		if errors.Is(err, model.ErrConflict) {
+			c.JSON(http.StatusConflict, gin.H{"details": err.Error(), "message": "Conflict"})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"details": err.Error(), "message": "Error"})
 		return
 	}
 	//on transaction approved return ok
 	c.JSON(http.StatusOK, gin.H{"status": "ok"})
 }
+
+// Refund handles refund requests of an approved deposit
+func (h *Handler) Refund(c *gin.Context) {
+	var req model.RefundRequest
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"details": err.Error(), "message": "Bad Request"})
+		return
+	}
+
+	response, err := h.service.Refund(&req)
+	if err != nil {
+		switch {
+		case errors.Is(err, model.ErrValidation):
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error":   "Validation failed",
+				"details": err.Error(),
+			})
+		case errors.Is(err, model.ErrNotFound):
+			c.JSON(http.StatusNotFound, gin.H{
+				"error":   "Transaction not found",
+				"details": err.Error(),
+			})
+		case errors.Is(err, model.ErrDeclined):
+			c.JSON(http.StatusPaymentRequired, gin.H{
+				"error":   "Refund declined",
+				"details": err.Error(),
+			})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error":   "Failed to process request",
+				"details": err.Error(),
+			})
+		}
+		return
+	}
+
+	//on success return accepted
+	c.JSON(http.StatusAccepted, response)
+}
+
+// Void handles cancellation of an authorized transaction
+func (h *Handler) Void(c *gin.Context) {
+	var req model.VoidRequest
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"details": err.Error(), "message": "Bad Request"})
+		return
+	}
+
+	txn, err := h.service.Void(req.TransactionID, service.SourceAPI)
+	if err != nil {
+		switch {
+		case errors.Is(err, model.ErrValidation):
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error":   "Validation failed",
+				"details": err.Error(),
+			})
+		case errors.Is(err, model.ErrNotFound):
+			c.JSON(http.StatusNotFound, gin.H{
+				"error":   "Transaction not found",
+				"details": err.Error(),
+			})
+		case errors.Is(err, model.ErrConflict):
+			c.JSON(http.StatusConflict, gin.H{
+				"error":   "Cancellation refused",
+				"details": err.Error(),
+			})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error":   "Failed to process request",
+				"details": err.Error(),
+			})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, txn)
+}
+
+// GetWallet returns the ledger and available balance of each wallet of a user,
+// the currency query parameter selects a single wallet
+func (h *Handler) GetWallet(c *gin.Context) {
+	userID := c.Param("userId")
+	var wallets []*model.Wallet
+	var err error
+	if currency := c.Query("currency"); currency != "" {
+		var wallet *model.Wallet
+		if wallet, err = h.service.GetBalance(userID, currency); err == nil {
+			wallets = []*model.Wallet{wallet}
+		}
+	} else {
+		wallets, err = h.service.ListWallets(userID)
+	}
+	if err != nil {
+		if errors.Is(err, model.ErrValidation) {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error":   "Validation failed",
+				"details": err.Error(),
+			})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to process request",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	response := WalletsResponse{UserID: userID, Wallets: []WalletResponse{}}
+	for _, wallet := range wallets {
+		response.Wallets = append(response.Wallets, WalletResponse{
+			Currency:         wallet.Currency,
+			Exponent:         wallet.Exponent,
+			LedgerBalance:    wallet.Balance,
+			AvailableBalance: wallet.Available(),
+			Held:             wallet.Held,
+		})
+	}
+	c.JSON(http.StatusOK, response)
+}
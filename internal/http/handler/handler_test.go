@@ -64,15 +64,30 @@ func initGock() {
 		`)
 }
 
+// testRoutingMasters is the routing table of the handler tests, the one of the sample
+// routing.yaml: USD is routed to PGA before PGB and USD and AED are routed for US and AE
+var testRoutingMasters = []*model.PgRoutingMaster{
+	{Currency: "USD", CountryCode: "AE", PaymentGateway: "PGA", Active: true, MaxRetryCount: 3, Priority: 0},
+	{Currency: "USD", CountryCode: "AE", PaymentGateway: "PGB", Active: true, MaxRetryCount: 3, Priority: 1},
+	{Currency: "USD", CountryCode: "US", PaymentGateway: "PGA", Active: true, MaxRetryCount: 3, Priority: 0},
+	{Currency: "USD", CountryCode: "US", PaymentGateway: "PGB", Active: true, MaxRetryCount: 3, Priority: 1},
+	{Currency: "EUR", CountryCode: "EU", PaymentGateway: "PGA", Active: true, MaxRetryCount: 3, Priority: 0},
+	{Currency: "AED", CountryCode: "US", PaymentGateway: "PGA", Active: true, MaxRetryCount: 3, Priority: 0},
+	{Currency: "AED", CountryCode: "AE", PaymentGateway: "PGA", Active: true, MaxRetryCount: 3, Priority: 0},
+}
+
 // newTestServer initializes a new Gin server and handler for testing.
 func newTestServer() *gin.Engine {
-	processor := service.NewPaymentProcessor(model.PgRoutingMasters)
+	processor := service.NewPaymentProcessor(testRoutingMasters)
 	handler := NewHandler(processor)
 
 	router := gin.Default()
 	router.POST("/deposit", handler.Deposit)
 	router.POST("/withdraw", handler.Withdraw)
 	router.POST("/callback", handler.HandleCallback)
+	router.POST("/refund", handler.Refund)
+	router.POST("/void", handler.Void)
+	router.GET("/wallet/:userId", handler.GetWallet)
 	return router
 }
 
@@ -214,3 +229,173 @@ func TestHandler_Deposit_UnsupportedCurrency(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Contains(t, response["details"], "validation error: invalid currency")
 }
+
+// TestHandler_Refund verifies that an approved deposit can be partially refunded
+// and that refunds above the deposit or of unknown transactions are rejected.
+func TestHandler_Refund(t *testing.T) {
+	defer gock.Off()
+	initGock()
+	gock.New("http://pgsa.com").
+		Post("/refund").
+		Reply(200).
+		JSON(map[string]string{"status": "success", "message": "Refund processed successfully"})
+
+	router := newTestServer()
+
+	depositRequest := &model.PaymentRequest{
+		UserID:      "123",
+		Amount:      10000,
+		Currency:    "USD",
+		CountryCode: "US",
+	}
+
+	w := performRequest(router, "POST", "/deposit", depositRequest)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	var response map[string]interface{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	depositID := cast.ToString(response["id"])
+
+	// a deposit awaiting its callback cannot be refunded
+	w = performRequest(router, "POST", "/refund", &model.RefundRequest{TransactionID: depositID, Amount: 4000})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = performRequest(router, "POST", "/callback", &model.CallbackRequest{TransactionID: depositID, State: model.StateApproved})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = performRequest(router, "POST", "/refund", &model.RefundRequest{TransactionID: depositID, Amount: 4000})
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, "success", response["status"])
+
+	w = performRequest(router, "POST", "/refund", &model.RefundRequest{TransactionID: depositID, Amount: 7000})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Contains(t, response["details"], "exceeds the refundable amount")
+
+	w = performRequest(router, "POST", "/refund", &model.RefundRequest{TransactionID: "missing"})
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+// TestHandler_Void verifies that an authorized deposit can be voided and that a
+// callback arriving afterwards is rejected.
+func TestHandler_Void(t *testing.T) {
+	defer gock.Off()
+	initGock()
+	gock.New("http://pgsa.com").
+		Post("/cancel").
+		Reply(200).
+		JSON(map[string]string{"status": "success", "message": "Transaction cancelled"})
+
+	router := newTestServer()
+
+	depositRequest := &model.PaymentRequest{
+		UserID:      "123",
+		Amount:      10000,
+		Currency:    "USD",
+		CountryCode: "US",
+	}
+
+	w := performRequest(router, "POST", "/deposit", depositRequest)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	var response map[string]interface{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	depositID := cast.ToString(response["id"])
+
+	w = performRequest(router, "POST", "/void", &model.VoidRequest{TransactionID: depositID})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, model.StateVoided, response["state"])
+
+	w = performRequest(router, "POST", "/callback", &model.CallbackRequest{TransactionID: depositID, State: model.StateApproved})
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	w = performRequest(router, "POST", "/void", &model.VoidRequest{TransactionID: "missing"})
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+// TestHandler_Deposit_IdempotencyKey verifies that a deposit retried with the same
+// Idempotency-Key returns the original transaction and that reusing the key for
+// another request is rejected.
+func TestHandler_Deposit_IdempotencyKey(t *testing.T) {
+	defer gock.Off()
+	initGock()
+
+	router := newTestServer()
+	deposit := func(amount int64) *httptest.ResponseRecorder {
+		reqBody, _ := json.Marshal(&HandlerRequest{UserID: "123", Amount: amount, Currency: "USD", CountryCode: "US"})
+		req, _ := http.NewRequest("POST", "/deposit", bytes.NewBuffer(reqBody))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(IdempotencyKeyHeader, "order-42")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	var first, retry map[string]interface{}
+	w := deposit(10000)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &first))
+
+	w = deposit(10000)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &retry))
+	assert.Equal(t, first["id"], retry["id"])
+
+	w = deposit(20000)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+}
+
+// TestHandler_GetWallet verifies that the ledger and available balance are returned,
+// the available balance excluding the amount held by a pending withdrawal.
+func TestHandler_GetWallet(t *testing.T) {
+	defer gock.Off()
+	initGock()
+
+	router := newTestServer()
+
+	paymentRequest := &model.PaymentRequest{
+		UserID:      "123",
+		Amount:      10000,
+		Currency:    "USD",
+		CountryCode: "US",
+	}
+	w := performRequest(router, "POST", "/deposit", paymentRequest)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	var response map[string]interface{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	w = performRequest(router, "POST", "/callback", &model.CallbackRequest{TransactionID: cast.ToString(response["id"]), State: model.StateApproved})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	paymentRequest.Amount = 4000
+	w = performRequest(router, "POST", "/withdraw", paymentRequest)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+
+	w = performRequest(router, "GET", "/wallet/123", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var wallets WalletsResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &wallets))
+	usd := WalletResponse{Currency: "USD", Exponent: 2, LedgerBalance: 10000, AvailableBalance: 6000, Held: 4000}
+	assert.Equal(t, WalletsResponse{UserID: "123", Wallets: []WalletResponse{usd}}, wallets)
+
+	// a deposit in another currency opens a separate wallet
+	initGock()
+	paymentRequest.Currency = "AED"
+	w = performRequest(router, "POST", "/deposit", paymentRequest)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	w = performRequest(router, "POST", "/callback", &model.CallbackRequest{TransactionID: cast.ToString(response["id"]), State: model.StateApproved})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = performRequest(router, "GET", "/wallet/123?currency=AED", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &wallets))
+	aed := WalletResponse{Currency: "AED", Exponent: 2, LedgerBalance: 4000, AvailableBalance: 4000}
+	assert.Equal(t, WalletsResponse{UserID: "123", Wallets: []WalletResponse{aed}}, wallets)
+
+	w = performRequest(router, "GET", "/wallet/123", nil)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &wallets))
+	assert.Equal(t, []WalletResponse{aed, usd}, wallets.Wallets)
+
+	w = performRequest(router, "GET", "/wallet/123?currency=XYZ", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
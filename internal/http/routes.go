@@ -1,19 +1,69 @@
 package http
 
 import (
+	"fmt"
+
 	"github.com/gin-gonic/gin"
+	"github.com/wajidp/micro-payment-gateway/internal/app/config"
 	"github.com/wajidp/micro-payment-gateway/internal/http/handler"
+	"github.com/wajidp/micro-payment-gateway/internal/logger"
 	"github.com/wajidp/micro-payment-gateway/internal/service"
 )
 
 // RegisterRoutes register routes
-func RegisterRoutes(router *gin.Engine, service service.PaymentProcessorRepo) {
+func RegisterRoutes(router *gin.Engine, service service.PaymentProcessorRepo, admin service.RoutingAdminRepo) {
 
 	handler := handler.NewHandler(service)
 	router.POST("/deposit", handler.Deposit)
 	router.POST("/withdraw", handler.Withdraw)
 	router.POST("/callback", handler.HandleCallback)
+	router.POST("/refund", handler.Refund)
+	router.POST("/void", handler.Void)
+	router.GET("/wallet/:userId", handler.GetWallet)
 	// Serve the swagger-docs directory as static files
 	router.Static("/swagger", "./swagger-docs")
 
+	keys, err := adminKeys()
+	if err != nil {
+		logger.Errorf("Invalid ADMIN_API_KEYS, admin endpoints are disabled: %v", err)
+		return
+	}
+	registerAdminRoutes(router, admin, service, keys)
+}
+
+// adminKeys returns the admin tokens of the config, ADMIN_API_KEY is the token of the user "admin"
+func adminKeys() (handler.AdminKeys, error) {
+	keys, err := handler.ParseAdminKeys(config.AppConfig.AdminAPIKeys)
+	if err != nil {
+		return nil, err
+	}
+	if key := config.AppConfig.AdminAPIKey; key != "" {
+		if user, exists := keys[key]; exists {
+			return nil, fmt.Errorf("ADMIN_API_KEY is also the key of %s", user)
+		}
+		keys[key] = "admin"
+	}
+	return keys, nil
+}
+
+// registerAdminRoutes registers the routing and transaction administration endpoints,
+// they are disabled when no admin API key is configured
+func registerAdminRoutes(router *gin.Engine, admin service.RoutingAdminRepo, payments service.PaymentProcessorRepo, keys handler.AdminKeys) {
+	if len(keys) == 0 {
+		logger.Warnf("ADMIN_API_KEYS not set, admin endpoints are disabled")
+		return
+	}
+
+	adminHandler := handler.NewAdminHandler(admin, payments)
+	group := router.Group("/admin", handler.AdminAuth(keys))
+	group.GET("/routes", adminHandler.ListRoutes)
+	group.POST("/routes", adminHandler.CreateRoute)
+	group.PUT("/routes/:id", adminHandler.UpdateRoute)
+	group.POST("/routes/:id/deactivate", adminHandler.DeactivateRoute)
+	group.POST("/routes/reorder", adminHandler.ReorderRoutes)
+	group.POST("/routes/dry-run", adminHandler.DryRun)
+	group.GET("/audit", adminHandler.Audit)
+	group.GET("/gateways", adminHandler.Gateways)
+	group.POST("/transactions/:id/void", adminHandler.VoidTransaction)
+	group.GET("/ledger/:account", adminHandler.LedgerEntries)
 }
@@ -2,6 +2,7 @@ package logger
 
 import (
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/wajidp/micro-payment-gateway/internal/app/config"
@@ -16,15 +17,26 @@ const (
 	Console = "console"
 )
 
-var log *zap.Logger
+var (
+	// mu guards log, it is read by every goroutine that logs
+	mu       sync.RWMutex
+	log      *zap.Logger
+	initOnce sync.Once
+)
 
 // Log is intended as global logger instance pre-initialized by the
 // framework
 func Log() *zap.Logger {
-	if log == nil {
-		SetUp()
+	mu.RLock()
+	l := log
+	mu.RUnlock()
+	if l == nil {
+		initOnce.Do(SetUp)
+		mu.RLock()
+		l = log
+		mu.RUnlock()
 	}
-	return log
+	return l
 }
 
 //SetUp bla
@@ -57,6 +69,8 @@ func setLog(level zapcore.Level, encoding string) {
 
 	logger, err := cfg.Build()
 
+	mu.Lock()
+	defer mu.Unlock()
 	if err != nil {
 		if log != nil {
 			log.With(zap.Error(err)).Warn("New settings not applied.")
@@ -0,0 +1,81 @@
+package service
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/wajidp/micro-payment-gateway/internal/service/currency"
+	"github.com/wajidp/micro-payment-gateway/internal/service/fx"
+	"github.com/wajidp/micro-payment-gateway/internal/service/model"
+)
+
+// convertToWallet sets the wallet side of a new transaction. A transaction in
+// the currency of the wallet applies its amount as is, otherwise the amount is
+// converted at a quoted rate which is locked on the transaction, so settlement
+// applies the same wallet amount whatever the rate is by then. Credits are
+// rounded down and debits up.
+func (p *PaymentProcessor) convertToWallet(txn *model.Transaction, walletCurrency string) error {
+	txn.WalletCurrency = txn.Currency
+	txn.WalletAmount = txn.Amount
+	if walletCurrency == "" || walletCurrency == txn.Currency {
+		return nil
+	}
+	if !validateCurrency(walletCurrency) {
+		return model.WrapError(model.ErrValidation, "invalid wallet currency")
+	}
+	if p.Rates == nil {
+		return model.WrapError(model.ErrValidation, "currency conversion is not available")
+	}
+
+	quote, err := p.Rates.Quote(txn.Currency, walletCurrency)
+	if err != nil {
+		return fmt.Errorf("rate quote failed: %w", err)
+	}
+	if quote.Expired(time.Now()) {
+		return model.WrapError(model.ErrValidation, fmt.Sprintf("rate quote for %s/%s expired at %s", txn.Currency, walletCurrency, quote.ExpiresAt.Format(time.RFC3339)))
+	}
+
+	rounding := fx.Floor
+	if isDebit(txn.Type) {
+		rounding = fx.Ceil
+	}
+	amount, err := fx.Convert(txn.Amount, txn.Exponent, quote.Rate, currency.Default().Exponent(walletCurrency), rounding)
+	if err != nil {
+		return err
+	}
+	if amount <= 0 {
+		return model.WrapError(model.ErrValidation, "amount too small to convert")
+	}
+
+	txn.WalletCurrency = walletCurrency
+	txn.WalletAmount = amount
+	txn.Rate = fx.FormatRate(quote.Rate)
+	txn.QuoteID = quote.ID
+	return nil
+}
+
+// refundWalletAmount is the amount debited from the wallet for a refund of amount,
+// converted at the rate locked on the deposit. walletRemaining is the part of the
+// deposit's wallet amount not yet refunded, a refund of the whole remainder takes
+// all of it so that rounding never leaves a residue.
+func refundWalletAmount(parent *model.Transaction, amount, remaining, walletRemaining int64) (int64, error) {
+	if parent.Rate == "" {
+		return amount, nil
+	}
+	if amount == remaining {
+		return walletRemaining, nil
+	}
+
+	rate, err := fx.ParseRate(parent.Rate)
+	if err != nil {
+		return 0, model.WrapError(model.ErrInternal, err.Error())
+	}
+	walletAmount, err := fx.Convert(amount, parent.Exponent, rate, currency.Default().Exponent(parent.WalletCurrency), fx.Ceil)
+	if err != nil {
+		return 0, err
+	}
+	if walletAmount > walletRemaining {
+		walletAmount = walletRemaining
+	}
+	return walletAmount, nil
+}
@@ -0,0 +1,158 @@
+package currency
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/spf13/viper"
+	"github.com/wajidp/micro-payment-gateway/internal/service/model"
+)
+
+// Currency is an ISO 4217 currency and the limits the gateway applies to it
+type Currency struct {
+	// Code is the alphabetic code, e.g. USD
+	Code string `json:"code"`
+	// Numeric is the three digit numeric code, e.g. 840
+	Numeric string `json:"numeric"`
+	// Exponent is the number of decimal places of the minor unit
+	Exponent int `json:"exponent"`
+	// Enabled currencies can be used in payments, routes and wallets
+	Enabled bool `json:"enabled"`
+	// MinAmount and MaxAmount bound the amount of a payment in the minor unit, zero is no bound
+	MinAmount int64 `json:"min_amount,omitempty"`
+	MaxAmount int64 `json:"max_amount,omitempty"`
+}
+
+// Settings overrides the defaults of a currency, a currency listed in the config
+// is enabled unless it sets enabled to false
+type Settings struct {
+	Enabled   *bool `mapstructure:"enabled" json:"enabled,omitempty"`
+	MinAmount int64 `mapstructure:"min_amount" json:"min_amount"`
+	MaxAmount int64 `mapstructure:"max_amount" json:"max_amount"`
+}
+
+// Registry holds the known currencies, it is safe for concurrent use
+type Registry struct {
+	mu        sync.RWMutex
+	byCode    map[string]Currency
+	byNumeric map[string]string
+}
+
+// defaultRegistry is the registry used by the service, the wallets and the ISO8583 server
+var defaultRegistry = NewRegistry()
+
+// Default returns the registry of the process
+func Default() *Registry {
+	return defaultRegistry
+}
+
+// NewRegistry creates a registry of the ISO 4217 currencies with their default settings
+func NewRegistry() *Registry {
+	r := &Registry{}
+	r.reset()
+	return r
+}
+
+func (r *Registry) reset() {
+	r.byCode = make(map[string]Currency, len(iso4217))
+	r.byNumeric = make(map[string]string, len(iso4217))
+	for _, c := range iso4217 {
+		r.byCode[c.Code] = c
+		r.byNumeric[c.Numeric] = c.Code
+	}
+}
+
+// Configure applies the settings keyed by alphabetic code on top of the
+// defaults, replacing any settings applied before. Nil restores the defaults.
+func (r *Registry) Configure(settings map[string]Settings) error {
+	for code, s := range settings {
+		if _, ok := r.Lookup(code); !ok {
+			return model.WrapError(model.ErrValidation, fmt.Sprintf("unknown currency %q", code))
+		}
+		if s.MinAmount < 0 || s.MaxAmount < 0 || (s.MaxAmount > 0 && s.MinAmount > s.MaxAmount) {
+			return model.WrapError(model.ErrValidation, fmt.Sprintf("%s: invalid amount limits", code))
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.reset()
+	for code, s := range settings {
+		c := r.byCode[code]
+		c.Enabled = s.Enabled == nil || *s.Enabled
+		c.MinAmount = s.MinAmount
+		c.MaxAmount = s.MaxAmount
+		r.byCode[code] = c
+	}
+	return nil
+}
+
+// Lookup returns the currency with the alphabetic code, enabled or not
+func (r *Registry) Lookup(code string) (Currency, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	c, ok := r.byCode[code]
+	return c, ok
+}
+
+// LookupNumeric returns the currency with the numeric code
+func (r *Registry) LookupNumeric(numeric string) (Currency, bool) {
+	r.mu.RLock()
+	code, ok := r.byNumeric[numeric]
+	r.mu.RUnlock()
+	if !ok {
+		return Currency{}, false
+	}
+	return r.Lookup(code)
+}
+
+// Enabled reports whether the currency can be used
+func (r *Registry) Enabled(code string) bool {
+	c, ok := r.Lookup(code)
+	return ok && c.Enabled
+}
+
+// Exponent returns the decimal places of the minor unit of the currency, 0 when unknown
+func (r *Registry) Exponent(code string) int {
+	c, _ := r.Lookup(code)
+	return c.Exponent
+}
+
+// CheckAmount validates an amount in the minor unit against the limits of the currency
+func (r *Registry) CheckAmount(code string, amount int64) error {
+	c, ok := r.Lookup(code)
+	switch {
+	case !ok || !c.Enabled:
+		return model.WrapError(model.ErrValidation, "invalid currency")
+	case c.MinAmount > 0 && amount < c.MinAmount:
+		return model.WrapError(model.ErrInvalidAmount, fmt.Sprintf("amount below the minimum of %d for %s", c.MinAmount, code))
+	case c.MaxAmount > 0 && amount > c.MaxAmount:
+		return model.WrapError(model.ErrInvalidAmount, fmt.Sprintf("amount above the maximum of %d for %s", c.MaxAmount, code))
+	}
+	return nil
+}
+
+// LoadSettings reads the currency settings from a YAML or JSON file of the form
+// currencies -> code -> {enabled, min_amount, max_amount}
+func LoadSettings(path string) (map[string]Settings, error) {
+	v := viper.New()
+	v.SetConfigFile(path)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, err
+	}
+
+	var raw struct {
+		Currencies map[string]Settings `mapstructure:"currencies"`
+	}
+	if err := v.Unmarshal(&raw); err != nil {
+		return nil, err
+	}
+
+	// viper lower cases keys, currency codes are upper case
+	settings := make(map[string]Settings, len(raw.Currencies))
+	for code, s := range raw.Currencies {
+		settings[strings.ToUpper(code)] = s
+	}
+	return settings, nil
+}
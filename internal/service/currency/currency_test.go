@@ -0,0 +1,74 @@
+package currency
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wajidp/micro-payment-gateway/internal/service/model"
+)
+
+// TestRegistry_Lookup verifies the lookup by alphabetic and numeric code and the default currencies.
+func TestRegistry_Lookup(t *testing.T) {
+	r := NewRegistry()
+
+	usd, ok := r.Lookup("USD")
+	assert.True(t, ok)
+	assert.Equal(t, Currency{Code: "USD", Numeric: "840", Exponent: 2, Enabled: true}, usd)
+
+	jpy, ok := r.LookupNumeric("392")
+	assert.True(t, ok)
+	assert.Equal(t, "JPY", jpy.Code)
+	assert.Equal(t, 0, r.Exponent("JPY"))
+	assert.Equal(t, 3, r.Exponent("KWD"))
+
+	assert.True(t, r.Enabled("AED"))
+	assert.False(t, r.Enabled("JPY"), "Expected currencies outside the defaults to be disabled")
+	_, ok = r.Lookup("XYZ")
+	assert.False(t, ok)
+	_, ok = r.LookupNumeric("999")
+	assert.False(t, ok)
+}
+
+// TestRegistry_Configure verifies that settings enable currencies, bound amounts and replace earlier settings.
+func TestRegistry_Configure(t *testing.T) {
+	r := NewRegistry()
+	disabled := false
+	assert.NoError(t, r.Configure(map[string]Settings{
+		"JPY": {MaxAmount: 100000},
+		"USD": {MinAmount: 100, MaxAmount: 1000000},
+		"EUR": {Enabled: &disabled},
+	}))
+
+	assert.True(t, r.Enabled("JPY"))
+	assert.False(t, r.Enabled("EUR"))
+	assert.NoError(t, r.CheckAmount("USD", 100))
+	assert.ErrorIs(t, r.CheckAmount("USD", 99), model.ErrValidation)
+	assert.ErrorIs(t, r.CheckAmount("USD", 1000001), model.ErrValidation)
+	assert.ErrorIs(t, r.CheckAmount("EUR", 100), model.ErrValidation)
+	assert.ErrorIs(t, r.CheckAmount("JPY", 100001), model.ErrValidation)
+
+	assert.ErrorIs(t, r.Configure(map[string]Settings{"XYZ": {}}), model.ErrValidation)
+	assert.ErrorIs(t, r.Configure(map[string]Settings{"USD": {MinAmount: 10, MaxAmount: 5}}), model.ErrValidation)
+	assert.True(t, r.Enabled("JPY"), "Expected an invalid config to keep the settings in use")
+
+	assert.NoError(t, r.Configure(nil))
+	assert.False(t, r.Enabled("JPY"))
+	assert.True(t, r.Enabled("EUR"))
+	assert.NoError(t, r.CheckAmount("USD", 1))
+}
+
+// TestLoadSettings verifies that codes are upper cased and the limits are read.
+func TestLoadSettings(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "currencies.yaml")
+	content := "currencies:\n  usd:\n    min_amount: 100\n  gbp:\n    enabled: true\n  eur:\n    enabled: false\n"
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+
+	settings, err := LoadSettings(path)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(100), settings["USD"].MinAmount)
+	assert.Nil(t, settings["USD"].Enabled)
+	assert.True(t, *settings["GBP"].Enabled)
+	assert.False(t, *settings["EUR"].Enabled)
+}
@@ -0,0 +1,57 @@
+package currency
+
+// iso4217 lists the ISO 4217 currencies known to the gateway with their numeric
+// code, carried in ISO8583 field 49, and the number of decimal places of their
+// minor unit. Only the currencies enabled here can be used unless the currency
+// config enables others.
+var iso4217 = []Currency{
+	{Code: "AED", Numeric: "784", Exponent: 2, Enabled: true},
+	{Code: "AUD", Numeric: "036", Exponent: 2},
+	{Code: "BDT", Numeric: "050", Exponent: 2},
+	{Code: "BHD", Numeric: "048", Exponent: 3},
+	{Code: "BRL", Numeric: "986", Exponent: 2},
+	{Code: "CAD", Numeric: "124", Exponent: 2},
+	{Code: "CHF", Numeric: "756", Exponent: 2},
+	{Code: "CLP", Numeric: "152", Exponent: 0},
+	{Code: "CNY", Numeric: "156", Exponent: 2},
+	{Code: "CZK", Numeric: "203", Exponent: 2},
+	{Code: "DKK", Numeric: "208", Exponent: 2},
+	{Code: "EGP", Numeric: "818", Exponent: 2},
+	{Code: "EUR", Numeric: "978", Exponent: 2, Enabled: true},
+	{Code: "GBP", Numeric: "826", Exponent: 2},
+	{Code: "HKD", Numeric: "344", Exponent: 2},
+	{Code: "HUF", Numeric: "348", Exponent: 2},
+	{Code: "IDR", Numeric: "360", Exponent: 2},
+	{Code: "ILS", Numeric: "376", Exponent: 2},
+	{Code: "INR", Numeric: "356", Exponent: 2},
+	{Code: "IQD", Numeric: "368", Exponent: 3},
+	{Code: "ISK", Numeric: "352", Exponent: 0},
+	{Code: "JOD", Numeric: "400", Exponent: 3},
+	{Code: "JPY", Numeric: "392", Exponent: 0},
+	{Code: "KES", Numeric: "404", Exponent: 2},
+	{Code: "KRW", Numeric: "410", Exponent: 0},
+	{Code: "KWD", Numeric: "414", Exponent: 3},
+	{Code: "LKR", Numeric: "144", Exponent: 2},
+	{Code: "LYD", Numeric: "434", Exponent: 3},
+	{Code: "MXN", Numeric: "484", Exponent: 2},
+	{Code: "MYR", Numeric: "458", Exponent: 2},
+	{Code: "NGN", Numeric: "566", Exponent: 2},
+	{Code: "NOK", Numeric: "578", Exponent: 2},
+	{Code: "NZD", Numeric: "554", Exponent: 2},
+	{Code: "OMR", Numeric: "512", Exponent: 3},
+	{Code: "PHP", Numeric: "608", Exponent: 2},
+	{Code: "PKR", Numeric: "586", Exponent: 2},
+	{Code: "PLN", Numeric: "985", Exponent: 2},
+	{Code: "QAR", Numeric: "634", Exponent: 2},
+	{Code: "RUB", Numeric: "643", Exponent: 2},
+	{Code: "SAR", Numeric: "682", Exponent: 2},
+	{Code: "SEK", Numeric: "752", Exponent: 2},
+	{Code: "SGD", Numeric: "702", Exponent: 2},
+	{Code: "THB", Numeric: "764", Exponent: 2},
+	{Code: "TND", Numeric: "788", Exponent: 3},
+	{Code: "TRY", Numeric: "949", Exponent: 2},
+	{Code: "UGX", Numeric: "800", Exponent: 0},
+	{Code: "USD", Numeric: "840", Exponent: 2, Enabled: true},
+	{Code: "VND", Numeric: "704", Exponent: 0},
+	{Code: "ZAR", Numeric: "710", Exponent: 2},
+}
@@ -0,0 +1,108 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/wajidp/micro-payment-gateway/internal/logger"
+)
+
+// migrations are applied in order, each once. Released migrations must not be
+// changed, add a new one instead.
+var migrations = [][]string{
+	// 1: wallets, transactions and holds
+	{
+		`CREATE TABLE wallets (
+			user_id  TEXT NOT NULL,
+			currency TEXT NOT NULL,
+			exponent INTEGER NOT NULL,
+			balance  BIGINT NOT NULL DEFAULT 0,
+			held     BIGINT NOT NULL DEFAULT 0,
+			version  BIGINT NOT NULL DEFAULT 0,
+			PRIMARY KEY (user_id, currency)
+		)`,
+		`CREATE TABLE transactions (
+			id         TEXT PRIMARY KEY,
+			user_id    TEXT NOT NULL,
+			parent_id  TEXT NOT NULL DEFAULT '',
+			state      TEXT NOT NULL,
+			data       TEXT NOT NULL,
+			created_at BIGINT NOT NULL,
+			updated_at BIGINT NOT NULL
+		)`,
+		`CREATE INDEX transactions_state ON transactions (state, created_at)`,
+		`CREATE INDEX transactions_parent ON transactions (parent_id, created_at)`,
+		`CREATE TABLE holds (
+			id         TEXT PRIMARY KEY,
+			user_id    TEXT NOT NULL,
+			currency   TEXT NOT NULL,
+			amount     BIGINT NOT NULL,
+			state      TEXT NOT NULL,
+			created_at BIGINT NOT NULL
+		)`,
+	},
+	// 2: optimistic locking of transactions, rows stored before count as version 1
+	{
+		`ALTER TABLE transactions ADD COLUMN version BIGINT NOT NULL DEFAULT 0`,
+		`UPDATE transactions SET version = 1`,
+	},
+	// 3: ledger journals and their entries with the running balance of the account
+	{
+		`CREATE TABLE ledger_journals (
+			id             TEXT PRIMARY KEY,
+			transaction_id TEXT NOT NULL,
+			description    TEXT NOT NULL,
+			created_at     BIGINT NOT NULL
+		)`,
+		`CREATE TABLE ledger_entries (
+			id         INTEGER PRIMARY KEY AUTOINCREMENT,
+			journal_id TEXT NOT NULL REFERENCES ledger_journals (id),
+			account    TEXT NOT NULL,
+			currency   TEXT NOT NULL,
+			amount     BIGINT NOT NULL,
+			balance    BIGINT NOT NULL
+		)`,
+		`CREATE INDEX ledger_entries_account ON ledger_entries (account, id)`,
+	},
+	// 4: the idempotency key of the request which created a transaction, so it can be found after a restart
+	{
+		`ALTER TABLE transactions ADD COLUMN idempotency_key TEXT NOT NULL DEFAULT ''`,
+		`CREATE INDEX transactions_idempotency_key ON transactions (idempotency_key, created_at)`,
+	},
+}
+
+// migrate brings the schema up to date, recording the applied versions in schema_migrations
+func migrate(db *sql.DB) error {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY, applied_at BIGINT NOT NULL)`); err != nil {
+		return err
+	}
+
+	var current int
+	if err := db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+		return err
+	}
+
+	for i := current; i < len(migrations); i++ {
+		version := i + 1
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		for _, statement := range migrations[i] {
+			if _, err := tx.Exec(statement); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("migration %d: %w", version, err)
+			}
+		}
+		if _, err := tx.Exec(`INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`, version, time.Now().UnixNano()); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", version, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("migration %d: %w", version, err)
+		}
+		logger.Infof("Applied database migration %d", version)
+	}
+	return nil
+}
@@ -0,0 +1,510 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/wajidp/micro-payment-gateway/internal/logger"
+	"github.com/wajidp/micro-payment-gateway/internal/service/ledger"
+	"github.com/wajidp/micro-payment-gateway/internal/service/model"
+
+	// registers the pure Go SQLite driver as "sqlite"
+	_ "modernc.org/sqlite"
+)
+
+// SQLWalletRepo is a WalletRepository stored in a SQLite database. Wallet and
+// transaction updates use optimistic versioning: an update based on a stale
+// read is rejected with ErrConflict. Transactions are stored as JSON next to
+// the columns they are queried by, ledger entries keep the running balance of
+// their account.
+type SQLWalletRepo struct {
+	db *sql.DB
+}
+
+// OpenSQLite opens a SQLite database, e.g. "file:wallets.db". SQLite allows a
+// single writer, so the pool is limited to one connection.
+func OpenSQLite(dsn string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	return db, nil
+}
+
+// NewSQLWalletRepo migrates the schema of the database and returns the repository.
+func NewSQLWalletRepo(db *sql.DB) (model.WalletRepository, error) {
+	if err := migrate(db); err != nil {
+		return nil, err
+	}
+	return &SQLWalletRepo{db: db}, nil
+}
+
+// queryer is the part of *sql.DB and *sql.Tx the repository uses
+type queryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// inTx runs fn in a database transaction, committed when fn succeeds
+func (r *SQLWalletRepo) inTx(fn func(tx *sql.Tx) error) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return model.WrapError(model.ErrInternal, err.Error())
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return model.WrapError(model.ErrInternal, err.Error())
+	}
+	return nil
+}
+
+// dbError wraps a driver error as an internal error
+func dbError(err error) error {
+	return model.WrapError(model.ErrInternal, err.Error())
+}
+
+// loadWallet reads a wallet, the returned wallet is nil when it does not exist
+func (r *SQLWalletRepo) loadWallet(q queryer, userID, currency string) (*model.Wallet, error) {
+	wallet := &model.Wallet{UserID: userID, Currency: currency}
+	err := q.QueryRow(`SELECT exponent, balance, held, version FROM wallets WHERE user_id = ? AND currency = ?`, userID, currency).
+		Scan(&wallet.Exponent, &wallet.Balance, &wallet.Held, &wallet.Version)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, dbError(err)
+	}
+	return wallet, nil
+}
+
+// saveWallet writes the wallet if it is still at the version read, a new wallet
+// has version 0. The wallet's version is advanced on success.
+func (r *SQLWalletRepo) saveWallet(q queryer, wallet *model.Wallet) error {
+	var result sql.Result
+	var err error
+	if wallet.Version == 0 {
+		result, err = q.Exec(`INSERT INTO wallets (user_id, currency, exponent, balance, held, version) VALUES (?, ?, ?, ?, ?, 1) ON CONFLICT (user_id, currency) DO NOTHING`,
+			wallet.UserID, wallet.Currency, wallet.Exponent, wallet.Balance, wallet.Held)
+	} else {
+		result, err = q.Exec(`UPDATE wallets SET balance = ?, held = ?, version = version + 1 WHERE user_id = ? AND currency = ? AND version = ?`,
+			wallet.Balance, wallet.Held, wallet.UserID, wallet.Currency, wallet.Version)
+	}
+	if err != nil {
+		return dbError(err)
+	}
+	if rows, err := result.RowsAffected(); err != nil {
+		return dbError(err)
+	} else if rows == 0 {
+		return model.WrapError(model.ErrConflict, "wallet was modified concurrently")
+	}
+	wallet.Version++
+	return nil
+}
+
+// GetWallet retrieves the wallet for a given userID and currency, creating an empty one if it does not exist.
+// The wallet is a copy, changes are stored with UpdateWallet.
+func (r *SQLWalletRepo) GetWallet(userID, currency string) (*model.Wallet, error) {
+	wallet, err := r.loadWallet(r.db, userID, currency)
+	if err != nil || wallet != nil {
+		return wallet, err
+	}
+
+	wallet = newWallet(userID, currency)
+	if err := r.saveWallet(r.db, wallet); err != nil && !errors.Is(err, model.ErrConflict) {
+		return nil, err
+	}
+	// created by a concurrent request in the meantime
+	return r.loadWallet(r.db, userID, currency)
+}
+
+// UpdateWallet stores the wallet for a given userID and currency. It returns ErrConflict
+// when the wallet changed since it was read.
+func (r *SQLWalletRepo) UpdateWallet(userID, currency string, _wallet *model.Wallet) error {
+	return r.updateWallet(r.db, userID, currency, _wallet)
+}
+
+func (r *SQLWalletRepo) updateWallet(q queryer, userID, currency string, _wallet *model.Wallet) error {
+	_wallet.UserID = userID
+	_wallet.Currency = currency
+	if err := r.saveWallet(q, _wallet); err != nil {
+		return err
+	}
+
+	jw, _ := json.Marshal(_wallet)
+	logger.Infof("Wallet Update for User %s --> %v", userID, string(jw))
+	return nil
+}
+
+// ListWallets returns the wallets of the user, ordered by currency.
+func (r *SQLWalletRepo) ListWallets(userID string) ([]*model.Wallet, error) {
+	rows, err := r.db.Query(`SELECT currency, exponent, balance, held, version FROM wallets WHERE user_id = ? ORDER BY currency`, userID)
+	if err != nil {
+		return nil, dbError(err)
+	}
+	defer rows.Close()
+
+	var wallets []*model.Wallet
+	for rows.Next() {
+		wallet := &model.Wallet{UserID: userID}
+		if err := rows.Scan(&wallet.Currency, &wallet.Exponent, &wallet.Balance, &wallet.Held, &wallet.Version); err != nil {
+			return nil, dbError(err)
+		}
+		wallets = append(wallets, wallet)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, dbError(err)
+	}
+	return wallets, nil
+}
+
+// GetTransaction retrieves a transaction by its ID, it returns ErrNotFound if it does not exist.
+func (r *SQLWalletRepo) GetTransaction(txnID string) (*model.Transaction, error) {
+	return r.getTransaction(r.db, txnID)
+}
+
+func (r *SQLWalletRepo) getTransaction(q queryer, txnID string) (*model.Transaction, error) {
+	var data string
+	var version int64
+	err := q.QueryRow(`SELECT data, version FROM transactions WHERE id = ?`, txnID).Scan(&data, &version)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, model.WrapError(model.ErrNotFound, "transaction not found")
+	}
+	if err != nil {
+		return nil, dbError(err)
+	}
+	return decodeTransaction(data, version)
+}
+
+// UpdateTransaction stores the transaction and sets its UpdatedAt. It returns
+// ErrConflict when the transaction changed since it was read, or when a new
+// transaction has the ID of a stored one.
+func (r *SQLWalletRepo) UpdateTransaction(txn *model.Transaction) error {
+	return r.updateTransaction(r.db, txn)
+}
+
+// updateTransaction writes the transaction if it is still at the version read,
+// a new transaction has version 0. The transaction's version is advanced on success.
+func (r *SQLWalletRepo) updateTransaction(q queryer, txn *model.Transaction) error {
+	updatedAt := time.Now()
+	stored := *txn
+	stored.UpdatedAt = updatedAt
+	data, err := json.Marshal(&stored)
+	if err != nil {
+		return model.WrapError(model.ErrInternal, err.Error())
+	}
+
+	var result sql.Result
+	if txn.Version == 0 {
+		result, err = q.Exec(`INSERT INTO transactions (id, user_id, parent_id, idempotency_key, state, data, created_at, updated_at, version) VALUES (?, ?, ?, ?, ?, ?, ?, ?, 1)
+			ON CONFLICT (id) DO NOTHING`,
+			txn.ID, txn.UserID, txn.ParentID, txn.IdempotencyKey, txn.State, string(data), txn.CreatedAt.UnixNano(), updatedAt.UnixNano())
+	} else {
+		result, err = q.Exec(`UPDATE transactions SET state = ?, data = ?, updated_at = ?, version = version + 1 WHERE id = ? AND version = ?`,
+			txn.State, string(data), updatedAt.UnixNano(), txn.ID, txn.Version)
+	}
+	if err != nil {
+		return dbError(err)
+	}
+	if rows, err := result.RowsAffected(); err != nil {
+		return dbError(err)
+	} else if rows == 0 {
+		return model.WrapError(model.ErrConflict, "transaction was modified concurrently")
+	}
+	txn.UpdatedAt = updatedAt
+	txn.Version++
+
+	logger.Infof("Transaction Update for User %s --> %v", txn.UserID, string(data))
+	return nil
+}
+
+// ListTransactionsByState returns the transactions in the given state, oldest first.
+func (r *SQLWalletRepo) ListTransactionsByState(state string) ([]*model.Transaction, error) {
+	return r.listTransactions(r.db, `SELECT data, version FROM transactions WHERE state = ? ORDER BY created_at`, state)
+}
+
+// ListTransactionsByParent returns the transactions linked to the parent, oldest first.
+func (r *SQLWalletRepo) ListTransactionsByParent(parentID string) ([]*model.Transaction, error) {
+	return r.listTransactions(r.db, `SELECT data, version FROM transactions WHERE parent_id = ? ORDER BY created_at`, parentID)
+}
+
+// GetTransactionByIdempotencyKey returns the latest transaction created with the key, it returns ErrNotFound if there is none.
+func (r *SQLWalletRepo) GetTransactionByIdempotencyKey(key string) (*model.Transaction, error) {
+	var data string
+	var version int64
+	err := r.db.QueryRow(`SELECT data, version FROM transactions WHERE idempotency_key = ? AND idempotency_key <> '' ORDER BY created_at DESC LIMIT 1`, key).Scan(&data, &version)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, model.WrapError(model.ErrNotFound, "transaction not found")
+	}
+	if err != nil {
+		return nil, dbError(err)
+	}
+	return decodeTransaction(data, version)
+}
+
+func (r *SQLWalletRepo) listTransactions(q queryer, query string, arg string) ([]*model.Transaction, error) {
+	rows, err := q.Query(query, arg)
+	if err != nil {
+		return nil, dbError(err)
+	}
+	defer rows.Close()
+
+	var txns []*model.Transaction
+	for rows.Next() {
+		var data string
+		var version int64
+		if err := rows.Scan(&data, &version); err != nil {
+			return nil, dbError(err)
+		}
+		txn, err := decodeTransaction(data, version)
+		if err != nil {
+			return nil, err
+		}
+		txns = append(txns, txn)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, dbError(err)
+	}
+	return txns, nil
+}
+
+func decodeTransaction(data string, version int64) (*model.Transaction, error) {
+	var txn model.Transaction
+	if err := json.Unmarshal([]byte(data), &txn); err != nil {
+		return nil, model.WrapError(model.ErrInternal, err.Error())
+	}
+	txn.Version = version
+	return &txn, nil
+}
+
+// PlaceHold reserves amount of the available balance of the user's wallet in the currency.
+func (r *SQLWalletRepo) PlaceHold(userID, currency, holdID string, amount int64) error {
+	err := r.inTx(func(tx *sql.Tx) error {
+		var exists int
+		err := tx.QueryRow(`SELECT 1 FROM holds WHERE id = ?`, holdID).Scan(&exists)
+		if err == nil {
+			return model.WrapError(model.ErrConflict, "hold already placed")
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return dbError(err)
+		}
+
+		wallet, err := r.loadWallet(tx, userID, currency)
+		if err != nil {
+			return err
+		}
+		if wallet == nil {
+			wallet = newWallet(userID, currency)
+		}
+		if wallet.Available() < amount {
+			return model.ErrInsufficientFunds
+		}
+
+		wallet.Held += amount
+		if err := r.saveWallet(tx, wallet); err != nil {
+			return err
+		}
+		_, err = tx.Exec(`INSERT INTO holds (id, user_id, currency, amount, state, created_at) VALUES (?, ?, ?, ?, ?, ?)`,
+			holdID, userID, currency, amount, model.HoldActive, time.Now().UnixNano())
+		if err != nil {
+			return dbError(err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	logger.Infof("Hold %s placed for User %s --> %d %s", holdID, userID, amount, currency)
+	return nil
+}
+
+// CaptureHold debits a held amount from the ledger balance.
+func (r *SQLWalletRepo) CaptureHold(holdID string) error {
+	return r.inTx(func(tx *sql.Tx) error { return r.finishHold(tx, holdID, model.HoldCaptured) })
+}
+
+// ReleaseHold returns a held amount to the available balance.
+func (r *SQLWalletRepo) ReleaseHold(holdID string) error {
+	return r.inTx(func(tx *sql.Tx) error { return r.finishHold(tx, holdID, model.HoldReleased) })
+}
+
+// finishHold moves an active hold to its final state and updates the wallet, q
+// must be a database transaction.
+func (r *SQLWalletRepo) finishHold(q queryer, holdID, state string) error {
+	var hold model.Hold
+	err := q.QueryRow(`SELECT user_id, currency, amount, state FROM holds WHERE id = ?`, holdID).
+		Scan(&hold.UserID, &hold.Currency, &hold.Amount, &hold.State)
+	if errors.Is(err, sql.ErrNoRows) {
+		return model.WrapError(model.ErrNotFound, "hold not found")
+	}
+	if err != nil {
+		return dbError(err)
+	}
+	switch hold.State {
+	case state:
+		return nil
+	case model.HoldActive:
+	default:
+		return model.WrapError(model.ErrConflict, "hold already "+hold.State)
+	}
+
+	wallet, err := r.loadWallet(q, hold.UserID, hold.Currency)
+	if err != nil {
+		return err
+	}
+	if wallet == nil {
+		return model.WrapError(model.ErrInternal, "wallet of hold not found")
+	}
+	wallet.Held -= hold.Amount
+	if state == model.HoldCaptured {
+		wallet.Balance -= hold.Amount
+	}
+	if err := r.saveWallet(q, wallet); err != nil {
+		return err
+	}
+	if _, err := q.Exec(`UPDATE holds SET state = ? WHERE id = ?`, state, holdID); err != nil {
+		return dbError(err)
+	}
+	logger.Infof("Hold %s %s for User %s --> %d", holdID, state, hold.UserID, hold.Amount)
+	return nil
+}
+
+// LedgerEntries returns the entries of a ledger account, oldest first.
+func (r *SQLWalletRepo) LedgerEntries(account string) ([]model.LedgerEntry, error) {
+	rows, err := r.db.Query(`SELECT e.journal_id, j.transaction_id, j.description, e.currency, e.amount, e.balance, j.created_at
+		FROM ledger_entries e JOIN ledger_journals j ON j.id = e.journal_id WHERE e.account = ? ORDER BY e.id`, account)
+	if err != nil {
+		return nil, dbError(err)
+	}
+	defer rows.Close()
+
+	entries := []model.LedgerEntry{}
+	for rows.Next() {
+		entry := model.LedgerEntry{Account: account}
+		var createdAt int64
+		if err := rows.Scan(&entry.JournalID, &entry.TransactionID, &entry.Description, &entry.Currency, &entry.Amount, &entry.Balance, &createdAt); err != nil {
+			return nil, dbError(err)
+		}
+		entry.CreatedAt = time.Unix(0, createdAt)
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, dbError(err)
+	}
+	return entries, nil
+}
+
+// LedgerBalance returns the balance of a ledger account.
+func (r *SQLWalletRepo) LedgerBalance(account string) (int64, error) {
+	return r.ledgerBalance(r.db, account)
+}
+
+// ledgerBalance is the balance after the last entry of the account
+func (r *SQLWalletRepo) ledgerBalance(q queryer, account string) (int64, error) {
+	var balance int64
+	err := q.QueryRow(`SELECT balance FROM ledger_entries WHERE account = ? ORDER BY id DESC LIMIT 1`, account).Scan(&balance)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, dbError(err)
+	}
+	return balance, nil
+}
+
+// postJournal records a balanced journal and an entry for each of its postings,
+// q must be a database transaction.
+func (r *SQLWalletRepo) postJournal(q queryer, journal *model.Journal) error {
+	if err := ledger.Validate(journal); err != nil {
+		return err
+	}
+	if journal.CreatedAt.IsZero() {
+		journal.CreatedAt = time.Now()
+	}
+	result, err := q.Exec(`INSERT INTO ledger_journals (id, transaction_id, description, created_at) VALUES (?, ?, ?, ?) ON CONFLICT (id) DO NOTHING`,
+		journal.ID, journal.TransactionID, journal.Description, journal.CreatedAt.UnixNano())
+	if err != nil {
+		return dbError(err)
+	}
+	if rows, err := result.RowsAffected(); err != nil {
+		return dbError(err)
+	} else if rows == 0 {
+		return model.WrapError(model.ErrConflict, fmt.Sprintf("journal %s already posted", journal.ID))
+	}
+
+	for _, posting := range journal.Postings {
+		balance, err := r.ledgerBalance(q, posting.Account)
+		if err != nil {
+			return err
+		}
+		_, err = q.Exec(`INSERT INTO ledger_entries (journal_id, account, currency, amount, balance) VALUES (?, ?, ?, ?, ?)`,
+			journal.ID, posting.Account, posting.Currency, posting.Amount, balance+posting.Amount)
+		if err != nil {
+			return dbError(err)
+		}
+	}
+	return nil
+}
+
+// WithTx runs fn in a database transaction, committed when fn succeeds and
+// rolled back otherwise. SQLite serialises the writers, stale reads of wallets
+// and transactions are still rejected by their version.
+func (r *SQLWalletRepo) WithTx(fn func(tx model.WalletTx) error) error {
+	return r.inTx(func(tx *sql.Tx) error {
+		return fn(&sqlTx{repo: r, tx: tx})
+	})
+}
+
+// sqlTx is a unit of work of the SQL repository, bound to a database transaction
+type sqlTx struct {
+	repo *SQLWalletRepo
+	tx   *sql.Tx
+}
+
+// GetWallet returns the wallet, a new wallet is created when it is updated.
+func (tx *sqlTx) GetWallet(userID, currency string) (*model.Wallet, error) {
+	wallet, err := tx.repo.loadWallet(tx.tx, userID, currency)
+	if err != nil || wallet != nil {
+		return wallet, err
+	}
+	return newWallet(userID, currency), nil
+}
+
+func (tx *sqlTx) UpdateWallet(userID, currency string, wallet *model.Wallet) error {
+	return tx.repo.updateWallet(tx.tx, userID, currency, wallet)
+}
+
+func (tx *sqlTx) GetTransaction(txnID string) (*model.Transaction, error) {
+	return tx.repo.getTransaction(tx.tx, txnID)
+}
+
+func (tx *sqlTx) UpdateTransaction(txn *model.Transaction) error {
+	return tx.repo.updateTransaction(tx.tx, txn)
+}
+
+func (tx *sqlTx) ListTransactionsByParent(parentID string) ([]*model.Transaction, error) {
+	return tx.repo.listTransactions(tx.tx, `SELECT data, version FROM transactions WHERE parent_id = ? ORDER BY created_at`, parentID)
+}
+
+func (tx *sqlTx) CaptureHold(holdID string) error {
+	return tx.repo.finishHold(tx.tx, holdID, model.HoldCaptured)
+}
+
+func (tx *sqlTx) ReleaseHold(holdID string) error {
+	return tx.repo.finishHold(tx.tx, holdID, model.HoldReleased)
+}
+
+func (tx *sqlTx) PostJournal(journal *model.Journal) error {
+	return tx.repo.postJournal(tx.tx, journal)
+}
+
+func (tx *sqlTx) LedgerBalance(account string) (int64, error) {
+	return tx.repo.ledgerBalance(tx.tx, account)
+}
@@ -2,18 +2,24 @@ package database
 
 import (
 	"encoding/json"
-	"errors"
+	"fmt"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/wajidp/micro-payment-gateway/internal/logger"
+	"github.com/wajidp/micro-payment-gateway/internal/service/currency"
+	"github.com/wajidp/micro-payment-gateway/internal/service/ledger"
 	"github.com/wajidp/micro-payment-gateway/internal/service/model"
 )
 
 // UserWalletRepo is an in-memory implementation of the WalletRepository interface
 // It stores user wallets and transactions in a thread-safe manner using a read-write mutex.
 type UserWalletRepo struct {
-	data         map[string]*model.Wallet      // data holds the wallet information for each user, keyed by user ID.
+	data         map[walletKey]*model.Wallet   // data holds the wallet information for each user, keyed by user ID and currency.
 	transactions map[string]*model.Transaction // transactions holds transaction details for each transaction ID.
+	holds        map[string]*model.Hold        // holds holds the wallet holds keyed by the ID of the transaction which placed them.
+	ledger       *ledger.Ledger                // ledger holds the journals posted by units of work.
 	mu           sync.RWMutex                  // mu is a read-write mutex used to ensure thread-safe access to the data.
 }
 
@@ -21,33 +27,54 @@ type UserWalletRepo struct {
 // This repository stores wallet and transaction data in memory.
 func NewUserWalletRepo() model.WalletRepository {
 	return &UserWalletRepo{
-		data:         make(map[string]*model.Wallet),
+		data:         make(map[walletKey]*model.Wallet),
 		transactions: make(map[string]*model.Transaction),
+		holds:        make(map[string]*model.Hold),
+		ledger:       ledger.New(),
 	}
 }
 
-// GetWallet retrieves the wallet for a given userID from the repository.
+// walletKey identifies the wallet of a user in a currency
+type walletKey struct {
+	userID   string
+	currency string
+}
+
+// newWallet creates an empty wallet in the minor unit of the currency
+func newWallet(userID, code string) *model.Wallet {
+	return &model.Wallet{UserID: userID, Currency: code, Exponent: currency.Default().Exponent(code)}
+}
+
+// GetWallet retrieves the wallet for a given userID and currency from the repository.
 // If the wallet does not exist, it initializes a new one and stores it in the repository.
-func (r *UserWalletRepo) GetWallet(userID string) (*model.Wallet, error) {
+func (r *UserWalletRepo) GetWallet(userID, currency string) (*model.Wallet, error) {
+	key := walletKey{userID, currency}
 	r.mu.RLock()
-	defer r.mu.RUnlock()
-
-	wallet, exists := r.data[userID]
-	if !exists {
-		wallet = &model.Wallet{}
-		r.data[userID] = wallet
+	wallet, exists := r.data[key]
+	r.mu.RUnlock()
+	if exists {
+		return wallet, nil
 	}
 
+	// another request may have created it since the read
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if wallet, exists = r.data[key]; !exists {
+		wallet = newWallet(userID, currency)
+		r.data[key] = wallet
+	}
 	return wallet, nil
 }
 
-// UpdateWallet updates the wallet for a given userID in the repository.
+// UpdateWallet updates the wallet for a given userID and currency in the repository.
 // The function locks the repository for writing, updates the wallet, and logs the change.
-func (r *UserWalletRepo) UpdateWallet(userID string, _wallet *model.Wallet) error {
+func (r *UserWalletRepo) UpdateWallet(userID, currency string, _wallet *model.Wallet) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	r.data[userID] = _wallet
+	_wallet.UserID = userID
+	_wallet.Currency = currency
+	r.data[walletKey{userID, currency}] = _wallet
 
 	jw, _ := json.Marshal(_wallet)
 	logger.Infof("Wallet Update for User %s --> %v", userID, string(jw))
@@ -55,6 +82,21 @@ func (r *UserWalletRepo) UpdateWallet(userID string, _wallet *model.Wallet) erro
 	return nil
 }
 
+// ListWallets returns the wallets of the user, ordered by currency.
+func (r *UserWalletRepo) ListWallets(userID string) ([]*model.Wallet, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var wallets []*model.Wallet
+	for key, wallet := range r.data {
+		if key.userID == userID {
+			wallets = append(wallets, wallet)
+		}
+	}
+	sort.Slice(wallets, func(i, j int) bool { return wallets[i].Currency < wallets[j].Currency })
+	return wallets, nil
+}
+
 // GetTransaction retrieves a transaction by its ID from the repository.
 // If the transaction does not exist, it returns an error.
 func (r *UserWalletRepo) GetTransaction(txnID string) (*model.Transaction, error) {
@@ -63,18 +105,19 @@ func (r *UserWalletRepo) GetTransaction(txnID string) (*model.Transaction, error
 
 	txn, exists := r.transactions[txnID]
 	if !exists {
-		return nil, errors.New("transaction not found")
+		return nil, model.WrapError(model.ErrNotFound, "transaction not found")
 	}
 
 	return txn, nil
 }
 
-// UpdateTransaction updates the transaction in the repository.
+// UpdateTransaction updates the transaction in the repository and sets its UpdatedAt.
 // The function locks the repository for writing, updates the transaction, and logs the change.
 func (r *UserWalletRepo) UpdateTransaction(txn *model.Transaction) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
+	txn.UpdatedAt = time.Now()
 	r.transactions[txn.ID] = txn
 
 	jw, _ := json.Marshal(txn)
@@ -82,3 +125,283 @@ func (r *UserWalletRepo) UpdateTransaction(txn *model.Transaction) error {
 
 	return nil
 }
+
+// ListTransactionsByState returns the transactions in the given state, oldest first.
+func (r *UserWalletRepo) ListTransactionsByState(state string) ([]*model.Transaction, error) {
+	return r.listTransactions(func(txn *model.Transaction) bool { return txn.State == state }), nil
+}
+
+// ListTransactionsByParent returns the transactions linked to the parent, oldest first.
+func (r *UserWalletRepo) ListTransactionsByParent(parentID string) ([]*model.Transaction, error) {
+	return r.listTransactions(func(txn *model.Transaction) bool { return txn.ParentID == parentID }), nil
+}
+
+// GetTransactionByIdempotencyKey returns the latest transaction created with the key.
+func (r *UserWalletRepo) GetTransactionByIdempotencyKey(key string) (*model.Transaction, error) {
+	txns := r.listTransactions(func(txn *model.Transaction) bool { return key != "" && txn.IdempotencyKey == key })
+	if len(txns) == 0 {
+		return nil, model.WrapError(model.ErrNotFound, "transaction not found")
+	}
+	return txns[len(txns)-1], nil
+}
+
+// listTransactions returns the transactions matching the filter, oldest first.
+func (r *UserWalletRepo) listTransactions(match func(*model.Transaction) bool) []*model.Transaction {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var txns []*model.Transaction
+	for _, txn := range r.transactions {
+		if match(txn) {
+			txns = append(txns, txn)
+		}
+	}
+	sort.Slice(txns, func(i, j int) bool { return txns[i].CreatedAt.Before(txns[j].CreatedAt) })
+	return txns
+}
+
+// PlaceHold reserves amount of the available balance of the user's wallet in the currency.
+func (r *UserWalletRepo) PlaceHold(userID, currency, holdID string, amount int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, exists := r.holds[holdID]; exists {
+		return model.WrapError(model.ErrConflict, "hold already placed")
+	}
+	key := walletKey{userID, currency}
+	wallet, exists := r.data[key]
+	if !exists {
+		wallet = newWallet(userID, currency)
+		r.data[key] = wallet
+	}
+	if wallet.Available() < amount {
+		return model.ErrInsufficientFunds
+	}
+
+	wallet.Held += amount
+	r.holds[holdID] = &model.Hold{ID: holdID, UserID: userID, Currency: currency, Amount: amount, State: model.HoldActive, CreatedAt: time.Now()}
+	logger.Infof("Hold %s placed for User %s --> %d %s", holdID, userID, amount, currency)
+	return nil
+}
+
+// CaptureHold debits a held amount from the ledger balance.
+func (r *UserWalletRepo) CaptureHold(holdID string) error {
+	return r.WithTx(func(tx model.WalletTx) error { return tx.CaptureHold(holdID) })
+}
+
+// ReleaseHold returns a held amount to the available balance.
+func (r *UserWalletRepo) ReleaseHold(holdID string) error {
+	return r.WithTx(func(tx model.WalletTx) error { return tx.ReleaseHold(holdID) })
+}
+
+// LedgerEntries returns the entries of a ledger account, oldest first.
+func (r *UserWalletRepo) LedgerEntries(account string) ([]model.LedgerEntry, error) {
+	return r.ledger.Entries(account), nil
+}
+
+// LedgerBalance returns the balance of a ledger account.
+func (r *UserWalletRepo) LedgerBalance(account string) (int64, error) {
+	return r.ledger.Balance(account), nil
+}
+
+// WithTx runs fn as a unit of work. The repository is locked while fn runs and
+// fn works on copies, which are written back only when it succeeds.
+func (r *UserWalletRepo) WithTx(fn func(tx model.WalletTx) error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	tx := &memoryTx{
+		repo:         r,
+		wallets:      make(map[walletKey]*model.Wallet),
+		transactions: make(map[string]*model.Transaction),
+		holds:        make(map[string]*model.Hold),
+	}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	tx.commit()
+	return nil
+}
+
+// memoryTx is a unit of work of the in-memory repository. It keeps the wallets,
+// transactions, holds and journals written during the unit of work apart from
+// the repository until it is committed.
+type memoryTx struct {
+	repo         *UserWalletRepo
+	wallets      map[walletKey]*model.Wallet
+	transactions map[string]*model.Transaction
+	holds        map[string]*model.Hold
+	journals     []*model.Journal
+}
+
+// GetWallet returns a copy of the wallet as written in the unit of work or stored, a new wallet when neither.
+func (tx *memoryTx) GetWallet(userID, currency string) (*model.Wallet, error) {
+	key := walletKey{userID, currency}
+	wallet, exists := tx.wallets[key]
+	if !exists {
+		if wallet, exists = tx.repo.data[key]; !exists {
+			return newWallet(userID, currency), nil
+		}
+	}
+	copied := *wallet
+	return &copied, nil
+}
+
+// UpdateWallet writes the wallet in the unit of work.
+func (tx *memoryTx) UpdateWallet(userID, currency string, _wallet *model.Wallet) error {
+	_wallet.UserID = userID
+	_wallet.Currency = currency
+	tx.wallets[walletKey{userID, currency}] = _wallet
+	return nil
+}
+
+// GetTransaction returns a copy of the transaction as written in the unit of work or stored.
+func (tx *memoryTx) GetTransaction(txnID string) (*model.Transaction, error) {
+	txn, exists := tx.transactions[txnID]
+	if !exists {
+		if txn, exists = tx.repo.transactions[txnID]; !exists {
+			return nil, model.WrapError(model.ErrNotFound, "transaction not found")
+		}
+	}
+	copied := *txn
+	return &copied, nil
+}
+
+// UpdateTransaction writes the transaction in the unit of work and sets its UpdatedAt.
+func (tx *memoryTx) UpdateTransaction(txn *model.Transaction) error {
+	txn.UpdatedAt = time.Now()
+	tx.transactions[txn.ID] = txn
+	return nil
+}
+
+// ListTransactionsByParent returns the transactions linked to the parent as written in the unit of work or stored, oldest first.
+func (tx *memoryTx) ListTransactionsByParent(parentID string) ([]*model.Transaction, error) {
+	var txns []*model.Transaction
+	for id, txn := range tx.repo.transactions {
+		if _, written := tx.transactions[id]; !written && txn.ParentID == parentID {
+			copied := *txn
+			txns = append(txns, &copied)
+		}
+	}
+	for _, txn := range tx.transactions {
+		if txn.ParentID == parentID {
+			copied := *txn
+			txns = append(txns, &copied)
+		}
+	}
+	sort.Slice(txns, func(i, j int) bool { return txns[i].CreatedAt.Before(txns[j].CreatedAt) })
+	return txns, nil
+}
+
+// CaptureHold debits a held amount from the ledger balance.
+func (tx *memoryTx) CaptureHold(holdID string) error {
+	return tx.finishHold(holdID, model.HoldCaptured)
+}
+
+// ReleaseHold returns a held amount to the available balance.
+func (tx *memoryTx) ReleaseHold(holdID string) error {
+	return tx.finishHold(holdID, model.HoldReleased)
+}
+
+// finishHold moves an active hold to its final state and updates the wallet.
+func (tx *memoryTx) finishHold(holdID, state string) error {
+	hold, exists := tx.holds[holdID]
+	if !exists {
+		stored, exists := tx.repo.holds[holdID]
+		if !exists {
+			return model.WrapError(model.ErrNotFound, "hold not found")
+		}
+		copied := *stored
+		hold = &copied
+	}
+	switch hold.State {
+	case state:
+		return nil
+	case model.HoldActive:
+	default:
+		return model.WrapError(model.ErrConflict, "hold already "+hold.State)
+	}
+
+	wallet, _ := tx.GetWallet(hold.UserID, hold.Currency)
+	wallet.Held -= hold.Amount
+	if state == model.HoldCaptured {
+		wallet.Balance -= hold.Amount
+	}
+	hold.State = state
+	tx.wallets[walletKey{hold.UserID, hold.Currency}] = wallet
+	tx.holds[holdID] = hold
+	return nil
+}
+
+// PostJournal checks the journal and records it in the unit of work, it is
+// posted to the ledger on commit.
+func (tx *memoryTx) PostJournal(journal *model.Journal) error {
+	if err := ledger.Validate(journal); err != nil {
+		return err
+	}
+	posted := func(id string) bool {
+		for _, staged := range tx.journals {
+			if staged.ID == id {
+				return true
+			}
+		}
+		_, exists := tx.repo.ledger.Journal(id)
+		return exists
+	}
+	if posted(journal.ID) {
+		return model.WrapError(model.ErrConflict, fmt.Sprintf("journal %s already posted", journal.ID))
+	}
+	tx.journals = append(tx.journals, journal)
+	return nil
+}
+
+// LedgerBalance returns the balance of a ledger account including the journals of the unit of work.
+func (tx *memoryTx) LedgerBalance(account string) (int64, error) {
+	balance := tx.repo.ledger.Balance(account)
+	for _, journal := range tx.journals {
+		for _, posting := range journal.Postings {
+			if posting.Account == account {
+				balance += posting.Amount
+			}
+		}
+	}
+	return balance, nil
+}
+
+// commit writes the changes of the unit of work to the repository. Stored
+// entries are overwritten in place since callers may hold on to them.
+func (tx *memoryTx) commit() {
+	r := tx.repo
+	for id, hold := range tx.holds {
+		if stored, exists := r.holds[id]; exists {
+			*stored = *hold
+		} else {
+			r.holds[id] = hold
+		}
+		logger.Infof("Hold %s %s for User %s --> %d", id, hold.State, hold.UserID, hold.Amount)
+	}
+	for key, wallet := range tx.wallets {
+		if stored, exists := r.data[key]; exists {
+			*stored = *wallet
+		} else {
+			r.data[key] = wallet
+		}
+		jw, _ := json.Marshal(wallet)
+		logger.Infof("Wallet Update for User %s --> %v", key.userID, string(jw))
+	}
+	for id, txn := range tx.transactions {
+		if stored, exists := r.transactions[id]; exists {
+			*stored = *txn
+		} else {
+			r.transactions[id] = txn
+		}
+		jw, _ := json.Marshal(txn)
+		logger.Infof("Transaction Update for User %s --> %v", txn.UserID, string(jw))
+	}
+	// checked by PostJournal while the repository is locked
+	for _, journal := range tx.journals {
+		if err := r.ledger.Post(journal); err != nil {
+			logger.Errorf("Failed to post journal %s: %v", journal.ID, err)
+		}
+	}
+}
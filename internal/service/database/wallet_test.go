@@ -0,0 +1,393 @@
+package database
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wajidp/micro-payment-gateway/internal/service/ledger"
+	"github.com/wajidp/micro-payment-gateway/internal/service/model"
+)
+
+// newSQLiteRepo returns a SQL repository on a fresh database file
+func newSQLiteRepo(t *testing.T, path string) model.WalletRepository {
+	db, err := OpenSQLite("file:" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	repo, err := NewSQLWalletRepo(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return repo
+}
+
+// repositories returns each WalletRepository implementation, they must behave alike
+func repositories(t *testing.T) map[string]model.WalletRepository {
+	return map[string]model.WalletRepository{
+		"memory": NewUserWalletRepo(),
+		"sqlite": newSQLiteRepo(t, filepath.Join(t.TempDir(), "wallets.db")),
+	}
+}
+
+// TestWalletRepository_Wallets verifies that wallets are created empty in the minor unit and updates are stored.
+func TestWalletRepository_Wallets(t *testing.T) {
+	for name, repo := range repositories(t) {
+		t.Run(name, func(t *testing.T) {
+			wallet, err := repo.GetWallet("123", "USD")
+			assert.NoError(t, err)
+			assert.Equal(t, "USD", wallet.Currency)
+			assert.Equal(t, 2, wallet.Exponent)
+			assert.Equal(t, int64(0), wallet.Balance)
+
+			wallet.Balance = 1000
+			assert.NoError(t, repo.UpdateWallet("123", "USD", wallet))
+			_, err = repo.GetWallet("123", "AED")
+			assert.NoError(t, err)
+
+			wallet, err = repo.GetWallet("123", "USD")
+			assert.NoError(t, err)
+			assert.Equal(t, int64(1000), wallet.Balance)
+
+			wallets, err := repo.ListWallets("123")
+			assert.NoError(t, err)
+			assert.Len(t, wallets, 2)
+			assert.Equal(t, "AED", wallets[0].Currency)
+			assert.Equal(t, "USD", wallets[1].Currency)
+
+			wallets, err = repo.ListWallets("456")
+			assert.NoError(t, err)
+			assert.Empty(t, wallets)
+		})
+	}
+}
+
+// TestWalletRepository_Transactions verifies storing, looking up by ID and idempotency key, and
+// listing transactions.
+func TestWalletRepository_Transactions(t *testing.T) {
+	for name, repo := range repositories(t) {
+		t.Run(name, func(t *testing.T) {
+			now := time.Now()
+			deposit := &model.Transaction{ID: "t1", UserID: "123", Type: "Deposit", Amount: 1000, Currency: "USD", State: model.StateAuthorized, CreatedAt: now}
+			refund := &model.Transaction{ID: "t2", UserID: "123", Type: "Refund", Amount: 400, Currency: "USD", State: model.StateAuthorized, ParentID: "t1", CreatedAt: now.Add(time.Second)}
+			assert.NoError(t, repo.UpdateTransaction(refund))
+			assert.NoError(t, repo.UpdateTransaction(deposit))
+			assert.False(t, deposit.UpdatedAt.IsZero())
+
+			txns, err := repo.ListTransactionsByState(model.StateAuthorized)
+			assert.NoError(t, err)
+			assert.Len(t, txns, 2)
+			assert.Equal(t, "t1", txns[0].ID, "Expected the oldest transaction first")
+			assert.Equal(t, "t2", txns[1].ID)
+
+			deposit.State = model.StateApproved
+			assert.NoError(t, repo.UpdateTransaction(deposit))
+			txn, err := repo.GetTransaction("t1")
+			assert.NoError(t, err)
+			assert.Equal(t, model.StateApproved, txn.State)
+			assert.Equal(t, int64(1000), txn.Amount)
+
+			txns, err = repo.ListTransactionsByState(model.StateAuthorized)
+			assert.NoError(t, err)
+			assert.Len(t, txns, 1)
+			txns, err = repo.ListTransactionsByParent("t1")
+			assert.NoError(t, err)
+			assert.Len(t, txns, 1)
+			assert.Equal(t, "t2", txns[0].ID)
+
+			_, err = repo.GetTransaction("missing")
+			assert.ErrorIs(t, err, model.ErrNotFound)
+
+			// a retry after a failure creates another transaction with the key, the latest is returned
+			failed := &model.Transaction{ID: "t3", UserID: "123", Type: "Deposit", State: model.StateFailed, IdempotencyKey: "key-1", CreatedAt: now}
+			retried := &model.Transaction{ID: "t4", UserID: "123", Type: "Deposit", State: model.StateAuthorized, IdempotencyKey: "key-1", CreatedAt: now.Add(time.Second)}
+			assert.NoError(t, repo.UpdateTransaction(retried))
+			assert.NoError(t, repo.UpdateTransaction(failed))
+			txn, err = repo.GetTransactionByIdempotencyKey("key-1")
+			assert.NoError(t, err)
+			assert.Equal(t, "t4", txn.ID)
+			_, err = repo.GetTransactionByIdempotencyKey("")
+			assert.ErrorIs(t, err, model.ErrNotFound)
+		})
+	}
+}
+
+// TestWalletRepository_Holds verifies that holds reserve available funds and end once.
+func TestWalletRepository_Holds(t *testing.T) {
+	for name, repo := range repositories(t) {
+		t.Run(name, func(t *testing.T) {
+			wallet, err := repo.GetWallet("123", "USD")
+			assert.NoError(t, err)
+			wallet.Balance = 1000
+			assert.NoError(t, repo.UpdateWallet("123", "USD", wallet))
+
+			assert.NoError(t, repo.PlaceHold("123", "USD", "h1", 600))
+			assert.ErrorIs(t, repo.PlaceHold("123", "USD", "h1", 100), model.ErrConflict)
+			assert.ErrorIs(t, repo.PlaceHold("123", "USD", "h2", 500), model.ErrValidation)
+			assert.ErrorIs(t, repo.PlaceHold("123", "AED", "h3", 1), model.ErrValidation)
+			assert.NoError(t, repo.PlaceHold("123", "USD", "h4", 300))
+
+			wallet, err = repo.GetWallet("123", "USD")
+			assert.NoError(t, err)
+			assert.Equal(t, int64(900), wallet.Held)
+			assert.Equal(t, int64(100), wallet.Available())
+
+			assert.NoError(t, repo.CaptureHold("h1"))
+			assert.NoError(t, repo.CaptureHold("h1"), "Expected capturing twice to be harmless")
+			assert.ErrorIs(t, repo.ReleaseHold("h1"), model.ErrConflict)
+			assert.NoError(t, repo.ReleaseHold("h4"))
+			assert.ErrorIs(t, repo.CaptureHold("missing"), model.ErrNotFound)
+
+			wallet, err = repo.GetWallet("123", "USD")
+			assert.NoError(t, err)
+			assert.Equal(t, int64(400), wallet.Balance)
+			assert.Equal(t, int64(0), wallet.Held)
+		})
+	}
+}
+
+// TestWalletRepository_WithTx verifies that the changes of a unit of work are stored
+// together when it succeeds and discarded when it fails.
+func TestWalletRepository_WithTx(t *testing.T) {
+	for name, repo := range repositories(t) {
+		t.Run(name, func(t *testing.T) {
+			wallet, err := repo.GetWallet("123", "USD")
+			assert.NoError(t, err)
+			wallet.Balance = 1000
+			assert.NoError(t, repo.UpdateWallet("123", "USD", wallet))
+			assert.NoError(t, repo.PlaceHold("123", "USD", "w1", 300))
+			assert.NoError(t, repo.UpdateTransaction(&model.Transaction{ID: "d1", UserID: "123", Amount: 500, State: model.StateAuthorized, CreatedAt: time.Now()}))
+			assert.NoError(t, repo.UpdateTransaction(&model.Transaction{ID: "r1", UserID: "123", Amount: 100, State: model.StateAuthorized, ParentID: "d1", CreatedAt: time.Now()}))
+
+			// credit, capture and settle, then fail
+			settle := func(tx model.WalletTx) error {
+				wallet, err := tx.GetWallet("123", "USD")
+				if err != nil {
+					return err
+				}
+				wallet.Balance += 500
+				if err := tx.UpdateWallet("123", "USD", wallet); err != nil {
+					return err
+				}
+				if err := tx.CaptureHold("w1"); err != nil {
+					return err
+				}
+				txn, err := tx.GetTransaction("r1")
+				if err != nil {
+					return err
+				}
+				txn.State = model.StateApproved
+				if err := tx.UpdateTransaction(txn); err != nil {
+					return err
+				}
+				refunds, err := tx.ListTransactionsByParent("d1")
+				if err != nil {
+					return err
+				}
+				assert.Equal(t, model.StateApproved, refunds[0].State, "Expected the unit of work to read its own writes")
+				wallet, err = tx.GetWallet("123", "USD")
+				assert.Equal(t, int64(1200), wallet.Balance)
+				return err
+			}
+			err = repo.WithTx(func(tx model.WalletTx) error {
+				if err := settle(tx); err != nil {
+					return err
+				}
+				return model.WrapError(model.ErrInternal, "crash")
+			})
+			assert.ErrorIs(t, err, model.ErrInternal)
+
+			wallet, err = repo.GetWallet("123", "USD")
+			assert.NoError(t, err)
+			assert.Equal(t, int64(1000), wallet.Balance, "Expected a failed unit of work to leave the wallet untouched")
+			assert.Equal(t, int64(300), wallet.Held)
+			txn, err := repo.GetTransaction("r1")
+			assert.NoError(t, err)
+			assert.Equal(t, model.StateAuthorized, txn.State)
+
+			assert.NoError(t, repo.WithTx(settle))
+			wallet, err = repo.GetWallet("123", "USD")
+			assert.NoError(t, err)
+			assert.Equal(t, int64(1200), wallet.Balance)
+			assert.Equal(t, int64(0), wallet.Held)
+			txn, err = repo.GetTransaction("r1")
+			assert.NoError(t, err)
+			assert.Equal(t, model.StateApproved, txn.State)
+			assert.ErrorIs(t, repo.ReleaseHold("w1"), model.ErrConflict, "Expected the hold to be captured")
+		})
+	}
+}
+
+// TestWalletRepository_Ledger verifies that journals are posted with their unit of work, with
+// running balances, and that unbalanced or repeated journals are rejected.
+func TestWalletRepository_Ledger(t *testing.T) {
+	wallet := ledger.WalletAccount("123", "USD")
+	clearing := ledger.ClearingAccount("PGA", "USD")
+	journal := func(id string, amount int64) *model.Journal {
+		return &model.Journal{ID: id, TransactionID: id, Description: "Deposit", Postings: []model.Posting{
+			{Account: clearing, Currency: "USD", Amount: -amount},
+			{Account: wallet, Currency: "USD", Amount: amount},
+		}}
+	}
+
+	for name, repo := range repositories(t) {
+		t.Run(name, func(t *testing.T) {
+			err := repo.WithTx(func(tx model.WalletTx) error {
+				if err := tx.PostJournal(journal("t1", 1000)); err != nil {
+					return err
+				}
+				if err := tx.PostJournal(journal("t2", 300)); err != nil {
+					return err
+				}
+				balance, err := tx.LedgerBalance(wallet)
+				assert.NoError(t, err)
+				assert.Equal(t, int64(1300), balance)
+				return nil
+			})
+			assert.NoError(t, err)
+
+			// a unit of work which fails posts nothing
+			err = repo.WithTx(func(tx model.WalletTx) error {
+				assert.NoError(t, tx.PostJournal(journal("t3", 500)))
+				return model.ErrInternal
+			})
+			assert.ErrorIs(t, err, model.ErrInternal)
+
+			err = repo.WithTx(func(tx model.WalletTx) error { return tx.PostJournal(journal("t1", 1)) })
+			assert.ErrorIs(t, err, model.ErrConflict)
+			unbalanced := journal("t4", 100)
+			unbalanced.Postings[0].Amount = -99
+			err = repo.WithTx(func(tx model.WalletTx) error { return tx.PostJournal(unbalanced) })
+			assert.ErrorIs(t, err, model.ErrValidation)
+
+			balance, err := repo.LedgerBalance(wallet)
+			assert.NoError(t, err)
+			assert.Equal(t, int64(1300), balance)
+			balance, err = repo.LedgerBalance(clearing)
+			assert.NoError(t, err)
+			assert.Equal(t, int64(-1300), balance)
+
+			entries, err := repo.LedgerEntries(wallet)
+			assert.NoError(t, err)
+			assert.Len(t, entries, 2)
+			assert.Equal(t, "t1", entries[0].JournalID)
+			assert.Equal(t, "Deposit", entries[0].Description)
+			assert.Equal(t, int64(1000), entries[0].Balance)
+			assert.Equal(t, int64(300), entries[1].Amount)
+			assert.Equal(t, int64(1300), entries[1].Balance)
+			assert.False(t, entries[1].CreatedAt.IsZero())
+
+			entries, err = repo.LedgerEntries(ledger.FeeAccount("USD"))
+			assert.NoError(t, err)
+			assert.Empty(t, entries)
+		})
+	}
+}
+
+// TestUserWalletRepo_GetWalletConcurrent verifies that concurrent first reads of a wallet create it once.
+func TestUserWalletRepo_GetWalletConcurrent(t *testing.T) {
+	repo := NewUserWalletRepo()
+	wallets := make(chan *model.Wallet, 10)
+	var wg sync.WaitGroup
+	for i := 0; i < cap(wallets); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			wallet, _ := repo.GetWallet("123", "USD")
+			wallets <- wallet
+		}()
+	}
+	wg.Wait()
+	close(wallets)
+
+	first := <-wallets
+	for wallet := range wallets {
+		assert.Same(t, first, wallet)
+	}
+}
+
+// TestSQLWalletRepo_Versioning verifies that an update of a stale wallet is rejected.
+func TestSQLWalletRepo_Versioning(t *testing.T) {
+	repo := newSQLiteRepo(t, filepath.Join(t.TempDir(), "wallets.db"))
+
+	first, err := repo.GetWallet("123", "USD")
+	assert.NoError(t, err)
+	second, err := repo.GetWallet("123", "USD")
+	assert.NoError(t, err)
+
+	first.Balance = 1000
+	assert.NoError(t, repo.UpdateWallet("123", "USD", first))
+	second.Balance = 500
+	assert.ErrorIs(t, repo.UpdateWallet("123", "USD", second), model.ErrConflict)
+
+	first.Balance = 1200
+	assert.NoError(t, repo.UpdateWallet("123", "USD", first), "Expected the version to advance with the update")
+	wallet, err := repo.GetWallet("123", "USD")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1200), wallet.Balance)
+
+	// a hold changes the wallet too
+	assert.NoError(t, repo.PlaceHold("123", "USD", "h1", 200))
+	wallet.Balance = 0
+	assert.ErrorIs(t, repo.UpdateWallet("123", "USD", wallet), model.ErrConflict)
+}
+
+// TestSQLWalletRepo_TransactionVersioning verifies that an update of a stale transaction and a new
+// transaction reusing a stored ID are rejected.
+func TestSQLWalletRepo_TransactionVersioning(t *testing.T) {
+	repo := newSQLiteRepo(t, filepath.Join(t.TempDir(), "wallets.db"))
+
+	assert.NoError(t, repo.UpdateTransaction(&model.Transaction{ID: "t1", UserID: "123", State: model.StateInitiated, CreatedAt: time.Now()}))
+	assert.ErrorIs(t, repo.UpdateTransaction(&model.Transaction{ID: "t1", UserID: "123", State: model.StateFailed, CreatedAt: time.Now()}), model.ErrConflict)
+
+	first, err := repo.GetTransaction("t1")
+	assert.NoError(t, err)
+	second, err := repo.GetTransaction("t1")
+	assert.NoError(t, err)
+
+	first.State = model.StateAuthorized
+	assert.NoError(t, repo.UpdateTransaction(first))
+	second.State = model.StateFailed
+	assert.ErrorIs(t, repo.UpdateTransaction(second), model.ErrConflict)
+
+	first.State = model.StateApproved
+	assert.NoError(t, repo.UpdateTransaction(first), "Expected the version to advance with the update")
+	txn, err := repo.GetTransaction("t1")
+	assert.NoError(t, err)
+	assert.Equal(t, model.StateApproved, txn.State)
+
+	// a unit of work rejects a stale write as well and is rolled back
+	err = repo.WithTx(func(tx model.WalletTx) error {
+		return tx.UpdateTransaction(second)
+	})
+	assert.ErrorIs(t, err, model.ErrConflict)
+	txns, err := repo.ListTransactionsByState(model.StateApproved)
+	assert.NoError(t, err)
+	assert.Len(t, txns, 1)
+	assert.Equal(t, first.Version, txns[0].Version)
+}
+
+// TestSQLWalletRepo_Reopen verifies that wallets, transactions and holds survive a restart.
+func TestSQLWalletRepo_Reopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wallets.db")
+	repo := newSQLiteRepo(t, path)
+	wallet, err := repo.GetWallet("123", "USD")
+	assert.NoError(t, err)
+	wallet.Balance = 1000
+	assert.NoError(t, repo.UpdateWallet("123", "USD", wallet))
+	assert.NoError(t, repo.PlaceHold("123", "USD", "t1", 300))
+	assert.NoError(t, repo.UpdateTransaction(&model.Transaction{ID: "t1", UserID: "123", Amount: 300, State: model.StateAuthorized, CreatedAt: time.Now()}))
+
+	repo = newSQLiteRepo(t, path)
+	wallet, err = repo.GetWallet("123", "USD")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1000), wallet.Balance)
+	assert.Equal(t, int64(300), wallet.Held)
+	txn, err := repo.GetTransaction("t1")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(300), txn.Amount)
+	assert.NoError(t, repo.CaptureHold("t1"))
+}
@@ -0,0 +1,49 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/viper"
+	"github.com/wajidp/micro-payment-gateway/internal/service/model"
+)
+
+// chargeFee sets the fee the user pays for a deposit or withdrawal, in the
+// currency of the wallet. A deposit credits its amount less the fee, a
+// withdrawal holds and debits its amount plus the fee.
+func (p *PaymentProcessor) chargeFee(txn *model.Transaction) error {
+	fee, ok := p.Fees[txn.WalletCurrency]
+	if !ok {
+		return nil
+	}
+	txn.Fee = fee.Fixed + txn.WalletAmount*fee.BasisPoints/10000
+	if txn.Type == ActionDeposit && txn.Fee >= txn.WalletAmount {
+		return model.WrapError(model.ErrValidation, fmt.Sprintf("amount does not cover the fee of %d", txn.Fee))
+	}
+	return nil
+}
+
+// LoadTransactionFees reads the fees charged to users from a YAML or JSON file
+// of the form currency -> {fixed, basis_points}
+func LoadTransactionFees(path string) (map[string]model.Fee, error) {
+	v := viper.New()
+	v.SetConfigFile(path)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, err
+	}
+
+	raw := map[string]model.Fee{}
+	if err := v.Unmarshal(&raw); err != nil {
+		return nil, err
+	}
+
+	// viper lower cases keys, currencies are upper case
+	fees := make(map[string]model.Fee, len(raw))
+	for currency, fee := range raw {
+		if fee.Fixed < 0 || fee.BasisPoints < 0 {
+			return nil, fmt.Errorf("%s: fees must not be negative", currency)
+		}
+		fees[strings.ToUpper(currency)] = fee
+	}
+	return fees, nil
+}
@@ -0,0 +1,99 @@
+package fx
+
+import (
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+	"github.com/wajidp/micro-payment-gateway/internal/service/model"
+)
+
+// FileProvider quotes the rates of a YAML or JSON file of the form
+//
+//	updated_at: 2024-01-01T00:00:00Z
+//	rates:
+//	  EUR/AED: "4.0123"
+//
+// A pair missing from the file is quoted at the inverse of the reverse pair.
+// Quotes expire maxAge after the rates were updated, the modification time of
+// the file when updated_at is missing, so a stale file stops conversions.
+type FileProvider struct {
+	path   string
+	maxAge time.Duration
+
+	mu        sync.RWMutex
+	rates     map[string]*big.Rat
+	updatedAt time.Time
+}
+
+// NewFileProvider loads the rates file
+func NewFileProvider(path string, maxAge time.Duration) (*FileProvider, error) {
+	p := &FileProvider{path: path, maxAge: maxAge}
+	if err := p.Reload(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Reload reads the rates file again, the rates in use are kept if it is invalid
+func (p *FileProvider) Reload() error {
+	v := viper.New()
+	v.SetConfigFile(p.path)
+	if err := v.ReadInConfig(); err != nil {
+		return err
+	}
+
+	// viper lower cases keys, currencies are upper case
+	raw := v.GetStringMapString("rates")
+	rates := make(map[string]*big.Rat, len(raw))
+	for pair, value := range raw {
+		rate, err := ParseRate(value)
+		if err != nil {
+			return fmt.Errorf("%s: %v", pair, err)
+		}
+		rates[strings.ToUpper(pair)] = rate
+	}
+
+	var updatedAt time.Time
+	if v.IsSet("updated_at") {
+		var err error
+		if updatedAt, err = cast.ToTimeE(v.Get("updated_at")); err != nil {
+			return fmt.Errorf("updated_at: %v", err)
+		}
+	} else {
+		info, err := os.Stat(p.path)
+		if err != nil {
+			return err
+		}
+		updatedAt = info.ModTime()
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rates = rates
+	p.updatedAt = updatedAt
+	return nil
+}
+
+// Quote returns the rate of the pair from the file
+func (p *FileProvider) Quote(from, to string) (*Quote, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	expiresAt := p.updatedAt.Add(p.maxAge)
+	if from == to {
+		return newQuote(from, to, big.NewRat(1, 1), expiresAt), nil
+	}
+	if rate, ok := p.rates[from+"/"+to]; ok {
+		return newQuote(from, to, rate, expiresAt), nil
+	}
+	if rate, ok := p.rates[to+"/"+from]; ok {
+		return newQuote(from, to, new(big.Rat).Inv(rate), expiresAt), nil
+	}
+	return nil, model.WrapError(model.ErrValidation, fmt.Sprintf("no exchange rate for %s/%s", from, to))
+}
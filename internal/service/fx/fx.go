@@ -0,0 +1,90 @@
+package fx
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/wajidp/micro-payment-gateway/internal/service/model"
+)
+
+// Quote is an exchange rate offered for a limited time
+type Quote struct {
+	// ID identifies the quote, it is recorded on the transaction using it
+	ID string `json:"id"`
+	// From and To are the ISO 4217 codes of the currencies converted
+	From string `json:"from"`
+	To   string `json:"to"`
+	// Rate is the amount of To bought by one unit of From
+	Rate *big.Rat `json:"-"`
+	// ExpiresAt is the time after which the rate may no longer be used
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Expired reports whether the quote can no longer be used at the given time
+func (q *Quote) Expired(now time.Time) bool {
+	return !now.Before(q.ExpiresAt)
+}
+
+// RateProvider quotes the exchange rate between two currencies
+type RateProvider interface {
+	Quote(from, to string) (*Quote, error)
+}
+
+// Rounding selects how a converted amount is rounded to the minor unit
+type Rounding int
+
+// Rounding modes, credits are rounded down and debits up so that the rounding
+// never pays out more than was received
+const (
+	Floor Rounding = iota
+	Ceil
+)
+
+// Convert converts amount, with the exponent from, at the rate to an amount with
+// the exponent to. The conversion is exact until the final rounding.
+func Convert(amount int64, from int, rate *big.Rat, to int, rounding Rounding) (int64, error) {
+	if rate == nil || rate.Sign() <= 0 {
+		return 0, model.WrapError(model.ErrValidation, "invalid exchange rate")
+	}
+
+	value := new(big.Rat).SetInt64(amount)
+	value.Mul(value, rate)
+	value.Mul(value, new(big.Rat).SetFrac(pow10(to), pow10(from)))
+
+	quo, rem := new(big.Int).QuoRem(value.Num(), value.Denom(), new(big.Int))
+	if rem.Sign() != 0 && rounding == Ceil {
+		quo.Add(quo, big.NewInt(1))
+	}
+	if !quo.IsInt64() {
+		return 0, model.WrapError(model.ErrValidation, "converted amount out of range")
+	}
+	return quo.Int64(), nil
+}
+
+// ParseRate parses a decimal exchange rate such as "3.6725"
+func ParseRate(s string) (*big.Rat, error) {
+	rate, ok := new(big.Rat).SetString(strings.TrimSpace(s))
+	if !ok || rate.Sign() <= 0 {
+		return nil, fmt.Errorf("invalid exchange rate %q", s)
+	}
+	return rate, nil
+}
+
+// FormatRate formats a rate as a decimal with at most 10 decimal places
+func FormatRate(rate *big.Rat) string {
+	s := rate.FloatString(10)
+	s = strings.TrimRight(s, "0")
+	return strings.TrimSuffix(s, ".")
+}
+
+// newQuote builds a quote for a currency pair
+func newQuote(from, to string, rate *big.Rat, expiresAt time.Time) *Quote {
+	return &Quote{ID: uuid.New().String(), From: from, To: to, Rate: rate, ExpiresAt: expiresAt}
+}
+
+func pow10(n int) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(n)), nil)
+}
@@ -0,0 +1,115 @@
+package fx
+
+import (
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/h2non/gock"
+	"github.com/stretchr/testify/assert"
+	"github.com/wajidp/micro-payment-gateway/internal/service/model"
+)
+
+// TestConvert verifies the rescaling between exponents and the rounding of credits and debits.
+func TestConvert(t *testing.T) {
+	rate, err := ParseRate("4.0123")
+	assert.NoError(t, err)
+
+	// 10.01 EUR is 40.163123 AED
+	amount, err := Convert(1001, 2, rate, 2, Floor)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(4016), amount)
+	amount, err = Convert(1001, 2, rate, 2, Ceil)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(4017), amount)
+
+	// exact conversions are not rounded up
+	amount, err = Convert(1000, 2, big.NewRat(4, 1), 2, Ceil)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(4000), amount)
+
+	// into a currency without minor unit
+	amount, err = Convert(1000, 2, big.NewRat(150, 1), 0, Floor)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1500), amount)
+
+	_, err = Convert(100, 2, big.NewRat(0, 1), 2, Floor)
+	assert.ErrorIs(t, err, model.ErrValidation)
+
+	assert.Equal(t, "4.0123", FormatRate(rate))
+	assert.Equal(t, "4", FormatRate(big.NewRat(4, 1)))
+	_, err = ParseRate("-1")
+	assert.Error(t, err)
+}
+
+// TestFileProvider verifies direct and inverse pairs and that quotes expire with the file.
+func TestFileProvider(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rates.yaml")
+	updatedAt := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	content := "updated_at: " + updatedAt.Format(time.RFC3339) + "\nrates:\n  EUR/AED: \"4\"\n"
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+
+	provider, err := NewFileProvider(path, 2*time.Hour)
+	assert.NoError(t, err)
+
+	quote, err := provider.Quote("EUR", "AED")
+	assert.NoError(t, err)
+	assert.Equal(t, big.NewRat(4, 1), quote.Rate)
+	assert.Equal(t, updatedAt.Add(2*time.Hour), quote.ExpiresAt.UTC())
+	assert.False(t, quote.Expired(time.Now()))
+	assert.NotEmpty(t, quote.ID)
+
+	quote, err = provider.Quote("AED", "EUR")
+	assert.NoError(t, err)
+	assert.Equal(t, big.NewRat(1, 4), quote.Rate)
+
+	_, err = provider.Quote("USD", "AED")
+	assert.ErrorIs(t, err, model.ErrValidation)
+
+	// rates older than the max age are no longer used
+	provider, err = NewFileProvider(path, time.Minute)
+	assert.NoError(t, err)
+	quote, err = provider.Quote("EUR", "AED")
+	assert.NoError(t, err)
+	assert.True(t, quote.Expired(time.Now()))
+}
+
+// TestHTTPProvider verifies that quotes of the rate service are decoded and
+// that a missing expiry falls back to the TTL.
+func TestHTTPProvider(t *testing.T) {
+	defer gock.Off()
+	gock.DisableNetworking()
+
+	expiresAt := time.Now().Add(30 * time.Second).UTC().Truncate(time.Second)
+	gock.New("http://rates.test").
+		Get("/rates").
+		MatchParam("from", "EUR").
+		MatchParam("to", "AED").
+		Reply(http.StatusOK).
+		JSON(map[string]string{"id": "q-1", "rate": "4.0123", "expires_at": expiresAt.Format(time.RFC3339)})
+	gock.New("http://rates.test").
+		Get("/rates").
+		Reply(http.StatusOK).
+		JSON(map[string]string{"rate": "0.2492"})
+	gock.New("http://rates.test").
+		Get("/rates").
+		Reply(http.StatusServiceUnavailable)
+
+	provider := NewHTTPProvider(&http.Client{}, "http://rates.test")
+	quote, err := provider.Quote("EUR", "AED")
+	assert.NoError(t, err)
+	assert.Equal(t, "q-1", quote.ID)
+	assert.Equal(t, "4.0123", FormatRate(quote.Rate))
+	assert.Equal(t, expiresAt, quote.ExpiresAt.UTC())
+
+	quote, err = provider.Quote("AED", "EUR")
+	assert.NoError(t, err)
+	assert.NotEmpty(t, quote.ID)
+	assert.WithinDuration(t, time.Now().Add(DefaultQuoteTTL), quote.ExpiresAt, time.Second)
+
+	_, err = provider.Quote("EUR", "AED")
+	assert.ErrorIs(t, err, model.ErrHttpResponseFailure)
+}
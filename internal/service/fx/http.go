@@ -0,0 +1,79 @@
+package fx
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/wajidp/micro-payment-gateway/internal/service/model"
+)
+
+// DefaultQuoteTTL is how long a quote of the HTTP provider is used when the
+// rate service does not return an expiry
+const DefaultQuoteTTL = time.Minute
+
+// HTTPProvider quotes rates from a rate service answering
+//
+//	GET {baseURL}/rates?from=EUR&to=AED
+//
+// with {"id": "...", "rate": "4.0123", "expires_at": "2024-01-01T00:00:00Z"}
+type HTTPProvider struct {
+	baseURL    string
+	httpClient *http.Client
+	// TTL is the lifetime of quotes returned without expires_at, DefaultQuoteTTL when zero
+	TTL time.Duration
+}
+
+type rateResponse struct {
+	ID        string    `json:"id"`
+	Rate      string    `json:"rate"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// NewHTTPProvider creates a provider for the rate service at baseURL
+func NewHTTPProvider(httpClient *http.Client, baseURL string) *HTTPProvider {
+	return &HTTPProvider{baseURL: baseURL, httpClient: httpClient}
+}
+
+// Quote asks the rate service for the rate of the pair
+func (p *HTTPProvider) Quote(from, to string) (*Quote, error) {
+	query := url.Values{"from": {from}, "to": {to}}
+	resp, err := p.httpClient.Get(fmt.Sprintf("%s/rates?%s", p.baseURL, query.Encode()))
+	if err != nil {
+		return nil, model.WrapError(model.ErrHttpRequestFailure, err.Error())
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, model.WrapError(model.ErrHttpResponseFailure, err.Error())
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, &model.HttpStatusError{StatusCode: resp.StatusCode, Body: string(body)}
+	}
+
+	var response rateResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, model.WrapError(model.ErrHttpResponseFailure, err.Error())
+	}
+	rate, err := ParseRate(response.Rate)
+	if err != nil {
+		return nil, model.WrapError(model.ErrHttpResponseFailure, err.Error())
+	}
+
+	quote := newQuote(from, to, rate, response.ExpiresAt)
+	if response.ID != "" {
+		quote.ID = response.ID
+	}
+	if quote.ExpiresAt.IsZero() {
+		ttl := p.TTL
+		if ttl <= 0 {
+			ttl = DefaultQuoteTTL
+		}
+		quote.ExpiresAt = time.Now().Add(ttl)
+	}
+	return quote, nil
+}
@@ -0,0 +1,161 @@
+package gateway
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// DefaultRequestTimeout bounds a gateway call when no timeout is configured
+const DefaultRequestTimeout = 30 * time.Second
+
+// GatewayConfig holds the connection settings of a payment gateway
+type GatewayConfig struct {
+	// Type is the registered gateway type, the gateway name when empty
+	Type string `mapstructure:"type" json:"type"`
+	// Options holds the gateway specific settings declared by its registration
+	Options map[string]interface{} `mapstructure:"options" json:"options"`
+	// BaseURL is the gateway endpoint, the action is appended as a path element
+	BaseURL string `mapstructure:"base_url" json:"base_url"`
+	// ConnectTimeout bounds dialing and the TLS handshake
+	ConnectTimeout time.Duration `mapstructure:"connect_timeout" json:"connect_timeout"`
+	// ReadTimeout bounds the wait for the response headers once the request is sent
+	ReadTimeout time.Duration `mapstructure:"read_timeout" json:"read_timeout"`
+	// RequestTimeout bounds the whole call including reading the body, DefaultRequestTimeout when zero
+	RequestTimeout time.Duration `mapstructure:"request_timeout" json:"request_timeout"`
+	// MaxIdleConns is the number of keep-alive connections kept to the gateway
+	MaxIdleConns int `mapstructure:"max_idle_conns" json:"max_idle_conns"`
+	// ClientCertFile and ClientKeyFile are the PEM client certificate and key for mTLS
+	ClientCertFile string `mapstructure:"client_cert_file" json:"client_cert_file"`
+	ClientKeyFile  string `mapstructure:"client_key_file" json:"client_key_file"`
+	// CAFile is a PEM bundle used instead of the system roots to verify the gateway
+	CAFile string `mapstructure:"ca_file" json:"ca_file"`
+	// ProxyURL routes the gateway traffic through a proxy, HTTP_PROXY, HTTPS_PROXY and
+	// NO_PROXY from the environment apply when empty
+	ProxyURL string `mapstructure:"proxy_url" json:"proxy_url"`
+}
+
+// DefaultGatewayConfigs returns the settings used for gateways missing from the configuration
+func DefaultGatewayConfigs() map[string]GatewayConfig {
+	return map[string]GatewayConfig{
+		"PGA": {Type: "PGA", BaseURL: "http://pgsa.com"},
+		"PGB": {Type: "PGB", BaseURL: "http://pgsb.com/soap"},
+	}
+}
+
+// LoadGatewayConfigs reads gateway settings from a YAML or JSON file of the form
+// gateways -> name -> settings. Gateways not in the file keep their defaults and
+// a gateway without a base URL takes the default one.
+func LoadGatewayConfigs(path string) (map[string]GatewayConfig, error) {
+	v := viper.New()
+	v.SetConfigFile(path)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, err
+	}
+
+	var file struct {
+		Gateways map[string]GatewayConfig `mapstructure:"gateways"`
+	}
+	if err := v.Unmarshal(&file); err != nil {
+		return nil, err
+	}
+
+	// viper lower cases keys, gateway names are upper case
+	configs := DefaultGatewayConfigs()
+	for name, cfg := range file.Gateways {
+		name = strings.ToUpper(name)
+		if cfg.Type == "" {
+			cfg.Type = name
+		}
+		if cfg.BaseURL == "" {
+			cfg.BaseURL = configs[name].BaseURL
+		}
+		configs[name] = cfg
+	}
+	return configs, nil
+}
+
+// NewHTTPClient builds the HTTP client of a gateway. The default transport is
+// shared when no transport setting is configured.
+func NewHTTPClient(cfg GatewayConfig) (*http.Client, error) {
+	client := &http.Client{Timeout: cfg.RequestTimeout}
+	if client.Timeout <= 0 {
+		client.Timeout = DefaultRequestTimeout
+	}
+	if !cfg.customTransport() {
+		return client, nil
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if cfg.ConnectTimeout > 0 {
+		transport.DialContext = (&net.Dialer{Timeout: cfg.ConnectTimeout, KeepAlive: 30 * time.Second}).DialContext
+		transport.TLSHandshakeTimeout = cfg.ConnectTimeout
+	}
+	if cfg.ReadTimeout > 0 {
+		transport.ResponseHeaderTimeout = cfg.ReadTimeout
+	}
+	if cfg.MaxIdleConns > 0 {
+		transport.MaxIdleConns = cfg.MaxIdleConns
+		transport.MaxIdleConnsPerHost = cfg.MaxIdleConns
+	}
+	if cfg.ProxyURL != "" {
+		proxy, err := url.Parse(cfg.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy url: %w", err)
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+
+	tlsConfig, err := cfg.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	client.Transport = transport
+	return client, nil
+}
+
+// customTransport reports whether a transport level setting is configured
+func (cfg GatewayConfig) customTransport() bool {
+	return cfg.ConnectTimeout > 0 || cfg.ReadTimeout > 0 || cfg.MaxIdleConns > 0 ||
+		cfg.ProxyURL != "" || cfg.CAFile != "" || cfg.ClientCertFile != "" || cfg.ClientKeyFile != ""
+}
+
+// tlsConfig loads the CA bundle and client certificate, nil when neither is configured
+func (cfg GatewayConfig) tlsConfig() (*tls.Config, error) {
+	if cfg.CAFile == "" && cfg.ClientCertFile == "" && cfg.ClientKeyFile == "" {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.CAFile != "" {
+		pem, err := ioutil.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA bundle: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", cfg.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if cfg.ClientCertFile != "" || cfg.ClientKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.ClientCertFile, cfg.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
@@ -0,0 +1,108 @@
+package gateway
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wajidp/micro-payment-gateway/internal/service/model"
+)
+
+// TestLoadGatewayConfigs verifies that the file overrides the defaults and missing
+// base URLs fall back to the default endpoint.
+func TestLoadGatewayConfigs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gateways.yaml")
+	content := "gateways:\n  pga:\n    connect_timeout: 2s\n    read_timeout: 500ms\n    max_idle_conns: 5\n  pgb:\n    base_url: https://pgb.example.com/soap\n"
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+
+	configs, err := LoadGatewayConfigs(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "http://pgsa.com", configs["PGA"].BaseURL)
+	assert.Equal(t, 2*time.Second, configs["PGA"].ConnectTimeout)
+	assert.Equal(t, 500*time.Millisecond, configs["PGA"].ReadTimeout)
+	assert.Equal(t, 5, configs["PGA"].MaxIdleConns)
+	assert.Equal(t, "https://pgb.example.com/soap", configs["PGB"].BaseURL)
+}
+
+// TestNewHTTPClient verifies the client timeouts and transport settings.
+func TestNewHTTPClient(t *testing.T) {
+	client, err := NewHTTPClient(GatewayConfig{BaseURL: "http://pgsa.com"})
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultRequestTimeout, client.Timeout)
+	assert.Nil(t, client.Transport, "Expected the default transport without transport settings")
+
+	client, err = NewHTTPClient(GatewayConfig{
+		BaseURL:        "http://pgsa.com",
+		RequestTimeout: time.Second,
+		ReadTimeout:    200 * time.Millisecond,
+		MaxIdleConns:   7,
+		ProxyURL:       "http://proxy.local:3128",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, time.Second, client.Timeout)
+	transport := client.Transport.(*http.Transport)
+	assert.Equal(t, 200*time.Millisecond, transport.ResponseHeaderTimeout)
+	assert.Equal(t, 7, transport.MaxIdleConnsPerHost)
+	req, _ := http.NewRequest("POST", "http://pgsa.com/deposit", nil)
+	proxy, err := transport.Proxy(req)
+	assert.NoError(t, err)
+	assert.Equal(t, "proxy.local:3128", proxy.Host)
+
+	// without a proxy url the environment proxy still applies
+	client, err = NewHTTPClient(GatewayConfig{BaseURL: "http://pgsa.com", ReadTimeout: time.Second})
+	assert.NoError(t, err)
+	assert.NotNil(t, client.Transport.(*http.Transport).Proxy)
+
+	_, err = NewHTTPClient(GatewayConfig{BaseURL: "http://pgsa.com", CAFile: filepath.Join(t.TempDir(), "missing.pem")})
+	assert.Error(t, err)
+}
+
+// TestNewHTTPClient_CABundle verifies that a gateway with a private CA is trusted
+// through the configured bundle.
+func TestNewHTTPClient_CABundle(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"status":"success"}`))
+	}))
+	defer server.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	assert.NoError(t, os.WriteFile(caFile, certPEM(server), 0o600))
+
+	client, err := NewHTTPClient(GatewayConfig{BaseURL: server.URL, CAFile: caFile, ConnectTimeout: time.Second})
+	assert.NoError(t, err)
+	response, err := NewPGSA(client, server.URL).Deposit(&model.PaymentRequest{TransactionID: "txn"})
+	assert.NoError(t, err)
+	assert.Equal(t, "success", response.Status)
+
+	// without the bundle the certificate is rejected
+	client, err = NewHTTPClient(GatewayConfig{BaseURL: server.URL, ConnectTimeout: time.Second})
+	assert.NoError(t, err)
+	_, err = NewPGSA(client, server.URL).Deposit(&model.PaymentRequest{TransactionID: "txn"})
+	assert.ErrorIs(t, err, model.ErrHttpRequestFailure)
+}
+
+// TestGatewayFactory_Cache verifies that gateways are built once and unknown ones are rejected.
+func TestGatewayFactory_Cache(t *testing.T) {
+	factory := NewGatewayFactory()
+	first, err := factory.GetPaymentGatewayInstance("PGA")
+	assert.NoError(t, err)
+	second, err := factory.GetPaymentGatewayInstance("PGA")
+	assert.NoError(t, err)
+	assert.Same(t, first, second)
+
+	_, err = factory.GetPaymentGatewayInstance("PGX")
+	assert.Error(t, err)
+
+	_, err = NewConfiguredGatewayFactory(map[string]GatewayConfig{"PGA": {BaseURL: "http://pgsa.com", ProxyURL: "://bad"}})
+	assert.Error(t, err)
+}
+
+// certPEM returns the certificate of a TLS test server in PEM form.
+func certPEM(server *httptest.Server) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+}
@@ -4,8 +4,10 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"strings"
+	"sync"
 
 	"github.com/wajidp/micro-payment-gateway/internal/service/model"
 )
@@ -14,63 +16,175 @@ import (
 const (
 	ActionDeposit  = "deposit"
 	ActionWithdraw = "withdraw"
+	ActionStatus   = "status"
+	ActionRefund   = "refund"
+	ActionCancel   = "cancel"
+)
+
+// Gateway status values of PaymentResponse.Status
+const (
+	StatusSuccess = "success"
+	StatusFailed  = "failed"
+	StatusPending = "pending"
 )
 
 type PaymentGateway interface {
 	Deposit(request *model.PaymentRequest) (*model.PaymentResponse, error)
 	Withdraw(request *model.PaymentRequest) (*model.PaymentResponse, error)
+	// QueryStatus asks the gateway for the current status of a transaction it processed
+	QueryStatus(txnID string) (*model.PaymentResponse, error)
+	// Refund returns request.Amount of request.OriginalTransactionID, request.TransactionID
+	// identifies the refund itself
+	Refund(request *model.PaymentRequest) (*model.PaymentResponse, error)
+	// Cancel voids a transaction the gateway authorized but has not settled yet
+	Cancel(txnID string) (*model.PaymentResponse, error)
 }
 
 type GatewayFactoryInterface interface {
 	GetPaymentGatewayInstance(provider string) (PaymentGateway, error)
+	Capabilities(provider string) (Capabilities, error)
 }
 
-type GatewayFactory struct{}
+// GatewayFactory builds gateways from their config and caches them, so the
+// HTTP client and its connections are shared by all requests to a gateway
+type GatewayFactory struct {
+	configs map[string]GatewayConfig
+
+	mu        sync.Mutex
+	instances map[string]PaymentGateway
+}
 
+// NewGatewayFactory creates a factory with the default gateway configs
 func NewGatewayFactory() *GatewayFactory {
-	return &GatewayFactory{}
+	return &GatewayFactory{
+		configs:   DefaultGatewayConfigs(),
+		instances: make(map[string]PaymentGateway),
+	}
 }
 
+// NewConfiguredGatewayFactory creates a factory from the given configs and builds
+// every gateway up front so that invalid TLS or proxy settings fail at startup
+func NewConfiguredGatewayFactory(configs map[string]GatewayConfig) (*GatewayFactory, error) {
+	f := &GatewayFactory{
+		configs:   make(map[string]GatewayConfig, len(configs)),
+		instances: make(map[string]PaymentGateway),
+	}
+	for name, cfg := range configs {
+		f.configs[name] = cfg
+	}
+	for name := range f.configs {
+		if _, err := f.GetPaymentGatewayInstance(name); err != nil {
+			return nil, fmt.Errorf("gateway %s: %w", name, err)
+		}
+	}
+	return f, nil
+}
+
+// GetPaymentGatewayInstance returns the cached gateway, building it on first use
 func (f *GatewayFactory) GetPaymentGatewayInstance(provider string) (PaymentGateway, error) {
-	switch provider {
-	case "PGA":
-		return NewPGSA(), nil
-	case "PGB":
-		return NewPGSB(), nil
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if pg, ok := f.instances[provider]; ok {
+		return pg, nil
+	}
+	pg, err := f.newGateway(provider)
+	if err != nil {
+		return nil, err
+	}
+	f.instances[provider] = pg
+	return pg, nil
+}
 
-	default:
-		return nil, errors.New("payment gateway not implemented")
+// Capabilities returns what the gateway's registered type supports
+func (f *GatewayFactory) Capabilities(provider string) (Capabilities, error) {
+	_, registration, err := f.registration(provider)
+	if err != nil {
+		return Capabilities{}, err
 	}
+	return registration.Capabilities, nil
 }
 
-// makeHTTPRequest is a common function to handle HTTP requests for both JSON and XML requests
-func makeHTTPRequest(httpClient *http.Client, url, action, contentType, requestBody string) ([]byte, error) {
+// newGateway builds a gateway and its HTTP client with the constructor registered for its type
+func (f *GatewayFactory) newGateway(provider string) (PaymentGateway, error) {
+	cfg, registration, err := f.registration(provider)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.BaseURL == "" {
+		return nil, errors.New("base url is required")
+	}
+	if cfg.Options, err = ValidateOptions(registration.Options, cfg.Options); err != nil {
+		return nil, err
+	}
+	httpClient, err := NewHTTPClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return registration.New(cfg, httpClient)
+}
+
+// registration returns the config of a gateway and the registration of its type
+func (f *GatewayFactory) registration(provider string) (GatewayConfig, Registration, error) {
+	cfg, ok := f.configs[provider]
+	if !ok {
+		return cfg, Registration{}, errors.New("payment gateway not implemented")
+	}
+	typ := cfg.Type
+	if typ == "" {
+		typ = provider
+	}
+	registration, ok := Lookup(typ)
+	if !ok {
+		return cfg, Registration{}, fmt.Errorf("unknown payment gateway type %s", typ)
+	}
+	return cfg, registration, nil
+}
+
+// makeHTTPRequest is a common function to handle HTTP requests for both JSON and XML requests,
+// headers are added to the request
+func makeHTTPRequest(httpClient *http.Client, url, action, contentType, requestBody string, headers map[string]string) ([]byte, error) {
 	// Create HTTP request
 	req, err := http.NewRequest("POST", fmt.Sprintf("%s/%s", url, action), strings.NewReader(requestBody))
 	if err != nil {
 		return nil, model.WrapError(model.ErrHttpRequestFailure, err.Error())
 	}
 	req.Header.Set("Content-Type", contentType)
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
 
 	// Send HTTP request
 	resp, err := httpClient.Do(req)
 	if err != nil {
+		if isTimeout(err) {
+			return nil, model.WrapError(model.ErrGatewayTimeout, err.Error())
+		}
 		return nil, model.WrapError(model.ErrHttpRequestFailure, err.Error())
 	}
 	defer resp.Body.Close()
 
 	respBody, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
+		if isTimeout(err) {
+			return nil, model.WrapError(model.ErrGatewayTimeout, err.Error())
+		}
 		return nil, model.WrapError(model.ErrHttpResponseFailure, err.Error())
 	}
 
 	if !IsSuccessStatus(resp.StatusCode) {
-		return nil, model.WrapError(model.ErrHttpResponseFailure, string(respBody))
+		return nil, &model.HttpStatusError{StatusCode: resp.StatusCode, Body: string(respBody)}
 	}
 
 	return respBody, nil
 }
 
+// isTimeout checks if a transport error is a timeout
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
 // isSuccessStatus checks if the status code indicates success (2xx)
 func IsSuccessStatus(statusCode int) bool {
 	return statusCode >= 200 && statusCode < 300
@@ -0,0 +1,350 @@
+package gateway
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"math/big"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cast"
+	"github.com/wajidp/micro-payment-gateway/internal/logger"
+	"github.com/wajidp/micro-payment-gateway/internal/service/model"
+)
+
+// JSONGatewayType is the registered type of the configurable JSON gateway
+const JSONGatewayType = "JSON"
+
+// defaultRequestTemplate produces the PGSA request body
+const defaultRequestTemplate = `{"id":{{id}},"userId":{{user_id}},"currency":{{currency}},"amount":{{amount}},"exponent":{{exponent}},"country_code":{{country_code}}}`
+
+// defaultRefundTemplate produces the PGSA refund body
+const defaultRefundTemplate = `{"id":{{id}},"userId":{{user_id}},"currency":{{currency}},"amount":{{amount}},"exponent":{{exponent}},"original_id":{{original_id}}}`
+
+// placeholder matches {{name}} in a request template
+var placeholder = regexp.MustCompile(`{{\s*([a-z_]+)\s*}}`)
+
+func init() {
+	Register(Registration{
+		Name: JSONGatewayType,
+		New:  newJSONGatewayFromConfig,
+		Options: []OptionSpec{
+			{Name: "request_template", Type: OptionString, Default: defaultRequestTemplate,
+				Description: "JSON request body, {{id}}, {{user_id}}, {{currency}}, {{amount}}, {{amount_decimal}}, {{exponent}}, {{country_code}} and {{action}} are replaced by JSON values"},
+			{Name: "deposit_path", Type: OptionString, Default: ActionDeposit, Description: "path appended to the base url for deposits"},
+			{Name: "withdraw_path", Type: OptionString, Default: ActionWithdraw, Description: "path appended to the base url for withdrawals"},
+			{Name: "refund_path", Type: OptionString, Default: ActionRefund, Description: "path appended to the base url for refunds"},
+			{Name: "refund_template", Type: OptionString, Default: defaultRefundTemplate,
+				Description: "JSON refund body, takes the request_template fields and {{original_id}}, the refunded transaction"},
+			{Name: "cancel_path", Type: OptionString, Default: ActionCancel, Description: "path appended to the base url for cancellations"},
+			{Name: "cancel_template", Type: OptionString, Default: `{"id":{{id}}}`, Description: "JSON cancellation body, {{id}} is the transaction ID"},
+			{Name: "status_path", Type: OptionString, Default: ActionStatus, Description: "path appended to the base url for status queries"},
+			{Name: "status_template", Type: OptionString, Default: `{"id":{{id}}}`, Description: "JSON status query body, {{id}} is the transaction ID"},
+			{Name: "response_mapping", Type: OptionMap,
+				Description: "status, message and reference paths in the response such as $.data.status or result.items[0].code, reference is the gateway's own ID of the transaction"},
+			{Name: "status_mapping", Type: OptionMap, Description: "gateway status value to success, failed or pending, case insensitive, unmapped values are rejected"},
+			{Name: "headers", Type: OptionMap, Description: "static headers added to every request"},
+			{Name: "hmac_secret", Type: OptionString, Description: "signs the request body when set"},
+			{Name: "hmac_header", Type: OptionString, Default: "X-Signature", Description: "header carrying the signature"},
+			{Name: "hmac_algorithm", Type: OptionString, Default: "sha256", Description: "sha256 or sha512"},
+			{Name: "hmac_encoding", Type: OptionString, Default: "hex", Description: "hex or base64"},
+		},
+		Capabilities: Capabilities{
+			Deposit:     true,
+			Withdraw:    true,
+			Refund:      true,
+			Cancel:      true,
+			StatusQuery: true,
+		},
+	})
+}
+
+// JSONGateway is a JSON over HTTP gateway whose request body, response fields,
+// status values, headers and signature are all taken from config
+type JSONGateway struct {
+	httpClient *http.Client
+	url        string
+
+	template        string
+	refundTemplate  string
+	cancelTemplate  string
+	statusTemplate  string
+	paths           map[string]string
+	responseMapping map[string]string
+	statusMapping   map[string]string
+	headers         map[string]string
+
+	hmacSecret   []byte
+	hmacHeader   string
+	hmacHash     func() hash.Hash
+	hmacEncoding string
+}
+
+// newJSONGatewayFromConfig builds a JSON gateway from validated options
+func newJSONGatewayFromConfig(cfg GatewayConfig, httpClient *http.Client) (PaymentGateway, error) {
+	g := &JSONGateway{
+		httpClient:     httpClient,
+		url:            strings.TrimSuffix(cfg.BaseURL, "/"),
+		template:       cast.ToString(cfg.Options["request_template"]),
+		refundTemplate: cast.ToString(cfg.Options["refund_template"]),
+		cancelTemplate: cast.ToString(cfg.Options["cancel_template"]),
+		statusTemplate: cast.ToString(cfg.Options["status_template"]),
+		paths: map[string]string{
+			ActionDeposit:  cast.ToString(cfg.Options["deposit_path"]),
+			ActionWithdraw: cast.ToString(cfg.Options["withdraw_path"]),
+			ActionRefund:   cast.ToString(cfg.Options["refund_path"]),
+			ActionCancel:   cast.ToString(cfg.Options["cancel_path"]),
+			ActionStatus:   cast.ToString(cfg.Options["status_path"]),
+		},
+		responseMapping: map[string]string{"status": "status", "message": "message"},
+		statusMapping:   make(map[string]string),
+		headers:         cast.ToStringMapString(cfg.Options["headers"]),
+		hmacSecret:      []byte(cast.ToString(cfg.Options["hmac_secret"])),
+		hmacHeader:      cast.ToString(cfg.Options["hmac_header"]),
+		hmacEncoding:    cast.ToString(cfg.Options["hmac_encoding"]),
+	}
+	for field, path := range cast.ToStringMapString(cfg.Options["response_mapping"]) {
+		switch field {
+		case "status", "message", "reference":
+			g.responseMapping[field] = path
+		default:
+			return nil, fmt.Errorf("unknown response field %s", field)
+		}
+	}
+	for value, status := range cast.ToStringMapString(cfg.Options["status_mapping"]) {
+		switch status {
+		case StatusSuccess, StatusFailed, StatusPending:
+			g.statusMapping[strings.ToLower(value)] = status
+		default:
+			return nil, fmt.Errorf("status %s maps to unknown status %s", value, status)
+		}
+	}
+
+	switch cast.ToString(cfg.Options["hmac_algorithm"]) {
+	case "sha256":
+		g.hmacHash = sha256.New
+	case "sha512":
+		g.hmacHash = sha512.New
+	default:
+		return nil, fmt.Errorf("unsupported hmac algorithm %s", cfg.Options["hmac_algorithm"])
+	}
+	if g.hmacEncoding != "hex" && g.hmacEncoding != "base64" {
+		return nil, fmt.Errorf("unsupported hmac encoding %s", g.hmacEncoding)
+	}
+
+	// render samples to reject an invalid template at startup
+	if _, err := g.renderRequest(&model.PaymentRequest{}, ActionDeposit); err != nil {
+		return nil, err
+	}
+	if _, err := g.renderRequest(&model.PaymentRequest{}, ActionRefund); err != nil {
+		return nil, fmt.Errorf("refund template: %w", err)
+	}
+	if _, err := g.renderRequest(&model.PaymentRequest{}, ActionCancel); err != nil {
+		return nil, fmt.Errorf("cancel template: %w", err)
+	}
+	if _, err := g.renderRequest(&model.PaymentRequest{}, ActionStatus); err != nil {
+		return nil, fmt.Errorf("status template: %w", err)
+	}
+	return g, nil
+}
+
+// processPayment handles deposit, withdraw, refund, cancel and status operations
+func (g *JSONGateway) processPayment(request *model.PaymentRequest, action string) (*model.PaymentResponse, error) {
+	requestBody, err := g.renderRequest(request, action)
+	if err != nil {
+		return nil, model.WrapError(model.ErrHttpRequestFailure, err.Error())
+	}
+	logger.Debugf("JSON gateway request --> %s", requestBody)
+
+	respBody, err := makeHTTPRequest(g.httpClient, g.url, g.paths[action], "application/json", requestBody, g.requestHeaders(requestBody))
+	if err != nil {
+		return nil, err
+	}
+	logger.Debugf("JSON gateway response --> %s", string(respBody))
+
+	paymentResponse, err := g.parseResponse(respBody)
+	if err != nil {
+		return nil, model.WrapError(model.ErrHttpResponseFailure, err.Error())
+	}
+	paymentResponse.TransactionID = request.TransactionID
+	return paymentResponse, nil
+}
+
+// Deposit handles deposit requests
+func (g *JSONGateway) Deposit(request *model.PaymentRequest) (*model.PaymentResponse, error) {
+	return g.processPayment(request, ActionDeposit)
+}
+
+// Withdraw handles withdrawal requests
+func (g *JSONGateway) Withdraw(request *model.PaymentRequest) (*model.PaymentResponse, error) {
+	return g.processPayment(request, ActionWithdraw)
+}
+
+// Refund handles refund requests
+func (g *JSONGateway) Refund(request *model.PaymentRequest) (*model.PaymentResponse, error) {
+	return g.processPayment(request, ActionRefund)
+}
+
+// Cancel asks the gateway to void an authorized transaction
+func (g *JSONGateway) Cancel(txnID string) (*model.PaymentResponse, error) {
+	return g.processPayment(&model.PaymentRequest{TransactionID: txnID}, ActionCancel)
+}
+
+// QueryStatus asks the gateway for the status of a transaction
+func (g *JSONGateway) QueryStatus(txnID string) (*model.PaymentResponse, error) {
+	return g.processPayment(&model.PaymentRequest{TransactionID: txnID}, ActionStatus)
+}
+
+// renderRequest fills the template of the action with the JSON encoded request fields
+func (g *JSONGateway) renderRequest(request *model.PaymentRequest, action string) (string, error) {
+	template := g.template
+	switch action {
+	case ActionRefund:
+		template = g.refundTemplate
+	case ActionCancel:
+		template = g.cancelTemplate
+	case ActionStatus:
+		template = g.statusTemplate
+	}
+	values := map[string]interface{}{
+		"id":             request.TransactionID,
+		"user_id":        request.UserID,
+		"currency":       request.Currency,
+		"amount":         request.Amount,
+		"amount_decimal": decimalAmount(request.Amount, request.Exponent),
+		"exponent":       request.Exponent,
+		"country_code":   request.CountryCode,
+		"action":         action,
+		"original_id":    request.OriginalTransactionID,
+	}
+
+	var renderErr error
+	body := placeholder.ReplaceAllStringFunc(template, func(match string) string {
+		name := placeholder.FindStringSubmatch(match)[1]
+		value, ok := values[name]
+		if !ok {
+			renderErr = fmt.Errorf("unknown template field %s", name)
+			return match
+		}
+		encoded, _ := json.Marshal(value)
+		return string(encoded)
+	})
+	if renderErr != nil {
+		return "", renderErr
+	}
+	if !json.Valid([]byte(body)) {
+		return "", fmt.Errorf("request template does not produce valid JSON")
+	}
+	return body, nil
+}
+
+// requestHeaders returns the static headers and the signature of the body
+func (g *JSONGateway) requestHeaders(body string) map[string]string {
+	headers := make(map[string]string, len(g.headers)+1)
+	for name, value := range g.headers {
+		headers[name] = value
+	}
+	if len(g.hmacSecret) > 0 {
+		headers[g.hmacHeader] = g.sign(body)
+	}
+	return headers
+}
+
+// sign returns the HMAC of the body with the configured hash and encoding
+func (g *JSONGateway) sign(body string) string {
+	mac := hmac.New(g.hmacHash, g.hmacSecret)
+	mac.Write([]byte(body))
+	if g.hmacEncoding == "base64" {
+		return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// parseResponse extracts the mapped fields and translates the status
+func (g *JSONGateway) parseResponse(respBody []byte) (*model.PaymentResponse, error) {
+	var doc interface{}
+	if err := json.Unmarshal(respBody, &doc); err != nil {
+		return nil, fmt.Errorf("invalid JSON response: %s", string(respBody))
+	}
+
+	status, ok := extractJSONPath(doc, g.responseMapping["status"])
+	if !ok {
+		return nil, fmt.Errorf("status not found in response: %s", string(respBody))
+	}
+	response := &model.PaymentResponse{Status: cast.ToString(status)}
+	if len(g.statusMapping) > 0 {
+		mapped, ok := g.statusMapping[strings.ToLower(response.Status)]
+		if !ok {
+			return nil, fmt.Errorf("unmapped status %q", response.Status)
+		}
+		response.Status = mapped
+	}
+	if message, ok := extractJSONPath(doc, g.responseMapping["message"]); ok {
+		response.Message = cast.ToString(message)
+	}
+	if path, ok := g.responseMapping["reference"]; ok {
+		if reference, ok := extractJSONPath(doc, path); ok {
+			response.GatewayReference = cast.ToString(reference)
+		}
+	}
+	return response, nil
+}
+
+// extractJSONPath returns the value at a dotted path such as $.data.items[0].status
+func extractJSONPath(doc interface{}, path string) (interface{}, bool) {
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	if path == "" {
+		return nil, false
+	}
+
+	current := doc
+	for _, segment := range strings.Split(path, ".") {
+		name := segment
+		var indexes []int
+		if open := strings.Index(segment, "["); open >= 0 {
+			name = segment[:open]
+			for _, part := range strings.Split(strings.TrimSuffix(segment[open+1:], "]"), "][") {
+				i, err := strconv.Atoi(part)
+				if err != nil {
+					return nil, false
+				}
+				indexes = append(indexes, i)
+			}
+		}
+
+		if name != "" {
+			object, ok := current.(map[string]interface{})
+			if !ok {
+				return nil, false
+			}
+			if current, ok = object[name]; !ok {
+				return nil, false
+			}
+		}
+		for _, i := range indexes {
+			array, ok := current.([]interface{})
+			if !ok || i < 0 || i >= len(array) {
+				return nil, false
+			}
+			current = array[i]
+		}
+	}
+	return current, current != nil
+}
+
+// decimalAmount formats an amount in minor units as a decimal string, e.g. 1050 with exponent 2 is "10.50"
+func decimalAmount(amount int64, exponent int) string {
+	if exponent <= 0 {
+		return strconv.FormatInt(amount, 10)
+	}
+	scale := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(exponent)), nil)
+	return new(big.Rat).SetFrac(big.NewInt(amount), scale).FloatString(exponent)
+}
@@ -0,0 +1,171 @@
+package gateway
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wajidp/micro-payment-gateway/internal/service/model"
+)
+
+// newTestJSONGateway builds a JSON gateway through the factory, as it would be from config.
+func newTestJSONGateway(t *testing.T, url string, options map[string]interface{}) PaymentGateway {
+	factory, err := NewConfiguredGatewayFactory(map[string]GatewayConfig{
+		"PSP": {Type: JSONGatewayType, BaseURL: url, Options: options},
+	})
+	assert.NoError(t, err)
+	pg, err := factory.GetPaymentGatewayInstance("PSP")
+	assert.NoError(t, err)
+	return pg
+}
+
+// TestJSONGateway_Defaults verifies that without options the gateway behaves like PGSA.
+func TestJSONGateway_Defaults(t *testing.T) {
+	var body map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/deposit", r.URL.Path)
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		w.Write([]byte(`{"status":"success","message":"Transaction processed successfully"}`))
+	}))
+	defer server.Close()
+
+	request := &model.PaymentRequest{TransactionID: "txn-1", UserID: "123", Currency: "USD", Amount: 1050, Exponent: 2, CountryCode: "US"}
+	response, err := newTestJSONGateway(t, server.URL, nil).Deposit(request)
+	assert.NoError(t, err)
+	assert.Equal(t, "success", response.Status)
+	assert.Equal(t, "txn-1", response.TransactionID)
+
+	expected, _ := json.Marshal(request)
+	var want map[string]interface{}
+	assert.NoError(t, json.Unmarshal(expected, &want))
+	assert.Equal(t, want, body)
+}
+
+// TestJSONGateway_Mapping verifies the request template, nested response extraction,
+// status mapping, static headers and HMAC signature.
+func TestJSONGateway_Mapping(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v2/payouts", r.URL.Path)
+		assert.Equal(t, "key-1", r.Header.Get("X-Api-Key"))
+
+		raw, _ := ioutil.ReadAll(r.Body)
+		mac := hmac.New(sha256.New, []byte("s3cret"))
+		mac.Write(raw)
+		assert.Equal(t, hex.EncodeToString(mac.Sum(nil)), r.Header.Get("X-Signature"))
+
+		var body map[string]interface{}
+		assert.NoError(t, json.Unmarshal(raw, &body))
+		assert.Equal(t, "10.50", body["payment"].(map[string]interface{})["value"])
+		assert.Equal(t, "withdraw", body["type"])
+
+		w.Write([]byte(`{"data":{"results":[{"code":"OK","ref":"psp-9","text":"queued"}]}}`))
+	}))
+	defer server.Close()
+
+	pg := newTestJSONGateway(t, server.URL, map[string]interface{}{
+		"request_template": `{"reference":{{id}},"type":{{action}},"payment":{"value":{{amount_decimal}},"currency":{{currency}}}}`,
+		"withdraw_path":    "v2/payouts",
+		"response_mapping": map[string]interface{}{
+			"status":    "$.data.results[0].code",
+			"message":   "data.results[0].text",
+			"reference": "data.results[0].ref",
+		},
+		"status_mapping": map[string]interface{}{"ok": "success", "rejected": "failed"},
+		"headers":        map[string]interface{}{"X-Api-Key": "key-1"},
+		"hmac_secret":    "s3cret",
+	})
+
+	response, err := pg.Withdraw(&model.PaymentRequest{TransactionID: "txn-1", UserID: "123", Currency: "EUR", Amount: 1050, Exponent: 2})
+	assert.NoError(t, err)
+	assert.Equal(t, "success", response.Status)
+	assert.Equal(t, "queued", response.Message)
+	assert.Equal(t, "txn-1", response.TransactionID)
+	assert.Equal(t, "psp-9", response.GatewayReference)
+}
+
+// TestJSONGateway_QueryStatus verifies the status query path, template and status mapping.
+func TestJSONGateway_QueryStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/lookup", r.URL.Path)
+		raw, _ := ioutil.ReadAll(r.Body)
+		assert.JSONEq(t, `{"query":{"ref":"txn-1"}}`, string(raw))
+		w.Write([]byte(`{"state":"SETTLED"}`))
+	}))
+	defer server.Close()
+
+	pg := newTestJSONGateway(t, server.URL, map[string]interface{}{
+		"status_path":      "v1/lookup",
+		"status_template":  `{"query":{"ref":{{id}}}}`,
+		"response_mapping": map[string]interface{}{"status": "state"},
+		"status_mapping":   map[string]interface{}{"settled": StatusSuccess},
+	})
+	response, err := pg.QueryStatus("txn-1")
+	assert.NoError(t, err)
+	assert.Equal(t, StatusSuccess, response.Status)
+	assert.Equal(t, "txn-1", response.TransactionID)
+}
+
+// TestJSONGateway_Errors verifies unmapped statuses, HTTP errors, invalid templates and
+// status mappings to unknown statuses.
+func TestJSONGateway_Errors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/withdraw" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"status":"weird"}`))
+	}))
+	defer server.Close()
+
+	pg := newTestJSONGateway(t, server.URL, map[string]interface{}{
+		"status_mapping": map[string]interface{}{"approved": "success"},
+	})
+	_, err := pg.Deposit(&model.PaymentRequest{TransactionID: "txn-1"})
+	assert.ErrorIs(t, err, model.ErrHttpResponseFailure)
+	assert.Contains(t, err.Error(), "unmapped status")
+
+	_, err = pg.Withdraw(&model.PaymentRequest{TransactionID: "txn-1"})
+	var statusErr *model.HttpStatusError
+	assert.ErrorAs(t, err, &statusErr)
+	assert.Equal(t, http.StatusServiceUnavailable, statusErr.StatusCode)
+
+	_, err = NewConfiguredGatewayFactory(map[string]GatewayConfig{
+		"PSP": {Type: JSONGatewayType, BaseURL: server.URL, Options: map[string]interface{}{"request_template": `{"a":{{nope}}}`}},
+	})
+	assert.Error(t, err)
+	_, err = NewConfiguredGatewayFactory(map[string]GatewayConfig{
+		"PSP": {Type: JSONGatewayType, BaseURL: server.URL, Options: map[string]interface{}{"request_template": `{"a":{{id}}`}},
+	})
+	assert.Error(t, err)
+	_, err = NewConfiguredGatewayFactory(map[string]GatewayConfig{
+		"PSP": {Type: JSONGatewayType, BaseURL: server.URL, Options: map[string]interface{}{
+			"status_mapping": map[string]interface{}{"ok": StatusSuccess, "settled": "approved"},
+		}},
+	})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "unknown status approved")
+	}
+}
+
+// TestExtractJSONPath verifies path extraction on nested objects and arrays.
+func TestExtractJSONPath(t *testing.T) {
+	var doc interface{}
+	assert.NoError(t, json.Unmarshal([]byte(`{"a":{"b":[{"c":1},{"c":[5,6]}]}}`), &doc))
+
+	value, ok := extractJSONPath(doc, "$.a.b[1].c[1]")
+	assert.True(t, ok)
+	assert.Equal(t, float64(6), value)
+
+	_, ok = extractJSONPath(doc, "a.b[2].c")
+	assert.False(t, ok)
+	_, ok = extractJSONPath(doc, "a.x")
+	assert.False(t, ok)
+	assert.Equal(t, "0.05", decimalAmount(5, 2))
+	assert.Equal(t, "-1.5", decimalAmount(-15, 1))
+}
@@ -3,30 +3,59 @@ package gateway
 import (
 	"encoding/json"
 	"net/http"
+	"strings"
 
 	"github.com/wajidp/micro-payment-gateway/internal/logger"
 	"github.com/wajidp/micro-payment-gateway/internal/service/model"
 )
 
+func init() {
+	Register(Registration{
+		Name: "PGA",
+		New: func(cfg GatewayConfig, httpClient *http.Client) (PaymentGateway, error) {
+			return NewPGSA(httpClient, cfg.BaseURL), nil
+		},
+		Capabilities: Capabilities{
+			Deposit:     true,
+			Withdraw:    true,
+			Refund:      true,
+			Cancel:      true,
+			StatusQuery: true,
+			Currencies:  []string{"USD", "EUR", "AED"},
+		},
+	})
+}
+
 type PGSA struct {
 	httpClient *http.Client
 	url        string
 }
 
-func NewPGSA() *PGSA {
+// NewPGSA creates a new PGSA instance calling the given base url
+func NewPGSA(httpClient *http.Client, url string) *PGSA {
 	return &PGSA{
-		httpClient: &http.Client{},
-		url:        "http://pgsa.com",
+		httpClient: httpClient,
+		url:        strings.TrimSuffix(url, "/"),
 	}
 }
 
+// statusRequest is the body of a PGSA status query or cancellation
+type statusRequest struct {
+	TransactionID string `json:"id"`
+}
+
 // processPayment handles both deposit and withdraw operations
 func (pga *PGSA) processPayment(request *model.PaymentRequest, action string) (*model.PaymentResponse, error) {
+	return pga.post(action, request, request.TransactionID)
+}
+
+// post sends a JSON request to the action endpoint and decodes the response
+func (pga *PGSA) post(action string, request interface{}, txnID string) (*model.PaymentResponse, error) {
 
 	// Convert the request object into JSON
 	requestBody, _ := json.Marshal(request)
 	logger.Debugf("PGSA request --> %s", string(requestBody))
-	respBody, err := makeHTTPRequest(pga.httpClient, pga.url, action, "application/json", string(requestBody))
+	respBody, err := makeHTTPRequest(pga.httpClient, pga.url, action, "application/json", string(requestBody), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -40,7 +69,7 @@ func (pga *PGSA) processPayment(request *model.PaymentRequest, action string) (*
 		return nil, model.WrapError(model.ErrHttpResponseFailure, string(respBody))
 	}
 
-	paymentResponse.TransactionID = request.TransactionID
+	paymentResponse.TransactionID = txnID
 	return &paymentResponse, nil
 }
 
@@ -53,3 +82,18 @@ func (pga *PGSA) Deposit(request *model.PaymentRequest) (*model.PaymentResponse,
 func (pga *PGSA) Withdraw(request *model.PaymentRequest) (*model.PaymentResponse, error) {
 	return pga.processPayment(request, "withdraw")
 }
+
+// QueryStatus asks PGSA for the status of a transaction
+func (pga *PGSA) QueryStatus(txnID string) (*model.PaymentResponse, error) {
+	return pga.post(ActionStatus, &statusRequest{TransactionID: txnID}, txnID)
+}
+
+// Refund handles refund requests
+func (pga *PGSA) Refund(request *model.PaymentRequest) (*model.PaymentResponse, error) {
+	return pga.processPayment(request, ActionRefund)
+}
+
+// Cancel asks PGSA to void an authorized transaction
+func (pga *PGSA) Cancel(txnID string) (*model.PaymentResponse, error) {
+	return pga.post(ActionCancel, &statusRequest{TransactionID: txnID}, txnID)
+}
@@ -5,34 +5,65 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"strings"
+	"time"
+
+	"github.com/spf13/cast"
 
 	"github.com/wajidp/micro-payment-gateway/internal/logger"
 	"github.com/wajidp/micro-payment-gateway/internal/service/model"
 )
 
-// Envelope is the SOAP envelope that contains the Body
-type Envelope struct {
-	XMLName xml.Name `xml:"Envelope"`
-	Body    Body     `xml:"Body"`
+// PGSB namespaces, requests are qualified with PGSBNamespace and the service
+// answers in PGSBResponseNamespace
+const (
+	PGSBNamespace         = "http://pgsb.com/"
+	PGSBResponseNamespace = "http://pgb.com/"
+)
+
+// PGSBPaymentRequest is the PaymentRequest element of the PGSB WSDL, the
+// TransactionID is our ID which status, cancel and refund requests refer to
+type PGSBPaymentRequest struct {
+	XMLName       xml.Name `xml:"ws:PaymentRequest"`
+	Namespace     string   `xml:"xmlns:ws,attr"`
+	TransactionID string   `xml:"ws:TransactionID"`
+	UserID        string   `xml:"ws:UserID"`
+	Currency      string   `xml:"ws:Currency"`
+	Amount        int64    `xml:"ws:Amount"`
+	Exponent      int      `xml:"ws:Exponent"`
+	CountryCode   string   `xml:"ws:CountryCode"`
+}
+
+// PGSBStatusRequest is the StatusRequest element of the PGSB WSDL
+type PGSBStatusRequest struct {
+	XMLName       xml.Name `xml:"ws:StatusRequest"`
+	Namespace     string   `xml:"xmlns:ws,attr"`
+	TransactionID string   `xml:"ws:TransactionID"`
 }
 
-// Body contains the SOAP body, which can have different types of responses
-type Body struct {
-	XMLName          xml.Name          `xml:"Body"`
-	DepositResponse  *DepositResponse  `xml:"depositResponse,omitempty"`
-	WithdrawResponse *WithdrawResponse `xml:"withdrawResponse,omitempty"`
+// PGSBCancelRequest is the CancelRequest element of the PGSB WSDL
+type PGSBCancelRequest struct {
+	XMLName       xml.Name `xml:"ws:CancelRequest"`
+	Namespace     string   `xml:"xmlns:ws,attr"`
+	TransactionID string   `xml:"ws:TransactionID"`
 }
 
-// DepositResponse handles the deposit response
-type DepositResponse struct {
-	XMLName xml.Name `xml:"depositResponse"`
-	Return  Return   `xml:"return"`
+// PGSBRefundRequest is the RefundRequest element of the PGSB WSDL
+type PGSBRefundRequest struct {
+	XMLName               xml.Name `xml:"ws:RefundRequest"`
+	Namespace             string   `xml:"xmlns:ws,attr"`
+	TransactionID         string   `xml:"ws:TransactionID"`
+	OriginalTransactionID string   `xml:"ws:OriginalTransactionID"`
+	UserID                string   `xml:"ws:UserID"`
+	Currency              string   `xml:"ws:Currency"`
+	Amount                int64    `xml:"ws:Amount"`
+	Exponent              int      `xml:"ws:Exponent"`
 }
 
-// WithdrawResponse handles the withdraw response
-type WithdrawResponse struct {
-	XMLName xml.Name `xml:"withdrawResponse"`
-	Return  Return   `xml:"return"`
+// PGSBPaymentResponse is the depositResponse, withdrawResponse, refundResponse, cancelResponse or statusResponse element of the PGSB WSDL
+type PGSBPaymentResponse struct {
+	XMLName xml.Name
+	Return  Return `xml:"return"`
 }
 
 // Return contains the status and message returned from the SOAP service
@@ -41,52 +72,138 @@ type Return struct {
 	Message string `xml:"message"`
 }
 
+func init() {
+	Register(Registration{
+		Name: "PGB",
+		New:  newPGSBFromConfig,
+		Options: []OptionSpec{
+			{Name: "namespace", Type: OptionString, Default: PGSBNamespace, Description: "namespace of the request elements"},
+			{Name: "response_namespace", Type: OptionString, Default: PGSBResponseNamespace, Description: "namespace of the response elements"},
+			{Name: "soap_action", Type: OptionString, Default: PGSBNamespace, Description: "SOAPAction prefix, the operation name is appended"},
+			{Name: "username", Type: OptionString, Description: "WS-Security UsernameToken user, no security header when empty"},
+			{Name: "password", Type: OptionString, Description: "WS-Security UsernameToken password"},
+			{Name: "password_type", Type: OptionString, Default: PasswordText, Description: "PasswordText or PasswordDigest"},
+		},
+		Capabilities: Capabilities{
+			Deposit:     true,
+			Withdraw:    true,
+			Refund:      true,
+			Cancel:      true,
+			StatusQuery: true,
+			Currencies:  []string{"USD", "EUR", "AED"},
+		},
+	})
+}
+
 // PGSB represents the payment gateway service B
 type PGSB struct {
 	httpClient *http.Client
 	url        string
+
+	namespace         string
+	responseNamespace string
+	soapAction        string
+	token             *UsernameToken
 }
 
-// NewPGSB creates a new PGSB instance
-func NewPGSB() *PGSB {
+// NewPGSB creates a new PGSB instance calling the given base url
+func NewPGSB(httpClient *http.Client, url string) *PGSB {
 	return &PGSB{
-		httpClient: &http.Client{},
-		url:        "http://pgsb.com/soap",
+		httpClient:        httpClient,
+		url:               strings.TrimSuffix(url, "/"),
+		namespace:         PGSBNamespace,
+		responseNamespace: PGSBResponseNamespace,
+		soapAction:        PGSBNamespace,
+	}
+}
+
+// newPGSBFromConfig builds a PGSB instance from validated options
+func newPGSBFromConfig(cfg GatewayConfig, httpClient *http.Client) (PaymentGateway, error) {
+	pg := NewPGSB(httpClient, cfg.BaseURL)
+	pg.namespace = cast.ToString(cfg.Options["namespace"])
+	pg.responseNamespace = cast.ToString(cfg.Options["response_namespace"])
+	pg.soapAction = cast.ToString(cfg.Options["soap_action"])
+
+	if username := cast.ToString(cfg.Options["username"]); username != "" {
+		pg.token = &UsernameToken{
+			Username:     username,
+			Password:     cast.ToString(cfg.Options["password"]),
+			PasswordType: cast.ToString(cfg.Options["password_type"]),
+		}
+		// fail at startup on an unsupported password type
+		if _, err := pg.token.security(time.Now()); err != nil {
+			return nil, err
+		}
 	}
+	return pg, nil
 }
 
 // ProcessPayment is a generic method for processing both Deposit and Withdraw operations
 func (pg *PGSB) ProcessPayment(request *model.PaymentRequest, action string) (*model.PaymentResponse, error) {
 	logger.Infof("Preparing PGSB %s request..", action)
 
-	// Create the SOAP/XML request body
-	soapRequest := fmt.Sprintf(`
-	<soapenv:Envelope xmlns:soapenv="http://schemas.xmlsoap.org/soap/envelope/" xmlns:ws="http://pgsb.com/">
-	   <soapenv:Header/>
-	   <soapenv:Body>
-	      <ws:PaymentRequest>
-	         <ws:UserID>%s</ws:UserID>
-	         <ws:Currency>%s</ws:Currency>
-	         <ws:Amount>%d</ws:Amount>
-	         <ws:Exponent>%d</ws:Exponent>
-	         <ws:CountryCode>%s</ws:CountryCode>
-	      </ws:PaymentRequest>
-	   </soapenv:Body>
-	</soapenv:Envelope>`, request.UserID, request.Currency, request.Amount, request.Exponent, request.CountryCode)
-
-	logger.Infof("PGSB request --> %s", soapRequest)
+	// Create the SOAP/XML request body, values are escaped by the encoder
+	return pg.call(action, &PGSBPaymentRequest{
+		Namespace:     pg.namespace,
+		TransactionID: request.TransactionID,
+		UserID:        request.UserID,
+		Currency:      request.Currency,
+		Amount:        request.Amount,
+		Exponent:      request.Exponent,
+		CountryCode:   request.CountryCode,
+	}, request.TransactionID)
+}
+
+// QueryStatus asks PGSB for the status of a transaction
+func (pg *PGSB) QueryStatus(txnID string) (*model.PaymentResponse, error) {
+	return pg.call(ActionStatus, &PGSBStatusRequest{Namespace: pg.namespace, TransactionID: txnID}, txnID)
+}
+
+// Refund handles refund requests to the PGSB
+func (pg *PGSB) Refund(request *model.PaymentRequest) (*model.PaymentResponse, error) {
+	return pg.call(ActionRefund, &PGSBRefundRequest{
+		Namespace:             pg.namespace,
+		TransactionID:         request.TransactionID,
+		OriginalTransactionID: request.OriginalTransactionID,
+		UserID:                request.UserID,
+		Currency:              request.Currency,
+		Amount:                request.Amount,
+		Exponent:              request.Exponent,
+	}, request.TransactionID)
+}
+
+// Cancel asks PGSB to void an authorized transaction
+func (pg *PGSB) Cancel(txnID string) (*model.PaymentResponse, error) {
+	return pg.call(ActionCancel, &PGSBCancelRequest{Namespace: pg.namespace, TransactionID: txnID}, txnID)
+}
+
+// call sends the payload of an operation in a SOAP envelope and parses the response
+func (pg *PGSB) call(action string, payload interface{}, txnID string) (*model.PaymentResponse, error) {
+	soapRequest, err := marshalSOAPRequest(payload, pg.token)
+	if err != nil {
+		return nil, model.WrapError(model.ErrHttpRequestFailure, err.Error())
+	}
+
+	// the envelope may carry credentials, only the payload is logged
+	payloadXML, _ := xml.Marshal(payload)
+	logger.Infof("PGSB request --> %s", string(payloadXML))
 	// Make the HTTP request using the common utility function
-	respBody, err := makeHTTPRequest(pg.httpClient, pg.url, action, "text/xml", soapRequest)
+	headers := map[string]string{"SOAPAction": fmt.Sprintf("%q", pg.soapAction+action)}
+	respBody, err := makeHTTPRequest(pg.httpClient, pg.url, action, "text/xml; charset=utf-8", soapRequest, headers)
 	if err != nil {
-		return nil, err
+		return nil, soapFault(err)
 	}
 	logger.Infof("PGSB response --> %s", string(respBody))
 	// Parse the XML response
 	r, err := pg.parseResponse(respBody, action)
 	if err != nil {
-		return nil, model.WrapError(model.ErrHttpResponseFailure, string(respBody))
+		var fault *SOAPFault
+		if errors.As(err, &fault) {
+			return nil, fault
+		}
+		return nil, model.WrapError(model.ErrHttpResponseFailure, err.Error())
 	}
-	r.TransactionID = request.TransactionID
+	r.TransactionID = txnID
 	return r, nil
 }
 
@@ -100,36 +217,25 @@ func (pg *PGSB) Withdraw(request *model.PaymentRequest) (*model.PaymentResponse,
 	return pg.ProcessPayment(request, ActionWithdraw)
 }
 
-// parseResponse parses the SOAP response based on the action
+// parseResponse parses the SOAP response and checks it answers the action
 func (pg *PGSB) parseResponse(xmlData []byte, action string) (*model.PaymentResponse, error) {
-	var envelope Envelope
-	if err := xml.Unmarshal(xmlData, &envelope); err != nil {
-		return nil, fmt.Errorf("error parsing XML: %w", err)
-	}
-
-	var status, message string
-
 	switch action {
-	case ActionDeposit:
-		if envelope.Body.DepositResponse != nil {
-			status = envelope.Body.DepositResponse.Return.Status
-			message = envelope.Body.DepositResponse.Return.Message
-		} else {
-			return nil, errors.New("no valid deposit response found")
-		}
-	case ActionWithdraw:
-		if envelope.Body.WithdrawResponse != nil {
-			status = envelope.Body.WithdrawResponse.Return.Status
-			message = envelope.Body.WithdrawResponse.Return.Message
-		} else {
-			return nil, errors.New("no valid withdraw response found")
-		}
+	case ActionDeposit, ActionWithdraw, ActionRefund, ActionCancel, ActionStatus:
 	default:
 		return nil, errors.New("invalid action")
 	}
 
+	var response PGSBPaymentResponse
+	if err := unmarshalSOAPResponse(xmlData, &response); err != nil {
+		return nil, err
+	}
+	expected := xml.Name{Space: pg.responseNamespace, Local: action + "Response"}
+	if response.XMLName != expected {
+		return nil, fmt.Errorf("no valid %s response found, got {%s}%s", action, response.XMLName.Space, response.XMLName.Local)
+	}
+
 	return &model.PaymentResponse{
-		Status:  status,
-		Message: message,
+		Status:  response.Return.Status,
+		Message: response.Return.Message,
 	}, nil
 }
@@ -0,0 +1,229 @@
+package gateway
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wajidp/micro-payment-gateway/internal/service/model"
+)
+
+// receivedEnvelope captures what the PGSB test server received.
+type receivedEnvelope struct {
+	Header struct {
+		Security struct {
+			MustUnderstand string `xml:"mustUnderstand,attr"`
+			Token          struct {
+				Username string `xml:"Username"`
+				Password struct {
+					Type  string `xml:"Type,attr"`
+					Value string `xml:",chardata"`
+				} `xml:"Password"`
+				Nonce   string `xml:"Nonce"`
+				Created string `xml:"Created"`
+			} `xml:"UsernameToken"`
+		} `xml:"http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-secext-1.0.xsd Security"`
+	} `xml:"http://schemas.xmlsoap.org/soap/envelope/ Header"`
+	Body struct {
+		Request struct {
+			TransactionID string `xml:"http://pgsb.com/ TransactionID"`
+			UserID        string `xml:"http://pgsb.com/ UserID"`
+			Currency      string `xml:"http://pgsb.com/ Currency"`
+			Amount        int64  `xml:"http://pgsb.com/ Amount"`
+		} `xml:"http://pgsb.com/ PaymentRequest"`
+		Refund struct {
+			TransactionID         string `xml:"http://pgsb.com/ TransactionID"`
+			OriginalTransactionID string `xml:"http://pgsb.com/ OriginalTransactionID"`
+			Amount                int64  `xml:"http://pgsb.com/ Amount"`
+		} `xml:"http://pgsb.com/ RefundRequest"`
+	} `xml:"http://schemas.xmlsoap.org/soap/envelope/ Body"`
+}
+
+// newPGSBServer starts a server answering every request with the given status and body,
+// the received envelope and SOAPAction are stored.
+func newPGSBServer(t *testing.T, status int, reply string, received *receivedEnvelope, action *string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw, _ := ioutil.ReadAll(r.Body)
+		if received != nil {
+			assert.NoError(t, xml.Unmarshal(raw, received))
+		}
+		if action != nil {
+			*action = r.Header.Get("SOAPAction")
+		}
+		w.Header().Set("Content-Type", "text/xml")
+		w.WriteHeader(status)
+		w.Write([]byte(reply))
+	}))
+}
+
+const pgsbDepositReply = `<?xml version="1.0"?>
+<soapenv:Envelope xmlns:soapenv="http://schemas.xmlsoap.org/soap/envelope/" xmlns:ns2="http://pgb.com/">
+	<soapenv:Header/>
+	<soapenv:Body>
+		<ns2:depositResponse>
+			<return><status>success</status><message>ok &amp; done</message></return>
+		</ns2:depositResponse>
+	</soapenv:Body>
+</soapenv:Envelope>`
+
+// TestPGSB_Envelope verifies that request values are escaped, the SOAPAction is sent and
+// a response whose namespace is declared on the envelope is parsed.
+func TestPGSB_Envelope(t *testing.T) {
+	var received receivedEnvelope
+	var action string
+	server := newPGSBServer(t, http.StatusOK, pgsbDepositReply, &received, &action)
+	defer server.Close()
+
+	request := &model.PaymentRequest{TransactionID: "txn-1", UserID: `<a href="x">&`, Currency: "USD", Amount: 100}
+	response, err := NewPGSB(server.Client(), server.URL).Deposit(request)
+	assert.NoError(t, err)
+	assert.Equal(t, "success", response.Status)
+	assert.Equal(t, "ok & done", response.Message)
+	assert.Equal(t, "txn-1", response.TransactionID)
+
+	assert.Equal(t, `"http://pgsb.com/deposit"`, action)
+	assert.Equal(t, "txn-1", received.Body.Request.TransactionID)
+	assert.Equal(t, `<a href="x">&`, received.Body.Request.UserID)
+	assert.Equal(t, int64(100), received.Body.Request.Amount)
+	assert.Empty(t, received.Header.Security.Token.Username)
+
+	// a withdraw response to a deposit is rejected
+	server = newPGSBServer(t, http.StatusOK, strings.Replace(pgsbDepositReply, "depositResponse", "withdrawResponse", 2), nil, nil)
+	defer server.Close()
+	_, err = NewPGSB(server.Client(), server.URL).Deposit(request)
+	assert.ErrorIs(t, err, model.ErrHttpResponseFailure)
+
+	// same element in another namespace is rejected
+	server = newPGSBServer(t, http.StatusOK, strings.Replace(pgsbDepositReply, "http://pgb.com/", "http://other.com/", 1), nil, nil)
+	defer server.Close()
+	_, err = NewPGSB(server.Client(), server.URL).Deposit(request)
+	assert.ErrorIs(t, err, model.ErrHttpResponseFailure)
+}
+
+// TestPGSB_Fault verifies that SOAP faults are returned as structured errors and that only
+// server faults are temporary.
+func TestPGSB_Fault(t *testing.T) {
+	fault := func(code string) string {
+		return `<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/"><soap:Body>
+			<soap:Fault><faultcode>soap:` + code + `</faultcode><faultstring>Invalid &lt;amount&gt;</faultstring>
+			<detail><code>E42</code></detail></soap:Fault></soap:Body></soap:Envelope>`
+	}
+	request := &model.PaymentRequest{TransactionID: "txn-1", UserID: "123", Currency: "USD", Amount: 100}
+
+	server := newPGSBServer(t, http.StatusInternalServerError, fault("Client"), nil, nil)
+	defer server.Close()
+	_, err := NewPGSB(server.Client(), server.URL).Deposit(request)
+	var soapErr *SOAPFault
+	assert.ErrorAs(t, err, &soapErr)
+	assert.Equal(t, "soap:Client", soapErr.Code)
+	assert.Equal(t, "Invalid <amount>", soapErr.String)
+	assert.Equal(t, "<code>E42</code>", soapErr.Detail.Content)
+	assert.Equal(t, http.StatusInternalServerError, soapErr.StatusCode)
+	assert.False(t, soapErr.Temporary())
+	assert.ErrorIs(t, err, model.ErrHttpResponseFailure)
+
+	// fault returned with a 200
+	server = newPGSBServer(t, http.StatusOK, fault("Server.Busy"), nil, nil)
+	defer server.Close()
+	_, err = NewPGSB(server.Client(), server.URL).Deposit(request)
+	assert.ErrorAs(t, err, &soapErr)
+	assert.True(t, soapErr.Temporary())
+
+	// 5xx without a fault keeps the status error
+	server = newPGSBServer(t, http.StatusBadGateway, "bad gateway", nil, nil)
+	defer server.Close()
+	_, err = NewPGSB(server.Client(), server.URL).Deposit(request)
+	var statusErr *model.HttpStatusError
+	assert.ErrorAs(t, err, &statusErr)
+}
+
+// TestPGSB_UsernameToken verifies the WS-Security header for text and digest passwords.
+func TestPGSB_UsernameToken(t *testing.T) {
+	var received receivedEnvelope
+	server := newPGSBServer(t, http.StatusOK, pgsbDepositReply, &received, nil)
+	defer server.Close()
+	request := &model.PaymentRequest{TransactionID: "txn-1", UserID: "123", Currency: "USD", Amount: 100}
+
+	build := func(passwordType string) PaymentGateway {
+		factory, err := NewConfiguredGatewayFactory(map[string]GatewayConfig{"PGB": {
+			Type:    "PGB",
+			BaseURL: server.URL,
+			Options: map[string]interface{}{"username": "merchant", "password": "s3cret", "password_type": passwordType},
+		}})
+		assert.NoError(t, err)
+		pg, err := factory.GetPaymentGatewayInstance("PGB")
+		assert.NoError(t, err)
+		return pg
+	}
+
+	_, err := build(PasswordText).Deposit(request)
+	assert.NoError(t, err)
+	token := received.Header.Security.Token
+	assert.Equal(t, "1", received.Header.Security.MustUnderstand)
+	assert.Equal(t, "merchant", token.Username)
+	assert.Equal(t, "s3cret", token.Password.Value)
+	assert.True(t, strings.HasSuffix(token.Password.Type, "#PasswordText"))
+
+	_, err = build(PasswordDigest).Deposit(request)
+	assert.NoError(t, err)
+	token = received.Header.Security.Token
+	assert.True(t, strings.HasSuffix(token.Password.Type, "#PasswordDigest"))
+	nonce, err := base64.StdEncoding.DecodeString(token.Nonce)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, token.Created)
+	assert.Equal(t, passwordDigest(nonce, token.Created, "s3cret"), token.Password.Value)
+
+	_, err = NewConfiguredGatewayFactory(map[string]GatewayConfig{"PGB": {
+		Type: "PGB", BaseURL: server.URL, Options: map[string]interface{}{"username": "merchant", "password_type": "Plain"},
+	}})
+	assert.Error(t, err)
+}
+
+// TestPGSB_QueryStatus verifies the status query operation.
+func TestPGSB_QueryStatus(t *testing.T) {
+	var action string
+	reply := strings.Replace(pgsbDepositReply, "depositResponse", "statusResponse", 2)
+	server := newPGSBServer(t, http.StatusOK, strings.Replace(reply, "success", "failed", 1), nil, &action)
+	defer server.Close()
+
+	response, err := NewPGSB(server.Client(), server.URL).QueryStatus("txn-1")
+	assert.NoError(t, err)
+	assert.Equal(t, StatusFailed, response.Status)
+	assert.Equal(t, "txn-1", response.TransactionID)
+	assert.Equal(t, `"http://pgsb.com/status"`, action)
+}
+
+// TestPGSB_Cancel verifies the cancel operation.
+func TestPGSB_Cancel(t *testing.T) {
+	var action string
+	server := newPGSBServer(t, http.StatusOK, strings.Replace(pgsbDepositReply, "depositResponse", "cancelResponse", 2), nil, &action)
+	defer server.Close()
+
+	response, err := NewPGSB(server.Client(), server.URL).Cancel("txn-1")
+	assert.NoError(t, err)
+	assert.Equal(t, StatusSuccess, response.Status)
+	assert.Equal(t, "txn-1", response.TransactionID)
+	assert.Equal(t, `"http://pgsb.com/cancel"`, action)
+}
+
+// TestPGSB_Refund verifies that a refund carries its own and the original transaction ID.
+func TestPGSB_Refund(t *testing.T) {
+	var received receivedEnvelope
+	var action string
+	server := newPGSBServer(t, http.StatusOK, strings.Replace(pgsbDepositReply, "depositResponse", "refundResponse", 2), &received, &action)
+	defer server.Close()
+
+	request := &model.PaymentRequest{TransactionID: "txn-2", OriginalTransactionID: "txn-1", UserID: "123", Currency: "USD", Amount: 40}
+	response, err := NewPGSB(server.Client(), server.URL).Refund(request)
+	assert.NoError(t, err)
+	assert.Equal(t, StatusSuccess, response.Status)
+	assert.Equal(t, `"http://pgsb.com/refund"`, action)
+	assert.Equal(t, "txn-2", received.Body.Refund.TransactionID)
+	assert.Equal(t, "txn-1", received.Body.Refund.OriginalTransactionID)
+	assert.Equal(t, int64(40), received.Body.Refund.Amount)
+}
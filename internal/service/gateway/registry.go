@@ -0,0 +1,156 @@
+package gateway
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/spf13/cast"
+)
+
+// Option types of a config schema
+const (
+	OptionString   = "string"
+	OptionInt      = "int"
+	OptionBool     = "bool"
+	OptionDuration = "duration"
+	OptionMap      = "map"
+)
+
+// Constructor builds a gateway from its config and the HTTP client built for it
+type Constructor func(cfg GatewayConfig, httpClient *http.Client) (PaymentGateway, error)
+
+// OptionSpec describes a gateway specific setting of GatewayConfig.Options
+type OptionSpec struct {
+	Name        string      `json:"name"`
+	Type        string      `json:"type"`
+	Required    bool        `json:"required"`
+	Default     interface{} `json:"default,omitempty"`
+	Description string      `json:"description"`
+}
+
+// Capabilities lists the operations and currencies a gateway supports
+type Capabilities struct {
+	Deposit     bool `json:"deposit"`
+	Withdraw    bool `json:"withdraw"`
+	Refund      bool `json:"refund"`
+	Cancel      bool `json:"cancel"`
+	StatusQuery bool `json:"status_query"`
+	// Currencies supported by the gateway, empty means any
+	Currencies []string `json:"currencies"`
+}
+
+// SupportsCurrency reports whether the gateway accepts the currency
+func (c Capabilities) SupportsCurrency(currency string) bool {
+	if len(c.Currencies) == 0 {
+		return true
+	}
+	for _, supported := range c.Currencies {
+		if strings.EqualFold(supported, currency) {
+			return true
+		}
+	}
+	return false
+}
+
+// Registration is a gateway type known to the factory
+type Registration struct {
+	// Name is the gateway type, referenced by GatewayConfig.Type
+	Name         string       `json:"name"`
+	New          Constructor  `json:"-"`
+	Options      []OptionSpec `json:"options"`
+	Capabilities Capabilities `json:"capabilities"`
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]Registration)
+)
+
+// Register makes a gateway type available to the factory. It is meant to be
+// called from the init function of the package implementing the gateway and
+// panics when the name is empty, taken or has no constructor.
+func Register(r Registration) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if r.Name == "" || r.New == nil {
+		panic("gateway: Register needs a name and a constructor")
+	}
+	if _, dup := registry[r.Name]; dup {
+		panic("gateway: Register called twice for " + r.Name)
+	}
+	registry[r.Name] = r
+}
+
+// Lookup returns the registration of a gateway type
+func Lookup(name string) (Registration, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	r, ok := registry[name]
+	return r, ok
+}
+
+// Registered returns every registered gateway type, sorted by name
+func Registered() []Registration {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	out := make([]Registration, 0, len(registry))
+	for _, r := range registry {
+		out = append(out, r)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// ValidateOptions checks the options against the schema, fills in defaults
+// and converts the values to the declared types
+func ValidateOptions(schema []OptionSpec, options map[string]interface{}) (map[string]interface{}, error) {
+	out := make(map[string]interface{}, len(schema))
+	known := make(map[string]bool, len(schema))
+	for _, spec := range schema {
+		known[spec.Name] = true
+		value, ok := options[spec.Name]
+		if !ok || value == nil {
+			if spec.Required {
+				return nil, fmt.Errorf("option %s is required", spec.Name)
+			}
+			if spec.Default == nil {
+				continue
+			}
+			value = spec.Default
+		}
+		converted, err := convertOption(spec.Type, value)
+		if err != nil {
+			return nil, fmt.Errorf("option %s: %w", spec.Name, err)
+		}
+		out[spec.Name] = converted
+	}
+	for name := range options {
+		if !known[name] {
+			return nil, fmt.Errorf("unknown option %s", name)
+		}
+	}
+	return out, nil
+}
+
+// convertOption converts a config value to the option type
+func convertOption(typ string, value interface{}) (interface{}, error) {
+	switch typ {
+	case OptionString:
+		return cast.ToStringE(value)
+	case OptionInt:
+		return cast.ToIntE(value)
+	case OptionBool:
+		return cast.ToBoolE(value)
+	case OptionDuration:
+		return cast.ToDurationE(value)
+	case OptionMap:
+		return cast.ToStringMapE(value)
+	default:
+		return nil, fmt.Errorf("unknown option type %s", typ)
+	}
+}
@@ -0,0 +1,94 @@
+package gateway
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wajidp/micro-payment-gateway/internal/service/model"
+)
+
+// stubGateway is a gateway registered by the tests.
+type stubGateway struct {
+	cfg GatewayConfig
+}
+
+func (s *stubGateway) Deposit(request *model.PaymentRequest) (*model.PaymentResponse, error) {
+	return &model.PaymentResponse{Status: "success", TransactionID: request.TransactionID}, nil
+}
+
+func (s *stubGateway) Withdraw(request *model.PaymentRequest) (*model.PaymentResponse, error) {
+	return s.Deposit(request)
+}
+
+func (s *stubGateway) QueryStatus(txnID string) (*model.PaymentResponse, error) {
+	return &model.PaymentResponse{Status: StatusSuccess, TransactionID: txnID}, nil
+}
+
+func (s *stubGateway) Refund(request *model.PaymentRequest) (*model.PaymentResponse, error) {
+	return s.Deposit(request)
+}
+
+func (s *stubGateway) Cancel(txnID string) (*model.PaymentResponse, error) {
+	return s.QueryStatus(txnID)
+}
+
+func init() {
+	Register(Registration{
+		Name: "TEST",
+		New: func(cfg GatewayConfig, httpClient *http.Client) (PaymentGateway, error) {
+			return &stubGateway{cfg: cfg}, nil
+		},
+		Options: []OptionSpec{
+			{Name: "merchant_id", Type: OptionString, Required: true},
+			{Name: "poll_interval", Type: OptionDuration, Default: "5s"},
+		},
+		Capabilities: Capabilities{Deposit: true, Currencies: []string{"USD"}},
+	})
+}
+
+// TestRegistry_Factory verifies that the factory builds registered gateway types
+// under any name, validating their options against the schema.
+func TestRegistry_Factory(t *testing.T) {
+	factory, err := NewConfiguredGatewayFactory(map[string]GatewayConfig{
+		"ACQ1": {Type: "TEST", BaseURL: "http://acq1.com", Options: map[string]interface{}{"merchant_id": 42}},
+	})
+	assert.NoError(t, err)
+
+	pg, err := factory.GetPaymentGatewayInstance("ACQ1")
+	assert.NoError(t, err)
+	cfg := pg.(*stubGateway).cfg
+	assert.Equal(t, "42", cfg.Options["merchant_id"])
+	assert.Equal(t, 5*time.Second, cfg.Options["poll_interval"])
+
+	capabilities, err := factory.Capabilities("ACQ1")
+	assert.NoError(t, err)
+	assert.True(t, capabilities.SupportsCurrency("usd"))
+	assert.False(t, capabilities.SupportsCurrency("EUR"))
+
+	// missing required option
+	_, err = NewConfiguredGatewayFactory(map[string]GatewayConfig{"ACQ1": {Type: "TEST", BaseURL: "http://acq1.com"}})
+	assert.Error(t, err)
+	// unknown option
+	_, err = NewConfiguredGatewayFactory(map[string]GatewayConfig{
+		"ACQ1": {Type: "TEST", BaseURL: "http://acq1.com", Options: map[string]interface{}{"merchant_id": "1", "colour": "red"}},
+	})
+	assert.Error(t, err)
+	// unknown type
+	_, err = NewConfiguredGatewayFactory(map[string]GatewayConfig{"ACQ1": {Type: "NOPE", BaseURL: "http://acq1.com"}})
+	assert.Error(t, err)
+}
+
+// TestRegistry_Registered verifies the built-in gateways are registered and duplicates are refused.
+func TestRegistry_Registered(t *testing.T) {
+	var names []string
+	for _, r := range Registered() {
+		names = append(names, r.Name)
+	}
+	assert.Subset(t, names, []string{"PGA", "PGB", "TEST"})
+
+	assert.Panics(t, func() {
+		Register(Registration{Name: "PGA", New: func(GatewayConfig, *http.Client) (PaymentGateway, error) { return nil, nil }})
+	})
+}
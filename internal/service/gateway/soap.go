@@ -0,0 +1,228 @@
+package gateway
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/wajidp/micro-payment-gateway/internal/service/model"
+)
+
+// SOAP 1.1 and WS-Security namespaces
+const (
+	SOAPEnvelopeNS  = "http://schemas.xmlsoap.org/soap/envelope/"
+	WSSESecurityNS  = "http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-secext-1.0.xsd"
+	WSSEUtilityNS   = "http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-utility-1.0.xsd"
+	wssePasswordURI = "http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-username-token-profile-1.0"
+	wsseBase64URI   = "http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-soap-message-security-1.0#Base64Binary"
+)
+
+// WS-Security password types
+const (
+	PasswordText   = "PasswordText"
+	PasswordDigest = "PasswordDigest"
+)
+
+// soapRequestEnvelope is the envelope sent to a SOAP service, the payload is
+// marshalled into the body so every value is escaped
+type soapRequestEnvelope struct {
+	XMLName xml.Name           `xml:"soapenv:Envelope"`
+	SoapEnv string             `xml:"xmlns:soapenv,attr"`
+	Header  *soapRequestHeader `xml:"soapenv:Header"`
+	Body    soapRequestBody    `xml:"soapenv:Body"`
+}
+
+type soapRequestHeader struct {
+	Security *wsseSecurity `xml:"wsse:Security,omitempty"`
+}
+
+type soapRequestBody struct {
+	Payload interface{}
+}
+
+// SOAPFault is a soap:Fault returned by a SOAP service
+type SOAPFault struct {
+	// Code is the faultcode, e.g. soap:Client or soap:Server
+	Code string `xml:"faultcode"`
+	// String is the human readable faultstring
+	String string `xml:"faultstring"`
+	// Actor is the optional faultactor
+	Actor string `xml:"faultactor,omitempty"`
+	// Detail holds the raw content of the detail element
+	Detail *FaultDetail `xml:"detail,omitempty"`
+	// StatusCode is the HTTP status the fault came with
+	StatusCode int `xml:"-"`
+}
+
+// Error implements the error interface
+func (f *SOAPFault) Error() string {
+	return fmt.Sprintf("soap fault %s: %s", f.Code, f.String)
+}
+
+// Unwrap lets callers match a fault as an unsuccessful gateway response
+func (f *SOAPFault) Unwrap() error {
+	return model.ErrHttpResponseFailure
+}
+
+// Temporary reports whether the fault is on the service side and may succeed
+// on retry. Client faults mean the request itself was rejected.
+func (f *SOAPFault) Temporary() bool {
+	code := f.Code
+	if i := strings.LastIndex(code, ":"); i >= 0 {
+		code = code[i+1:]
+	}
+	return strings.HasPrefix(code, "Server")
+}
+
+// FaultDetail is the application specific content of a fault
+type FaultDetail struct {
+	Content string `xml:",innerxml"`
+}
+
+// UsernameToken holds WS-Security UsernameToken credentials
+type UsernameToken struct {
+	Username string
+	Password string
+	// PasswordType is PasswordText or PasswordDigest
+	PasswordType string
+}
+
+type wsseSecurity struct {
+	Wsse           string            `xml:"xmlns:wsse,attr"`
+	Wsu            string            `xml:"xmlns:wsu,attr"`
+	MustUnderstand string            `xml:"soapenv:mustUnderstand,attr"`
+	Token          wsseUsernameToken `xml:"wsse:UsernameToken"`
+}
+
+type wsseUsernameToken struct {
+	Username string       `xml:"wsse:Username"`
+	Password wssePassword `xml:"wsse:Password"`
+	Nonce    *wsseNonce   `xml:"wsse:Nonce,omitempty"`
+	Created  string       `xml:"wsu:Created,omitempty"`
+}
+
+type wssePassword struct {
+	Type  string `xml:"Type,attr"`
+	Value string `xml:",chardata"`
+}
+
+type wsseNonce struct {
+	EncodingType string `xml:"EncodingType,attr"`
+	Value        string `xml:",chardata"`
+}
+
+// security builds the WS-Security header, a digest password is
+// Base64(SHA1(nonce + created + password)) with a fresh nonce
+func (t *UsernameToken) security(now time.Time) (*wsseSecurity, error) {
+	token := wsseUsernameToken{Username: t.Username}
+	switch t.PasswordType {
+	case PasswordDigest:
+		nonce := make([]byte, 16)
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, err
+		}
+		created := now.UTC().Format(time.RFC3339)
+		token.Nonce = &wsseNonce{EncodingType: wsseBase64URI, Value: base64.StdEncoding.EncodeToString(nonce)}
+		token.Created = created
+		token.Password = wssePassword{Type: wssePasswordURI + "#" + PasswordDigest, Value: passwordDigest(nonce, created, t.Password)}
+	case PasswordText, "":
+		token.Password = wssePassword{Type: wssePasswordURI + "#" + PasswordText, Value: t.Password}
+	default:
+		return nil, fmt.Errorf("unsupported password type %s", t.PasswordType)
+	}
+	return &wsseSecurity{Wsse: WSSESecurityNS, Wsu: WSSEUtilityNS, MustUnderstand: "1", Token: token}, nil
+}
+
+// passwordDigest computes the UsernameToken password digest
+func passwordDigest(nonce []byte, created, password string) string {
+	h := sha1.New()
+	h.Write(nonce)
+	h.Write([]byte(created))
+	h.Write([]byte(password))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// marshalSOAPRequest wraps the payload in an envelope with an optional WS-Security header
+func marshalSOAPRequest(payload interface{}, token *UsernameToken) (string, error) {
+	envelope := soapRequestEnvelope{
+		SoapEnv: SOAPEnvelopeNS,
+		Header:  &soapRequestHeader{},
+		Body:    soapRequestBody{Payload: payload},
+	}
+	if token != nil {
+		security, err := token.security(time.Now())
+		if err != nil {
+			return "", err
+		}
+		envelope.Header.Security = security
+	}
+
+	out, err := xml.Marshal(envelope)
+	if err != nil {
+		return "", err
+	}
+	return xml.Header + string(out), nil
+}
+
+// unmarshalSOAPResponse decodes the first element of the SOAP body into out,
+// returning the fault when the service answered with one. The decoder keeps
+// the namespaces declared on the envelope in scope.
+func unmarshalSOAPResponse(data []byte, out interface{}) error {
+	d := xml.NewDecoder(bytes.NewReader(data))
+	inBody := false
+	for {
+		token, err := d.Token()
+		if err == io.EOF {
+			return errors.New("no SOAP body found")
+		}
+		if err != nil {
+			return fmt.Errorf("error parsing XML: %w", err)
+		}
+
+		start, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch {
+		case !inBody && start.Name.Space == SOAPEnvelopeNS && start.Name.Local == "Body":
+			inBody = true
+		case !inBody && start.Name.Space == SOAPEnvelopeNS && start.Name.Local == "Header":
+			if err := d.Skip(); err != nil {
+				return fmt.Errorf("error parsing XML: %w", err)
+			}
+		case !inBody:
+			if start.Name.Space != SOAPEnvelopeNS || start.Name.Local != "Envelope" {
+				return fmt.Errorf("unexpected element %s outside the SOAP body", start.Name.Local)
+			}
+		case start.Name.Space == SOAPEnvelopeNS && start.Name.Local == "Fault":
+			var fault SOAPFault
+			if err := d.DecodeElement(&fault, &start); err != nil {
+				return fmt.Errorf("error parsing SOAP fault: %w", err)
+			}
+			return &fault
+		default:
+			return d.DecodeElement(out, &start)
+		}
+	}
+}
+
+// soapFault extracts a fault from the body of an unsuccessful HTTP response
+func soapFault(err error) error {
+	var statusErr *model.HttpStatusError
+	if !errors.As(err, &statusErr) {
+		return err
+	}
+	var fault *SOAPFault
+	if !errors.As(unmarshalSOAPResponse([]byte(statusErr.Body), &struct{}{}), &fault) {
+		return err
+	}
+	fault.StatusCode = statusErr.StatusCode
+	return fault
+}
@@ -0,0 +1,163 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wajidp/micro-payment-gateway/internal/service/model"
+)
+
+// DefaultIdempotencyTTL is how long an idempotency key is kept when no TTL is configured
+const DefaultIdempotencyTTL = 24 * time.Hour
+
+// MaxIdempotencyKeyLength bounds the keys accepted from clients
+const MaxIdempotencyKeyLength = 255
+
+// IdempotencyStore remembers the response of every request sent with an
+// idempotency key so a retried request returns it instead of paying twice
+type IdempotencyStore struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*idempotencyEntry
+	sweepAt time.Time
+}
+
+type idempotencyEntry struct {
+	hash     string
+	response *model.PaymentResponse
+	// done is false while the first request is being processed
+	done    bool
+	expires time.Time
+}
+
+// NewIdempotencyStore creates a store keeping keys for ttl, DefaultIdempotencyTTL when zero
+func NewIdempotencyStore(ttl time.Duration) *IdempotencyStore {
+	if ttl <= 0 {
+		ttl = DefaultIdempotencyTTL
+	}
+	return &IdempotencyStore{
+		ttl:     ttl,
+		entries: make(map[string]*idempotencyEntry),
+	}
+}
+
+// Begin reserves the key for a request with the given hash. It returns the
+// response of a completed request with the same key, ErrConflict while that
+// request is still being processed and ErrIdempotencyMismatch when the key was
+// used for a different request. A nil response and error means the caller owns
+// the key and must Complete or Release it.
+func (s *IdempotencyStore) Begin(key, hash string) (*model.PaymentResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.sweep(now)
+	if entry, ok := s.entries[key]; ok && now.Before(entry.expires) {
+		switch {
+		case entry.hash != hash:
+			return nil, model.WrapError(model.ErrIdempotencyMismatch, "the key was used for a different request")
+		case !entry.done:
+			return nil, model.WrapError(model.ErrConflict, "a request with the same idempotency key is in progress")
+		default:
+			response := *entry.response
+			return &response, nil
+		}
+	}
+
+	s.entries[key] = &idempotencyEntry{hash: hash, expires: now.Add(s.ttl)}
+	return nil, nil
+}
+
+// Complete stores the response of the request owning the key
+func (s *IdempotencyStore) Complete(key string, response *model.PaymentResponse) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if entry, ok := s.entries[key]; ok {
+		stored := *response
+		entry.response = &stored
+		entry.done = true
+	}
+}
+
+// Release forgets the key of a request which failed, so that it can be retried
+func (s *IdempotencyStore) Release(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, key)
+}
+
+// sweep drops expired keys, at most once per minute
+func (s *IdempotencyStore) sweep(now time.Time) {
+	if now.Before(s.sweepAt) {
+		return
+	}
+	s.sweepAt = now.Add(time.Minute)
+	for key, entry := range s.entries {
+		if !now.Before(entry.expires) {
+			delete(s.entries, key)
+		}
+	}
+}
+
+// requestHash is the hash of the canonical form of a payment request, the
+// fields which decide what is paid
+func requestHash(action string, request *model.PaymentRequest) string {
+	canonical, _ := json.Marshal([]interface{}{
+		action,
+		request.UserID,
+		strings.ToUpper(request.Currency),
+		request.Amount,
+		request.Exponent,
+		strings.ToUpper(request.CountryCode),
+		strings.ToUpper(request.WalletCurrency),
+	})
+	sum := sha256.Sum256(canonical)
+	return hex.EncodeToString(sum[:])
+}
+
+// TransactionByIdempotencyKey returns the latest transaction created by a
+// request with the key, the stored transaction outlives the key in the store
+func (p *PaymentProcessor) TransactionByIdempotencyKey(key string) (*model.Transaction, error) {
+	return p.WalletRepo.GetTransactionByIdempotencyKey(key)
+}
+
+// idempotent runs the payment once per idempotency key, a request without a
+// key is always processed. The key is released when the payment failed before
+// a gateway accepted it, a payment returning its response with an error was
+// accepted and is answered from the key even though it could not be stored
+func (p *PaymentProcessor) idempotent(request *model.PaymentRequest, action string, process func() (*model.PaymentResponse, error)) (*model.PaymentResponse, error) {
+	key := request.IdempotencyKey
+	if key == "" || p.Idempotency == nil {
+		response, err := process()
+		if err != nil {
+			return nil, err
+		}
+		return response, nil
+	}
+	if len(key) > MaxIdempotencyKeyLength {
+		return nil, model.WrapError(model.ErrValidation, "idempotency key too long")
+	}
+
+	response, err := p.Idempotency.Begin(key, requestHash(action, request))
+	if err != nil || response != nil {
+		return response, err
+	}
+
+	response, err = process()
+	if err != nil {
+		if response != nil {
+			p.Idempotency.Complete(key, response)
+		} else {
+			p.Idempotency.Release(key)
+		}
+		return nil, err
+	}
+	p.Idempotency.Complete(key, response)
+	return response, nil
+}
@@ -0,0 +1,165 @@
+package ledger
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wajidp/micro-payment-gateway/internal/service/model"
+)
+
+// Account kinds, an account ID is the kind followed by its owner and currency,
+// e.g. wallet:123:USD
+const (
+	// KindWallet is the balance a user holds with us
+	KindWallet = "wallet"
+	// KindClearing is what a gateway owes us, funds collected or paid out through it
+	KindClearing = "clearing"
+	// KindFees is the revenue from the fees charged to users
+	KindFees = "fees"
+	// KindFX is our position in a currency from conversions
+	KindFX = "fx"
+)
+
+// WalletAccount is the account of the wallet of a user in a currency
+func WalletAccount(userID, currency string) string {
+	return KindWallet + ":" + userID + ":" + currency
+}
+
+// ClearingAccount is the clearing account of a gateway in a currency
+func ClearingAccount(gateway, currency string) string {
+	return KindClearing + ":" + gateway + ":" + currency
+}
+
+// FeeAccount is the fee revenue account of a currency
+func FeeAccount(currency string) string {
+	return KindFees + ":" + currency
+}
+
+// FXAccount is the conversion account of a currency
+func FXAccount(currency string) string {
+	return KindFX + ":" + currency
+}
+
+// Posting, Journal and Entry are the records of the ledger, they are part of
+// the model so that wallet repositories can store them
+type (
+	Posting = model.Posting
+	Journal = model.Journal
+	Entry   = model.LedgerEntry
+)
+
+// Ledger is an in-memory double-entry ledger, it is safe for concurrent use.
+// It backs the ledger of the in-memory wallet repository.
+type Ledger struct {
+	mu       sync.RWMutex
+	journals map[string]*Journal
+	entries  map[string][]Entry
+}
+
+// New creates an empty ledger
+func New() *Ledger {
+	return &Ledger{
+		journals: make(map[string]*Journal),
+		entries:  make(map[string][]Entry),
+	}
+}
+
+// Post records a balanced journal. A journal with an ID already posted is
+// rejected with ErrConflict.
+func (l *Ledger) Post(journal *Journal) error {
+	if err := Validate(journal); err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, exists := l.journals[journal.ID]; exists {
+		return model.WrapError(model.ErrConflict, fmt.Sprintf("journal %s already posted", journal.ID))
+	}
+	if journal.CreatedAt.IsZero() {
+		journal.CreatedAt = time.Now()
+	}
+	l.journals[journal.ID] = journal
+	for _, posting := range journal.Postings {
+		entries := l.entries[posting.Account]
+		var balance int64
+		if len(entries) > 0 {
+			balance = entries[len(entries)-1].Balance
+		}
+		l.entries[posting.Account] = append(entries, Entry{
+			JournalID:     journal.ID,
+			TransactionID: journal.TransactionID,
+			Description:   journal.Description,
+			Account:       posting.Account,
+			Currency:      posting.Currency,
+			Amount:        posting.Amount,
+			Balance:       balance + posting.Amount,
+			CreatedAt:     journal.CreatedAt,
+		})
+	}
+	return nil
+}
+
+// Validate checks that the journal has postings and that they balance in each currency
+func Validate(journal *Journal) error {
+	if journal.ID == "" || len(journal.Postings) == 0 {
+		return model.WrapError(model.ErrValidation, "journal without ID or postings")
+	}
+	sums := make(map[string]int64)
+	for _, posting := range journal.Postings {
+		if posting.Account == "" || posting.Currency == "" {
+			return model.WrapError(model.ErrValidation, fmt.Sprintf("journal %s has a posting without account or currency", journal.ID))
+		}
+		if !strings.HasSuffix(posting.Account, ":"+posting.Currency) {
+			return model.WrapError(model.ErrValidation, fmt.Sprintf("journal %s posts %s to account %s", journal.ID, posting.Currency, posting.Account))
+		}
+		sums[posting.Currency] += posting.Amount
+	}
+
+	currencies := make([]string, 0, len(sums))
+	for currency := range sums {
+		currencies = append(currencies, currency)
+	}
+	sort.Strings(currencies)
+	for _, currency := range currencies {
+		if sums[currency] != 0 {
+			return model.WrapError(model.ErrValidation, fmt.Sprintf("journal %s does not balance in %s by %d", journal.ID, currency, sums[currency]))
+		}
+	}
+	return nil
+}
+
+// Balance returns the sum of the entries of the account
+func (l *Ledger) Balance(account string) int64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	entries := l.entries[account]
+	if len(entries) == 0 {
+		return 0
+	}
+	return entries[len(entries)-1].Balance
+}
+
+// Entries returns the entries of the account, oldest first
+func (l *Ledger) Entries(account string) []Entry {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	entries := make([]Entry, len(l.entries[account]))
+	copy(entries, l.entries[account])
+	return entries
+}
+
+// Journal returns the journal with the ID
+func (l *Ledger) Journal(id string) (*Journal, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	journal, ok := l.journals[id]
+	return journal, ok
+}
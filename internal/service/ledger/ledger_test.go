@@ -0,0 +1,72 @@
+package ledger
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wajidp/micro-payment-gateway/internal/service/model"
+)
+
+// TestLedger_Post verifies that balanced journals are recorded with running balances
+// and that unbalanced or repeated journals are rejected.
+func TestLedger_Post(t *testing.T) {
+	l := New()
+	wallet := WalletAccount("123", "USD")
+	clearing := ClearingAccount("PGA", "USD")
+
+	assert.NoError(t, l.Post(&Journal{ID: "t1", TransactionID: "t1", Description: "Deposit", Postings: []Posting{
+		{Account: clearing, Currency: "USD", Amount: -1000},
+		{Account: wallet, Currency: "USD", Amount: 1000},
+	}}))
+	assert.NoError(t, l.Post(&Journal{ID: "t2", TransactionID: "t2", Description: "Withdraw", Postings: []Posting{
+		{Account: wallet, Currency: "USD", Amount: -300},
+		{Account: clearing, Currency: "USD", Amount: 300},
+	}}))
+
+	assert.Equal(t, int64(700), l.Balance(wallet))
+	assert.Equal(t, int64(-700), l.Balance(clearing))
+	assert.Equal(t, int64(0), l.Balance(WalletAccount("456", "USD")))
+	entries := l.Entries(wallet)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, "Deposit", entries[0].Description)
+	assert.Equal(t, int64(1000), entries[0].Balance)
+	assert.Equal(t, int64(-300), entries[1].Amount)
+	assert.Equal(t, int64(700), entries[1].Balance)
+
+	err := l.Post(&Journal{ID: "t1", Postings: []Posting{
+		{Account: clearing, Currency: "USD", Amount: -1},
+		{Account: wallet, Currency: "USD", Amount: 1},
+	}})
+	assert.ErrorIs(t, err, model.ErrConflict)
+
+	err = l.Post(&Journal{ID: "t3", Postings: []Posting{
+		{Account: clearing, Currency: "USD", Amount: -100},
+		{Account: wallet, Currency: "USD", Amount: 99},
+	}})
+	assert.ErrorIs(t, err, model.ErrValidation)
+	assert.Equal(t, int64(700), l.Balance(wallet), "Expected a rejected journal to leave the balances untouched")
+}
+
+// TestValidate verifies that each currency of a journal must balance on its own
+// and postings must match the currency of their account.
+func TestValidate(t *testing.T) {
+	// 10.00 EUR converted to 40.00 AED
+	assert.NoError(t, Validate(&Journal{ID: "fx", Postings: []Posting{
+		{Account: ClearingAccount("PGA", "EUR"), Currency: "EUR", Amount: -1000},
+		{Account: FXAccount("EUR"), Currency: "EUR", Amount: 1000},
+		{Account: FXAccount("AED"), Currency: "AED", Amount: -4000},
+		{Account: WalletAccount("123", "AED"), Currency: "AED", Amount: 4000},
+	}}))
+
+	assert.ErrorIs(t, Validate(&Journal{ID: "mixed", Postings: []Posting{
+		{Account: ClearingAccount("PGA", "EUR"), Currency: "EUR", Amount: -1000},
+		{Account: WalletAccount("123", "AED"), Currency: "AED", Amount: 1000},
+	}}), model.ErrValidation)
+
+	assert.ErrorIs(t, Validate(&Journal{ID: "account", Postings: []Posting{
+		{Account: ClearingAccount("PGA", "EUR"), Currency: "USD", Amount: -1000},
+		{Account: WalletAccount("123", "USD"), Currency: "USD", Amount: 1000},
+	}}), model.ErrValidation)
+
+	assert.ErrorIs(t, Validate(&Journal{ID: "empty"}), model.ErrValidation)
+}
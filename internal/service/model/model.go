@@ -3,6 +3,7 @@ package model
 import (
 	"errors"
 	"fmt"
+	"time"
 
 	"go.uber.org/zap/zapcore"
 )
@@ -19,12 +20,38 @@ var (
 	ErrInternal            = errors.New("internal error")
 	ErrHttpResponseFailure = errors.New("Http response failure")
 	ErrHttpRequestFailure  = errors.New("Http request failure")
+	ErrGatewayTimeout      = errors.New("gateway timeout")
+	ErrNotFound            = errors.New("not found")
+	ErrConflict            = errors.New("conflict")
+	ErrIdempotencyMismatch = errors.New("idempotency key mismatch")
+	ErrDeclined            = errors.New("declined")
+
+	// ErrInsufficientFunds and ErrInvalidAmount are validation errors a caller
+	// may answer specifically, they also match ErrValidation
+	ErrInsufficientFunds = fmt.Errorf("%w: insufficient funds", ErrValidation)
+	ErrInvalidAmount     = fmt.Errorf("%w: invalid amount", ErrValidation)
 )
 
 func WrapError(errType error, message string) error {
 	return fmt.Errorf("%w: %s", errType, message)
 }
 
+// HttpStatusError is returned when a gateway answers with a non 2xx status,
+// it matches ErrHttpResponseFailure with errors.Is
+type HttpStatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *HttpStatusError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrHttpResponseFailure, e.Body)
+}
+
+// Unwrap exposes ErrHttpResponseFailure
+func (e *HttpStatusError) Unwrap() error {
+	return ErrHttpResponseFailure
+}
+
 // payment request model
 // PaymentRequest represents a request for a payment transaction, such as a deposit or withdrawal.
 type PaymentRequest struct {
@@ -46,12 +73,18 @@ type PaymentRequest struct {
 
 	// Exponent defines the number of decimal places to be used in the amount. Optional
 	// For example, an exponent of 2 would mean the amount is in cents if the currency is USD.
+	// Zero means the minor unit of the currency, the amount is rescaled to it otherwise.
 	Exponent int `json:"exponent"`
 
 	// CountryCode represents the country where the transaction is being initiated. Optional
 	// It is typically a two-letter ISO 3166-1 alpha-2 country code (e.g., "US" for the United States).
 	CountryCode string `json:"country_code"`
 
+	// WalletCurrency is the currency of the wallet credited or debited, when it differs from
+	// Currency the amount is converted at a quoted rate. Optional, Currency when empty.
+	// It is not sent to the gateway, which is paid in Currency.
+	WalletCurrency string `json:"-"`
+
 	// Callback is a URL or endpoint where the service should send updates or results of the transaction.
 	// This field is not serialized to JSON (indicated by `json:"-"`).
 	Callback string `json:"-"`
@@ -59,6 +92,19 @@ type PaymentRequest struct {
 	// Type indicates the type of the payment request (e.g., deposit or withdraw).
 	// This field is also not serialized to JSON (indicated by `json:"-"`).
 	Type RequestType `json:"-"`
+
+	// OriginalTransactionID is the transaction being refunded, set on refund requests only.
+	OriginalTransactionID string `json:"original_id,omitempty"`
+
+	// ProcessingCode is the ISO8583 processing code (field 3) for requests received over TCP.
+	ProcessingCode string `json:"-"`
+
+	// STAN is the ISO8583 system trace audit number (field 11) for requests received over TCP.
+	STAN string `json:"-"`
+
+	// IdempotencyKey identifies retries of the same request, a repeated key returns the
+	// original response. It is the Idempotency-Key header over HTTP and STAN+terminal over TCP.
+	IdempotencyKey string `json:"-"`
 }
 
 // MarshalLogObject implements the zapcore.ObjectMarshaler interface to mask sensitive content
@@ -92,57 +138,159 @@ type PaymentResponse struct {
 	// TransactionID is the unique identifier for the transaction associated with this response.
 	// It should match the TransactionID provided in the PaymentRequest.
 	TransactionID string `json:"id"`
+
+	// GatewayReference is the gateway's own identifier for the transaction, when it returns one.
+	GatewayReference string `json:"gateway_reference,omitempty"`
 }
 
 // PgRoutingMaster represents the configuration details for routing payment requests
 // to the appropriate payment gateway based on certain criteria.
 type PgRoutingMaster struct {
+	// ID uniquely identifies the entry, it is assigned when the table is stored if left empty.
+	ID string `mapstructure:"id" json:"id"`
+
 	// Currency indicates the currency for which this routing configuration applies.
 	// This is typically represented by its ISO 4217 currency code (e.g., "USD", "EUR").
-	Currency string
+	Currency string `mapstructure:"currency" json:"currency"`
 
 	// CountryCode represents the country where this routing configuration is applicable.
 	// It is typically a two-letter ISO 3166-1 alpha-2 country code (e.g., "US" for the United States).
-	CountryCode string
+	CountryCode string `mapstructure:"country_code" json:"country_code"`
 
 	// PaymentGateway specifies the name or identifier of the payment gateway to be used
 	// for transactions matching the specified currency and country code.
-	PaymentGateway string
+	PaymentGateway string `mapstructure:"payment_gateway" json:"payment_gateway"`
 
 	// Active indicates whether this routing configuration is currently active or not.
 	// If set to false, this configuration will be ignored.
-	Active bool
+	Active bool `mapstructure:"active" json:"active"`
 
 	// MaxRetryCount defines the maximum number of retry attempts allowed for a transaction
 	// if the initial attempt fails. This is useful for handling temporary issues with the payment gateway.
-	MaxRetryCount int
+	MaxRetryCount int `mapstructure:"max_retry_count" json:"max_retry_count"`
 
 	// Priority determines the order in which this routing configuration should be considered
 	// relative to others. Lower values indicate higher priority, meaning this configuration
 	// will be used before others with a higher priority value.
-	Priority int
+	Priority int `mapstructure:"priority" json:"priority"`
+
+	// Weight is the share of traffic for this gateway among the entries with the same Priority
+	// when a split mode is set. Entries with a zero weight are only used as fallback.
+	Weight int `mapstructure:"weight" json:"weight"`
+
+	// SplitMode selects how traffic is split between entries with the same Priority:
+	// empty for strict table order, SplitWeighted or SplitHash.
+	SplitMode string `mapstructure:"split_mode" json:"split_mode"`
 }
 
+// Traffic split modes for PgRoutingMaster.SplitMode
+const (
+	// SplitWeighted picks the first gateway at random, proportionally to Weight.
+	SplitWeighted = "weighted"
+
+	// SplitHash picks the first gateway from a hash of the user ID, proportionally to Weight,
+	// so a given user always lands on the same gateway.
+	SplitHash = "hash"
+)
+
 // PgRoutingMasters in memory slice for the routing data
 var PgRoutingMasters = []*PgRoutingMaster{
-	{"USD", "AE", "PGA", true, 3, 0},
-	{"USD", "AE", "PGB", true, 3, 0},
-	{"EUR", "EU", "PGA", true, 3, 0},
-	{"AED", "US", "PGA", true, 3, 0},
+	{Currency: "USD", CountryCode: "AE", PaymentGateway: "PGA", Active: true, MaxRetryCount: 3, Priority: 0},
+	{Currency: "USD", CountryCode: "AE", PaymentGateway: "PGB", Active: true, MaxRetryCount: 3, Priority: 0},
+	{Currency: "EUR", CountryCode: "EU", PaymentGateway: "PGA", Active: true, MaxRetryCount: 3, Priority: 0},
+	{Currency: "AED", CountryCode: "US", PaymentGateway: "PGA", Active: true, MaxRetryCount: 3, Priority: 0},
+}
+
+// RoutingAudit records a change to the routing table.
+type RoutingAudit struct {
+	// Time is when the change was applied.
+	Time time.Time `json:"time"`
+
+	// Actor is who made the change, e.g. the admin user or "file" for reloads.
+	Actor string `json:"actor"`
+
+	// Action is the kind of change: create, update, deactivate, reorder or reload.
+	Action string `json:"action"`
+
+	// RouteID is the entry that changed, empty for changes to the whole table.
+	RouteID string `json:"route_id,omitempty"`
+
+	// Before is the entry before the change, nil on create.
+	Before *PgRoutingMaster `json:"before,omitempty"`
+
+	// After is the entry after the change.
+	After *PgRoutingMaster `json:"after,omitempty"`
+}
+
+// Fee is what a gateway charges for one transaction.
+type Fee struct {
+	// Fixed is a flat fee in the smallest unit of the currency.
+	Fixed int64 `mapstructure:"fixed" json:"fixed"`
+
+	// BasisPoints is a variable fee in hundredths of a percent of the amount.
+	BasisPoints int64 `mapstructure:"basis_points" json:"basis_points"`
 }
 
-// SupportedCurrencies supported currencies
-var SupportedCurrencies = map[string]bool{
-	"USD": true,
-	"EUR": true,
-	"AED": true,
+// FeeSchedule holds the fees per gateway and currency, e.g. schedule["PGA"]["USD"].
+type FeeSchedule map[string]map[string]Fee
+
+// Fee returns the fee of a gateway for an amount, and whether one is configured.
+func (f FeeSchedule) Fee(gateway, currency string, amount int64) (int64, bool) {
+	fee, ok := f[gateway][currency]
+	if !ok {
+		return 0, false
+	}
+	return fee.Fixed + amount*fee.BasisPoints/10000, true
 }
 
-// Wallet user wallet
+// Wallet user wallet, a user has one wallet per currency
 type Wallet struct {
-	Balance int64 // The balance
+	UserID   string // The owner
+	Currency string // ISO 4217 code of the balances
+	Exponent int    // Decimal places of the balances, the minor unit of the currency
+	Balance  int64  // The ledger balance, settled funds
+	Held     int64  // Funds reserved by the holds of pending debits
+	Version  int64  // Optimistic lock of persistent repositories, an update of a stale wallet is rejected
+}
+
+// Available returns the balance which can be spent, the ledger balance less the holds
+func (w *Wallet) Available() int64 {
+	return w.Balance - w.Held
 }
 
+// Hold reserves wallet funds for a debit awaiting its final state.
+type Hold struct {
+	// ID is the transaction which placed the hold.
+	ID string `json:"id"`
+
+	// UserID is the owner of the wallet.
+	UserID string `json:"userId"`
+
+	// Currency selects the wallet of the user.
+	Currency string `json:"currency"`
+
+	// Amount is the reserved amount in the smallest unit of the currency.
+	Amount int64 `json:"amount"`
+
+	// State is "active" until the hold is captured or released.
+	State string `json:"state"`
+
+	// CreatedAt is when the hold was placed.
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Constants representing the possible states of a hold.
+const (
+	// HoldActive indicates that the funds are reserved.
+	HoldActive = "active"
+
+	// HoldCaptured indicates that the funds were debited from the ledger balance.
+	HoldCaptured = "captured"
+
+	// HoldReleased indicates that the funds were returned to the available balance.
+	HoldReleased = "released"
+)
+
 // Transaction represents a record of a financial transaction processed through the payment system.
 type Transaction struct {
 	// ID is the unique identifier for the transaction.
@@ -159,15 +307,100 @@ type Transaction struct {
 	// It is typically represented by its ISO 4217 currency code (e.g., "USD", "EUR").
 	Currency string `json:"currency"`
 
-	// Type specifies the nature of the transaction, such as "Deposit" or "Withdraw".
+	// Exponent is the number of decimal places of Amount, the minor unit of the currency.
+	Exponent int `json:"exponent"`
+
+	// WalletCurrency is the currency of the wallet the transaction applies to, Currency unless converted.
+	WalletCurrency string `json:"wallet_currency"`
+
+	// WalletAmount is the amount applied to the wallet in the minor unit of WalletCurrency.
+	WalletAmount int64 `json:"wallet_amount"`
+
+	// Rate is the exchange rate from Currency to WalletCurrency locked when the transaction
+	// was initiated, empty when no conversion took place.
+	Rate string `json:"rate,omitempty"`
+
+	// QuoteID identifies the rate quote used for the conversion.
+	QuoteID string `json:"quote_id,omitempty"`
+
+	// Fee is charged to the user in the minor unit of WalletCurrency, on top of the wallet
+	// amount of a withdrawal and out of the wallet amount of a deposit.
+	Fee int64 `json:"fee,omitempty"`
+
+	// Type specifies the nature of the transaction, such as "Deposit", "Withdraw" or "Refund".
 	Type string `json:"type"`
 
-	// State reflects the current state of the transaction, such as "authorized", "approved", or "failed".
+	// State reflects the current state of the transaction, such as "authorized", "approved", "failed" or "voided".
 	State string `json:"state"`
+
+	// Transitions records every state change of the transaction, oldest first.
+	Transitions []Transition `json:"transitions,omitempty"`
+
+	// LateCallback is the state reported by a callback which was rejected because the transaction
+	// had already ended otherwise, e.g. it was voided. A set value means the gateway and the wallet may disagree.
+	LateCallback string `json:"late_callback,omitempty"`
+
+	// ParentID is the original transaction of a refund, empty for other transactions.
+	ParentID string `json:"parent_id,omitempty"`
+
+	// IdempotencyKey is the key of the request which created the transaction, if it was sent with one.
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+
+	// Gateway is the payment gateway which accepted the transaction.
+	// It is queried for the status when no callback arrives.
+	Gateway string `json:"gateway,omitempty"`
+
+	// Attempts records every gateway call made for the transaction, including retries.
+	Attempts []Attempt `json:"attempts,omitempty"`
+
+	// CreatedAt is when the transaction was initiated.
+	CreatedAt time.Time `json:"created_at"`
+
+	// UpdatedAt is when the transaction was last stored, it is set by the repository.
+	UpdatedAt time.Time `json:"updated_at"`
+
+	// Version is the optimistic lock of persistent repositories, an update of a stale transaction is rejected.
+	Version int64 `json:"-"`
+}
+
+// Transition is a change of the state of a transaction.
+type Transition struct {
+	// From is the previous state, empty when the transaction was created.
+	From string `json:"from"`
+
+	// To is the new state.
+	To string `json:"to"`
+
+	// At is when the state changed.
+	At time.Time `json:"at"`
+
+	// Source is what triggered the change: "api", "callback", "poller" or "admin".
+	Source string `json:"source"`
+}
+
+// Attempt is a single call to a payment gateway.
+type Attempt struct {
+	// Gateway is the payment gateway that was called.
+	Gateway string `json:"gateway"`
+
+	// Number is the attempt number for the gateway, starting at 1.
+	Number int `json:"number"`
+
+	// StartedAt is when the call was made.
+	StartedAt time.Time `json:"started_at"`
+
+	// LatencyMs is the duration of the call in milliseconds.
+	LatencyMs int64 `json:"latency_ms"`
+
+	// Error is the failure reason, empty when the call succeeded.
+	Error string `json:"error,omitempty"`
 }
 
 // Constants representing the possible states of a transaction.
 const (
+	// StateInitiated indicates that the transaction was created and is being sent to a gateway.
+	StateInitiated = "initiated"
+
 	// StateAuthorized indicates that the transaction has been authorized but not yet completed.
 	StateAuthorized = "authorized"
 
@@ -176,8 +409,33 @@ const (
 
 	// StateFailed indicates that the transaction could not be completed successfully.
 	StateFailed = "failed"
+
+	// StateVoided indicates that the transaction was cancelled before it was settled.
+	StateVoided = "voided"
+
+	// StateRefunded indicates that an approved deposit was refunded in full.
+	StateRefunded = "refunded"
+
+	// StateExpired indicates that no final state was received in time.
+	StateExpired = "expired"
 )
 
+// RefundRequest represents a request to refund part or all of an approved deposit.
+type RefundRequest struct {
+	// TransactionID is the approved deposit to refund.
+	TransactionID string `json:"transaction_id"`
+
+	// Amount is the amount to refund in the smallest unit of the currency.
+	// Zero refunds everything not yet refunded.
+	Amount int64 `json:"amount"`
+}
+
+// VoidRequest represents a request to cancel an authorized transaction.
+type VoidRequest struct {
+	// TransactionID is the authorized transaction to cancel.
+	TransactionID string `json:"transaction_id"`
+}
+
 // CallbackRequest represents the request payload used to update the status of a transaction.
 type CallbackRequest struct {
 	// TransactionID is the unique identifier of the transaction that is being updated.
@@ -187,15 +445,55 @@ type CallbackRequest struct {
 	State string `json:"state"`
 }
 
+// Posting moves an amount into or out of a ledger account, it is credited to
+// the account when positive and debited when negative.
+type Posting struct {
+	Account  string `json:"account"`
+	Currency string `json:"currency"`
+	Amount   int64  `json:"amount"`
+}
+
+// Journal is a set of postings recorded together in the ledger, the postings
+// of each currency sum to zero.
+type Journal struct {
+	// ID identifies the journal, a journal is posted once.
+	ID string `json:"id"`
+
+	// TransactionID is the transaction the journal records.
+	TransactionID string `json:"transaction_id"`
+
+	// Description says what the journal records, e.g. Deposit.
+	Description string    `json:"description"`
+	Postings    []Posting `json:"postings"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// LedgerEntry is a posting as recorded on its ledger account.
+type LedgerEntry struct {
+	JournalID     string `json:"journal_id"`
+	TransactionID string `json:"transaction_id"`
+	Description   string `json:"description"`
+	Account       string `json:"account"`
+	Currency      string `json:"currency"`
+	Amount        int64  `json:"amount"`
+
+	// Balance is the balance of the account after the entry.
+	Balance   int64     `json:"balance"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
 // WalletRepository defines the methods required for interacting with the wallet and transaction data store.
 type WalletRepository interface {
-	// GetWallet retrieves the wallet associated with the given userID.
+	// GetWallet retrieves the wallet of the given userID in the currency.
 	// It returns the wallet or an error if the wallet could not be retrieved.
-	GetWallet(userID string) (*Wallet, error)
+	GetWallet(userID, currency string) (*Wallet, error)
 
-	// UpdateWallet updates the wallet data for the user specified by userID.
+	// UpdateWallet updates the wallet data for the user specified by userID in the currency.
 	// It takes the updated wallet data and returns an error if the update fails.
-	UpdateWallet(userID string, wallet *Wallet) error
+	UpdateWallet(userID, currency string, wallet *Wallet) error
+
+	// ListWallets returns the wallets of the user, ordered by currency.
+	ListWallets(userID string) ([]*Wallet, error)
 
 	// GetTransaction retrieves the transaction associated with the given txnID.
 	// It returns the transaction or an error if the transaction could not be found.
@@ -204,4 +502,60 @@ type WalletRepository interface {
 	// UpdateTransaction updates the transaction record in the data store.
 	// It takes the updated transaction data and returns an error if the update fails.
 	UpdateTransaction(txn *Transaction) error
+
+	// ListTransactionsByParent returns the transactions linked to the given parent,
+	// such as the refunds of a deposit, oldest first.
+	ListTransactionsByParent(parentID string) ([]*Transaction, error)
+
+	// ListTransactionsByState returns the transactions currently in the given state,
+	// oldest first.
+	ListTransactionsByState(state string) ([]*Transaction, error)
+
+	// GetTransactionByIdempotencyKey returns the latest transaction created by a request
+	// with the key. It returns ErrNotFound if there is none.
+	GetTransactionByIdempotencyKey(key string) (*Transaction, error)
+
+	// PlaceHold reserves amount of the available balance of the user's wallet in the currency under holdID.
+	// It returns a validation error if the available balance is insufficient.
+	PlaceHold(userID, currency, holdID string, amount int64) error
+
+	// CaptureHold debits the held amount from the ledger balance. Capturing a
+	// captured hold is a no-op, a released hold cannot be captured.
+	CaptureHold(holdID string) error
+
+	// ReleaseHold returns the held amount to the available balance. Releasing a
+	// released hold is a no-op, a captured hold cannot be released.
+	ReleaseHold(holdID string) error
+
+	// LedgerEntries returns the entries of a ledger account, oldest first.
+	LedgerEntries(account string) ([]LedgerEntry, error)
+
+	// LedgerBalance returns the balance of a ledger account, zero when it has no entries.
+	LedgerBalance(account string) (int64, error)
+
+	// WithTx runs fn as a unit of work. The changes fn makes through tx are stored
+	// together when it returns nil and discarded when it returns an error, so a
+	// wallet is never credited without its transaction moving on. fn must only use
+	// tx, not the repository, and should not call other services.
+	WithTx(fn func(tx WalletTx) error) error
+}
+
+// WalletTx reads and writes wallets, transactions, holds and ledger journals
+// within a unit of work of a WalletRepository. Its methods behave like those of
+// the repository, the changes become visible to others when the unit of work is
+// stored.
+type WalletTx interface {
+	GetWallet(userID, currency string) (*Wallet, error)
+	UpdateWallet(userID, currency string, wallet *Wallet) error
+	GetTransaction(txnID string) (*Transaction, error)
+	UpdateTransaction(txn *Transaction) error
+	ListTransactionsByParent(parentID string) ([]*Transaction, error)
+	CaptureHold(holdID string) error
+	ReleaseHold(holdID string) error
+
+	// PostJournal records a journal in the ledger. A journal which does not
+	// balance is rejected with ErrValidation, one with an ID already posted with
+	// ErrConflict.
+	PostJournal(journal *Journal) error
+	LedgerBalance(account string) (int64, error)
 }
@@ -0,0 +1,87 @@
+package service
+
+import (
+	"strings"
+
+	"github.com/wajidp/micro-payment-gateway/internal/logger"
+	"github.com/wajidp/micro-payment-gateway/internal/service/ledger"
+	"github.com/wajidp/micro-payment-gateway/internal/service/model"
+)
+
+// journalsFor builds the journals of an approved transaction. The gateway side
+// moves the amount through the clearing account of the gateway, a conversion
+// exchanges it through the FX accounts of both currencies, and the fee moves
+// from the wallet to the fee revenue account in a journal of its own.
+func journalsFor(txn *model.Transaction) []*ledger.Journal {
+	// a deposit credits the wallet, a withdrawal or refund debits it
+	sign := int64(1)
+	if isDebit(txn.Type) {
+		sign = -1
+	}
+
+	journal := &ledger.Journal{ID: txn.ID, TransactionID: txn.ID, Description: txn.Type}
+	journal.Postings = append(journal.Postings, ledger.Posting{
+		Account: ledger.ClearingAccount(txn.Gateway, txn.Currency), Currency: txn.Currency, Amount: -sign * txn.Amount,
+	})
+	if txn.WalletCurrency != txn.Currency {
+		journal.Postings = append(journal.Postings,
+			ledger.Posting{Account: ledger.FXAccount(txn.Currency), Currency: txn.Currency, Amount: sign * txn.Amount},
+			ledger.Posting{Account: ledger.FXAccount(txn.WalletCurrency), Currency: txn.WalletCurrency, Amount: -sign * txn.WalletAmount},
+		)
+	}
+	journal.Postings = append(journal.Postings, ledger.Posting{
+		Account: ledger.WalletAccount(txn.UserID, txn.WalletCurrency), Currency: txn.WalletCurrency, Amount: sign * txn.WalletAmount,
+	})
+
+	journals := []*ledger.Journal{journal}
+	if txn.Fee > 0 {
+		journals = append(journals, &ledger.Journal{
+			ID:            txn.ID + "/fee",
+			TransactionID: txn.ID,
+			Description:   "Fee",
+			Postings: []ledger.Posting{
+				{Account: ledger.WalletAccount(txn.UserID, txn.WalletCurrency), Currency: txn.WalletCurrency, Amount: -txn.Fee},
+				{Account: ledger.FeeAccount(txn.WalletCurrency), Currency: txn.WalletCurrency, Amount: txn.Fee},
+			},
+		})
+	}
+	return journals
+}
+
+// postToLedger records an approved transaction in the ledger within the unit of
+// work which applies its wallet change, then checks the wallet balance against
+// the ledger. A rejected journal fails the unit of work, a wallet which does
+// not match is reported since its balance may have been set outside the ledger.
+func (p *PaymentProcessor) postToLedger(tx model.WalletTx, txn *model.Transaction) error {
+	for _, journal := range journalsFor(txn) {
+		if err := tx.PostJournal(journal); err != nil {
+			logger.Errorf("Journal %s of transaction %s rejected: %v", journal.ID, txn.ID, err)
+			return err
+		}
+	}
+
+	wallet, err := tx.GetWallet(txn.UserID, txn.WalletCurrency)
+	if err != nil {
+		return err
+	}
+	account := ledger.WalletAccount(txn.UserID, txn.WalletCurrency)
+	balance, err := tx.LedgerBalance(account)
+	if err != nil {
+		return err
+	}
+	if balance != wallet.Balance {
+		logger.Errorf("Wallet %s balance %d does not match the ledger balance %d", account, wallet.Balance, balance)
+	}
+	return nil
+}
+
+// LedgerEntries returns the entries of a ledger account, oldest first
+func (p *PaymentProcessor) LedgerEntries(account string) ([]ledger.Entry, error) {
+	kind := strings.SplitN(account, ":", 2)[0]
+	switch kind {
+	case ledger.KindWallet, ledger.KindClearing, ledger.KindFees, ledger.KindFX:
+	default:
+		return nil, model.WrapError(model.ErrValidation, "invalid account")
+	}
+	return p.WalletRepo.LedgerEntries(account)
+}
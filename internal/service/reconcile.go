@@ -0,0 +1,161 @@
+package service
+
+import (
+	"strings"
+	"time"
+
+	"github.com/sony/gobreaker"
+	"github.com/wajidp/micro-payment-gateway/internal/logger"
+	"github.com/wajidp/micro-payment-gateway/internal/service/gateway"
+	"github.com/wajidp/micro-payment-gateway/internal/service/model"
+)
+
+// ReconcileResult counts the outcome of a reconciliation run
+type ReconcileResult struct {
+	Checked  int
+	Approved int
+	Failed   int
+	Pending  int
+	Expired  int
+	Errors   int
+}
+
+// Reconcile queries the gateway of every transaction left authorized for longer
+// than maxAge and applies the final state as if the gateway's callback had
+// arrived. Transactions the gateway still reports as pending, or which cannot be
+// queried, are left for the next run unless they are older than ExpireAfter.
+// Transactions left initiated, such as a payment whose gateway call never
+// returned, are authorized once their gateway reports them and expired with
+// their hold released once they are older than ExpireAfter otherwise.
+func (p *PaymentProcessor) Reconcile(maxAge time.Duration) (ReconcileResult, error) {
+	var result ReconcileResult
+
+	txns, err := p.WalletRepo.ListTransactionsByState(model.StateAuthorized)
+	if err != nil {
+		return result, err
+	}
+	initiated, err := p.WalletRepo.ListTransactionsByState(model.StateInitiated)
+	if err != nil {
+		return result, err
+	}
+	txns = append(txns, initiated...)
+
+	cutoff := time.Now().Add(-maxAge)
+	for _, txn := range txns {
+		if txn.CreatedAt.After(cutoff) {
+			continue
+		}
+		result.Checked++
+
+		// a transaction no gateway was tried for has nobody to ask
+		var state string
+		if txn.Gateway != "" {
+			state, err = p.queryState(txn)
+			if err != nil {
+				logger.Infof("Status query for transaction %s on PG %s failed: %v", txn.ID, txn.Gateway, err)
+				result.Errors++
+				continue
+			}
+		}
+		if txn.State == model.StateInitiated && state != "" {
+			if err := p.authorize(txn.ID, "", SourcePoller, nil); err != nil {
+				logger.Errorf("Failed to authorize transaction %s: %v", txn.ID, err)
+				result.Errors++
+				continue
+			}
+		}
+
+		switch state {
+		case model.StateApproved:
+			result.Approved++
+		case model.StateFailed:
+			result.Failed++
+		default:
+			if p.ExpireAfter > 0 && time.Since(txn.CreatedAt) > p.ExpireAfter {
+				if err := p.expire(txn.ID, SourcePoller); err != nil {
+					logger.Errorf("Failed to expire transaction %s: %v", txn.ID, err)
+					result.Errors++
+					continue
+				}
+				logger.Infof("Expired transaction %s on PG %s", txn.ID, txn.Gateway)
+				result.Expired++
+				continue
+			}
+			result.Pending++
+			continue
+		}
+
+		logger.Infof("Reconciled transaction %s on PG %s to %s", txn.ID, txn.Gateway, state)
+		if err := p.settle(txn.ID, state, SourcePoller); err != nil {
+			logger.Errorf("Failed to apply reconciled state to transaction %s: %v", txn.ID, err)
+			result.Errors++
+		}
+	}
+	return result, nil
+}
+
+// queryState asks the gateway of the transaction for its status and maps it to
+// a transaction state, empty when the gateway cannot be asked or reports an
+// unknown status
+func (p *PaymentProcessor) queryState(txn *model.Transaction) (string, error) {
+	capabilities, err := p.Factory.Capabilities(txn.Gateway)
+	if err != nil {
+		return "", err
+	}
+	if !capabilities.StatusQuery {
+		return "", nil
+	}
+	if p.circuitBreaker(txn.Gateway).State() == gobreaker.StateOpen {
+		return "", nil
+	}
+
+	pg, err := p.Factory.GetPaymentGatewayInstance(txn.Gateway)
+	if err != nil {
+		return "", err
+	}
+	response, err := pg.QueryStatus(txn.ID)
+	if err != nil {
+		return "", err
+	}
+	return gatewayState(response.Status), nil
+}
+
+// gatewayState maps a gateway status to a transaction state
+func gatewayState(status string) string {
+	switch strings.ToLower(status) {
+	case gateway.StatusSuccess, model.StateApproved:
+		return model.StateApproved
+	case gateway.StatusFailed, "failure", "declined":
+		return model.StateFailed
+	case gateway.StatusPending, model.StateAuthorized:
+		return model.StateAuthorized
+	default:
+		return ""
+	}
+}
+
+// StartReconciler runs Reconcile every interval until the returned stop function is called
+func (p *PaymentProcessor) StartReconciler(interval, maxAge time.Duration) (stop func()) {
+	done := make(chan struct{})
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				result, err := p.Reconcile(maxAge)
+				if err != nil {
+					logger.Errorf("Reconciliation failed: %v", err)
+					continue
+				}
+				if result.Checked > 0 {
+					logger.Infof("Reconciliation checked %d transactions: %d approved, %d failed, %d pending, %d expired, %d errors",
+						result.Checked, result.Approved, result.Failed, result.Pending, result.Expired, result.Errors)
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
@@ -0,0 +1,185 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sony/gobreaker"
+	"github.com/wajidp/micro-payment-gateway/internal/logger"
+	"github.com/wajidp/micro-payment-gateway/internal/service/gateway"
+	"github.com/wajidp/micro-payment-gateway/internal/service/model"
+	"go.uber.org/zap"
+)
+
+// Refund returns part or all of an approved deposit through the gateway which
+// processed it. A deposit can be refunded several times up to its amount,
+// refunds still awaiting their callback count towards that cap. The refund is
+// recorded as its own transaction linked to the deposit, its amount is held
+// right away and debited from the ledger balance once the refund is approved.
+func (p *PaymentProcessor) Refund(request *model.RefundRequest) (*model.PaymentResponse, error) {
+	logger.Info("Refund Request ", zap.String("transaction_id", request.TransactionID), zap.Int64("amount", request.Amount))
+
+	txn, pg, err := p.reserveRefund(request)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := p.sendRefund(pg, txn)
+	if errors.Is(err, model.ErrDeclined) {
+		if failErr := p.fail(txn.ID, "", SourceAPI, txn.Attempts); failErr != nil {
+			logger.Infof("failed to fail transaction %s: %v", txn.ID, failErr)
+		}
+		return nil, fmt.Errorf("%s operation failed: %w", ActionRefund, err)
+	}
+	if err != nil {
+		// the gateway may have processed a refund which timed out or failed on
+		// its side, it keeps its hold until the reconciler queries its status
+		if recordErr := p.recordAttempts(txn.ID, txn.Attempts); recordErr != nil {
+			logger.Infof("failed to record attempts of transaction %s: %v", txn.ID, recordErr)
+		}
+		return nil, fmt.Errorf("%s operation failed: %v", ActionRefund, err)
+	}
+
+	// the gateway accepted the refund, it keeps its hold and is settled by the
+	// callback or the reconciler even when it cannot be marked authorized here
+	if err := p.authorize(txn.ID, "", SourceAPI, txn.Attempts); err != nil {
+		logger.Errorf("Refund %s accepted by PG %s but not stored: %v", txn.ID, txn.Gateway, err)
+		return nil, err
+	}
+	return response, nil
+}
+
+// reserveRefund validates the refund against the original deposit and its
+// gateway and stores the refund transaction, so concurrent refunds see it when
+// checking the cap. It returns the gateway to send the refund to.
+func (p *PaymentProcessor) reserveRefund(request *model.RefundRequest) (*model.Transaction, gateway.PaymentGateway, error) {
+	p.refundMu.Lock()
+	defer p.refundMu.Unlock()
+
+	parent, err := p.WalletRepo.GetTransaction(request.TransactionID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if parent.Type != ActionDeposit {
+		return nil, nil, model.WrapError(model.ErrValidation, "only deposits can be refunded")
+	}
+	if parent.State != model.StateApproved {
+		return nil, nil, model.WrapError(model.ErrValidation, fmt.Sprintf("transaction is %s, only approved deposits can be refunded", parent.State))
+	}
+	// a refund the gateway cannot take is rejected before it holds funds
+	pg, err := p.refundGateway(parent.Gateway)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	refunds, err := p.WalletRepo.ListTransactionsByParent(parent.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	remaining, walletRemaining := parent.Amount, parent.WalletAmount
+	for _, refund := range refunds {
+		if refund.Type == ActionRefund && refundPending(refund.State) {
+			remaining -= refund.Amount
+			walletRemaining -= refund.WalletAmount
+		}
+	}
+
+	amount := request.Amount
+	if amount == 0 {
+		amount = remaining
+	}
+	switch {
+	case amount < 0:
+		return nil, nil, model.ErrInvalidAmount
+	case remaining <= 0:
+		return nil, nil, model.WrapError(model.ErrValidation, "transaction already fully refunded")
+	case amount > remaining:
+		return nil, nil, model.WrapError(model.ErrInvalidAmount, fmt.Sprintf("refund amount exceeds the refundable amount of %d", remaining))
+	}
+	walletAmount, err := refundWalletAmount(parent, amount, remaining, walletRemaining)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	txn := &model.Transaction{
+		ID:        uuid.New().String(),
+		ParentID:  parent.ID,
+		UserID:    parent.UserID,
+		Amount:    amount,
+		Currency:  parent.Currency,
+		Exponent:  parent.Exponent,
+		Type:      ActionRefund,
+		Gateway:   parent.Gateway,
+		CreatedAt: time.Now(),
+
+		WalletCurrency: parent.WalletCurrency,
+		WalletAmount:   walletAmount,
+		Rate:           parent.Rate,
+		QuoteID:        parent.QuoteID,
+	}
+	if err := transition(txn, model.StateInitiated, SourceAPI); err != nil {
+		return nil, nil, err
+	}
+	if err := p.WalletRepo.PlaceHold(txn.UserID, txn.WalletCurrency, txn.ID, txn.WalletAmount); err != nil {
+		return nil, nil, err
+	}
+	if err := p.WalletRepo.UpdateTransaction(txn); err != nil {
+		p.releaseHold(p.WalletRepo, txn)
+		return nil, nil, err
+	}
+	return txn, pg, nil
+}
+
+// refundGateway returns the gateway of a deposit if it takes refunds now, a
+// gateway whose circuit breaker is open would refuse the refund without sending it
+func (p *PaymentProcessor) refundGateway(name string) (gateway.PaymentGateway, error) {
+	capabilities, err := p.Factory.Capabilities(name)
+	if err != nil {
+		return nil, err
+	}
+	if !capabilities.Refund {
+		return nil, model.WrapError(model.ErrValidation, fmt.Sprintf("gateway %s does not support refunds", name))
+	}
+	if p.circuitBreaker(name).State() == gobreaker.StateOpen {
+		return nil, model.WrapError(model.ErrInternal, fmt.Sprintf("gateway %s is unavailable", name))
+	}
+	return p.Factory.GetPaymentGatewayInstance(name)
+}
+
+// sendRefund sends the refund to the gateway of the original deposit. A refund
+// the gateway declined returns ErrDeclined, any other error leaves open whether
+// the gateway processed it. Refunds are not retried since a gateway may have
+// processed a request which timed out.
+func (p *PaymentProcessor) sendRefund(pg gateway.PaymentGateway, txn *model.Transaction) (*model.PaymentResponse, error) {
+	request := &model.PaymentRequest{
+		TransactionID:         txn.ID,
+		OriginalTransactionID: txn.ParentID,
+		UserID:                txn.UserID,
+		Currency:              txn.Currency,
+		Amount:                txn.Amount,
+		Exponent:              txn.Exponent,
+	}
+	result, err := p.executeWithRetry(p.circuitBreaker(txn.Gateway), &model.PgRoutingMaster{PaymentGateway: txn.Gateway}, txn, func() (interface{}, error) {
+		return pg.Refund(request)
+	})
+	if err != nil {
+		return nil, err
+	}
+	response := result.(*model.PaymentResponse)
+	if response.Status == gateway.StatusFailed {
+		return nil, model.WrapError(model.ErrDeclined, fmt.Sprintf("gateway %s declined the refund: %s", txn.Gateway, response.Message))
+	}
+	return response, nil
+}
+
+// refundPending reports whether a refund in the state counts towards the refundable amount
+func refundPending(state string) bool {
+	switch state {
+	case model.StateInitiated, model.StateAuthorized, model.StateApproved:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,109 @@
+package service
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/sony/gobreaker"
+	"github.com/wajidp/micro-payment-gateway/internal/logger"
+	"github.com/wajidp/micro-payment-gateway/internal/service/model"
+)
+
+// RetryPolicy defines the backoff between attempts on the same gateway,
+// the number of retries comes from PgRoutingMaster.MaxRetryCount
+type RetryPolicy struct {
+	// BaseDelay is the delay before the first retry, doubled on each further retry
+	BaseDelay time.Duration
+	// MaxDelay caps the delay between two attempts
+	MaxDelay time.Duration
+}
+
+// DefaultRetryPolicy is used by NewPaymentProcessor
+var DefaultRetryPolicy = RetryPolicy{
+	BaseDelay: 100 * time.Millisecond,
+	MaxDelay:  2 * time.Second,
+}
+
+// Backoff returns the delay before the given retry (1 based), exponential with
+// jitter: a random value between half and the full exponential delay
+func (r RetryPolicy) Backoff(retry int) time.Duration {
+	if r.BaseDelay <= 0 {
+		return 0
+	}
+	delay := r.BaseDelay
+	for i := 1; i < retry && (r.MaxDelay <= 0 || delay < r.MaxDelay); i++ {
+		delay *= 2
+	}
+	if r.MaxDelay > 0 && delay > r.MaxDelay {
+		delay = r.MaxDelay
+	}
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(delay-half)+1))
+}
+
+// temporary is implemented by gateway errors which know whether they are transient,
+// such as SOAP faults
+type temporary interface {
+	Temporary() bool
+}
+
+// IsRetryable reports whether a gateway error is transient: errors reporting
+// themselves as temporary, request failures, timeouts and 5xx responses.
+// Declines and other responses are not retried.
+func IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	var t temporary
+	if errors.As(err, &t) {
+		return t.Temporary()
+	}
+	if errors.Is(err, model.ErrHttpRequestFailure) || errors.Is(err, model.ErrGatewayTimeout) {
+		return true
+	}
+	var statusErr *model.HttpStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= 500
+	}
+	return false
+}
+
+// executeWithRetry runs the operation through the circuit breaker of the gateway,
+// retrying transient failures up to MaxRetryCount times. Every attempt is
+// recorded on the transaction. Retries stop as soon as the breaker opens.
+func (p *PaymentProcessor) executeWithRetry(cb *gobreaker.CircuitBreaker, pgm *model.PgRoutingMaster, txn *model.Transaction, operation func() (interface{}, error)) (interface{}, error) {
+	var (
+		result interface{}
+		err    error
+	)
+	for attempt := 1; attempt <= pgm.MaxRetryCount+1; attempt++ {
+		if attempt > 1 {
+			delay := p.RetryPolicy.Backoff(attempt - 1)
+			logger.Infof("Retrying PG %s in %v (attempt %d of %d)", pgm.PaymentGateway, delay, attempt, pgm.MaxRetryCount+1)
+			time.Sleep(delay)
+		}
+
+		start := time.Now()
+		result, err = cb.Execute(operation)
+		record := model.Attempt{
+			Gateway:   pgm.PaymentGateway,
+			Number:    attempt,
+			StartedAt: start,
+			LatencyMs: time.Since(start).Milliseconds(),
+		}
+		if err != nil {
+			record.Error = err.Error()
+		}
+		txn.Attempts = append(txn.Attempts, record)
+		// a call the open breaker refused never reached the gateway
+		if !errors.Is(err, gobreaker.ErrOpenState) && !errors.Is(err, gobreaker.ErrTooManyRequests) {
+			p.stats.record(pgm.PaymentGateway, record.LatencyMs, err == nil, time.Now())
+		}
+
+		if err == nil || !IsRetryable(err) {
+			break
+		}
+	}
+	return result, err
+}
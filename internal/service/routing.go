@@ -0,0 +1,132 @@
+package service
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"sort"
+	"strings"
+
+	"github.com/wajidp/micro-payment-gateway/internal/service/model"
+)
+
+// selectRoutes returns the routing entries to try for a request, in order.
+// Inactive entries and entries for another currency or country are skipped,
+// an empty country on either side matches any country. Entries are ordered by
+// Priority (lower first, table order on ties) and each gateway is kept once.
+// The routing strategy decides the final order.
+func selectRoutes(pgms []*model.PgRoutingMaster, request *model.PaymentRequest) ([]*model.PgRoutingMaster, error) {
+	var routes []*model.PgRoutingMaster
+	for _, pgm := range pgms {
+		if pgm == nil || !pgm.Active {
+			continue
+		}
+		if !strings.EqualFold(pgm.Currency, request.Currency) {
+			continue
+		}
+		if pgm.CountryCode != "" && request.CountryCode != "" && !strings.EqualFold(pgm.CountryCode, request.CountryCode) {
+			continue
+		}
+		routes = append(routes, pgm)
+	}
+
+	sort.SliceStable(routes, func(i, j int) bool {
+		return routes[i].Priority < routes[j].Priority
+	})
+
+	seen := make(map[string]bool, len(routes))
+	deduped := routes[:0]
+	for _, pgm := range routes {
+		if seen[pgm.PaymentGateway] {
+			continue
+		}
+		seen[pgm.PaymentGateway] = true
+		deduped = append(deduped, pgm)
+	}
+
+	if len(deduped) == 0 {
+		return nil, model.WrapError(model.ErrValidation,
+			fmt.Sprintf("no route for currency %s and country %s", request.Currency, request.CountryCode))
+	}
+	return deduped, nil
+}
+
+// splitRoutes reorders each group of entries sharing a Priority according to its
+// split mode, taken from the first entry of the group that sets one. The chosen
+// gateway goes first, the rest of the group stays behind it as fallback.
+func splitRoutes(routes []*model.PgRoutingMaster, userID string) []*model.PgRoutingMaster {
+	for start := 0; start < len(routes); {
+		end := start
+		mode := ""
+		for end < len(routes) && routes[end].Priority == routes[start].Priority {
+			if mode == "" {
+				mode = routes[end].SplitMode
+			}
+			end++
+		}
+
+		group := routes[start:end]
+		switch mode {
+		case model.SplitWeighted:
+			weightedOrder(group, func(total int) int { return rand.Intn(total) })
+		case model.SplitHash:
+			// only the first pick is hashed, the fallback order stays deterministic
+			if total := totalWeight(group); total > 0 {
+				moveToFront(group, pickByWeight(group, int(hashUser(userID)%uint32(total))))
+			}
+		}
+		start = end
+	}
+	return routes
+}
+
+// weightedOrder orders the group by repeated weighted random picks without
+// replacement, entries without weight keep their order at the end
+func weightedOrder(group []*model.PgRoutingMaster, random func(total int) int) {
+	for i := 0; i < len(group); i++ {
+		total := totalWeight(group[i:])
+		if total <= 0 {
+			return
+		}
+		moveToFront(group[i:], pickByWeight(group[i:], random(total)))
+	}
+}
+
+// moveToFront moves the entry at index i to the front, keeping the order of the others
+func moveToFront(group []*model.PgRoutingMaster, i int) {
+	chosen := group[i]
+	copy(group[1:i+1], group[:i])
+	group[0] = chosen
+}
+
+// pickByWeight returns the index of the entry whose weight range contains n
+func pickByWeight(group []*model.PgRoutingMaster, n int) int {
+	for i, pgm := range group {
+		if pgm.Weight <= 0 {
+			continue
+		}
+		if n < pgm.Weight {
+			return i
+		}
+		n -= pgm.Weight
+	}
+	return 0
+}
+
+// totalWeight sums the positive weights of the group
+func totalWeight(group []*model.PgRoutingMaster) int {
+	total := 0
+	for _, pgm := range group {
+		if pgm.Weight > 0 {
+			total += pgm.Weight
+		}
+	}
+	return total
+}
+
+// hashUser hashes a user ID for deterministic gateway selection
+func hashUser(userID string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(userID))
+	return h.Sum32()
+}
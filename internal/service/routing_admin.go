@@ -0,0 +1,215 @@
+package service
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/wajidp/micro-payment-gateway/internal/logger"
+	"github.com/wajidp/micro-payment-gateway/internal/service/gateway"
+	"github.com/wajidp/micro-payment-gateway/internal/service/model"
+	"go.uber.org/zap"
+)
+
+// Routing audit actions
+const (
+	AuditCreate     = "create"
+	AuditUpdate     = "update"
+	AuditDeactivate = "deactivate"
+	AuditReorder    = "reorder"
+	AuditReload     = "reload"
+)
+
+// RoutingAdminRepo manages the routing table of a running processor
+type RoutingAdminRepo interface {
+	ListRoutes() []*model.PgRoutingMaster
+	CreateRoute(actor string, route *model.PgRoutingMaster) (*model.PgRoutingMaster, error)
+	UpdateRoute(actor, id string, route *model.PgRoutingMaster) (*model.PgRoutingMaster, error)
+	DeactivateRoute(actor, id string) (*model.PgRoutingMaster, error)
+	ReorderRoutes(actor string, ids []string) ([]*model.PgRoutingMaster, error)
+	DryRun(request *model.PaymentRequest) ([]*model.PgRoutingMaster, error)
+	RoutingAudit() []model.RoutingAudit
+	Gateways() []gateway.Registration
+}
+
+// ListRoutes returns a copy of the routing table
+func (p *PaymentProcessor) ListRoutes() []*model.PgRoutingMaster {
+	return copyRoutingMasters(p.Routing.Load())
+}
+
+// CreateRoute adds an entry to the routing table
+func (p *PaymentProcessor) CreateRoute(actor string, route *model.PgRoutingMaster) (*model.PgRoutingMaster, error) {
+	var created *model.PgRoutingMaster
+	err := p.modifyRoutes(actor, AuditCreate, func(pgms []*model.PgRoutingMaster) ([]*model.PgRoutingMaster, []model.RoutingAudit, error) {
+		c := *route
+		normalizeRoutingMaster(&c)
+		if c.ID == "" {
+			c.ID = p.nextRouteID(pgms)
+		}
+		created = &c
+		return append(pgms, created), []model.RoutingAudit{{RouteID: c.ID, After: created}}, nil
+	})
+	return created, err
+}
+
+// UpdateRoute replaces an entry of the routing table, the ID is kept
+func (p *PaymentProcessor) UpdateRoute(actor, id string, route *model.PgRoutingMaster) (*model.PgRoutingMaster, error) {
+	var updated *model.PgRoutingMaster
+	err := p.modifyRoutes(actor, AuditUpdate, func(pgms []*model.PgRoutingMaster) ([]*model.PgRoutingMaster, []model.RoutingAudit, error) {
+		i, err := findRoute(pgms, id)
+		if err != nil {
+			return nil, nil, err
+		}
+		before := pgms[i]
+		c := *route
+		normalizeRoutingMaster(&c)
+		c.ID = id
+		updated = &c
+		pgms[i] = updated
+		return pgms, []model.RoutingAudit{{RouteID: id, Before: before, After: updated}}, nil
+	})
+	return updated, err
+}
+
+// DeactivateRoute marks an entry inactive, it stays in the table
+func (p *PaymentProcessor) DeactivateRoute(actor, id string) (*model.PgRoutingMaster, error) {
+	var updated *model.PgRoutingMaster
+	err := p.modifyRoutes(actor, AuditDeactivate, func(pgms []*model.PgRoutingMaster) ([]*model.PgRoutingMaster, []model.RoutingAudit, error) {
+		i, err := findRoute(pgms, id)
+		if err != nil {
+			return nil, nil, err
+		}
+		before := pgms[i]
+		c := *before
+		c.Active = false
+		updated = &c
+		pgms[i] = updated
+		return pgms, []model.RoutingAudit{{RouteID: id, Before: before, After: updated}}, nil
+	})
+	return updated, err
+}
+
+// ReorderRoutes sets the Priority of the given entries to their position in ids,
+// entries not listed keep their priority
+func (p *PaymentProcessor) ReorderRoutes(actor string, ids []string) ([]*model.PgRoutingMaster, error) {
+	var result []*model.PgRoutingMaster
+	err := p.modifyRoutes(actor, AuditReorder, func(pgms []*model.PgRoutingMaster) ([]*model.PgRoutingMaster, []model.RoutingAudit, error) {
+		var audits []model.RoutingAudit
+		seen := make(map[string]bool, len(ids))
+		for priority, id := range ids {
+			if seen[id] {
+				return nil, nil, model.WrapError(model.ErrValidation, fmt.Sprintf("route %s listed twice", id))
+			}
+			seen[id] = true
+
+			i, err := findRoute(pgms, id)
+			if err != nil {
+				return nil, nil, err
+			}
+			before := pgms[i]
+			if before.Priority == priority {
+				continue
+			}
+			c := *before
+			c.Priority = priority
+			pgms[i] = &c
+			audits = append(audits, model.RoutingAudit{RouteID: id, Before: before, After: &c})
+		}
+		result = pgms
+		return pgms, audits, nil
+	})
+	return copyRoutingMasters(result), err
+}
+
+// DryRun returns the gateways that would be tried for a request, in order,
+// without calling any gateway
+func (p *PaymentProcessor) DryRun(request *model.PaymentRequest) ([]*model.PgRoutingMaster, error) {
+	if !validateCurrency(request.Currency) {
+		return nil, model.WrapError(model.ErrValidation, "invalid currency")
+	}
+	routes, err := selectRoutes(p.Routing.Load(), request)
+	if err != nil {
+		return nil, err
+	}
+	return copyRoutingMasters(p.Strategy.Order(request, routes)), nil
+}
+
+// RoutingAudit returns the audit trail of routing changes, oldest first
+func (p *PaymentProcessor) RoutingAudit() []model.RoutingAudit {
+	p.adminMu.Lock()
+	defer p.adminMu.Unlock()
+	return append([]model.RoutingAudit(nil), p.audit...)
+}
+
+// Gateways returns the registered gateway types with their config schema and capabilities
+func (p *PaymentProcessor) Gateways() []gateway.Registration {
+	return gateway.Registered()
+}
+
+// modifyRoutes applies a change to a copy of the routing table under the admin
+// lock, validates the result, saves it to the routing file, swaps it in and
+// records the audit entries. A change which cannot be saved is not applied, so
+// a reload of the file never discards it.
+func (p *PaymentProcessor) modifyRoutes(actor, action string, change func([]*model.PgRoutingMaster) ([]*model.PgRoutingMaster, []model.RoutingAudit, error)) error {
+	p.adminMu.Lock()
+	defer p.adminMu.Unlock()
+
+	pgms, audits, err := change(copyRoutingMasters(p.Routing.Load()))
+	if err != nil {
+		return err
+	}
+	if err := p.validateRoutes(pgms); err != nil {
+		return err
+	}
+	if p.RoutingFile != "" {
+		if err := SaveRoutingFile(p.RoutingFile, pgms); err != nil {
+			return model.WrapError(model.ErrInternal, fmt.Sprintf("saving routing file: %v", err))
+		}
+	}
+	p.Routing.Store(pgms)
+
+	for _, audit := range audits {
+		audit.Actor = actor
+		audit.Action = action
+		p.recordAudit(audit)
+	}
+	return nil
+}
+
+// maxAuditEntries bounds the in-memory audit trail, older entries remain in the logs
+const maxAuditEntries = 1000
+
+// recordAudit appends an audit entry and logs it, the admin lock must be held
+func (p *PaymentProcessor) recordAudit(audit model.RoutingAudit) {
+	audit.Time = time.Now()
+	p.audit = append(p.audit, audit)
+	if len(p.audit) > maxAuditEntries {
+		p.audit = p.audit[len(p.audit)-maxAuditEntries:]
+	}
+	logger.SInfof("Routing table changed",
+		zap.String("actor", audit.Actor),
+		zap.String("action", audit.Action),
+		zap.String("route_id", audit.RouteID),
+		zap.Any("before", audit.Before),
+		zap.Any("after", audit.After))
+}
+
+// nextRouteID returns an ID which is not used in the table
+func (p *PaymentProcessor) nextRouteID(pgms []*model.PgRoutingMaster) string {
+	for {
+		p.routeSeq++
+		id := fmt.Sprintf("route-%d", p.routeSeq)
+		if _, err := findRoute(pgms, id); err != nil {
+			return id
+		}
+	}
+}
+
+// findRoute returns the index of the entry with the given ID
+func findRoute(pgms []*model.PgRoutingMaster, id string) (int, error) {
+	for i, pgm := range pgms {
+		if pgm.ID == id {
+			return i, nil
+		}
+	}
+	return -1, model.WrapError(model.ErrNotFound, fmt.Sprintf("route %s", id))
+}
@@ -0,0 +1,237 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/viper"
+	"github.com/wajidp/micro-payment-gateway/internal/logger"
+	"github.com/wajidp/micro-payment-gateway/internal/service/model"
+)
+
+// RoutingTable holds the routing entries and lets them be swapped atomically
+// while payments are in flight. A loaded table must not be modified, changes
+// are made by storing a new one.
+type RoutingTable struct {
+	value atomic.Value
+}
+
+// NewRoutingTable creates a routing table holding a copy of the entries
+func NewRoutingTable(pgms []*model.PgRoutingMaster) *RoutingTable {
+	t := &RoutingTable{}
+	t.value.Store(copyRoutingMasters(pgms))
+	return t
+}
+
+// Load returns the current entries
+func (t *RoutingTable) Load() []*model.PgRoutingMaster {
+	return t.value.Load().([]*model.PgRoutingMaster)
+}
+
+// Store swaps in a copy of the entries
+func (t *RoutingTable) Store(pgms []*model.PgRoutingMaster) {
+	t.value.Store(copyRoutingMasters(pgms))
+}
+
+// copyRoutingMasters deep copies entries so the stored table cannot be changed by the caller
+func copyRoutingMasters(pgms []*model.PgRoutingMaster) []*model.PgRoutingMaster {
+	out := make([]*model.PgRoutingMaster, 0, len(pgms))
+	for _, pgm := range pgms {
+		if pgm == nil {
+			continue
+		}
+		c := *pgm
+		out = append(out, &c)
+	}
+	return out
+}
+
+// ValidateRoutingMasters checks the entries of a routing table
+func ValidateRoutingMasters(pgms []*model.PgRoutingMaster) error {
+	if len(pgms) == 0 {
+		return model.WrapError(model.ErrValidation, "routing table is empty")
+	}
+	for i, pgm := range pgms {
+		if pgm == nil {
+			return model.WrapError(model.ErrValidation, fmt.Sprintf("route %d is empty", i))
+		}
+		if err := validateRoutingMaster(pgm); err != nil {
+			return model.WrapError(model.ErrValidation, fmt.Sprintf("route %d: %s", i, err))
+		}
+	}
+	return nil
+}
+
+// validateRoutingMaster checks a single entry
+func validateRoutingMaster(pgm *model.PgRoutingMaster) error {
+	switch {
+	case pgm.PaymentGateway == "":
+		return fmt.Errorf("payment gateway is required")
+	case !validateCurrency(pgm.Currency):
+		return fmt.Errorf("unsupported currency %q", pgm.Currency)
+	case pgm.CountryCode != "" && len(pgm.CountryCode) != 2:
+		return fmt.Errorf("invalid country code %q", pgm.CountryCode)
+	case pgm.MaxRetryCount < 0:
+		return fmt.Errorf("max retry count must not be negative")
+	case pgm.Priority < 0:
+		return fmt.Errorf("priority must not be negative")
+	case pgm.Weight < 0:
+		return fmt.Errorf("weight must not be negative")
+	case pgm.SplitMode != "" && pgm.SplitMode != model.SplitWeighted && pgm.SplitMode != model.SplitHash:
+		return fmt.Errorf("unknown split mode %q", pgm.SplitMode)
+	}
+	return nil
+}
+
+// routingFile is the layout of a routing file
+type routingFile struct {
+	Routes []*model.PgRoutingMaster `mapstructure:"routes"`
+}
+
+// LoadRoutingFile reads routing entries from a YAML or JSON file with a top level "routes" list
+func LoadRoutingFile(path string) ([]*model.PgRoutingMaster, error) {
+	v := viper.New()
+	v.SetConfigFile(path)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, err
+	}
+
+	var file routingFile
+	if err := v.Unmarshal(&file); err != nil {
+		return nil, err
+	}
+	for _, pgm := range file.Routes {
+		if pgm != nil {
+			normalizeRoutingMaster(pgm)
+		}
+	}
+	return file.Routes, nil
+}
+
+// SaveRoutingFile writes the entries to a YAML or JSON routing file in the
+// layout read by LoadRoutingFile. The file is replaced at once, so a watcher
+// never reads it half written.
+func SaveRoutingFile(path string, pgms []*model.PgRoutingMaster) error {
+	data, err := json.Marshal(pgms)
+	if err != nil {
+		return err
+	}
+	var routes []map[string]interface{}
+	if err := json.Unmarshal(data, &routes); err != nil {
+		return err
+	}
+
+	v := viper.New()
+	v.Set("routes", routes)
+	// same directory and extension, the extension selects the format
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path))
+	if err := v.WriteConfigAs(tmp); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// normalizeRoutingMaster upper cases the currency and country code
+func normalizeRoutingMaster(pgm *model.PgRoutingMaster) {
+	pgm.Currency = strings.ToUpper(pgm.Currency)
+	pgm.CountryCode = strings.ToUpper(pgm.CountryCode)
+}
+
+// WatchRoutingFile reloads the routing file whenever it changes and passes the new
+// entries to apply. A file which cannot be read or is rejected by apply is logged
+// and the last good table stays in place.
+func WatchRoutingFile(path string, apply func([]*model.PgRoutingMaster) error) {
+	v := viper.New()
+	v.SetConfigFile(path)
+	v.OnConfigChange(func(e fsnotify.Event) {
+		pgms, err := LoadRoutingFile(path)
+		if err == nil {
+			err = apply(pgms)
+		}
+		if err != nil {
+			logger.Errorf("Routing file %s rejected, keeping the current table: %v", path, err)
+			return
+		}
+		logger.Infof("Routing table reloaded from %s with %d routes", path, len(pgms))
+	})
+	v.WatchConfig()
+}
+
+// SetRoutingMasters validates the entries and swaps them in for new payments,
+// entries without an ID get one assigned. The assigned IDs are written back to
+// the routing file so that they stay the same when it is reloaded. Entries
+// equal to the current table, such as the reload of a routing file written by
+// an admin change, are ignored.
+func (p *PaymentProcessor) SetRoutingMasters(pgms []*model.PgRoutingMaster) error {
+	p.adminMu.Lock()
+	defer p.adminMu.Unlock()
+
+	pgms = copyRoutingMasters(pgms)
+	assigned := false
+	for _, pgm := range pgms {
+		assigned = assigned || pgm.ID == ""
+	}
+	pgms = p.assignRouteIDs(pgms)
+	if reflect.DeepEqual(pgms, p.Routing.Load()) {
+		return nil
+	}
+	if err := p.validateRoutes(pgms); err != nil {
+		return err
+	}
+	if assigned && p.RoutingFile != "" {
+		// the table is still applied, its IDs change on the next reload
+		if err := SaveRoutingFile(p.RoutingFile, pgms); err != nil {
+			logger.Errorf("Failed to save the route IDs to %s: %v", p.RoutingFile, err)
+		}
+	}
+	p.Routing.Store(pgms)
+	p.recordAudit(model.RoutingAudit{Actor: "system", Action: AuditReload})
+	return nil
+}
+
+// validateRoutes checks the entries, their IDs and that every gateway is known
+// and supports the currency of its entry
+func (p *PaymentProcessor) validateRoutes(pgms []*model.PgRoutingMaster) error {
+	if err := ValidateRoutingMasters(pgms); err != nil {
+		return err
+	}
+	ids := make(map[string]bool, len(pgms))
+	for _, pgm := range pgms {
+		if pgm.ID == "" || ids[pgm.ID] {
+			return model.WrapError(model.ErrValidation, fmt.Sprintf("missing or duplicate route ID %q", pgm.ID))
+		}
+		ids[pgm.ID] = true
+		if _, err := p.Factory.GetPaymentGatewayInstance(pgm.PaymentGateway); err != nil {
+			return model.WrapError(model.ErrValidation, fmt.Sprintf("gateway %s: %v", pgm.PaymentGateway, err))
+		}
+		capabilities, err := p.Factory.Capabilities(pgm.PaymentGateway)
+		if err != nil {
+			return model.WrapError(model.ErrValidation, fmt.Sprintf("gateway %s: %v", pgm.PaymentGateway, err))
+		}
+		if !capabilities.SupportsCurrency(pgm.Currency) {
+			return model.WrapError(model.ErrValidation, fmt.Sprintf("gateway %s does not support %s", pgm.PaymentGateway, pgm.Currency))
+		}
+	}
+	return nil
+}
+
+// assignRouteIDs gives an ID to the entries which have none
+func (p *PaymentProcessor) assignRouteIDs(pgms []*model.PgRoutingMaster) []*model.PgRoutingMaster {
+	for _, pgm := range pgms {
+		if pgm.ID == "" {
+			pgm.ID = p.nextRouteID(pgms)
+		}
+	}
+	return pgms
+}
+
+// RoutingMasters returns the current routing entries
+func (p *PaymentProcessor) RoutingMasters() []*model.PgRoutingMaster {
+	return p.Routing.Load()
+}
@@ -0,0 +1,270 @@
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wajidp/micro-payment-gateway/internal/service/model"
+)
+
+// splitTable returns a USD table split 70/30 between PGA and PGB with a PGC fallback.
+func splitTable(mode string) []*model.PgRoutingMaster {
+	return []*model.PgRoutingMaster{
+		{Currency: "USD", PaymentGateway: "PGA", Active: true, Priority: 0, Weight: 70, SplitMode: mode},
+		{Currency: "USD", PaymentGateway: "PGB", Active: true, Priority: 0, Weight: 30},
+		{Currency: "USD", PaymentGateway: "PGC", Active: true, Priority: 1},
+	}
+}
+
+// orderRoutes selects the routes for a request and orders them with priority routing.
+func orderRoutes(table []*model.PgRoutingMaster, request *model.PaymentRequest) ([]*model.PgRoutingMaster, error) {
+	routes, err := selectRoutes(table, request)
+	if err != nil {
+		return nil, err
+	}
+	return PriorityRouting{}.Order(request, routes), nil
+}
+
+// gateways returns the gateway names of the routes, in order.
+func gateways(routes []*model.PgRoutingMaster) []string {
+	var names []string
+	for _, r := range routes {
+		names = append(names, r.PaymentGateway)
+	}
+	return names
+}
+
+// TestPriorityRouting_Weighted verifies the weighted split is close to the configured ratio
+// and that the other gateways always follow as fallback.
+func TestPriorityRouting_Weighted(t *testing.T) {
+	table := splitTable(model.SplitWeighted)
+	request := &model.PaymentRequest{UserID: "123", Currency: "USD"}
+
+	first := map[string]int{}
+	for i := 0; i < 2000; i++ {
+		routes, err := orderRoutes(table, request)
+		assert.NoError(t, err)
+		assert.Len(t, routes, 3)
+		assert.Equal(t, "PGC", routes[2].PaymentGateway, "Expected the lower priority gateway last")
+		first[routes[0].PaymentGateway]++
+	}
+
+	assert.InDelta(t, 1400, first["PGA"], 150)
+	assert.InDelta(t, 600, first["PGB"], 150)
+	assert.Equal(t, "PGA", table[0].PaymentGateway, "Expected the routing table to be left untouched")
+}
+
+// TestPriorityRouting_Hash verifies that a user is always routed to the same gateway and that
+// users are spread across the gateways.
+func TestPriorityRouting_Hash(t *testing.T) {
+	table := splitTable(model.SplitHash)
+
+	first := map[string]int{}
+	for i := 0; i < 500; i++ {
+		request := &model.PaymentRequest{UserID: string(rune('a'+i%26)) + string(rune('0'+i)), Currency: "USD"}
+		routes, err := orderRoutes(table, request)
+		assert.NoError(t, err)
+
+		again, err := orderRoutes(table, request)
+		assert.NoError(t, err)
+		assert.Equal(t, gateways(routes), gateways(again))
+		assert.Len(t, routes, 3)
+		first[routes[0].PaymentGateway]++
+	}
+
+	assert.Greater(t, first["PGA"], first["PGB"])
+	assert.Greater(t, first["PGB"], 0)
+}
+
+// TestPriorityRouting_NoSplit verifies that without a split mode the table order is kept.
+func TestPriorityRouting_NoSplit(t *testing.T) {
+	routes, err := orderRoutes(splitTable(""), &model.PaymentRequest{UserID: "123", Currency: "USD"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"PGA", "PGB", "PGC"}, gateways(routes))
+}
+
+// stubStats is a StatsProvider with fixed statistics.
+type stubStats map[string]GatewayStats
+
+func (s stubStats) GatewayStats(gateway string) GatewayStats {
+	return s[gateway]
+}
+
+// TestSmartRouting_Order verifies that the score prefers the gateway with the better
+// success rate, latency and fee, and that fees alone decide between equal gateways.
+func TestSmartRouting_Order(t *testing.T) {
+	routes := func() []*model.PgRoutingMaster {
+		return []*model.PgRoutingMaster{
+			{Currency: "USD", PaymentGateway: "PGA", Active: true, Priority: 0},
+			{Currency: "USD", PaymentGateway: "PGB", Active: true, Priority: 1},
+		}
+	}
+	fees := model.FeeSchedule{
+		"PGA": {"USD": {Fixed: 30, BasisPoints: 250}},
+		"PGB": {"USD": {Fixed: 20, BasisPoints: 200}},
+	}
+	request := &model.PaymentRequest{UserID: "123", Currency: "USD", Amount: 10000}
+
+	// PGA is failing and slow
+	strategy := NewSmartRouting(stubStats{
+		"PGA": {Successes: 2, Failures: 8, AvgLatencyMs: 900},
+		"PGB": {Successes: 10, AvgLatencyMs: 100},
+	}, fees)
+	assert.Equal(t, []string{"PGB", "PGA"}, gateways(strategy.Order(request, routes())))
+
+	// no history, PGB is cheaper
+	strategy = NewSmartRouting(stubStats{}, fees)
+	assert.Equal(t, []string{"PGB", "PGA"}, gateways(strategy.Order(request, routes())))
+
+	// no history and no fees, priority order is kept
+	strategy = NewSmartRouting(stubStats{}, model.FeeSchedule{})
+	assert.Equal(t, []string{"PGA", "PGB"}, gateways(strategy.Order(request, routes())))
+}
+
+// TestGatewayStats_Decay verifies that gateway outcomes are kept beyond the breaker interval and
+// count half once outcomeHalfLife passed.
+func TestGatewayStats_Decay(t *testing.T) {
+	var stats gatewayStats
+	start := time.Now()
+	for i := 0; i < 8; i++ {
+		stats.record("PGA", 100, false, start)
+	}
+	stats.record("PGA", 200, true, start.Add(time.Second))
+	stats.record("PGA", 200, true, start.Add(time.Second))
+
+	recent := stats.get("PGA", start.Add(time.Second))
+	assert.InDelta(t, 2, recent.Successes, 0.01)
+	assert.InDelta(t, 8, recent.Failures, 0.01)
+	assert.InDelta(t, 136, recent.AvgLatencyMs, 0.01)
+
+	later := stats.get("PGA", start.Add(time.Second+outcomeHalfLife))
+	assert.InDelta(t, 1, later.Successes, 0.01)
+	assert.InDelta(t, 4, later.Failures, 0.01)
+
+	// new outcomes outweigh the decayed ones
+	for i := 0; i < 8; i++ {
+		stats.record("PGA", 100, true, start.Add(time.Second+3*outcomeHalfLife))
+	}
+	current := stats.get("PGA", start.Add(time.Second+3*outcomeHalfLife))
+	assert.InDelta(t, 8.25, current.Successes, 0.01)
+	assert.InDelta(t, 1, current.Failures, 0.01)
+	assert.Equal(t, GatewayStats{}, stats.get("PGB", start))
+}
+
+// TestLoadFeeSchedule verifies that fees are read from a file with upper case keys.
+func TestLoadFeeSchedule(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fees.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte("PGA:\n  USD: { fixed: 30, basis_points: 250 }\n"), 0o600))
+
+	fees, err := LoadFeeSchedule(path)
+	assert.NoError(t, err)
+	fee, ok := fees.Fee("PGA", "USD", 10000)
+	assert.True(t, ok)
+	assert.Equal(t, int64(280), fee)
+}
+
+// TestWatchRoutingFile verifies that a changed routing file is swapped in without a restart
+// and that an invalid file is rejected, keeping the last good table.
+func TestWatchRoutingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "routing.yaml")
+	write := func(content string) {
+		assert.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	}
+	write("routes:\n  - { currency: usd, payment_gateway: PGA, active: true, max_retry_count: 1 }\n")
+
+	pgms, err := LoadRoutingFile(path)
+	assert.NoError(t, err)
+	assert.Len(t, pgms, 1)
+	assert.Equal(t, "USD", pgms[0].Currency)
+
+	processor := NewPaymentProcessor(nil).(*PaymentProcessor)
+	assert.NoError(t, processor.SetRoutingMasters(pgms))
+	WatchRoutingFile(path, processor.SetRoutingMasters)
+
+	write("routes:\n  - { currency: USD, payment_gateway: PGA, active: true }\n  - { currency: USD, payment_gateway: PGB, active: true, priority: 1 }\n")
+	assert.Eventually(t, func() bool { return len(processor.RoutingMasters()) == 2 }, 5*time.Second, 20*time.Millisecond)
+
+	// unknown gateway is rejected
+	write("routes:\n  - { currency: USD, payment_gateway: PGX, active: true }\n")
+	// invalid currency is rejected
+	write("routes:\n  - { currency: XYZ, payment_gateway: PGA, active: true }\n")
+	time.Sleep(500 * time.Millisecond)
+	assert.Len(t, processor.RoutingMasters(), 2, "Expected the last good table to be kept")
+}
+
+// TestWatchRoutingFile_AdminChanges verifies that admin changes are saved to the routing file,
+// so that its reload keeps them, and that a change which cannot be saved is rejected.
+func TestWatchRoutingFile_AdminChanges(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "routing.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte("routes:\n  - { currency: USD, payment_gateway: PGA, active: true }\n"), 0o600))
+	pgms, err := LoadRoutingFile(path)
+	assert.NoError(t, err)
+
+	processor := NewPaymentProcessor(nil).(*PaymentProcessor)
+	assert.NoError(t, processor.SetRoutingMasters(pgms))
+	processor.RoutingFile = path
+	WatchRoutingFile(path, processor.SetRoutingMasters)
+
+	created, err := processor.CreateRoute("alice", &model.PgRoutingMaster{Currency: "usd", PaymentGateway: "PGB", Active: true, Priority: 1})
+	assert.NoError(t, err)
+	saved, err := LoadRoutingFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, processor.RoutingMasters(), saved)
+
+	// the reload of the saved file changes nothing
+	time.Sleep(500 * time.Millisecond)
+	assert.Equal(t, saved, processor.RoutingMasters())
+	audit := processor.RoutingAudit()
+	assert.Equal(t, AuditCreate, audit[len(audit)-1].Action)
+
+	// the file is still the source of the table
+	saved[1].Active = false
+	assert.NoError(t, SaveRoutingFile(path, saved))
+	assert.Eventually(t, func() bool {
+		route := processor.RoutingMasters()[1]
+		return route.ID == created.ID && !route.Active
+	}, 5*time.Second, 20*time.Millisecond)
+
+	processor.RoutingFile = filepath.Join(t.TempDir(), "missing", "routing.yaml")
+	_, err = processor.DeactivateRoute("alice", created.ID)
+	assert.ErrorIs(t, err, model.ErrInternal)
+	_, err = processor.ReorderRoutes("alice", []string{created.ID})
+	assert.ErrorIs(t, err, model.ErrInternal)
+	assert.Equal(t, 1, processor.RoutingMasters()[1].Priority, "Expected a change which cannot be saved to be rejected")
+}
+
+// TestSetRoutingMasters_StableIDs verifies that the IDs assigned to routes of a routing file
+// without IDs are saved to it, so that reloading the file keeps them.
+func TestSetRoutingMasters_StableIDs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "routing.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte("routes:\n  - { currency: USD, payment_gateway: PGA, active: true }\n  - { currency: USD, payment_gateway: PGB, active: true, priority: 1 }\n"), 0o600))
+	pgms, err := LoadRoutingFile(path)
+	assert.NoError(t, err)
+
+	processor := NewPaymentProcessor(nil).(*PaymentProcessor)
+	processor.RoutingFile = path
+	assert.NoError(t, processor.SetRoutingMasters(pgms))
+	ids := []string{processor.RoutingMasters()[0].ID, processor.RoutingMasters()[1].ID}
+
+	saved, err := LoadRoutingFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, processor.RoutingMasters(), saved)
+	audits := len(processor.RoutingAudit())
+
+	// reloading the file keeps the IDs and changes nothing
+	assert.NoError(t, processor.SetRoutingMasters(saved))
+	assert.Equal(t, ids, []string{processor.RoutingMasters()[0].ID, processor.RoutingMasters()[1].ID})
+	assert.Len(t, processor.RoutingAudit(), audits)
+}
+
+// TestRoutingTable_Isolation verifies that the stored table is not affected by changes to the
+// caller's entries.
+func TestRoutingTable_Isolation(t *testing.T) {
+	pgms := []*model.PgRoutingMaster{{Currency: "USD", PaymentGateway: "PGA", Active: true}}
+	table := NewRoutingTable(pgms)
+	pgms[0].Active = false
+	assert.True(t, table.Load()[0].Active)
+}
@@ -1,15 +1,19 @@
 package service
 
 import (
-	"errors"
 	"fmt"
+	"math"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/sony/gobreaker"
 	"github.com/wajidp/micro-payment-gateway/internal/logger"
+	"github.com/wajidp/micro-payment-gateway/internal/service/currency"
 	"github.com/wajidp/micro-payment-gateway/internal/service/database"
+	"github.com/wajidp/micro-payment-gateway/internal/service/fx"
 	"github.com/wajidp/micro-payment-gateway/internal/service/gateway"
+	"github.com/wajidp/micro-payment-gateway/internal/service/ledger"
 	"github.com/wajidp/micro-payment-gateway/internal/service/model"
 	"go.uber.org/zap"
 )
@@ -18,31 +22,72 @@ import (
 const (
 	ActionDeposit  = "Deposit"
 	ActionWithdraw = "Withdraw"
+	ActionRefund   = "Refund"
 )
 
 type PaymentProcessorRepo interface {
 	Deposit(request *model.PaymentRequest) (*model.PaymentResponse, error)
 	Withdraw(request *model.PaymentRequest) (*model.PaymentResponse, error)
 	HandleCallback(callback *model.CallbackRequest) error
+	GetBalance(userID, currency string) (*model.Wallet, error)
+	ListWallets(userID string) ([]*model.Wallet, error)
+	LedgerEntries(account string) ([]ledger.Entry, error)
+	TransactionByIdempotencyKey(key string) (*model.Transaction, error)
+	Void(txnID, source string) (*model.Transaction, error)
+	Refund(request *model.RefundRequest) (*model.PaymentResponse, error)
 }
 
 type PaymentProcessor struct {
-	Factory          gateway.GatewayFactoryInterface
-	WalletRepo       model.WalletRepository
-	CircuitBreakers  map[string]*gobreaker.CircuitBreaker
-	PgRoutingMasters []*model.PgRoutingMaster
+	Factory         gateway.GatewayFactoryInterface
+	WalletRepo      model.WalletRepository
+	CircuitBreakers map[string]*gobreaker.CircuitBreaker
+	Routing         *RoutingTable
+	RetryPolicy     RetryPolicy
+	Strategy        RoutingStrategy
+	// RoutingFile receives the changes made through the admin API so that a
+	// reload of the file keeps them, they are only kept in memory when empty
+	RoutingFile string
+	// Idempotency remembers the responses of requests sent with an idempotency key
+	Idempotency *IdempotencyStore
+	// Rates quotes the exchange rates of deposits and withdrawals into a wallet
+	// of another currency, they are rejected when nil
+	Rates fx.RateProvider
+	// Fees are charged to users per wallet currency, none when nil
+	Fees map[string]model.Fee
+	// ExpireAfter is the age at which Reconcile expires a transaction still
+	// without a final state, zero never expires
+	ExpireAfter time.Duration
+
+	cbMu  sync.Mutex
+	stats gatewayStats
+
+	// stateMu serialises state transitions so a transaction settles once
+	stateMu sync.Mutex
+
+	// refundMu serialises the refund cap check against the refunds already made
+	refundMu sync.Mutex
+
+	// adminMu serialises changes to the routing table
+	adminMu  sync.Mutex
+	audit    []model.RoutingAudit
+	routeSeq int
 }
 
 func NewPaymentProcessor(pgmasters []*model.PgRoutingMaster) PaymentProcessorRepo {
-	return &PaymentProcessor{
-		Factory:          gateway.NewGatewayFactory(),
-		CircuitBreakers:  make(map[string]*gobreaker.CircuitBreaker),
-		WalletRepo:       database.NewUserWalletRepo(),
-		PgRoutingMasters: pgmasters,
+	p := &PaymentProcessor{
+		Factory:         gateway.NewGatewayFactory(),
+		CircuitBreakers: make(map[string]*gobreaker.CircuitBreaker),
+		WalletRepo:      database.NewUserWalletRepo(),
+		RetryPolicy:     DefaultRetryPolicy,
+		Strategy:        PriorityRouting{},
+		Idempotency:     NewIdempotencyStore(DefaultIdempotencyTTL),
 	}
+	p.Routing = NewRoutingTable(p.assignRouteIDs(copyRoutingMasters(pgmasters)))
+	return p
 }
 
-// processPayment handles both Deposit and Withdraw operations with circuit breaker and PG switching
+// processPayment handles both Deposit and Withdraw operations with circuit breaker and PG switching,
+// the response of an accepted payment is returned with the error when it cannot be stored
 func (p *PaymentProcessor) processPayment(request *model.PaymentRequest, action string) (*model.PaymentResponse, error) {
 
 	//masking sensitive information
@@ -51,41 +96,67 @@ func (p *PaymentProcessor) processPayment(request *model.PaymentRequest, action
 	if err := validateRequest(request); err != nil {
 		return nil, err
 	}
+	// Amounts are kept in the minor unit of the currency
+	if err := normaliseAmount(request); err != nil {
+		return nil, err
+	}
+	if err := currency.Default().CheckAmount(request.Currency, request.Amount); err != nil {
+		return nil, err
+	}
+
+	// Select the gateways matching the request and let the strategy order them
+	routes, err := selectRoutes(p.Routing.Load(), request)
+	if err != nil {
+		return nil, err
+	}
+	routes = p.Strategy.Order(request, routes)
 
 	// creates a new id
 	id := uuid.New().String()
 	txn := &model.Transaction{
-		ID:       id,
-		UserID:   request.UserID,
-		Amount:   request.Amount,
-		Currency: request.Currency,
-		Type:     action,
-		State:    model.StateAuthorized,
+		ID:        id,
+		UserID:    request.UserID,
+		Amount:    request.Amount,
+		Currency:  request.Currency,
+		Exponent:  request.Exponent,
+		Type:      action,
+		CreatedAt: time.Now(),
+
+		IdempotencyKey: request.IdempotencyKey,
+	}
+	if err := transition(txn, model.StateInitiated, SourceAPI); err != nil {
+		return nil, err
+	}
+	if err := p.convertToWallet(txn, request.WalletCurrency); err != nil {
+		return nil, err
+	}
+	if err := p.chargeFee(txn); err != nil {
+		return nil, err
 	}
 	request.TransactionID = id
 
-	var lastError error
+	// reserve the funds of a withdrawal until the gateway settles it
+	if isDebit(action) {
+		if err := p.WalletRepo.PlaceHold(txn.UserID, txn.WalletCurrency, txn.ID, txn.WalletAmount+txn.Fee); err != nil {
+			return nil, err
+		}
+	}
 
-	// Iterate over all available payment gateways
-	for _, pgm := range p.PgRoutingMasters {
+	// store the transaction before any gateway sees it, so that a callback finds it
+	if err := p.WalletRepo.UpdateTransaction(txn); err != nil {
+		p.releaseHold(p.WalletRepo, txn)
+		return nil, err
+	}
+
+	var lastError, declined error
+
+	// Iterate over the selected payment gateways
+	for _, pgm := range routes {
 
 		logger.Debugf("Trying PG: %s", pgm.PaymentGateway)
 
 		// Get the circuit breaker for the payment gateway
-		cb, exists := p.CircuitBreakers[pgm.PaymentGateway]
-		if !exists {
-			cb = gobreaker.NewCircuitBreaker(gobreaker.Settings{
-				Name:     pgm.PaymentGateway,
-				Timeout:  2 * time.Second,
-				Interval: 500 * time.Millisecond,
-
-				OnStateChange: func(name string, from, to gobreaker.State) {
-					logger.Infof("Circuit breaker state changed from %s to %s for %s", from, to, name)
-				},
-				ReadyToTrip: p.tripLogic,
-			})
-			p.CircuitBreakers[pgm.PaymentGateway] = cb
-		}
+		cb := p.circuitBreaker(pgm.PaymentGateway)
 
 		// Check if the circuit breaker is open
 		if cb.State() == gobreaker.StateOpen {
@@ -100,6 +171,11 @@ func (p *PaymentProcessor) processPayment(request *model.PaymentRequest, action
 			continue
 		}
 
+		// the reconciler queries this gateway if the call never returns
+		if err := p.recordGateway(txn.ID, pgm.PaymentGateway); err != nil {
+			logger.Infof("failed to record PG %s on transaction %s: %v", pgm.PaymentGateway, txn.ID, err)
+		}
+
 		// Execute the action
 		operation := func() (interface{}, error) {
 			if action == ActionDeposit {
@@ -108,21 +184,37 @@ func (p *PaymentProcessor) processPayment(request *model.PaymentRequest, action
 			return pg.Withdraw(request)
 		}
 
-		result, err := cb.Execute(operation)
+		result, err := p.executeWithRetry(cb, pgm, txn, operation)
 		if err != nil {
 			logger.Infof("%s operation failed for PG %s: %v", action, pgm.PaymentGateway, err)
 			lastError = err
 			continue
 		}
-		if err := p.WalletRepo.UpdateTransaction(txn); err != nil {
-			lastError = err
-			return nil, err
+		response := result.(*model.PaymentResponse)
+		txn.Gateway = pgm.PaymentGateway
+		if response.Status == gateway.StatusFailed {
+			// a decline is final, the payment is not offered to another gateway
+			logger.Infof("%s declined by PG %s: %s", action, pgm.PaymentGateway, response.Message)
+			declined = model.WrapError(model.ErrDeclined, fmt.Sprintf("gateway %s declined the payment: %s", pgm.PaymentGateway, response.Message))
+			break
+		}
+		if err := p.authorize(txn.ID, pgm.PaymentGateway, SourceAPI, txn.Attempts); err != nil {
+			// the gateway accepted the payment, its response is kept so a retry is not sent again
+			return response, err
 		}
 
 		// If successful, return the response
-		return result.(*model.PaymentResponse), nil
+		return response, nil
+	}
+
+	// Keep the failed transaction with its attempts
+	if err := p.fail(txn.ID, txn.Gateway, SourceAPI, txn.Attempts); err != nil {
+		logger.Infof("failed to fail transaction %s: %v", txn.ID, err)
 	}
 
+	if declined != nil {
+		return nil, fmt.Errorf("%s operation failed: %w", action, declined)
+	}
 	// If all gateways failed, return the last error
 	if lastError != nil {
 		return nil, fmt.Errorf("%s operation failed: %v", action, lastError)
@@ -132,7 +224,9 @@ func (p *PaymentProcessor) processPayment(request *model.PaymentRequest, action
 
 // Deposit handles deposit requests
 func (p *PaymentProcessor) Deposit(request *model.PaymentRequest) (*model.PaymentResponse, error) {
-	res, err := p.processPayment(request, ActionDeposit)
+	res, err := p.idempotent(request, ActionDeposit, func() (*model.PaymentResponse, error) {
+		return p.processPayment(request, ActionDeposit)
+	})
 	if err != nil {
 		return res, err
 	}
@@ -140,17 +234,12 @@ func (p *PaymentProcessor) Deposit(request *model.PaymentRequest) (*model.Paymen
 	return res, nil
 }
 
-// Withdraw handles withdrawal requests
+// Withdraw handles withdrawal requests, the hold placed on the wallet of the
+// currency rejects a withdrawal above the available balance
 func (p *PaymentProcessor) Withdraw(request *model.PaymentRequest) (*model.PaymentResponse, error) {
-
-	wallet, err := p.WalletRepo.GetWallet(request.UserID)
-	if err != nil {
-		return nil, err
-	}
-	if wallet.Balance < request.Amount {
-		return nil, model.WrapError(model.ErrValidation, "validation error: insufficient funds")
-	}
-	res, err := p.processPayment(request, gateway.ActionWithdraw)
+	res, err := p.idempotent(request, ActionWithdraw, func() (*model.PaymentResponse, error) {
+		return p.processPayment(request, ActionWithdraw)
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -158,43 +247,51 @@ func (p *PaymentProcessor) Withdraw(request *model.PaymentRequest) (*model.Payme
 	return res, nil
 }
 
-// HandleCallback processes the callback and updates the transaction and wallet accordingly
+// HandleCallback processes the callback and updates the transaction and wallet accordingly,
+// a repeated callback is ignored
 func (p *PaymentProcessor) HandleCallback(callback *model.CallbackRequest) error {
-	// Retrieve the transaction by ID
-	txn, err := p.WalletRepo.GetTransaction(callback.TransactionID)
-	if err != nil {
-		return err
-	}
-
-	// Update the transaction state based on the callback status
-	if callback.State == model.StateApproved {
-		txn.State = model.StateApproved
-
-		// Update the user's wallet since the transaction is approved
-		wallet, err := p.WalletRepo.GetWallet(txn.UserID)
-		if err != nil {
-			return err
-		}
+	return p.settle(callback.TransactionID, callback.State, SourceCallback)
+}
 
-		if txn.Type == ActionDeposit {
-			wallet.Balance += txn.Amount
-		} else if txn.Type == ActionWithdraw {
-			if wallet.Balance < txn.Amount {
-				return errors.New("insufficient funds")
-			}
-			wallet.Balance -= txn.Amount
-		}
+// GetBalance returns the wallet of the user in the currency
+func (p *PaymentProcessor) GetBalance(userID, currency string) (*model.Wallet, error) {
+	if !validateAccount(userID) {
+		return nil, model.WrapError(model.ErrValidation, "invalid account ID")
+	}
+	if !validateCurrency(currency) {
+		return nil, model.WrapError(model.ErrValidation, "invalid currency")
+	}
+	return p.WalletRepo.GetWallet(userID, currency)
+}
 
-		if err := p.WalletRepo.UpdateWallet(txn.UserID, wallet); err != nil {
-			return err
-		}
-	} else if callback.State == model.StateFailed {
-		txn.State = model.StateFailed
+// ListWallets returns the wallets of the user in every currency it holds
+func (p *PaymentProcessor) ListWallets(userID string) ([]*model.Wallet, error) {
+	if !validateAccount(userID) {
+		return nil, model.WrapError(model.ErrValidation, "invalid account ID")
 	}
-	if err := p.WalletRepo.UpdateTransaction(txn); err != nil {
-		return err
+	return p.WalletRepo.ListWallets(userID)
+}
+
+// circuitBreaker returns the circuit breaker of a gateway, creating it on first use
+func (p *PaymentProcessor) circuitBreaker(name string) *gobreaker.CircuitBreaker {
+	p.cbMu.Lock()
+	defer p.cbMu.Unlock()
+
+	cb, exists := p.CircuitBreakers[name]
+	if !exists {
+		cb = gobreaker.NewCircuitBreaker(gobreaker.Settings{
+			Name:     name,
+			Timeout:  2 * time.Second,
+			Interval: 500 * time.Millisecond,
+
+			OnStateChange: func(name string, from, to gobreaker.State) {
+				logger.Infof("Circuit breaker state changed from %s to %s for %s", from, to, name)
+			},
+			ReadyToTrip: p.tripLogic,
+		})
+		p.CircuitBreakers[name] = cb
 	}
-	return nil
+	return cb
 }
 
 // tripLogic defines when the circuit breaker should trip
@@ -213,7 +310,7 @@ func validateRequest(request *model.PaymentRequest) error {
 		return model.WrapError(model.ErrValidation, "invalid currency")
 	}
 	if !validateAmount(request.Amount, request.Exponent) {
-		return model.WrapError(model.ErrValidation, "invalid amount")
+		return model.ErrInvalidAmount
 	}
 	return nil
 }
@@ -223,12 +320,52 @@ func validateAccount(userID string) bool {
 	return userID != ""
 }
 
-// validateCurrency checks if the currency is supported
-func validateCurrency(currency string) bool {
-	return model.SupportedCurrencies[currency]
+// validateCurrency checks if the currency is known and enabled in the currency registry
+func validateCurrency(code string) bool {
+	return currency.Default().Enabled(code)
 }
 
+// maxExponent bounds the exponent so that powers of ten fit an int64
+const maxExponent = 18
+
 // validateAmount checks if the amount and exponent are valid
 func validateAmount(amount int64, exponent int) bool {
-	return amount > 0
+	return amount > 0 && exponent >= 0 && exponent <= maxExponent
+}
+
+// normaliseAmount rescales the amount of the request to the minor unit of its
+// currency, an exponent of zero already is. An amount with more decimals than
+// the currency has is rejected rather than rounded.
+func normaliseAmount(request *model.PaymentRequest) error {
+	exponent := currency.Default().Exponent(request.Currency)
+	if request.Exponent == 0 || request.Exponent == exponent {
+		request.Exponent = exponent
+		return nil
+	}
+
+	amount, err := rescale(request.Amount, request.Exponent, exponent)
+	if err != nil {
+		return err
+	}
+	request.Amount = amount
+	request.Exponent = exponent
+	return nil
+}
+
+// rescale converts an amount with the exponent from to the exponent to
+func rescale(amount int64, from, to int) (int64, error) {
+	factor := int64(1)
+	for i := 0; i < from-to || i < to-from; i++ {
+		factor *= 10
+	}
+	if from > to {
+		if amount%factor != 0 {
+			return 0, model.WrapError(model.ErrInvalidAmount, fmt.Sprintf("amount has more than %d decimal places", to))
+		}
+		return amount / factor, nil
+	}
+	if amount > math.MaxInt64/factor {
+		return 0, model.ErrInvalidAmount
+	}
+	return amount * factor, nil
 }
@@ -3,114 +3,149 @@ package service_test
 import (
 	"fmt"
 	"net/http"
+	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/h2non/gock"
 	"github.com/stretchr/testify/assert"
 	"github.com/wajidp/micro-payment-gateway/internal/service"
+	"github.com/wajidp/micro-payment-gateway/internal/service/currency"
 	"github.com/wajidp/micro-payment-gateway/internal/service/database"
+	"github.com/wajidp/micro-payment-gateway/internal/service/fx"
+	"github.com/wajidp/micro-payment-gateway/internal/service/gateway"
+	"github.com/wajidp/micro-payment-gateway/internal/service/ledger"
 	"github.com/wajidp/micro-payment-gateway/internal/service/model"
 )
 
+// walletStores are the wallet repositories the processor is tested with, it must behave alike on each
+var walletStores = []string{"memory", "sqlite"}
+
+// newProcessor creates a processor on an empty wallet repository of the store
+func newProcessor(t *testing.T, store string, pgms []*model.PgRoutingMaster) *service.PaymentProcessor {
+	processor := service.NewPaymentProcessor(pgms).(*service.PaymentProcessor)
+	if store == "sqlite" {
+		db, err := database.OpenSQLite("file:" + filepath.Join(t.TempDir(), "wallets.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() })
+		walletRepo, err := database.NewSQLWalletRepo(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		processor.WalletRepo = walletRepo
+	}
+	return processor
+}
+
+// storedTransaction reads the transaction as stored in the wallet repository of the processor
+func storedTransaction(t *testing.T, processor *service.PaymentProcessor, txnID string) *model.Transaction {
+	txn, err := processor.WalletRepo.GetTransaction(txnID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return txn
+}
+
+// ledgerBalance returns the balance of a ledger account of the processor's wallet repository
+func ledgerBalance(t *testing.T, processor *service.PaymentProcessor, account string) int64 {
+	balance, err := processor.WalletRepo.LedgerBalance(account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return balance
+}
+
 // TestPaymentProcessor_Resilience_CircuitBreakerAndFallback verifies the circuit breaker mechanism
 // in the PaymentProcessor. The test simulates multiple failures from a payment gateway (PGSA)
 // and checks if the circuit breaker trips after the configured number of failures.
 // It also verifies that the circuit breaker resets after a timeout, allowing requests to be retried.
 func TestPaymentProcessor_Resilience_CircuitBreakerAndFallback(t *testing.T) {
-	defer gock.Off() // Ensure gock is disabled after test
+	for _, store := range walletStores {
+		t.Run(store, func(t *testing.T) {
+			defer gock.Off() // Ensure gock is disabled after test
 
-	// Ensure PgRoutingMasters is configured to select PGSA for the test
-	pgms := []*model.PgRoutingMaster{
-		{Currency: "USD", CountryCode: "US", PaymentGateway: "PGA", Active: true, MaxRetryCount: 3, Priority: 0}, // PGSA is selected for USD in the US
-	}
+			// Ensure PgRoutingMasters is configured to select PGSA for the test
+			pgms := []*model.PgRoutingMaster{
+				{Currency: "USD", CountryCode: "US", PaymentGateway: "PGA", Active: true, MaxRetryCount: 3, Priority: 0}, // PGSA is selected for USD in the US
+			}
 
-	// Initialize the wallet repository and set up the wallet
-	walletRepo := database.NewUserWalletRepo()
-	wallet := &model.Wallet{
-		Balance: 200, // Set an initial balance
-	}
-	walletRepo.UpdateWallet("123", wallet)
+			processor := newProcessor(t, store, pgms)
+			// Set up the wallet with an initial balance
+			processor.WalletRepo.UpdateWallet("123", "USD", &model.Wallet{Balance: 200})
 
-	processor := service.NewPaymentProcessor(pgms)
-	// Replace the real WalletRepo with the test wallet
-	processor.(*service.PaymentProcessor).WalletRepo = walletRepo
+			// Simulate a sequence of failed requests to trip the circuit breaker for PGSA
+			gock.New("http://pgsa.com").
+				Post("/deposit").
+				Times(4). // Simulate 4 failed requests
+				Reply(http.StatusInternalServerError).
+				JSON(map[string]string{"status": "error", "message": "Internal Server Error"})
 
-	// Simulate a sequence of failed requests to trip the circuit breaker for PGSA
-	gock.New("http://pgsa.com").
-		Post("/deposit").
-		Times(4). // Simulate 4 failed requests
-		Reply(http.StatusInternalServerError).
-		JSON(map[string]string{"status": "error", "message": "Internal Server Error"})
+			request := &model.PaymentRequest{
+				UserID:      "123",
+				Amount:      100,
+				Currency:    "USD",
+				CountryCode: "US",
+			}
 
-	request := &model.PaymentRequest{
-		UserID:      "123",
-		Amount:      100,
-		Currency:    "USD",
-		CountryCode: "US",
-	}
-
-	for i := 0; i < 4; i++ {
-		_, err := processor.Deposit(request)
-		if i < 3 {
-			assert.Error(t, err, "Expected error for failed requests")
-		} else {
-			assert.Equal(t, fmt.Errorf("Deposit operation failed"), err, "Expected circuit breaker to open on the 4th attempt")
-		}
-	}
+			for i := 0; i < 4; i++ {
+				_, err := processor.Deposit(request)
+				if i < 3 {
+					assert.Error(t, err, "Expected error for failed requests")
+				} else {
+					assert.Equal(t, fmt.Errorf("Deposit operation failed"), err, "Expected circuit breaker to open on the 4th attempt")
+				}
+			}
 
-	// Wait for the circuit breaker to reset
-	time.Sleep(4 * time.Second)
+			// Wait for the circuit breaker to reset
+			time.Sleep(4 * time.Second)
 
-	gock.Off()
-	// Ensure that the circuit breaker resets and allows requests again
-	gock.New("http://pgsa.com").
-		Post("/deposit").
-		Reply(http.StatusOK).
-		JSON(map[string]string{"status": "success", "message": "Transaction processed successfully"})
+			gock.Off()
+			// Ensure that the circuit breaker resets and allows requests again
+			gock.New("http://pgsa.com").
+				Post("/deposit").
+				Reply(http.StatusOK).
+				JSON(map[string]string{"status": "success", "message": "Transaction processed successfully"})
 
-	response, err := processor.Deposit(request)
-	gock.Off()
-	assert.NoError(t, err, "Expected no error after circuit breaker resets")
-	assert.Contains(t, "success", response.Status, "Expected successful response after reset")
+			response, err := processor.Deposit(request)
+			gock.Off()
+			assert.NoError(t, err, "Expected no error after circuit breaker resets")
+			assert.Contains(t, "success", response.Status, "Expected successful response after reset")
+		})
+	}
 }
 
 // TestPaymentProcessor_Resilience_FallbackToPGB ensures that the PaymentProcessor correctly falls back
 // to a secondary payment gateway (PGB) when the primary gateway (PGA) fails. The test simulates
 // failures from PGA and verifies that the processor successfully processes the deposit using PGB.
 func TestPaymentProcessor_Resilience_FallbackToPGB(t *testing.T) {
-	defer gock.Off() // Ensure gock is disabled after test
+	for _, store := range walletStores {
+		t.Run(store, func(t *testing.T) {
+			defer gock.Off() // Ensure gock is disabled after test
 
-	// Ensure PgRoutingMasters is configured for fallback to PGB
-	pgms := []*model.PgRoutingMaster{
-		{Currency: "USD", CountryCode: "US", PaymentGateway: "PGA", Active: true, MaxRetryCount: 3, Priority: 0},
-		{Currency: "USD", CountryCode: "US", PaymentGateway: "PGB", Active: true, MaxRetryCount: 3, Priority: 1}, // PGB as a fallback
-	}
+			// Ensure PgRoutingMasters is configured for fallback to PGB
+			pgms := []*model.PgRoutingMaster{
+				{Currency: "USD", CountryCode: "US", PaymentGateway: "PGA", Active: true, MaxRetryCount: 3, Priority: 0},
+				{Currency: "USD", CountryCode: "US", PaymentGateway: "PGB", Active: true, MaxRetryCount: 3, Priority: 1}, // PGB as a fallback
+			}
 
-	// Initialize the wallet repository and set up the wallet
-	walletRepo := database.NewUserWalletRepo()
-	wallet := &model.Wallet{
-		Balance: 200, // Set an initial balance
-	}
-	walletRepo.UpdateWallet("123", wallet)
+			// Initialize the payment processor and set up the wallet with an initial balance
+			processor := newProcessor(t, store, pgms)
+			processor.WalletRepo.UpdateWallet("123", "USD", &model.Wallet{Balance: 200})
 
-	// Initialize the payment processor
-	processor := service.NewPaymentProcessor(pgms)
-	// Replace the real WalletRepo with the test wallet
-	processor.(*service.PaymentProcessor).WalletRepo = walletRepo
-
-	// Simulate PGA failure
-	gock.New("http://pgsa.com").
-		Post("/deposit").
-		Times(3).
-		Reply(http.StatusInternalServerError).
-		JSON(map[string]string{"status": "error", "message": "Internal Server Error"})
-
-	// Simulate PGB success
-	gock.New("http://pgsb.com").
-		Post("/deposit").
-		Reply(http.StatusOK).
-		XML(`
+			// Simulate PGA failure
+			gock.New("http://pgsa.com").
+				Post("/deposit").
+				Times(3).
+				Reply(http.StatusInternalServerError).
+				JSON(map[string]string{"status": "error", "message": "Internal Server Error"})
+
+			// Simulate PGB success
+			gock.New("http://pgsb.com").
+				Post("/deposit").
+				Reply(http.StatusOK).
+				XML(`
 			<soapenv:Envelope xmlns:soapenv="http://schemas.xmlsoap.org/soap/envelope/">
 				<soapenv:Body>
 					<ns2:depositResponse xmlns:ns2="http://pgb.com/">
@@ -123,18 +158,1403 @@ func TestPaymentProcessor_Resilience_FallbackToPGB(t *testing.T) {
 			</soapenv:Envelope>
 		`)
 
+			request := &model.PaymentRequest{
+				UserID:      "123",
+				Amount:      100,
+				Currency:    "USD",
+				CountryCode: "US",
+			}
+
+			// Attempt deposit, expecting it to fall back to PGB after PGA fails
+			response, err := processor.Deposit(request)
+
+			gock.Off()
+			fmt.Println(response, err)
+			assert.NoError(t, err, "Expected fallback to PGB with no error")
+			assert.Contains(t, "success", response.Status, "Expected successful response from PGB")
+		})
+	}
+}
+
+// TestPaymentProcessor_Routing_Selection verifies that gateways are filtered by currency, country
+// and active flag and tried in priority order. PGA is inactive for USD, so PGB must be used even
+// though it has a lower priority than an EUR-only PGA entry.
+func TestPaymentProcessor_Routing_Selection(t *testing.T) {
+	for _, store := range walletStores {
+		t.Run(store, func(t *testing.T) {
+			defer gock.Off()
+
+			pgms := []*model.PgRoutingMaster{
+				{Currency: "USD", CountryCode: "US", PaymentGateway: "PGA", Active: false, MaxRetryCount: 3, Priority: 0},
+				{Currency: "EUR", CountryCode: "US", PaymentGateway: "PGA", Active: true, MaxRetryCount: 3, Priority: 0},
+				{Currency: "USD", CountryCode: "US", PaymentGateway: "PGB", Active: true, MaxRetryCount: 3, Priority: 5},
+				{Currency: "USD", CountryCode: "", PaymentGateway: "PGB", Active: true, MaxRetryCount: 3, Priority: 1},
+			}
+			processor := newProcessor(t, store, pgms)
+
+			// PGB must be called exactly once even though it matches twice
+			gock.New("http://pgsb.com").
+				Post("/deposit").
+				Times(1).
+				Reply(http.StatusBadRequest)
+
+			request := &model.PaymentRequest{
+				UserID:      "123",
+				Amount:      100,
+				Currency:    "USD",
+				CountryCode: "US",
+			}
+
+			_, err := processor.Deposit(request)
+			assert.Error(t, err)
+			assert.True(t, gock.IsDone(), "Expected PGB to be tried")
+			assert.False(t, gock.HasUnmatchedRequest(), "Expected no call to an inactive or duplicate gateway")
+		})
+	}
+}
+
+// TestPaymentProcessor_Routing_NoRoute verifies that a request without a matching route
+// is rejected with a validation error.
+func TestPaymentProcessor_Routing_NoRoute(t *testing.T) {
+	pgms := []*model.PgRoutingMaster{
+		{Currency: "USD", CountryCode: "AE", PaymentGateway: "PGA", Active: true, MaxRetryCount: 3, Priority: 0},
+	}
+	processor := service.NewPaymentProcessor(pgms)
+
 	request := &model.PaymentRequest{
 		UserID:      "123",
 		Amount:      100,
-		Currency:    "USD",
-		CountryCode: "US",
+		Currency:    "EUR",
+		CountryCode: "AE",
+	}
+
+	_, err := processor.Deposit(request)
+	assert.ErrorIs(t, err, model.ErrValidation)
+	assert.Contains(t, err.Error(), "no route")
+}
+
+// TestPaymentProcessor_Retry_TransientFailure verifies that a 5xx from a gateway is retried on the
+// same gateway and that every attempt is recorded on the transaction.
+func TestPaymentProcessor_Retry_TransientFailure(t *testing.T) {
+	for _, store := range walletStores {
+		t.Run(store, func(t *testing.T) {
+			defer gock.Off()
+
+			pgms := []*model.PgRoutingMaster{
+				{Currency: "USD", CountryCode: "US", PaymentGateway: "PGA", Active: true, MaxRetryCount: 2, Priority: 0},
+			}
+			processor := newProcessor(t, store, pgms)
+			processor.RetryPolicy = service.RetryPolicy{BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond}
+
+			gock.New("http://pgsa.com").
+				Post("/deposit").
+				Reply(http.StatusServiceUnavailable)
+			gock.New("http://pgsa.com").
+				Post("/deposit").
+				Reply(http.StatusOK).
+				JSON(map[string]string{"status": "success", "message": "Transaction processed successfully"})
+
+			request := &model.PaymentRequest{
+				UserID:      "123",
+				Amount:      100,
+				Currency:    "USD",
+				CountryCode: "US",
+			}
+
+			response, err := processor.Deposit(request)
+			assert.NoError(t, err)
+			assert.Equal(t, "success", response.Status)
+
+			txn, err := processor.WalletRepo.GetTransaction(response.TransactionID)
+			assert.NoError(t, err)
+			assert.Len(t, txn.Attempts, 2)
+			assert.NotEmpty(t, txn.Attempts[0].Error)
+			assert.Empty(t, txn.Attempts[1].Error)
+		})
+	}
+}
+
+// TestPaymentProcessor_Retry_NoRetryOnDecline verifies that a 4xx from a gateway is not retried
+// and that the failed transaction is kept with its attempt.
+func TestPaymentProcessor_Retry_NoRetryOnDecline(t *testing.T) {
+	for _, store := range walletStores {
+		t.Run(store, func(t *testing.T) {
+			defer gock.Off()
+
+			pgms := []*model.PgRoutingMaster{
+				{Currency: "USD", CountryCode: "US", PaymentGateway: "PGA", Active: true, MaxRetryCount: 3, Priority: 0},
+			}
+			processor := newProcessor(t, store, pgms)
+
+			gock.New("http://pgsa.com").
+				Post("/deposit").
+				Times(1).
+				Reply(http.StatusBadRequest).
+				JSON(map[string]string{"status": "declined", "message": "Card declined"})
+
+			request := &model.PaymentRequest{
+				UserID:      "123",
+				Amount:      100,
+				Currency:    "USD",
+				CountryCode: "US",
+			}
+
+			_, err := processor.Deposit(request)
+			assert.Error(t, err)
+
+			txn, err := processor.WalletRepo.GetTransaction(request.TransactionID)
+			assert.NoError(t, err)
+			assert.Equal(t, model.StateFailed, txn.State)
+			assert.Len(t, txn.Attempts, 1)
+		})
+	}
+}
+
+// TestPaymentProcessor_DeclinedStatus verifies that a gateway answering with a failed status
+// declines the payment: the transaction fails, the hold is released and no other gateway is tried.
+func TestPaymentProcessor_DeclinedStatus(t *testing.T) {
+	for _, store := range walletStores {
+		t.Run(store, func(t *testing.T) {
+			defer gock.Off()
+			gock.DisableNetworking()
+
+			pgms := []*model.PgRoutingMaster{
+				{Currency: "USD", CountryCode: "US", PaymentGateway: "PGA", Active: true, MaxRetryCount: 3, Priority: 0},
+				{Currency: "USD", CountryCode: "US", PaymentGateway: "PGB", Active: true, MaxRetryCount: 3, Priority: 1},
+			}
+			processor := newProcessor(t, store, pgms)
+			processor.WalletRepo.UpdateWallet("123", "USD", &model.Wallet{Balance: 200})
+
+			gock.New("http://pgsa.com").
+				Post("/withdraw").
+				Reply(http.StatusOK).
+				JSON(map[string]string{"status": "failed", "message": "Do not honor"})
+			request := &model.PaymentRequest{UserID: "123", Amount: 100, Currency: "USD", CountryCode: "US"}
+			_, err := processor.Withdraw(request)
+			assert.ErrorIs(t, err, model.ErrDeclined)
+			assert.True(t, gock.IsDone())
+
+			txn, err := processor.WalletRepo.GetTransaction(request.TransactionID)
+			assert.NoError(t, err)
+			assert.Equal(t, model.StateFailed, txn.State)
+			assert.Equal(t, "PGA", txn.Gateway)
+			wallet, err := processor.GetBalance("123", "USD")
+			assert.NoError(t, err)
+			assert.Equal(t, int64(200), wallet.Available())
+
+			// a declined refund fails and frees its amount
+			gock.New("http://pgsa.com").
+				Post("/deposit").
+				Reply(http.StatusOK).
+				JSON(map[string]string{"status": "success", "message": "Transaction processed successfully"})
+			deposit, err := processor.Deposit(&model.PaymentRequest{UserID: "123", Amount: 100, Currency: "USD", CountryCode: "US"})
+			assert.NoError(t, err)
+			assert.NoError(t, processor.HandleCallback(&model.CallbackRequest{TransactionID: deposit.TransactionID, State: model.StateApproved}))
+			gock.New("http://pgsa.com").
+				Post("/refund").
+				Reply(http.StatusOK).
+				JSON(map[string]string{"status": "failed", "message": "Refund not allowed"})
+			_, err = processor.Refund(&model.RefundRequest{TransactionID: deposit.TransactionID})
+			assert.ErrorIs(t, err, model.ErrDeclined)
+			refunds, err := processor.WalletRepo.ListTransactionsByParent(deposit.TransactionID)
+			assert.NoError(t, err)
+			if assert.Len(t, refunds, 1) {
+				assert.Equal(t, model.StateFailed, refunds[0].State)
+			}
+			wallet, err = processor.GetBalance("123", "USD")
+			assert.NoError(t, err)
+			assert.Equal(t, int64(300), wallet.Available())
+		})
+	}
+}
+
+// TestRetryPolicy_Backoff verifies the exponential growth, jitter bounds and the cap.
+func TestRetryPolicy_Backoff(t *testing.T) {
+	policy := service.RetryPolicy{BaseDelay: 100 * time.Millisecond, MaxDelay: 300 * time.Millisecond}
+
+	for i := 0; i < 20; i++ {
+		first := policy.Backoff(1)
+		assert.True(t, first >= 50*time.Millisecond && first <= 100*time.Millisecond)
+		second := policy.Backoff(2)
+		assert.True(t, second >= 100*time.Millisecond && second <= 200*time.Millisecond)
+		capped := policy.Backoff(10)
+		assert.True(t, capped >= 150*time.Millisecond && capped <= 300*time.Millisecond)
+	}
+}
+
+// TestIsRetryable_SOAPFault verifies that SOAP server faults are retried while client faults
+// are not, whatever HTTP status they came with.
+func TestIsRetryable_SOAPFault(t *testing.T) {
+	assert.True(t, service.IsRetryable(&gateway.SOAPFault{Code: "soap:Server", StatusCode: http.StatusInternalServerError}))
+	assert.False(t, service.IsRetryable(&gateway.SOAPFault{Code: "soap:Client", StatusCode: http.StatusInternalServerError}))
+	assert.True(t, service.IsRetryable(&model.HttpStatusError{StatusCode: http.StatusBadGateway}))
+	assert.False(t, service.IsRetryable(&model.HttpStatusError{StatusCode: http.StatusBadRequest}))
+}
+
+// TestPaymentProcessor_Reconcile verifies that transactions left authorized are queried with their
+// gateway once old enough, that final statuses are applied like a callback and pending ones are kept.
+func TestPaymentProcessor_Reconcile(t *testing.T) {
+	for _, store := range walletStores {
+		t.Run(store, func(t *testing.T) {
+			defer gock.Off()
+
+			pgms := []*model.PgRoutingMaster{
+				{Currency: "USD", CountryCode: "US", PaymentGateway: "PGA", Active: true, Priority: 0},
+			}
+			processor := newProcessor(t, store, pgms)
+
+			deposit := func() *model.Transaction {
+				gock.New("http://pgsa.com").
+					Post("/deposit").
+					Reply(http.StatusOK).
+					JSON(map[string]string{"status": "success", "message": "Transaction processed successfully"})
+				response, err := processor.Deposit(&model.PaymentRequest{UserID: "123", Amount: 100, Currency: "USD", CountryCode: "US"})
+				assert.NoError(t, err)
+				txn, err := processor.WalletRepo.GetTransaction(response.TransactionID)
+				assert.NoError(t, err)
+				assert.Equal(t, "PGA", txn.Gateway)
+				return txn
+			}
+			approved, declined, pending := deposit(), deposit(), deposit()
+
+			// too recent to be queried
+			result, err := processor.Reconcile(time.Hour)
+			assert.NoError(t, err)
+			assert.Equal(t, 0, result.Checked)
+
+			status := func(txn *model.Transaction, state string) {
+				gock.New("http://pgsa.com").
+					Post("/status").
+					MatchType("json").
+					JSON(map[string]string{"id": txn.ID}).
+					Reply(http.StatusOK).
+					JSON(map[string]string{"status": state})
+			}
+			status(approved, "success")
+			status(declined, "failed")
+			status(pending, "pending")
+
+			result, err = processor.Reconcile(0)
+			assert.NoError(t, err)
+			assert.Equal(t, service.ReconcileResult{Checked: 3, Approved: 1, Failed: 1, Pending: 1}, result)
+			assert.True(t, gock.IsDone())
+
+			approved = storedTransaction(t, processor, approved.ID)
+			assert.Equal(t, model.StateApproved, approved.State)
+			assert.Equal(t, model.StateFailed, storedTransaction(t, processor, declined.ID).State)
+			assert.Equal(t, model.StateAuthorized, storedTransaction(t, processor, pending.ID).State)
+			assert.Equal(t, service.SourcePoller, approved.Transitions[len(approved.Transitions)-1].Source)
+			wallet, err := processor.GetBalance("123", "USD")
+			assert.NoError(t, err)
+			assert.Equal(t, int64(100), wallet.Balance)
+
+			// a transaction still pending past ExpireAfter expires
+			processor.ExpireAfter = time.Nanosecond
+			status(pending, "pending")
+			result, err = processor.Reconcile(0)
+			assert.NoError(t, err)
+			assert.Equal(t, service.ReconcileResult{Checked: 1, Expired: 1}, result)
+			assert.Equal(t, model.StateExpired, storedTransaction(t, processor, pending.ID).State)
+		})
+	}
+}
+
+// TestPaymentProcessor_Refund verifies that an approved deposit can be refunded in parts
+// up to its amount and that the wallet is only debited once a refund is approved.
+func TestPaymentProcessor_Refund(t *testing.T) {
+	for _, store := range walletStores {
+		t.Run(store, func(t *testing.T) {
+			defer gock.Off()
+
+			pgms := []*model.PgRoutingMaster{
+				{Currency: "USD", CountryCode: "US", PaymentGateway: "PGA", Active: true, Priority: 0},
+			}
+			processor := newProcessor(t, store, pgms)
+
+			gock.New("http://pgsa.com").
+				Post("/deposit").
+				Reply(http.StatusOK).
+				JSON(map[string]string{"status": "success", "message": "Transaction processed successfully"})
+			response, err := processor.Deposit(&model.PaymentRequest{UserID: "123", Amount: 1000, Currency: "USD", CountryCode: "US"})
+			assert.NoError(t, err)
+			depositID := response.TransactionID
+
+			// only approved deposits can be refunded
+			_, err = processor.Refund(&model.RefundRequest{TransactionID: depositID, Amount: 100})
+			assert.ErrorIs(t, err, model.ErrValidation)
+			assert.NoError(t, processor.HandleCallback(&model.CallbackRequest{TransactionID: depositID, State: model.StateApproved}))
+
+			refund := func(amount int64) (*model.PaymentResponse, error) {
+				gock.New("http://pgsa.com").
+					Post("/refund").
+					BodyString(`"original_id":"` + depositID + `"`).
+					Reply(http.StatusOK).
+					JSON(map[string]string{"status": "success", "message": "Refund processed successfully"})
+				return processor.Refund(&model.RefundRequest{TransactionID: depositID, Amount: amount})
+			}
+
+			first, err := refund(300)
+			assert.NoError(t, err)
+			txn, err := processor.WalletRepo.GetTransaction(first.TransactionID)
+			assert.NoError(t, err)
+			assert.Equal(t, depositID, txn.ParentID)
+			assert.Equal(t, service.ActionRefund, txn.Type)
+			assert.Equal(t, model.StateAuthorized, txn.State)
+
+			// the wallet is not debited until the refund is approved
+			wallet, err := processor.GetBalance("123", "USD")
+			assert.NoError(t, err)
+			assert.Equal(t, int64(1000), wallet.Balance)
+			assert.NoError(t, processor.HandleCallback(&model.CallbackRequest{TransactionID: first.TransactionID, State: model.StateApproved}))
+			wallet, err = processor.GetBalance("123", "USD")
+			assert.NoError(t, err)
+			assert.Equal(t, int64(700), wallet.Balance)
+
+			// the pending refund counts towards the cap
+			second, err := refund(500)
+			assert.NoError(t, err)
+			gock.Off()
+			_, err = processor.Refund(&model.RefundRequest{TransactionID: depositID, Amount: 201})
+			assert.ErrorIs(t, err, model.ErrValidation)
+
+			// a failed refund frees its amount, zero refunds the remainder
+			assert.NoError(t, processor.HandleCallback(&model.CallbackRequest{TransactionID: second.TransactionID, State: model.StateFailed}))
+			rest, err := refund(0)
+			assert.NoError(t, err)
+			txn, err = processor.WalletRepo.GetTransaction(rest.TransactionID)
+			assert.NoError(t, err)
+			assert.Equal(t, int64(700), txn.Amount)
+			assert.True(t, gock.IsDone())
+
+			// the deposit is refunded once its refunds are approved in full
+			assert.NoError(t, processor.HandleCallback(&model.CallbackRequest{TransactionID: rest.TransactionID, State: model.StateApproved}))
+			deposit, err := processor.WalletRepo.GetTransaction(depositID)
+			assert.NoError(t, err)
+			assert.Equal(t, model.StateRefunded, deposit.State)
+			wallet, err = processor.GetBalance("123", "USD")
+			assert.NoError(t, err)
+			assert.Equal(t, int64(0), wallet.Balance)
+
+			_, err = processor.Refund(&model.RefundRequest{TransactionID: "missing"})
+			assert.ErrorIs(t, err, model.ErrNotFound)
+		})
+	}
+}
+
+// timeoutError is a network error which timed out
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// TestPaymentProcessor_RefundTimeout verifies that a refund whose gateway call timed out keeps
+// its hold and counts towards the cap, since the gateway may have processed it.
+func TestPaymentProcessor_RefundTimeout(t *testing.T) {
+	for _, store := range walletStores {
+		t.Run(store, func(t *testing.T) {
+			defer gock.Off()
+			gock.DisableNetworking()
+
+			pgms := []*model.PgRoutingMaster{
+				{Currency: "USD", CountryCode: "US", PaymentGateway: "PGA", Active: true, Priority: 0},
+			}
+			processor := newProcessor(t, store, pgms)
+			gock.New("http://pgsa.com").
+				Post("/deposit").
+				Reply(http.StatusOK).
+				JSON(map[string]string{"status": "success", "message": "Transaction processed successfully"})
+			deposit, err := processor.Deposit(&model.PaymentRequest{UserID: "123", Amount: 100, Currency: "USD", CountryCode: "US"})
+			assert.NoError(t, err)
+			assert.NoError(t, processor.HandleCallback(&model.CallbackRequest{TransactionID: deposit.TransactionID, State: model.StateApproved}))
+
+			gock.New("http://pgsa.com").
+				Post("/refund").
+				ReplyError(timeoutError{})
+			_, err = processor.Refund(&model.RefundRequest{TransactionID: deposit.TransactionID, Amount: 60})
+			if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), "timeout")
+			}
+
+			refunds, err := processor.WalletRepo.ListTransactionsByParent(deposit.TransactionID)
+			assert.NoError(t, err)
+			if !assert.Len(t, refunds, 1) {
+				return
+			}
+			assert.Equal(t, model.StateInitiated, refunds[0].State)
+			assert.Len(t, refunds[0].Attempts, 1)
+			wallet, err := processor.GetBalance("123", "USD")
+			assert.NoError(t, err)
+			assert.Equal(t, int64(40), wallet.Available(), "Expected the refund to keep its hold")
+
+			// a retry of the client cannot refund the amount again
+			_, err = processor.Refund(&model.RefundRequest{TransactionID: deposit.TransactionID, Amount: 60})
+			assert.ErrorIs(t, err, model.ErrInvalidAmount)
+			assert.True(t, gock.IsDone())
+		})
+	}
+}
+
+// TestPaymentProcessor_RefundNotStored verifies that a refund accepted by the gateway which
+// cannot be stored keeps its hold instead of failing, and is settled by the reconciler.
+func TestPaymentProcessor_RefundNotStored(t *testing.T) {
+	for _, store := range walletStores {
+		t.Run(store, func(t *testing.T) {
+			defer gock.Off()
+			gock.DisableNetworking()
+
+			pgms := []*model.PgRoutingMaster{
+				{Currency: "USD", CountryCode: "US", PaymentGateway: "PGA", Active: true, Priority: 0},
+			}
+			processor := newProcessor(t, store, pgms)
+			walletRepo := &crashingRepo{WalletRepository: processor.WalletRepo}
+			processor.WalletRepo = walletRepo
+
+			gock.New("http://pgsa.com").
+				Post("/deposit").
+				Reply(http.StatusOK).
+				JSON(map[string]string{"status": "success", "message": "Transaction processed successfully"})
+			deposit, err := processor.Deposit(&model.PaymentRequest{UserID: "123", Amount: 100, Currency: "USD", CountryCode: "US"})
+			assert.NoError(t, err)
+			assert.NoError(t, processor.HandleCallback(&model.CallbackRequest{TransactionID: deposit.TransactionID, State: model.StateApproved}))
+
+			gock.New("http://pgsa.com").
+				Post("/refund").
+				Reply(http.StatusOK).
+				JSON(map[string]string{"status": "success", "message": "Refund processed successfully"})
+			walletRepo.crash = true
+			_, err = processor.Refund(&model.RefundRequest{TransactionID: deposit.TransactionID})
+			assert.ErrorIs(t, err, model.ErrInternal)
+			walletRepo.crash = false
+
+			refunds, err := processor.WalletRepo.ListTransactionsByParent(deposit.TransactionID)
+			assert.NoError(t, err)
+			if !assert.Len(t, refunds, 1) {
+				return
+			}
+			assert.Equal(t, model.StateInitiated, refunds[0].State)
+			wallet, err := processor.GetBalance("123", "USD")
+			assert.NoError(t, err)
+			assert.Equal(t, int64(0), wallet.Available(), "Expected the refund to keep its hold")
+
+			gock.New("http://pgsa.com").
+				Post("/status").
+				MatchType("json").
+				JSON(map[string]string{"id": refunds[0].ID}).
+				Reply(http.StatusOK).
+				JSON(map[string]string{"status": "success"})
+			result, err := processor.Reconcile(0)
+			assert.NoError(t, err)
+			assert.Equal(t, service.ReconcileResult{Checked: 1, Approved: 1}, result)
+			refund, err := processor.WalletRepo.GetTransaction(refunds[0].ID)
+			assert.NoError(t, err)
+			assert.Equal(t, model.StateApproved, refund.State)
+			wallet, err = processor.GetBalance("123", "USD")
+			assert.NoError(t, err)
+			assert.Equal(t, int64(0), wallet.Balance)
+		})
+	}
+}
+
+// TestPaymentProcessor_ReconcileInitiated verifies that a transaction left initiated is only
+// authorized on a status its gateway knows, and that it expires with its hold released once
+// older than ExpireAfter, also when no gateway was recorded for it.
+func TestPaymentProcessor_ReconcileInitiated(t *testing.T) {
+	for _, store := range walletStores {
+		t.Run(store, func(t *testing.T) {
+			defer gock.Off()
+			gock.DisableNetworking()
+
+			pgms := []*model.PgRoutingMaster{
+				{Currency: "USD", CountryCode: "US", PaymentGateway: "PGA", Active: true, Priority: 0},
+			}
+			processor := newProcessor(t, store, pgms)
+			gock.New("http://pgsa.com").
+				Post("/deposit").
+				Reply(http.StatusOK).
+				JSON(map[string]string{"status": "success", "message": "Transaction processed successfully"})
+			deposit, err := processor.Deposit(&model.PaymentRequest{UserID: "123", Amount: 100, Currency: "USD", CountryCode: "US"})
+			assert.NoError(t, err)
+			assert.NoError(t, processor.HandleCallback(&model.CallbackRequest{TransactionID: deposit.TransactionID, State: model.StateApproved}))
+
+			gock.New("http://pgsa.com").
+				Post("/refund").
+				ReplyError(timeoutError{})
+			_, err = processor.Refund(&model.RefundRequest{TransactionID: deposit.TransactionID, Amount: 60})
+			assert.Error(t, err)
+			refunds, err := processor.WalletRepo.ListTransactionsByParent(deposit.TransactionID)
+			assert.NoError(t, err)
+			if !assert.Len(t, refunds, 1) {
+				return
+			}
+
+			// a withdrawal stored before the process stopped, no gateway was tried for it
+			crashed := &model.Transaction{
+				ID: "crashed", UserID: "123", Amount: 30, Currency: "USD", Type: service.ActionWithdraw,
+				State: model.StateInitiated, CreatedAt: time.Now(), WalletCurrency: "USD", WalletAmount: 30,
+			}
+			assert.NoError(t, processor.WalletRepo.PlaceHold("123", "USD", crashed.ID, crashed.WalletAmount))
+			assert.NoError(t, processor.WalletRepo.UpdateTransaction(crashed))
+
+			status := func(state string) {
+				gock.New("http://pgsa.com").
+					Post("/status").
+					MatchType("json").
+					JSON(map[string]string{"id": refunds[0].ID}).
+					Reply(http.StatusOK).
+					JSON(map[string]string{"status": state})
+			}
+			status("unknown")
+			result, err := processor.Reconcile(0)
+			assert.NoError(t, err)
+			assert.Equal(t, service.ReconcileResult{Checked: 2, Pending: 2}, result)
+			assert.Equal(t, model.StateInitiated, storedTransaction(t, processor, refunds[0].ID).State)
+			assert.Equal(t, model.StateInitiated, storedTransaction(t, processor, crashed.ID).State)
+			wallet, err := processor.GetBalance("123", "USD")
+			assert.NoError(t, err)
+			assert.Equal(t, int64(10), wallet.Available())
+
+			processor.ExpireAfter = time.Nanosecond
+			status("unknown")
+			result, err = processor.Reconcile(0)
+			assert.NoError(t, err)
+			assert.Equal(t, service.ReconcileResult{Checked: 2, Expired: 2}, result)
+			assert.Equal(t, model.StateExpired, storedTransaction(t, processor, refunds[0].ID).State)
+			assert.Equal(t, model.StateExpired, storedTransaction(t, processor, crashed.ID).State)
+			wallet, err = processor.GetBalance("123", "USD")
+			assert.NoError(t, err)
+			assert.Equal(t, int64(100), wallet.Available(), "Expected the holds to be released")
+			assert.True(t, gock.IsDone())
+		})
+	}
+}
+
+// TestPaymentProcessor_Void verifies that an authorized transaction is cancelled at its gateway,
+// that a refused cancellation leaves it authorized and that later callbacks are rejected.
+func TestPaymentProcessor_Void(t *testing.T) {
+	for _, store := range walletStores {
+		t.Run(store, func(t *testing.T) {
+			defer gock.Off()
+
+			pgms := []*model.PgRoutingMaster{
+				{Currency: "USD", CountryCode: "US", PaymentGateway: "PGA", Active: true, Priority: 0},
+			}
+			processor := newProcessor(t, store, pgms)
+
+			gock.New("http://pgsa.com").
+				Post("/deposit").
+				Times(2).
+				Reply(http.StatusOK).
+				JSON(map[string]string{"status": "success", "message": "Transaction processed successfully"})
+			voided, err := processor.Deposit(&model.PaymentRequest{UserID: "123", Amount: 100, Currency: "USD", CountryCode: "US"})
+			assert.NoError(t, err)
+			approved, err := processor.Deposit(&model.PaymentRequest{UserID: "123", Amount: 100, Currency: "USD", CountryCode: "US"})
+			assert.NoError(t, err)
+
+			// the gateway refuses the first cancellation
+			gock.New("http://pgsa.com").
+				Post("/cancel").
+				Reply(http.StatusOK).
+				JSON(map[string]string{"status": "failed", "message": "already settled"})
+			_, err = processor.Void(voided.TransactionID, service.SourceAPI)
+			assert.ErrorIs(t, err, model.ErrConflict)
+			txn, err := processor.WalletRepo.GetTransaction(voided.TransactionID)
+			assert.NoError(t, err)
+			assert.Equal(t, model.StateAuthorized, txn.State)
+
+			gock.New("http://pgsa.com").
+				Post("/cancel").
+				MatchType("json").
+				JSON(map[string]string{"id": voided.TransactionID}).
+				Reply(http.StatusOK).
+				JSON(map[string]string{"status": "success"})
+			txn, err = processor.Void(voided.TransactionID, service.SourceAPI)
+			assert.NoError(t, err)
+			assert.Equal(t, model.StateVoided, txn.State)
+			assert.True(t, gock.IsDone())
+
+			// voiding again does not call the gateway
+			_, err = processor.Void(voided.TransactionID, service.SourceAPI)
+			assert.NoError(t, err)
+
+			// a late callback is rejected and flagged, the wallet is untouched
+			err = processor.HandleCallback(&model.CallbackRequest{TransactionID: voided.TransactionID, State: model.StateApproved})
+			assert.ErrorIs(t, err, model.ErrConflict)
+			txn = storedTransaction(t, processor, voided.TransactionID)
+			assert.Equal(t, model.StateVoided, txn.State)
+			assert.Equal(t, model.StateApproved, txn.LateCallback)
+			wallet, err := processor.GetBalance("123", "USD")
+			assert.NoError(t, err)
+			assert.Equal(t, int64(0), wallet.Balance)
+
+			// settled transactions cannot be voided
+			assert.NoError(t, processor.HandleCallback(&model.CallbackRequest{TransactionID: approved.TransactionID, State: model.StateApproved}))
+			_, err = processor.Void(approved.TransactionID, service.SourceAPI)
+			assert.ErrorIs(t, err, model.ErrValidation)
+		})
+	}
+}
+
+// TestPaymentProcessor_VoidRefusedDuringCallback verifies that a callback approving the
+// transaction while its cancellation is refused is kept, the refusal only records the attempt.
+func TestPaymentProcessor_VoidRefusedDuringCallback(t *testing.T) {
+	for _, store := range walletStores {
+		t.Run(store, func(t *testing.T) {
+			defer gock.Off()
+			gock.DisableNetworking()
+
+			pgms := []*model.PgRoutingMaster{
+				{Currency: "USD", CountryCode: "US", PaymentGateway: "PGA", Active: true, Priority: 0},
+			}
+			processor := newProcessor(t, store, pgms)
+
+			gock.New("http://pgsa.com").
+				Post("/deposit").
+				Reply(http.StatusOK).
+				JSON(map[string]string{"status": "success", "message": "Transaction processed successfully"})
+			deposit, err := processor.Deposit(&model.PaymentRequest{UserID: "123", Amount: 100, Currency: "USD", CountryCode: "US"})
+			assert.NoError(t, err)
+
+			gock.New("http://pgsa.com").
+				Post("/cancel").
+				Map(func(req *http.Request) *http.Request {
+					assert.NoError(t, processor.HandleCallback(&model.CallbackRequest{TransactionID: deposit.TransactionID, State: model.StateApproved}))
+					return req
+				}).
+				Reply(http.StatusOK).
+				JSON(map[string]string{"status": "failed", "message": "already settled"})
+			_, err = processor.Void(deposit.TransactionID, service.SourceAPI)
+			assert.ErrorIs(t, err, model.ErrConflict)
+
+			txn, err := processor.WalletRepo.GetTransaction(deposit.TransactionID)
+			assert.NoError(t, err)
+			assert.Equal(t, model.StateApproved, txn.State)
+			assert.Len(t, txn.Attempts, 2)
+
+			// the callback delivered again does not credit the wallet twice
+			assert.NoError(t, processor.HandleCallback(&model.CallbackRequest{TransactionID: deposit.TransactionID, State: model.StateApproved}))
+			wallet, err := processor.GetBalance("123", "USD")
+			assert.NoError(t, err)
+			assert.Equal(t, int64(100), wallet.Balance)
+		})
+	}
+}
+
+// TestPaymentProcessor_StateMachine verifies that callbacks are idempotent, that only legal
+// transitions are applied and that every transition is recorded with its source.
+func TestPaymentProcessor_StateMachine(t *testing.T) {
+	for _, store := range walletStores {
+		t.Run(store, func(t *testing.T) {
+			defer gock.Off()
+
+			pgms := []*model.PgRoutingMaster{
+				{Currency: "USD", CountryCode: "US", PaymentGateway: "PGA", Active: true, Priority: 0},
+			}
+			processor := newProcessor(t, store, pgms)
+
+			gock.New("http://pgsa.com").
+				Post("/deposit").
+				Reply(http.StatusOK).
+				JSON(map[string]string{"status": "success", "message": "Transaction processed successfully"})
+			response, err := processor.Deposit(&model.PaymentRequest{UserID: "123", Amount: 100, Currency: "USD", CountryCode: "US"})
+			assert.NoError(t, err)
+
+			callback := &model.CallbackRequest{TransactionID: response.TransactionID, State: model.StateApproved}
+			assert.NoError(t, processor.HandleCallback(callback))
+			// a duplicate callback does not credit the wallet twice
+			assert.NoError(t, processor.HandleCallback(callback))
+			wallet, err := processor.GetBalance("123", "USD")
+			assert.NoError(t, err)
+			assert.Equal(t, int64(100), wallet.Balance)
+
+			// an approved transaction cannot fail afterwards
+			err = processor.HandleCallback(&model.CallbackRequest{TransactionID: response.TransactionID, State: model.StateFailed})
+			assert.ErrorIs(t, err, model.ErrConflict)
+			err = processor.HandleCallback(&model.CallbackRequest{TransactionID: response.TransactionID, State: "settled"})
+			assert.ErrorIs(t, err, model.ErrValidation)
+
+			txn, err := processor.WalletRepo.GetTransaction(response.TransactionID)
+			assert.NoError(t, err)
+			assert.Equal(t, model.StateApproved, txn.State)
+			assert.Equal(t, model.StateFailed, txn.LateCallback)
+			var steps []string
+			for _, transition := range txn.Transitions {
+				assert.False(t, transition.At.IsZero())
+				steps = append(steps, transition.From+">"+transition.To+"@"+transition.Source)
+			}
+			assert.Equal(t, []string{">initiated@api", "initiated>authorized@api", "authorized>approved@callback"}, steps)
+		})
+	}
+}
+
+// TestPaymentProcessor_Idempotency verifies that a repeated idempotency key returns the
+// original response without paying twice and is rejected for a different request.
+func TestPaymentProcessor_Idempotency(t *testing.T) {
+	for _, store := range walletStores {
+		t.Run(store, func(t *testing.T) {
+			defer gock.Off()
+			gock.DisableNetworking()
+
+			pgms := []*model.PgRoutingMaster{
+				{Currency: "USD", CountryCode: "US", PaymentGateway: "PGA", Active: true, Priority: 0},
+			}
+			processor := newProcessor(t, store, pgms)
+			request := func(amount int64) *model.PaymentRequest {
+				return &model.PaymentRequest{UserID: "123", Amount: amount, Currency: "USD", CountryCode: "US", IdempotencyKey: "key-1"}
+			}
+
+			// a failed request releases its key
+			_, err := processor.Deposit(request(100))
+			assert.Error(t, err)
+
+			gock.New("http://pgsa.com").
+				Post("/deposit").
+				Reply(http.StatusOK).
+				JSON(map[string]string{"status": "success", "message": "Transaction processed successfully"})
+			first, err := processor.Deposit(request(100))
+			assert.NoError(t, err)
+			assert.True(t, gock.IsDone())
+
+			// the retry is answered without calling the gateway
+			retry, err := processor.Deposit(request(100))
+			assert.NoError(t, err)
+			assert.Equal(t, first, retry)
+
+			// the accepted transaction is found by its key, not the failed one before it
+			txn, err := processor.TransactionByIdempotencyKey("key-1")
+			assert.NoError(t, err)
+			assert.Equal(t, first.TransactionID, txn.ID)
+
+			_, err = processor.Deposit(request(200))
+			assert.ErrorIs(t, err, model.ErrIdempotencyMismatch)
+			_, err = processor.Withdraw(request(100))
+			assert.ErrorIs(t, err, model.ErrIdempotencyMismatch)
+		})
+	}
+}
+
+// TestPaymentProcessor_IdempotencyAccepted verifies that the key of a payment accepted by the
+// gateway is kept when the transaction cannot be stored, so a retry does not pay twice.
+func TestPaymentProcessor_IdempotencyAccepted(t *testing.T) {
+	for _, store := range walletStores {
+		t.Run(store, func(t *testing.T) {
+			defer gock.Off()
+			gock.DisableNetworking()
+
+			pgms := []*model.PgRoutingMaster{
+				{Currency: "USD", CountryCode: "US", PaymentGateway: "PGA", Active: true, Priority: 0},
+			}
+			processor := newProcessor(t, store, pgms)
+			walletRepo := &crashingRepo{WalletRepository: processor.WalletRepo, crash: true}
+			processor.WalletRepo = walletRepo
+			request := func() *model.PaymentRequest {
+				return &model.PaymentRequest{UserID: "123", Amount: 100, Currency: "USD", CountryCode: "US", IdempotencyKey: "key-1"}
+			}
+
+			gock.New("http://pgsa.com").
+				Post("/deposit").
+				Reply(http.StatusOK).
+				JSON(map[string]string{"status": "success", "message": "Transaction processed successfully"})
+			_, err := processor.Deposit(request())
+			assert.ErrorIs(t, err, model.ErrInternal)
+			assert.True(t, gock.IsDone())
+
+			// the retry is answered from the key, the gateway is not called again
+			walletRepo.crash = false
+			response, err := processor.Deposit(request())
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Equal(t, "success", response.Status)
+		})
 	}
+}
+
+// TestPaymentProcessor_StoredBeforeGateway verifies that a transaction is stored with its
+// gateway before the gateway is called, so a callback arriving before the gateway returns finds it and is
+// asked to retry, and that it is stored as failed when every gateway declines.
+func TestPaymentProcessor_StoredBeforeGateway(t *testing.T) {
+	for _, store := range walletStores {
+		t.Run(store, func(t *testing.T) {
+			defer gock.Off()
+			gock.DisableNetworking()
+
+			pgms := []*model.PgRoutingMaster{
+				{Currency: "USD", CountryCode: "US", PaymentGateway: "PGA", Active: true, Priority: 0},
+			}
+			processor := newProcessor(t, store, pgms)
+
+			var callbackErr error
+			gock.New("http://pgsa.com").
+				Post("/deposit").
+				Map(func(req *http.Request) *http.Request {
+					txns, err := processor.WalletRepo.ListTransactionsByState(model.StateInitiated)
+					if assert.NoError(t, err) && assert.Len(t, txns, 1) {
+						assert.Equal(t, "PGA", txns[0].Gateway, "Expected the gateway to be recorded before the call")
+						callbackErr = processor.HandleCallback(&model.CallbackRequest{TransactionID: txns[0].ID, State: model.StateApproved})
+					}
+					return req
+				}).
+				Reply(http.StatusOK).
+				JSON(map[string]string{"status": "success", "message": "Transaction processed successfully"})
+			deposit, err := processor.Deposit(&model.PaymentRequest{UserID: "123", Amount: 100, Currency: "USD", CountryCode: "US"})
+			assert.NoError(t, err)
+			assert.ErrorIs(t, callbackErr, model.ErrConflict)
+
+			// the callback delivered again is applied
+			assert.NoError(t, processor.HandleCallback(&model.CallbackRequest{TransactionID: deposit.TransactionID, State: model.StateApproved}))
+			txn, err := processor.WalletRepo.GetTransaction(deposit.TransactionID)
+			assert.NoError(t, err)
+			assert.Equal(t, model.StateApproved, txn.State)
+			assert.Empty(t, txn.LateCallback)
+
+			// a declined withdrawal is kept as failed and its hold released
+			gock.New("http://pgsa.com").
+				Post("/withdraw").
+				Reply(http.StatusBadRequest).
+				JSON(map[string]string{"status": "failed", "message": "declined"})
+			_, err = processor.Withdraw(&model.PaymentRequest{UserID: "123", Amount: 50, Currency: "USD", CountryCode: "US"})
+			assert.Error(t, err)
+			failed, err := processor.WalletRepo.ListTransactionsByState(model.StateFailed)
+			assert.NoError(t, err)
+			assert.Len(t, failed, 1)
+			wallet, err := processor.GetBalance("123", "USD")
+			assert.NoError(t, err)
+			assert.Equal(t, int64(100), wallet.Available())
+		})
+	}
+}
+
+// TestIdempotencyStore verifies that a key is reserved while in flight and expires after its TTL.
+func TestIdempotencyStore(t *testing.T) {
+	store := service.NewIdempotencyStore(20 * time.Millisecond)
+
+	response, err := store.Begin("key", "hash")
+	assert.NoError(t, err)
+	assert.Nil(t, response)
+
+	_, err = store.Begin("key", "hash")
+	assert.ErrorIs(t, err, model.ErrConflict)
+
+	store.Complete("key", &model.PaymentResponse{TransactionID: "txn-1"})
+	response, err = store.Begin("key", "hash")
+	assert.NoError(t, err)
+	assert.Equal(t, "txn-1", response.TransactionID)
+
+	time.Sleep(30 * time.Millisecond)
+	response, err = store.Begin("key", "other")
+	assert.NoError(t, err)
+	assert.Nil(t, response)
+}
+
+// TestPaymentProcessor_WithdrawHolds verifies that a withdrawal holds its amount right away,
+// so concurrent withdrawals cannot overdraw the wallet, and that the hold is captured on
+// approval and released on failure.
+func TestPaymentProcessor_WithdrawHolds(t *testing.T) {
+	for _, store := range walletStores {
+		t.Run(store, func(t *testing.T) {
+			defer gock.Off()
+			gock.DisableNetworking()
+
+			pgms := []*model.PgRoutingMaster{
+				{Currency: "USD", CountryCode: "US", PaymentGateway: "PGA", Active: true, Priority: 0},
+			}
+			processor := newProcessor(t, store, pgms)
+			pay := func(action string, amount int64) (*model.PaymentResponse, error) {
+				gock.New("http://pgsa.com").
+					Post("/" + action).
+					Reply(http.StatusOK).
+					JSON(map[string]string{"status": "success", "message": "Transaction processed successfully"})
+				request := &model.PaymentRequest{UserID: "123", Amount: amount, Currency: "USD", CountryCode: "US"}
+				if action == "deposit" {
+					return processor.Deposit(request)
+				}
+				return processor.Withdraw(request)
+			}
+			balance := func(ledger, available int64) {
+				wallet, err := processor.GetBalance("123", "USD")
+				assert.NoError(t, err)
+				assert.Equal(t, ledger, wallet.Balance)
+				assert.Equal(t, available, wallet.Available())
+			}
 
-	// Attempt deposit, expecting it to fall back to PGB after PGA fails
-	response, err := processor.Deposit(request)
+			deposit, err := pay("deposit", 100)
+			assert.NoError(t, err)
+			assert.NoError(t, processor.HandleCallback(&model.CallbackRequest{TransactionID: deposit.TransactionID, State: model.StateApproved}))
 
-	gock.Off()
-	fmt.Println(response, err)
-	assert.NoError(t, err, "Expected fallback to PGB with no error")
-	assert.Contains(t, "success", response.Status, "Expected successful response from PGB")
+			first, err := pay("withdraw", 60)
+			assert.NoError(t, err)
+			balance(100, 40)
+			_, err = processor.Withdraw(&model.PaymentRequest{UserID: "123", Amount: 60, Currency: "USD", CountryCode: "US"})
+			assert.ErrorIs(t, err, model.ErrValidation)
+
+			// the hold is captured on approval
+			assert.NoError(t, processor.HandleCallback(&model.CallbackRequest{TransactionID: first.TransactionID, State: model.StateApproved}))
+			balance(40, 40)
+
+			// and released on failure
+			second, err := pay("withdraw", 30)
+			assert.NoError(t, err)
+			balance(40, 10)
+			assert.NoError(t, processor.HandleCallback(&model.CallbackRequest{TransactionID: second.TransactionID, State: model.StateFailed}))
+			balance(40, 40)
+
+			// or when no gateway accepts the withdrawal
+			gock.Off()
+			_, err = processor.Withdraw(&model.PaymentRequest{UserID: "123", Amount: 40, Currency: "USD", CountryCode: "US"})
+			assert.Error(t, err)
+			balance(40, 40)
+		})
+	}
+}
+
+// TestPaymentProcessor_MultiCurrency verifies that each currency has its own
+// wallet and that amounts are rescaled to the minor unit of the currency.
+func TestPaymentProcessor_MultiCurrency(t *testing.T) {
+	for _, store := range walletStores {
+		t.Run(store, func(t *testing.T) {
+			defer gock.Off()
+			gock.DisableNetworking()
+
+			pgms := []*model.PgRoutingMaster{
+				{Currency: "USD", CountryCode: "US", PaymentGateway: "PGA", Active: true, Priority: 0},
+				{Currency: "AED", CountryCode: "AE", PaymentGateway: "PGA", Active: true, Priority: 0},
+			}
+			processor := newProcessor(t, store, pgms)
+			deposit := func(request *model.PaymentRequest) {
+				gock.New("http://pgsa.com").
+					Post("/deposit").
+					Reply(http.StatusOK).
+					JSON(map[string]string{"status": "success", "message": "Transaction processed successfully"})
+				response, err := processor.Deposit(request)
+				assert.NoError(t, err)
+				assert.NoError(t, processor.HandleCallback(&model.CallbackRequest{TransactionID: response.TransactionID, State: model.StateApproved}))
+			}
+
+			deposit(&model.PaymentRequest{UserID: "123", Amount: 1050, Currency: "USD", CountryCode: "US"})
+			// 5.0 AED is 500 fils and 2.5000 AED is 250 fils
+			deposit(&model.PaymentRequest{UserID: "123", Amount: 50, Exponent: 1, Currency: "AED", CountryCode: "AE"})
+			deposit(&model.PaymentRequest{UserID: "123", Amount: 25000, Exponent: 4, Currency: "AED", CountryCode: "AE"})
+
+			usd, err := processor.GetBalance("123", "USD")
+			assert.NoError(t, err)
+			assert.Equal(t, int64(1050), usd.Balance)
+			aed, err := processor.GetBalance("123", "AED")
+			assert.NoError(t, err)
+			assert.Equal(t, int64(750), aed.Balance)
+			assert.Equal(t, 2, aed.Exponent)
+
+			wallets, err := processor.ListWallets("123")
+			assert.NoError(t, err)
+			assert.Len(t, wallets, 2)
+			assert.Equal(t, "AED", wallets[0].Currency)
+			assert.Equal(t, "USD", wallets[1].Currency)
+
+			// a withdrawal is held against the wallet of its currency only
+			_, err = processor.Withdraw(&model.PaymentRequest{UserID: "123", Amount: 1000, Currency: "AED", CountryCode: "AE"})
+			assert.ErrorIs(t, err, model.ErrValidation)
+
+			// amounts finer than the minor unit are rejected rather than rounded
+			_, err = processor.Deposit(&model.PaymentRequest{UserID: "123", Amount: 10505, Exponent: 3, Currency: "USD", CountryCode: "US"})
+			assert.ErrorIs(t, err, model.ErrValidation)
+		})
+	}
+}
+
+// stubRates quotes a fixed rate for every pair, replaced between calls by the tests
+type stubRates struct {
+	rate    string
+	expired bool
+}
+
+func (s *stubRates) Quote(from, to string) (*fx.Quote, error) {
+	rate, err := fx.ParseRate(s.rate)
+	if err != nil {
+		return nil, err
+	}
+	expiresAt := time.Now().Add(time.Minute)
+	if s.expired {
+		expiresAt = time.Now().Add(-time.Second)
+	}
+	return &fx.Quote{ID: "quote-" + s.rate, From: from, To: to, Rate: rate, ExpiresAt: expiresAt}, nil
+}
+
+// TestPaymentProcessor_Conversion verifies that deposits and withdrawals into a wallet of
+// another currency are converted at a rate locked on the transaction, rounding in favour
+// of the wallet balance.
+func TestPaymentProcessor_Conversion(t *testing.T) {
+	for _, store := range walletStores {
+		t.Run(store, func(t *testing.T) {
+			defer gock.Off()
+			gock.DisableNetworking()
+
+			pgms := []*model.PgRoutingMaster{
+				{Currency: "EUR", CountryCode: "DE", PaymentGateway: "PGA", Active: true, Priority: 0},
+			}
+			processor := newProcessor(t, store, pgms)
+			pay := func(action string, amount int64) (*model.PaymentResponse, error) {
+				gock.New("http://pgsa.com").
+					Post("/" + action).
+					Reply(http.StatusOK).
+					JSON(map[string]string{"status": "success", "message": "Transaction processed successfully"})
+				request := &model.PaymentRequest{UserID: "123", Amount: amount, Currency: "EUR", CountryCode: "DE", WalletCurrency: "AED"}
+				if action == "deposit" {
+					return processor.Deposit(request)
+				}
+				return processor.Withdraw(request)
+			}
+			balance := func(currency string) int64 {
+				wallet, err := processor.GetBalance("123", currency)
+				assert.NoError(t, err)
+				return wallet.Balance
+			}
+
+			// conversions are rejected without a rate provider
+			_, err := processor.Deposit(&model.PaymentRequest{UserID: "123", Amount: 1001, Currency: "EUR", CountryCode: "DE", WalletCurrency: "AED"})
+			assert.ErrorIs(t, err, model.ErrValidation)
+
+			rates := &stubRates{rate: "4.0123"}
+			processor.Rates = rates
+			deposit, err := pay("deposit", 1001)
+			assert.NoError(t, err)
+			txn, err := processor.WalletRepo.GetTransaction(deposit.TransactionID)
+			assert.NoError(t, err)
+			assert.Equal(t, int64(1001), txn.Amount)
+			assert.Equal(t, "EUR", txn.Currency)
+			assert.Equal(t, int64(4016), txn.WalletAmount, "Expected the credit to be rounded down")
+			assert.Equal(t, "AED", txn.WalletCurrency)
+			assert.Equal(t, "4.0123", txn.Rate)
+			assert.Equal(t, "quote-4.0123", txn.QuoteID)
+
+			// the rate is locked, a later change does not alter the credit
+			rates.rate = "5"
+			assert.NoError(t, processor.HandleCallback(&model.CallbackRequest{TransactionID: deposit.TransactionID, State: model.StateApproved}))
+			assert.Equal(t, int64(4016), balance("AED"))
+			assert.Equal(t, int64(0), balance("EUR"))
+
+			rates.rate = "4.0123"
+			withdrawal, err := pay("withdraw", 500)
+			assert.NoError(t, err)
+			txn, err = processor.WalletRepo.GetTransaction(withdrawal.TransactionID)
+			assert.NoError(t, err)
+			assert.Equal(t, int64(2007), txn.WalletAmount, "Expected the debit to be rounded up")
+			assert.NoError(t, processor.HandleCallback(&model.CallbackRequest{TransactionID: withdrawal.TransactionID, State: model.StateApproved}))
+			assert.Equal(t, int64(2009), balance("AED"))
+
+			// a refund is debited at the rate locked on the deposit, rounded up
+			gock.New("http://pgsa.com").
+				Post("/refund").
+				Reply(http.StatusOK).
+				JSON(map[string]string{"status": "success", "message": "Refund processed successfully"})
+			refund, err := processor.Refund(&model.RefundRequest{TransactionID: deposit.TransactionID, Amount: 250})
+			assert.NoError(t, err)
+			txn, err = processor.WalletRepo.GetTransaction(refund.TransactionID)
+			assert.NoError(t, err)
+			assert.Equal(t, "AED", txn.WalletCurrency)
+			assert.Equal(t, int64(1004), txn.WalletAmount)
+			assert.NoError(t, processor.HandleCallback(&model.CallbackRequest{TransactionID: refund.TransactionID, State: model.StateApproved}))
+			assert.Equal(t, int64(1005), balance("AED"))
+
+			// expired quotes are not used
+			rates.expired = true
+			_, err = pay("deposit", 1000)
+			assert.ErrorIs(t, err, model.ErrValidation)
+		})
+	}
+}
+
+// TestPaymentProcessor_CurrencyRegistry verifies that payments follow the currency
+// registry: disabled currencies, amount limits and the minor unit of each currency.
+func TestPaymentProcessor_CurrencyRegistry(t *testing.T) {
+	for _, store := range walletStores {
+		t.Run(store, func(t *testing.T) {
+			defer gock.Off()
+			gock.DisableNetworking()
+			defer currency.Default().Configure(nil)
+
+			pgms := []*model.PgRoutingMaster{
+				{Currency: "USD", CountryCode: "US", PaymentGateway: "PGA", Active: true, Priority: 0},
+				{Currency: "JPY", CountryCode: "JP", PaymentGateway: "PGA", Active: true, Priority: 0},
+			}
+			processor := newProcessor(t, store, pgms)
+			deposit := func(code string, amount int64, exponent int) (*model.PaymentResponse, error) {
+				gock.New("http://pgsa.com").
+					Post("/deposit").
+					Reply(http.StatusOK).
+					JSON(map[string]string{"status": "success", "message": "Transaction processed successfully"})
+				country := code[:2]
+				return processor.Deposit(&model.PaymentRequest{UserID: "123", Amount: amount, Exponent: exponent, Currency: code, CountryCode: country})
+			}
+
+			// JPY is disabled by default
+			_, err := deposit("JPY", 1500, 0)
+			assert.ErrorIs(t, err, model.ErrValidation)
+
+			assert.NoError(t, currency.Default().Configure(map[string]currency.Settings{
+				"JPY": {MaxAmount: 100000},
+				"USD": {MinAmount: 100},
+			}))
+
+			// JPY has no minor unit, 1500.00 is 1500 yen and 1500.50 cannot be paid
+			response, err := deposit("JPY", 150000, 2)
+			assert.NoError(t, err)
+			txn, err := processor.WalletRepo.GetTransaction(response.TransactionID)
+			assert.NoError(t, err)
+			assert.Equal(t, int64(1500), txn.Amount)
+			assert.Equal(t, 0, txn.Exponent)
+			_, err = deposit("JPY", 150050, 2)
+			assert.ErrorIs(t, err, model.ErrValidation)
+
+			_, err = deposit("JPY", 100001, 0)
+			assert.ErrorIs(t, err, model.ErrValidation)
+			_, err = deposit("USD", 99, 0)
+			assert.ErrorIs(t, err, model.ErrValidation)
+			_, err = deposit("USD", 100, 0)
+			assert.NoError(t, err)
+
+			wallet, err := processor.GetBalance("123", "JPY")
+			assert.NoError(t, err)
+			assert.Equal(t, 0, wallet.Exponent)
+		})
+	}
+}
+
+// TestPaymentProcessor_Ledger verifies the journals posted for approved deposits,
+// withdrawals, fees and conversions, and that the wallet matches its ledger account.
+func TestPaymentProcessor_Ledger(t *testing.T) {
+	for _, store := range walletStores {
+		t.Run(store, func(t *testing.T) {
+			defer gock.Off()
+			gock.DisableNetworking()
+
+			pgms := []*model.PgRoutingMaster{
+				{Currency: "USD", CountryCode: "US", PaymentGateway: "PGA", Active: true, Priority: 0},
+				{Currency: "EUR", CountryCode: "DE", PaymentGateway: "PGA", Active: true, Priority: 0},
+			}
+			processor := newProcessor(t, store, pgms)
+			processor.Fees = map[string]model.Fee{"USD": {Fixed: 10, BasisPoints: 100}}
+			processor.Rates = &stubRates{rate: "1.25"}
+			pay := func(action string, request *model.PaymentRequest) string {
+				gock.New("http://pgsa.com").
+					Post("/" + action).
+					Reply(http.StatusOK).
+					JSON(map[string]string{"status": "success", "message": "Transaction processed successfully"})
+				var response *model.PaymentResponse
+				var err error
+				if action == "deposit" {
+					response, err = processor.Deposit(request)
+				} else {
+					response, err = processor.Withdraw(request)
+				}
+				assert.NoError(t, err)
+				assert.NoError(t, processor.HandleCallback(&model.CallbackRequest{TransactionID: response.TransactionID, State: model.StateApproved}))
+				return response.TransactionID
+			}
+			wallet := ledger.WalletAccount("123", "USD")
+
+			// 10.00 USD less a fee of 0.10 + 1%
+			deposit := pay("deposit", &model.PaymentRequest{UserID: "123", Amount: 1000, Currency: "USD", CountryCode: "US"})
+			entries, err := processor.LedgerEntries(wallet)
+			assert.NoError(t, err)
+			assert.Len(t, entries, 2)
+			assert.Equal(t, int64(1000), entries[0].Amount)
+			assert.Equal(t, deposit, entries[0].TransactionID)
+			assert.Equal(t, int64(-20), entries[1].Amount)
+			assert.Equal(t, "Fee", entries[1].Description)
+			assert.Equal(t, int64(-1000), ledgerBalance(t, processor, ledger.ClearingAccount("PGA", "USD")))
+			assert.Equal(t, int64(20), ledgerBalance(t, processor, ledger.FeeAccount("USD")))
+
+			// a withdrawal pays its fee on top
+			pay("withdraw", &model.PaymentRequest{UserID: "123", Amount: 500, Currency: "USD", CountryCode: "US"})
+			assert.Equal(t, int64(35), ledgerBalance(t, processor, ledger.FeeAccount("USD")))
+
+			// 4.00 EUR bought at 1.25 credits 5.00 USD through the FX accounts
+			pay("deposit", &model.PaymentRequest{UserID: "123", Amount: 400, Currency: "EUR", CountryCode: "DE", WalletCurrency: "USD"})
+			assert.Equal(t, int64(-400), ledgerBalance(t, processor, ledger.ClearingAccount("PGA", "EUR")))
+			assert.Equal(t, int64(400), ledgerBalance(t, processor, ledger.FXAccount("EUR")))
+			assert.Equal(t, int64(-500), ledgerBalance(t, processor, ledger.FXAccount("USD")))
+
+			balance, err := processor.GetBalance("123", "USD")
+			assert.NoError(t, err)
+			assert.Equal(t, int64(1000-20-500-15+500-15), balance.Balance)
+			assert.Equal(t, balance.Balance, ledgerBalance(t, processor, wallet))
+
+			_, err = processor.LedgerEntries("bank:123:USD")
+			assert.ErrorIs(t, err, model.ErrValidation)
+		})
+	}
+}
+
+// TestPaymentProcessor_SQLWalletRepo verifies the payment flows against the SQLite
+// wallet repository and that balances and transactions survive a restart.
+func TestPaymentProcessor_SQLWalletRepo(t *testing.T) {
+	defer gock.Off()
+	gock.DisableNetworking()
+
+	pgms := []*model.PgRoutingMaster{
+		{Currency: "USD", CountryCode: "US", PaymentGateway: "PGA", Active: true, Priority: 0},
+	}
+	dsn := "file:" + filepath.Join(t.TempDir(), "wallets.db")
+	open := func() *service.PaymentProcessor {
+		db, err := database.OpenSQLite(dsn)
+		assert.NoError(t, err)
+		t.Cleanup(func() { db.Close() })
+		walletRepo, err := database.NewSQLWalletRepo(db)
+		assert.NoError(t, err)
+		processor := service.NewPaymentProcessor(pgms).(*service.PaymentProcessor)
+		processor.WalletRepo = walletRepo
+		return processor
+	}
+	processor := open()
+	pay := func(action string, amount int64) string {
+		gock.New("http://pgsa.com").
+			Post("/" + action).
+			Reply(http.StatusOK).
+			JSON(map[string]string{"status": "success", "message": "Transaction processed successfully"})
+		request := &model.PaymentRequest{UserID: "123", Amount: amount, Currency: "USD", CountryCode: "US"}
+		var response *model.PaymentResponse
+		var err error
+		if action == "deposit" {
+			response, err = processor.Deposit(request)
+		} else {
+			response, err = processor.Withdraw(request)
+		}
+		assert.NoError(t, err)
+		return response.TransactionID
+	}
+
+	deposit := pay("deposit", 100)
+	assert.NoError(t, processor.HandleCallback(&model.CallbackRequest{TransactionID: deposit, State: model.StateApproved}))
+	assert.NoError(t, processor.HandleCallback(&model.CallbackRequest{TransactionID: deposit, State: model.StateApproved}))
+	withdrawal := pay("withdraw", 60)
+	_, err := processor.Withdraw(&model.PaymentRequest{UserID: "123", Amount: 60, Currency: "USD", CountryCode: "US"})
+	assert.ErrorIs(t, err, model.ErrValidation)
+
+	wallet, err := processor.GetBalance("123", "USD")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(100), wallet.Balance)
+	assert.Equal(t, int64(40), wallet.Available())
+
+	// the pending withdrawal is settled after a restart
+	processor = open()
+	assert.NoError(t, processor.HandleCallback(&model.CallbackRequest{TransactionID: withdrawal, State: model.StateApproved}))
+	wallet, err = processor.GetBalance("123", "USD")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(40), wallet.Balance)
+	assert.Equal(t, int64(0), wallet.Held)
+	assert.Equal(t, wallet.Balance, ledgerBalance(t, processor, ledger.WalletAccount("123", "USD")), "Expected the ledger to survive the restart")
+
+	txn, err := processor.WalletRepo.GetTransaction(deposit)
+	assert.NoError(t, err)
+	assert.Equal(t, model.StateApproved, txn.State)
+	assert.Len(t, txn.Transitions, 3)
+}
+
+// TestPaymentProcessor_RejectedJournal verifies that a settlement whose journal the
+// ledger rejects fails and leaves the wallet and the transaction untouched.
+func TestPaymentProcessor_RejectedJournal(t *testing.T) {
+	for _, store := range walletStores {
+		t.Run(store, func(t *testing.T) {
+			defer gock.Off()
+			gock.DisableNetworking()
+
+			pgms := []*model.PgRoutingMaster{
+				{Currency: "USD", CountryCode: "US", PaymentGateway: "PGA", Active: true, Priority: 0},
+			}
+			processor := newProcessor(t, store, pgms)
+			gock.New("http://pgsa.com").
+				Post("/deposit").
+				Reply(http.StatusOK).
+				JSON(map[string]string{"status": "success", "message": "Transaction processed successfully"})
+			deposit, err := processor.Deposit(&model.PaymentRequest{UserID: "123", Amount: 100, Currency: "USD", CountryCode: "US"})
+			assert.NoError(t, err)
+
+			// a journal with the ID of the transaction is already posted
+			err = processor.WalletRepo.WithTx(func(tx model.WalletTx) error {
+				return tx.PostJournal(&ledger.Journal{ID: deposit.TransactionID, Description: "Adjustment", Postings: []ledger.Posting{
+					{Account: ledger.ClearingAccount("PGA", "USD"), Currency: "USD", Amount: -1},
+					{Account: ledger.FeeAccount("USD"), Currency: "USD", Amount: 1},
+				}})
+			})
+			assert.NoError(t, err)
+
+			err = processor.HandleCallback(&model.CallbackRequest{TransactionID: deposit.TransactionID, State: model.StateApproved})
+			assert.ErrorIs(t, err, model.ErrConflict)
+			wallet, err := processor.GetBalance("123", "USD")
+			assert.NoError(t, err)
+			assert.Equal(t, int64(0), wallet.Balance, "Expected the wallet not to be credited without its journal")
+			assert.Equal(t, model.StateAuthorized, storedTransaction(t, processor, deposit.TransactionID).State)
+			assert.Equal(t, int64(0), ledgerBalance(t, processor, ledger.WalletAccount("123", "USD")))
+			assert.Equal(t, int64(-1), ledgerBalance(t, processor, ledger.ClearingAccount("PGA", "USD")))
+		})
+	}
+}
+
+// crashingRepo fails the transaction writes of its units of work while crash is set
+type crashingRepo struct {
+	model.WalletRepository
+	crash bool
+}
+
+func (r *crashingRepo) WithTx(fn func(tx model.WalletTx) error) error {
+	return r.WalletRepository.WithTx(func(tx model.WalletTx) error {
+		return fn(&crashingTx{WalletTx: tx, crash: r.crash})
+	})
+}
+
+type crashingTx struct {
+	model.WalletTx
+	crash bool
+}
+
+func (tx *crashingTx) UpdateTransaction(txn *model.Transaction) error {
+	if tx.crash {
+		return model.WrapError(model.ErrInternal, "crash")
+	}
+	return tx.WalletTx.UpdateTransaction(txn)
+}
+
+// TestPaymentProcessor_AtomicSettlement verifies that a callback whose transaction
+// cannot be stored leaves the wallet untouched, so it can be applied again.
+func TestPaymentProcessor_AtomicSettlement(t *testing.T) {
+	for _, store := range walletStores {
+		t.Run(store, func(t *testing.T) {
+			defer gock.Off()
+			gock.DisableNetworking()
+
+			pgms := []*model.PgRoutingMaster{
+				{Currency: "USD", CountryCode: "US", PaymentGateway: "PGA", Active: true, Priority: 0},
+			}
+			processor := newProcessor(t, store, pgms)
+			walletRepo := &crashingRepo{WalletRepository: processor.WalletRepo}
+			processor.WalletRepo = walletRepo
+			gock.New("http://pgsa.com").
+				Post("/deposit").
+				Reply(http.StatusOK).
+				JSON(map[string]string{"status": "success", "message": "Transaction processed successfully"})
+			deposit, err := processor.Deposit(&model.PaymentRequest{UserID: "123", Amount: 100, Currency: "USD", CountryCode: "US"})
+			assert.NoError(t, err)
+
+			walletRepo.crash = true
+			err = processor.HandleCallback(&model.CallbackRequest{TransactionID: deposit.TransactionID, State: model.StateApproved})
+			assert.ErrorIs(t, err, model.ErrInternal)
+			wallet, err := processor.GetBalance("123", "USD")
+			assert.NoError(t, err)
+			assert.Equal(t, int64(0), wallet.Balance, "Expected the wallet not to be credited without the transaction")
+			txn, err := processor.WalletRepo.GetTransaction(deposit.TransactionID)
+			assert.NoError(t, err)
+			assert.Equal(t, model.StateAuthorized, txn.State)
+			assert.Equal(t, int64(0), ledgerBalance(t, processor, ledger.WalletAccount("123", "USD")))
+
+			// the callback is delivered again
+			walletRepo.crash = false
+			assert.NoError(t, processor.HandleCallback(&model.CallbackRequest{TransactionID: deposit.TransactionID, State: model.StateApproved}))
+			assert.NoError(t, processor.HandleCallback(&model.CallbackRequest{TransactionID: deposit.TransactionID, State: model.StateApproved}))
+			wallet, err = processor.GetBalance("123", "USD")
+			assert.NoError(t, err)
+			assert.Equal(t, int64(100), wallet.Balance)
+			assert.Equal(t, model.StateApproved, storedTransaction(t, processor, deposit.TransactionID).State)
+			assert.Equal(t, int64(100), ledgerBalance(t, processor, ledger.WalletAccount("123", "USD")))
+		})
+	}
 }
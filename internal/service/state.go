@@ -0,0 +1,300 @@
+package service
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/wajidp/micro-payment-gateway/internal/logger"
+	"github.com/wajidp/micro-payment-gateway/internal/service/model"
+)
+
+// Sources of a state transition
+const (
+	SourceAPI      = "api"
+	SourceCallback = "callback"
+	SourcePoller   = "poller"
+	SourceAdmin    = "admin"
+)
+
+// transitions lists the states a transaction may move to from each state,
+// the empty state is a transaction being created. States without an entry are final.
+var transitions = map[string][]string{
+	"":                    {model.StateInitiated},
+	model.StateInitiated:  {model.StateAuthorized, model.StateFailed, model.StateExpired},
+	model.StateAuthorized: {model.StateApproved, model.StateFailed, model.StateVoided, model.StateExpired},
+	model.StateApproved:   {model.StateRefunded},
+}
+
+// canTransition reports whether a transaction may move from one state to another
+func canTransition(from, to string) bool {
+	for _, state := range transitions[from] {
+		if state == to {
+			return true
+		}
+	}
+	return false
+}
+
+// transition moves the transaction to a new state and records the change,
+// an illegal transition leaves the transaction untouched
+func transition(txn *model.Transaction, to, source string) error {
+	if !canTransition(txn.State, to) {
+		return model.WrapError(model.ErrConflict, fmt.Sprintf("transaction %s cannot move from %s to %s", txn.ID, txn.State, to))
+	}
+	txn.Transitions = append(txn.Transitions, model.Transition{From: txn.State, To: to, At: time.Now(), Source: source})
+	txn.State = to
+	return nil
+}
+
+// reached reports whether the transaction is or has been in the state
+func reached(txn *model.Transaction, state string) bool {
+	if txn.State == state {
+		return true
+	}
+	for _, t := range txn.Transitions {
+		if t.To == state {
+			return true
+		}
+	}
+	return false
+}
+
+// settle applies a final state reported by the gateway, through a callback or
+// the poller. A state the transaction has already been in is ignored so that
+// duplicate callbacks are harmless, the wallet changes once on approval. The
+// wallet, the hold, the transaction and its ledger journals are stored in one
+// unit of work, a journal the ledger rejects fails the settlement.
+func (p *PaymentProcessor) settle(txnID, state, source string) error {
+	switch state {
+	case model.StateApproved, model.StateFailed:
+	default:
+		return model.WrapError(model.ErrValidation, fmt.Sprintf("invalid state %s", state))
+	}
+
+	p.stateMu.Lock()
+	defer p.stateMu.Unlock()
+
+	var rejected error
+	err := p.WalletRepo.WithTx(func(tx model.WalletTx) error {
+		txn, err := tx.GetTransaction(txnID)
+		if err != nil {
+			return err
+		}
+		if reached(txn, state) {
+			logger.Infof("Duplicate %s %s for transaction %s ignored", source, state, txn.ID)
+			return nil
+		}
+		if txn.State == model.StateInitiated {
+			// the gateway call has not returned yet, the callback is delivered again
+			rejected = model.WrapError(model.ErrConflict, fmt.Sprintf("transaction %s is not authorized yet", txn.ID))
+			return nil
+		}
+		if !canTransition(txn.State, state) {
+			rejected = model.WrapError(model.ErrConflict, fmt.Sprintf("transaction is %s", txn.State))
+			return p.rejectSettlement(tx, txn, state, source)
+		}
+
+		if state == model.StateApproved {
+			if err := p.applyToWallet(tx, txn); err != nil {
+				return err
+			}
+		}
+		if err := transition(txn, state, source); err != nil {
+			return err
+		}
+		if state == model.StateFailed {
+			p.releaseHold(tx, txn)
+		}
+		if err := tx.UpdateTransaction(txn); err != nil {
+			return err
+		}
+
+		if state == model.StateApproved && txn.Type == ActionRefund {
+			return p.markRefunded(tx, txn.ParentID, source)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return rejected
+}
+
+// applyToWallet credits the wallet amount less the fee to the wallet of the
+// transaction for an approved deposit and captures the hold of an approved
+// debit, then posts the journals recording the transaction in the ledger.
+func (p *PaymentProcessor) applyToWallet(tx model.WalletTx, txn *model.Transaction) error {
+	if txn.Type != ActionDeposit && !isDebit(txn.Type) {
+		return nil
+	}
+
+	if isDebit(txn.Type) {
+		if err := tx.CaptureHold(txn.ID); err != nil {
+			return err
+		}
+	} else {
+		wallet, err := tx.GetWallet(txn.UserID, txn.WalletCurrency)
+		if err != nil {
+			return err
+		}
+		wallet.Balance += txn.WalletAmount - txn.Fee
+		if err := tx.UpdateWallet(txn.UserID, txn.WalletCurrency, wallet); err != nil {
+			return err
+		}
+	}
+	return p.postToLedger(tx, txn)
+}
+
+// isDebit reports whether a transaction of the type takes funds out of the wallet
+func isDebit(txnType string) bool {
+	return txnType == ActionWithdraw || txnType == ActionRefund
+}
+
+// releaseHold returns the funds held for a debit which will not be settled,
+// through the repository or a unit of work of it
+func (p *PaymentProcessor) releaseHold(holds interface{ ReleaseHold(holdID string) error }, txn *model.Transaction) {
+	if !isDebit(txn.Type) {
+		return
+	}
+	if err := holds.ReleaseHold(txn.ID); err != nil {
+		logger.Errorf("Failed to release hold of transaction %s: %v", txn.ID, err)
+	}
+}
+
+// markRefunded moves a deposit to refunded once its approved refunds cover its amount
+func (p *PaymentProcessor) markRefunded(tx model.WalletTx, parentID, source string) error {
+	parent, err := tx.GetTransaction(parentID)
+	if err != nil {
+		return err
+	}
+	refunds, err := tx.ListTransactionsByParent(parentID)
+	if err != nil {
+		return err
+	}
+	var refunded int64
+	for _, refund := range refunds {
+		if refund.Type == ActionRefund && refund.State == model.StateApproved {
+			refunded += refund.Amount
+		}
+	}
+	if refunded < parent.Amount || !canTransition(parent.State, model.StateRefunded) {
+		return nil
+	}
+	if err := transition(parent, model.StateRefunded, source); err != nil {
+		return err
+	}
+	return tx.UpdateTransaction(parent)
+}
+
+// rejectSettlement flags a final state reported for a transaction which has
+// already ended otherwise, the wallet is left untouched
+func (p *PaymentProcessor) rejectSettlement(tx model.WalletTx, txn *model.Transaction, state, source string) error {
+	logger.Warnf("%s %s rejected for %s transaction %s", source, state, txn.State, txn.ID)
+	txn.LateCallback = state
+	return tx.UpdateTransaction(txn)
+}
+
+// authorize moves a transaction accepted by its gateway from initiated to
+// authorized, recording the gateway and the attempts made by the caller on the
+// stored transaction
+func (p *PaymentProcessor) authorize(txnID, gatewayName, source string, attempts []model.Attempt) error {
+	p.stateMu.Lock()
+	defer p.stateMu.Unlock()
+
+	return p.WalletRepo.WithTx(func(tx model.WalletTx) error {
+		txn, err := tx.GetTransaction(txnID)
+		if err != nil {
+			return err
+		}
+		if attempts != nil {
+			txn.Attempts = attempts
+		}
+		if gatewayName != "" {
+			txn.Gateway = gatewayName
+		}
+		if err := transition(txn, model.StateAuthorized, source); err != nil {
+			return err
+		}
+		return tx.UpdateTransaction(txn)
+	})
+}
+
+// fail moves a transaction no gateway accepted to failed and releases its
+// hold, recording the gateway which declined it and the attempts made by the
+// caller on the stored transaction
+func (p *PaymentProcessor) fail(txnID, gatewayName, source string, attempts []model.Attempt) error {
+	p.stateMu.Lock()
+	defer p.stateMu.Unlock()
+
+	return p.WalletRepo.WithTx(func(tx model.WalletTx) error {
+		txn, err := tx.GetTransaction(txnID)
+		if err != nil {
+			return err
+		}
+		if attempts != nil {
+			txn.Attempts = attempts
+		}
+		if gatewayName != "" {
+			txn.Gateway = gatewayName
+		}
+		if err := transition(txn, model.StateFailed, source); err != nil {
+			return err
+		}
+		p.releaseHold(tx, txn)
+		return tx.UpdateTransaction(txn)
+	})
+}
+
+// recordAttempts stores the gateway attempts made for a transaction on the
+// stored transaction, leaving its state as it is by now
+func (p *PaymentProcessor) recordAttempts(txnID string, attempts []model.Attempt) error {
+	p.stateMu.Lock()
+	defer p.stateMu.Unlock()
+
+	return p.WalletRepo.WithTx(func(tx model.WalletTx) error {
+		txn, err := tx.GetTransaction(txnID)
+		if err != nil {
+			return err
+		}
+		txn.Attempts = attempts
+		return tx.UpdateTransaction(txn)
+	})
+}
+
+// recordGateway stores the gateway an initiated transaction is about to be sent
+// to, so that the reconciler can ask it about a call which never returned
+func (p *PaymentProcessor) recordGateway(txnID, gatewayName string) error {
+	p.stateMu.Lock()
+	defer p.stateMu.Unlock()
+
+	return p.WalletRepo.WithTx(func(tx model.WalletTx) error {
+		txn, err := tx.GetTransaction(txnID)
+		if err != nil {
+			return err
+		}
+		if txn.State != model.StateInitiated || txn.Gateway == gatewayName {
+			return nil
+		}
+		txn.Gateway = gatewayName
+		return tx.UpdateTransaction(txn)
+	})
+}
+
+// expire moves a transaction still initiated or authorized to expired and
+// releases its hold
+func (p *PaymentProcessor) expire(txnID, source string) error {
+	p.stateMu.Lock()
+	defer p.stateMu.Unlock()
+
+	return p.WalletRepo.WithTx(func(tx model.WalletTx) error {
+		txn, err := tx.GetTransaction(txnID)
+		if err != nil {
+			return err
+		}
+		if err := transition(txn, model.StateExpired, source); err != nil {
+			return err
+		}
+		p.releaseHold(tx, txn)
+		return tx.UpdateTransaction(txn)
+	})
+}
@@ -0,0 +1,242 @@
+package service
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/wajidp/micro-payment-gateway/internal/logger"
+	"github.com/wajidp/micro-payment-gateway/internal/service/model"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Routing strategy names
+const (
+	StrategyPriority = "priority"
+	StrategySmart    = "smart"
+)
+
+// RoutingStrategy orders the routes matching a request, the processor tries
+// them in the returned order and falls back to the next one on failure
+type RoutingStrategy interface {
+	Order(request *model.PaymentRequest, routes []*model.PgRoutingMaster) []*model.PgRoutingMaster
+}
+
+// PriorityRouting keeps the Priority order and applies the traffic split of
+// each priority group
+type PriorityRouting struct{}
+
+// Order implements RoutingStrategy
+func (PriorityRouting) Order(request *model.PaymentRequest, routes []*model.PgRoutingMaster) []*model.PgRoutingMaster {
+	return splitRoutes(routes, request.UserID)
+}
+
+// GatewayStats is the recent outcome of a gateway, the success and failure
+// counts decay over time so that recent calls weigh more than old ones
+type GatewayStats struct {
+	Successes    float64
+	Failures     float64
+	AvgLatencyMs float64
+}
+
+// StatsProvider gives access to live gateway statistics
+type StatsProvider interface {
+	GatewayStats(gateway string) GatewayStats
+}
+
+// ScoreWeights balances the components of the smart routing score
+type ScoreWeights struct {
+	SuccessRate float64
+	Latency     float64
+	Cost        float64
+}
+
+// DefaultScoreWeights favours gateways that succeed, then cheaper and faster ones
+var DefaultScoreWeights = ScoreWeights{SuccessRate: 0.5, Latency: 0.2, Cost: 0.3}
+
+// referenceLatencyMs is the latency which halves the latency score
+const referenceLatencyMs = 500.0
+
+// SmartRouting orders routes by a score combining success rate, latency and fee
+type SmartRouting struct {
+	Stats   StatsProvider
+	Fees    model.FeeSchedule
+	Weights ScoreWeights
+}
+
+// NewSmartRouting creates the smart routing strategy with the default weights
+func NewSmartRouting(stats StatsProvider, fees model.FeeSchedule) *SmartRouting {
+	return &SmartRouting{Stats: stats, Fees: fees, Weights: DefaultScoreWeights}
+}
+
+// routeScore is the score breakdown of one route
+type routeScore struct {
+	route   *model.PgRoutingMaster
+	success float64
+	latency float64
+	cost    float64
+	fee     int64
+	total   float64
+}
+
+// MarshalLogObject implements the zapcore.ObjectMarshaler interface
+func (s *routeScore) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddString("gateway", s.route.PaymentGateway)
+	enc.AddFloat64("success_score", s.success)
+	enc.AddFloat64("latency_score", s.latency)
+	enc.AddFloat64("cost_score", s.cost)
+	enc.AddInt64("fee", s.fee)
+	enc.AddFloat64("total", s.total)
+	return nil
+}
+
+// Order implements RoutingStrategy, highest score first and Priority on ties
+func (s *SmartRouting) Order(request *model.PaymentRequest, routes []*model.PgRoutingMaster) []*model.PgRoutingMaster {
+	scores := make([]*routeScore, len(routes))
+	var minFee, maxFee int64
+	for i, route := range routes {
+		stats := s.Stats.GatewayStats(route.PaymentGateway)
+		score := &routeScore{route: route}
+
+		// Laplace smoothing so a gateway without history scores 0.5
+		score.success = (stats.Successes + 1) / (stats.Successes + stats.Failures + 2)
+		score.latency = 1 / (1 + stats.AvgLatencyMs/referenceLatencyMs)
+		score.fee, _ = s.Fees.Fee(route.PaymentGateway, request.Currency, request.Amount)
+
+		if i == 0 || score.fee < minFee {
+			minFee = score.fee
+		}
+		if i == 0 || score.fee > maxFee {
+			maxFee = score.fee
+		}
+		scores[i] = score
+	}
+
+	for _, score := range scores {
+		score.cost = 1
+		if maxFee > minFee {
+			score.cost = 1 - float64(score.fee-minFee)/float64(maxFee-minFee)
+		}
+		score.total = s.Weights.SuccessRate*score.success + s.Weights.Latency*score.latency + s.Weights.Cost*score.cost
+	}
+
+	sort.SliceStable(scores, func(i, j int) bool {
+		return scores[i].total > scores[j].total
+	})
+
+	ordered := make([]*model.PgRoutingMaster, len(scores))
+	fields := make([]zap.Field, 0, len(scores)+1)
+	fields = append(fields, zap.String("currency", request.Currency))
+	for i, score := range scores {
+		ordered[i] = score.route
+		fields = append(fields, zap.Object(fmt.Sprintf("rank_%d", i+1), score))
+	}
+	logger.SInfof("Smart routing decision", fields...)
+
+	return ordered
+}
+
+// gatewayStats keeps the recent outcomes of each gateway: an exponentially
+// weighted moving average of the latency and success and failure counts which
+// halve every outcomeHalfLife
+type gatewayStats struct {
+	mu       sync.Mutex
+	gateways map[string]*gatewayOutcomes
+}
+
+// gatewayOutcomes are the outcomes of one gateway as of updated
+type gatewayOutcomes struct {
+	avgLatencyMs float64
+	successes    float64
+	failures     float64
+	updated      time.Time
+}
+
+// latencySmoothing is the weight of the newest sample in the moving average
+const latencySmoothing = 0.2
+
+// outcomeHalfLife is the time after which an outcome counts half
+const outcomeHalfLife = 10 * time.Minute
+
+// decayed returns the success and failure counts as of now
+func (o *gatewayOutcomes) decayed(now time.Time) (successes, failures float64) {
+	elapsed := now.Sub(o.updated)
+	if elapsed <= 0 {
+		return o.successes, o.failures
+	}
+	factor := math.Pow(0.5, float64(elapsed)/float64(outcomeHalfLife))
+	return o.successes * factor, o.failures * factor
+}
+
+// record adds the outcome of a gateway call which completed at now
+func (s *gatewayStats) record(gateway string, latencyMs int64, success bool, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.gateways == nil {
+		s.gateways = make(map[string]*gatewayOutcomes)
+	}
+	o, ok := s.gateways[gateway]
+	if !ok {
+		o = &gatewayOutcomes{avgLatencyMs: float64(latencyMs), updated: now}
+		s.gateways[gateway] = o
+	} else {
+		o.avgLatencyMs += latencySmoothing * (float64(latencyMs) - o.avgLatencyMs)
+	}
+
+	o.successes, o.failures = o.decayed(now)
+	if now.After(o.updated) {
+		o.updated = now
+	}
+	if success {
+		o.successes++
+	} else {
+		o.failures++
+	}
+}
+
+// get returns the outcomes of a gateway as of now
+func (s *gatewayStats) get(gateway string, now time.Time) GatewayStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, ok := s.gateways[gateway]
+	if !ok {
+		return GatewayStats{}
+	}
+	successes, failures := o.decayed(now)
+	return GatewayStats{Successes: successes, Failures: failures, AvgLatencyMs: o.avgLatencyMs}
+}
+
+// GatewayStats implements StatsProvider from the decaying outcomes of the calls made to the gateway
+func (p *PaymentProcessor) GatewayStats(gateway string) GatewayStats {
+	return p.stats.get(gateway, time.Now())
+}
+
+// LoadFeeSchedule reads the fee schedule from a YAML or JSON file of the form
+// gateway -> currency -> {fixed, basis_points}
+func LoadFeeSchedule(path string) (model.FeeSchedule, error) {
+	v := viper.New()
+	v.SetConfigFile(path)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, err
+	}
+
+	raw := model.FeeSchedule{}
+	if err := v.Unmarshal(&raw); err != nil {
+		return nil, err
+	}
+
+	// viper lower cases keys, gateways and currencies are upper case
+	fees := make(model.FeeSchedule, len(raw))
+	for gateway, currencies := range raw {
+		fees[strings.ToUpper(gateway)] = make(map[string]model.Fee, len(currencies))
+		for currency, fee := range currencies {
+			fees[strings.ToUpper(gateway)][strings.ToUpper(currency)] = fee
+		}
+	}
+	return fees, nil
+}
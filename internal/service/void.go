@@ -0,0 +1,91 @@
+package service
+
+import (
+	"fmt"
+
+	"github.com/wajidp/micro-payment-gateway/internal/logger"
+	"github.com/wajidp/micro-payment-gateway/internal/service/gateway"
+	"github.com/wajidp/micro-payment-gateway/internal/service/model"
+)
+
+// Void cancels a transaction which is authorized but not yet settled. The
+// gateway is asked to cancel it when it supports cancellation, the transaction
+// stays authorized if the gateway refuses. The ledger balance is untouched since
+// it only changes on approval, the hold of a debit is released. Voiding a voided
+// transaction is a no-op.
+func (p *PaymentProcessor) Void(txnID, source string) (*model.Transaction, error) {
+	txn, err := p.WalletRepo.GetTransaction(txnID)
+	if err != nil {
+		return nil, err
+	}
+
+	switch txn.State {
+	case model.StateVoided:
+		return txn, nil
+	case model.StateAuthorized:
+	default:
+		return nil, model.WrapError(model.ErrValidation, fmt.Sprintf("transaction is %s, only authorized transactions can be voided", txn.State))
+	}
+
+	if err := p.cancelAtGateway(txn); err != nil {
+		// keep the attempt on the transaction, a callback may have settled it meanwhile
+		if updateErr := p.recordAttempts(txnID, txn.Attempts); updateErr != nil {
+			logger.Infof("failed to store transaction %s: %v", txn.ID, updateErr)
+		}
+		return nil, err
+	}
+
+	// a callback may have settled the transaction during the cancellation
+	p.stateMu.Lock()
+	defer p.stateMu.Unlock()
+	attempts := txn.Attempts
+	err = p.WalletRepo.WithTx(func(tx model.WalletTx) error {
+		txn, err := tx.GetTransaction(txnID)
+		if err != nil {
+			return err
+		}
+		txn.Attempts = attempts
+		if err := transition(txn, model.StateVoided, source); err != nil {
+			logger.Warnf("Transaction %s cancelled at PG %s but %s locally", txn.ID, txn.Gateway, txn.State)
+			return err
+		}
+		p.releaseHold(tx, txn)
+		return tx.UpdateTransaction(txn)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return p.WalletRepo.GetTransaction(txnID)
+}
+
+// cancelAtGateway calls the cancel API of the gateway which accepted the
+// transaction. Gateways without one are skipped, the transaction is only voided
+// locally. Cancellations are not retried.
+func (p *PaymentProcessor) cancelAtGateway(txn *model.Transaction) error {
+	if txn.Gateway == "" {
+		return nil
+	}
+	capabilities, err := p.Factory.Capabilities(txn.Gateway)
+	if err != nil {
+		return err
+	}
+	if !capabilities.Cancel {
+		logger.Infof("Gateway %s has no cancel API, voiding transaction %s locally", txn.Gateway, txn.ID)
+		return nil
+	}
+	pg, err := p.Factory.GetPaymentGatewayInstance(txn.Gateway)
+	if err != nil {
+		return err
+	}
+
+	result, err := p.executeWithRetry(p.circuitBreaker(txn.Gateway), &model.PgRoutingMaster{PaymentGateway: txn.Gateway}, txn, func() (interface{}, error) {
+		return pg.Cancel(txn.ID)
+	})
+	if err != nil {
+		return fmt.Errorf("cancel operation failed: %v", err)
+	}
+	if response := result.(*model.PaymentResponse); response.Status == gateway.StatusFailed {
+		return model.WrapError(model.ErrConflict, fmt.Sprintf("gateway %s refused to cancel the transaction: %s", txn.Gateway, response.Message))
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package tcp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// Supported framing modes
+const (
+	// FramingBinary2 prefixes each message with a 2-byte big-endian length
+	FramingBinary2 = "binary2"
+	// FramingASCII4 prefixes each message with a 4-digit ASCII length
+	FramingASCII4 = "ascii4"
+	// FramingNone has no header, each read is treated as one message
+	FramingNone = "none"
+)
+
+// DefaultMaxMessageSize is used when no max message size is configured
+const DefaultMaxMessageSize = 8192
+
+// ErrFrameTooLarge is returned when a frame exceeds the configured max message size
+var ErrFrameTooLarge = errors.New("frame exceeds max message size")
+
+// Framer reads and writes length-delimited messages on a stream
+type Framer interface {
+	// ReadFrame reads the next message, without its header
+	ReadFrame(r *bufio.Reader) ([]byte, error)
+	// WriteFrame writes a message prefixed with its header
+	WriteFrame(w io.Writer, msg []byte) error
+}
+
+// NewFramer creates the framer for the given mode
+func NewFramer(mode string, maxSize int) (Framer, error) {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxMessageSize
+	}
+	switch mode {
+	case FramingBinary2, "":
+		if maxSize > 0xFFFF {
+			maxSize = 0xFFFF
+		}
+		return &binary2Framer{maxSize: maxSize}, nil
+	case FramingASCII4:
+		if maxSize > 9999 {
+			maxSize = 9999
+		}
+		return &ascii4Framer{maxSize: maxSize}, nil
+	case FramingNone:
+		return &noneFramer{maxSize: maxSize}, nil
+	default:
+		return nil, fmt.Errorf("unsupported framing %q", mode)
+	}
+}
+
+// binary2Framer handles a 2-byte binary length header
+type binary2Framer struct {
+	maxSize int
+}
+
+func (f *binary2Framer) ReadFrame(r *bufio.Reader) ([]byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	return readBody(r, int(binary.BigEndian.Uint16(header)), f.maxSize)
+}
+
+func (f *binary2Framer) WriteFrame(w io.Writer, msg []byte) error {
+	if len(msg) > f.maxSize {
+		return ErrFrameTooLarge
+	}
+	frame := make([]byte, 2, 2+len(msg))
+	binary.BigEndian.PutUint16(frame, uint16(len(msg)))
+	_, err := w.Write(append(frame, msg...))
+	return err
+}
+
+// ascii4Framer handles a 4-digit ASCII length header
+type ascii4Framer struct {
+	maxSize int
+}
+
+func (f *ascii4Framer) ReadFrame(r *bufio.Reader) ([]byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	length, err := strconv.Atoi(string(header))
+	if err != nil || length < 0 {
+		return nil, fmt.Errorf("invalid length header %q", header)
+	}
+	return readBody(r, length, f.maxSize)
+}
+
+func (f *ascii4Framer) WriteFrame(w io.Writer, msg []byte) error {
+	if len(msg) > f.maxSize {
+		return ErrFrameTooLarge
+	}
+	_, err := w.Write(append([]byte(fmt.Sprintf("%04d", len(msg))), msg...))
+	return err
+}
+
+// noneFramer has no header, whatever a single read returns is one message
+type noneFramer struct {
+	maxSize int
+}
+
+func (f *noneFramer) ReadFrame(r *bufio.Reader) ([]byte, error) {
+	buf := make([]byte, f.maxSize)
+	n, err := r.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+func (f *noneFramer) WriteFrame(w io.Writer, msg []byte) error {
+	_, err := w.Write(msg)
+	return err
+}
+
+// readBody reads a message body of the given length, enforcing the max size
+func readBody(r *bufio.Reader, length, maxSize int) ([]byte, error) {
+	if length > maxSize {
+		return nil, fmt.Errorf("%w: %d > %d", ErrFrameTooLarge, length, maxSize)
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
@@ -1,11 +1,575 @@
 package tcp
 
-// ParseISO8583Message parses a raw ISO8583 message
-// TODO: Implement the actual parsing logic to extract the user ID and amount from the ISO8583 message
-func parseISO8583Message(rawMessage []byte) (string, int64, error) {
-
-	amt := int64(0)
-	user := ""
-	// parse ISO8583 & get the amount, userId
-	return user, amt, nil
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/wajidp/micro-payment-gateway/internal/service/currency"
+	"github.com/wajidp/micro-payment-gateway/internal/service/model"
+)
+
+// Version identifies the ISO8583 revision of a message, derived from the first MTI digit
+type Version int
+
+const (
+	Version1987 Version = iota
+	Version1993
+)
+
+// Encoding defines how the MTI, length prefixes and numeric fields are represented on the wire
+type Encoding int
+
+const (
+	// EncodingASCII represents every digit as one ASCII character
+	EncodingASCII Encoding = iota
+	// EncodingBCD packs two digits into one byte
+	EncodingBCD
+)
+
+// FieldType is the ISO8583 content type of a data element
+type FieldType int
+
+const (
+	// TypeNumeric is an "n" field, BCD packed when the codec uses BCD
+	TypeNumeric FieldType = iota
+	// TypeAlphaNumeric covers "a", "an" and "ans" fields which are always ASCII
+	TypeAlphaNumeric
+	// TypeBinary is a "b" field whose length is expressed in bytes
+	TypeBinary
+	// TypeTrack is a "z" track data field, packed like numeric data
+	TypeTrack
+)
+
+// LengthType describes whether a field is fixed or variable length
+type LengthType int
+
+const (
+	Fixed LengthType = iota
+	LLVar
+	LLLVar
+)
+
+// FieldSpec describes a single data element
+type FieldSpec struct {
+	Type        FieldType
+	LengthType  LengthType
+	Length      int // fixed length, or maximum length for variable fields
+	Description string
+}
+
+// Data elements used by the service
+const (
+	FieldPAN                   = 2
+	FieldProcessingCode        = 3
+	FieldAmount                = 4
+	FieldTransmissionDateTime  = 7
+	FieldSTAN                  = 11
+	FieldLocalTime             = 12
+	FieldLocalDate             = 13
+	FieldAcquirerID            = 32
+	FieldRRN                   = 37
+	FieldAuthCode              = 38
+	FieldResponseCode          = 39
+	FieldTerminalID            = 41
+	FieldMerchantID            = 42
+	FieldCurrency              = 49
+	FieldOriginalData1993      = 56
+	FieldNetworkManagementCode = 70
+	FieldOriginalData          = 90
+	FieldAccountID             = 102
+)
+
+// spec1987 is the field-spec table for ISO8583:1987
+var spec1987 = map[int]FieldSpec{
+	2:   {TypeNumeric, LLVar, 19, "Primary account number"},
+	3:   {TypeNumeric, Fixed, 6, "Processing code"},
+	4:   {TypeNumeric, Fixed, 12, "Amount, transaction"},
+	5:   {TypeNumeric, Fixed, 12, "Amount, settlement"},
+	6:   {TypeNumeric, Fixed, 12, "Amount, cardholder billing"},
+	7:   {TypeNumeric, Fixed, 10, "Transmission date & time"},
+	11:  {TypeNumeric, Fixed, 6, "System trace audit number"},
+	12:  {TypeNumeric, Fixed, 6, "Time, local transaction"},
+	13:  {TypeNumeric, Fixed, 4, "Date, local transaction"},
+	14:  {TypeNumeric, Fixed, 4, "Date, expiration"},
+	15:  {TypeNumeric, Fixed, 4, "Date, settlement"},
+	18:  {TypeNumeric, Fixed, 4, "Merchant type"},
+	19:  {TypeNumeric, Fixed, 3, "Acquiring institution country code"},
+	22:  {TypeNumeric, Fixed, 3, "POS entry mode"},
+	23:  {TypeNumeric, Fixed, 3, "Card sequence number"},
+	25:  {TypeNumeric, Fixed, 2, "POS condition code"},
+	32:  {TypeNumeric, LLVar, 11, "Acquiring institution identification code"},
+	35:  {TypeTrack, LLVar, 37, "Track 2 data"},
+	37:  {TypeAlphaNumeric, Fixed, 12, "Retrieval reference number"},
+	38:  {TypeAlphaNumeric, Fixed, 6, "Authorization identification response"},
+	39:  {TypeAlphaNumeric, Fixed, 2, "Response code"},
+	41:  {TypeAlphaNumeric, Fixed, 8, "Card acceptor terminal identification"},
+	42:  {TypeAlphaNumeric, Fixed, 15, "Card acceptor identification code"},
+	43:  {TypeAlphaNumeric, Fixed, 40, "Card acceptor name/location"},
+	48:  {TypeAlphaNumeric, LLLVar, 999, "Additional data - private"},
+	49:  {TypeAlphaNumeric, Fixed, 3, "Currency code, transaction"},
+	52:  {TypeBinary, Fixed, 8, "Personal identification number data"},
+	54:  {TypeAlphaNumeric, LLLVar, 120, "Additional amounts"},
+	60:  {TypeAlphaNumeric, LLLVar, 999, "Reserved national"},
+	63:  {TypeAlphaNumeric, LLLVar, 999, "Reserved private"},
+	64:  {TypeBinary, Fixed, 8, "Message authentication code"},
+	70:  {TypeNumeric, Fixed, 3, "Network management information code"},
+	90:  {TypeNumeric, Fixed, 42, "Original data elements"},
+	102: {TypeAlphaNumeric, LLVar, 28, "Account identification 1"},
+	103: {TypeAlphaNumeric, LLVar, 28, "Account identification 2"},
+	128: {TypeBinary, Fixed, 8, "Message authentication code"},
+}
+
+// spec1993 derives the ISO8583:1993 table from the 1987 one, overriding the elements that changed
+var spec1993 = func() map[int]FieldSpec {
+	spec := make(map[int]FieldSpec, len(spec1987))
+	for k, v := range spec1987 {
+		spec[k] = v
+	}
+	spec[12] = FieldSpec{TypeNumeric, Fixed, 12, "Date and time, local transaction"}
+	spec[22] = FieldSpec{TypeAlphaNumeric, Fixed, 12, "POS data code"}
+	spec[24] = FieldSpec{TypeNumeric, Fixed, 3, "Function code"}
+	spec[39] = FieldSpec{TypeNumeric, Fixed, 3, "Action code"}
+	spec[56] = FieldSpec{TypeNumeric, LLVar, 35, "Original data elements"}
+	delete(spec, 90)
+	return spec
+}()
+
+// Message is a decoded ISO8583 message, field values are kept as strings
+// (binary fields hold the raw bytes)
+type Message struct {
+	MTI    string
+	Fields map[int]string
+}
+
+// NewMessage creates an empty message with the given MTI
+func NewMessage(mti string) *Message {
+	return &Message{MTI: mti, Fields: make(map[int]string)}
+}
+
+// Get returns the value of a field and whether it is present
+func (m *Message) Get(field int) (string, bool) {
+	v, ok := m.Fields[field]
+	return v, ok
+}
+
+// Set sets the value of a field
+func (m *Message) Set(field int, value string) {
+	m.Fields[field] = value
+}
+
+// Version returns the ISO8583 revision encoded in the MTI
+func (m *Message) Version() Version {
+	if strings.HasPrefix(m.MTI, "1") {
+		return Version1993
+	}
+	return Version1987
+}
+
+// Codec packs and unpacks ISO8583 messages using a fixed wire encoding,
+// the field-spec table is selected from the MTI version
+type Codec struct {
+	Encoding Encoding
+}
+
+// NewCodec creates a codec for the given encoding
+func NewCodec(encoding Encoding) *Codec {
+	return &Codec{Encoding: encoding}
+}
+
+// ErrMalformedMessage is returned when a message cannot be decoded
+var ErrMalformedMessage = errors.New("malformed ISO8583 message")
+
+func (c *Codec) specFor(version Version) map[int]FieldSpec {
+	if version == Version1993 {
+		return spec1993
+	}
+	return spec1987
+}
+
+// Unpack decodes a raw ISO8583 message (without any framing header). A malformed
+// message whose MTI could be read is returned with the error, holding the fields
+// decoded before it, so that a format error can be answered.
+func (c *Codec) Unpack(raw []byte) (*Message, error) {
+	r := &reader{buf: raw}
+
+	mti, err := c.readDigits(r, 4, false)
+	if err != nil {
+		return nil, fmt.Errorf("%w: mti: %v", ErrMalformedMessage, err)
+	}
+	msg := NewMessage(mti)
+	spec := c.specFor(msg.Version())
+
+	bitmap, err := r.next(8)
+	if err != nil {
+		return msg, fmt.Errorf("%w: primary bitmap: %v", ErrMalformedMessage, err)
+	}
+	bits := append([]byte{}, bitmap...)
+	if bits[0]&0x80 != 0 {
+		secondary, err := r.next(8)
+		if err != nil {
+			return msg, fmt.Errorf("%w: secondary bitmap: %v", ErrMalformedMessage, err)
+		}
+		bits = append(bits, secondary...)
+	}
+
+	for field := 2; field <= len(bits)*8; field++ {
+		if !bitSet(bits, field) {
+			continue
+		}
+		fs, ok := spec[field]
+		if !ok {
+			return msg, fmt.Errorf("%w: no spec for field %d", ErrMalformedMessage, field)
+		}
+		value, err := c.unpackField(r, fs)
+		if err != nil {
+			return msg, fmt.Errorf("%w: field %d: %v", ErrMalformedMessage, field, err)
+		}
+		msg.Fields[field] = value
+	}
+
+	if r.remaining() != 0 {
+		return msg, fmt.Errorf("%w: %d trailing bytes", ErrMalformedMessage, r.remaining())
+	}
+	return msg, nil
+}
+
+// Pack encodes a message, a secondary bitmap is added when any field above 64 is present
+func (c *Codec) Pack(msg *Message) ([]byte, error) {
+	if len(msg.MTI) != 4 || !isDigits(msg.MTI) {
+		return nil, fmt.Errorf("invalid MTI %q", msg.MTI)
+	}
+	spec := c.specFor(msg.Version())
+
+	fields := make([]int, 0, len(msg.Fields))
+	for f := range msg.Fields {
+		if f < 2 || f > 128 {
+			return nil, fmt.Errorf("invalid field number %d", f)
+		}
+		fields = append(fields, f)
+	}
+	sort.Ints(fields)
+
+	bits := make([]byte, 8)
+	if len(fields) > 0 && fields[len(fields)-1] > 64 {
+		bits = make([]byte, 16)
+		bits[0] |= 0x80
+	}
+
+	out := c.packDigits(msg.MTI)
+	var body []byte
+	for _, f := range fields {
+		fs, ok := spec[f]
+		if !ok {
+			return nil, fmt.Errorf("no spec for field %d", f)
+		}
+		packed, err := c.packField(msg.Fields[f], fs)
+		if err != nil {
+			return nil, fmt.Errorf("field %d: %w", f, err)
+		}
+		setBit(bits, f)
+		body = append(body, packed...)
+	}
+
+	out = append(out, bits...)
+	return append(out, body...), nil
+}
+
+// unpackField reads a single data element
+func (c *Codec) unpackField(r *reader, fs FieldSpec) (string, error) {
+	length := fs.Length
+	if fs.LengthType != Fixed {
+		digits := 2
+		if fs.LengthType == LLLVar {
+			digits = 3
+		}
+		l, err := c.readDigits(r, digits, false)
+		if err != nil {
+			return "", err
+		}
+		if length, err = strconv.Atoi(l); err != nil {
+			return "", fmt.Errorf("invalid length %q", l)
+		}
+		if length > fs.Length {
+			return "", fmt.Errorf("length %d exceeds max %d", length, fs.Length)
+		}
+	}
+
+	if c.packed(fs) {
+		return c.readDigits(r, length, fs.Type == TypeTrack)
+	}
+	b, err := r.next(length)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// packField encodes a single data element, fixed numeric fields are zero padded
+// and fixed alphanumeric fields are space padded
+func (c *Codec) packField(value string, fs FieldSpec) ([]byte, error) {
+	if (fs.Type == TypeNumeric && !isDigits(value)) || (fs.Type == TypeTrack && !isTrack(value)) {
+		return nil, fmt.Errorf("invalid numeric value %q", value)
+	}
+
+	var out []byte
+	switch fs.LengthType {
+	case Fixed:
+		if len(value) > fs.Length {
+			return nil, fmt.Errorf("length %d exceeds %d", len(value), fs.Length)
+		}
+		switch fs.Type {
+		case TypeNumeric:
+			value = strings.Repeat("0", fs.Length-len(value)) + value
+		case TypeAlphaNumeric:
+			value = value + strings.Repeat(" ", fs.Length-len(value))
+		case TypeBinary:
+			if len(value) != fs.Length {
+				return nil, fmt.Errorf("binary length %d, want %d", len(value), fs.Length)
+			}
+		}
+	default:
+		if len(value) > fs.Length {
+			return nil, fmt.Errorf("length %d exceeds max %d", len(value), fs.Length)
+		}
+		format := "%02d"
+		if fs.LengthType == LLLVar {
+			format = "%03d"
+		}
+		out = c.packDigits(fmt.Sprintf(format, len(value)))
+	}
+
+	if c.packed(fs) {
+		return append(out, c.packDigits(value)...), nil
+	}
+	return append(out, value...), nil
+}
+
+// packed reports whether a field's content is BCD packed under this codec
+func (c *Codec) packed(fs FieldSpec) bool {
+	return c.Encoding == EncodingBCD && (fs.Type == TypeNumeric || fs.Type == TypeTrack)
+}
+
+// readDigits reads n digits using the codec encoding, track data may also
+// hold the '=' separator
+func (c *Codec) readDigits(r *reader, n int, track bool) (string, error) {
+	if c.Encoding == EncodingASCII {
+		b, err := r.next(n)
+		if err != nil {
+			return "", err
+		}
+		if !isDigits(string(b)) && !(track && isTrack(string(b))) {
+			return "", fmt.Errorf("non numeric data %q", b)
+		}
+		return string(b), nil
+	}
+
+	b, err := r.next((n + 1) / 2)
+	if err != nil {
+		return "", err
+	}
+	digits, err := decodeBCD(b, track)
+	if err != nil {
+		return "", err
+	}
+	// odd lengths are left padded with a zero nibble
+	return digits[len(digits)-n:], nil
+}
+
+// packDigits encodes digits using the codec encoding
+func (c *Codec) packDigits(digits string) []byte {
+	if c.Encoding == EncodingASCII {
+		return []byte(digits)
+	}
+	return encodeBCD(digits)
+}
+
+// encodeBCD packs a digit string two digits per byte, left padding odd lengths
+func encodeBCD(digits string) []byte {
+	if len(digits)%2 != 0 {
+		digits = "0" + digits
+	}
+	out := make([]byte, len(digits)/2)
+	for i := 0; i < len(out); i++ {
+		out[i] = nibble(digits[2*i])<<4 | nibble(digits[2*i+1])
+	}
+	return out
+}
+
+// decodeBCD unpacks BCD bytes into a digit string, the track separator nibble
+// is mapped to '=' in track data and any other nibble above 9 is rejected
+func decodeBCD(b []byte, track bool) (string, error) {
+	var sb strings.Builder
+	for _, v := range b {
+		for _, n := range [2]byte{v >> 4, v & 0x0f} {
+			switch {
+			case n <= 9:
+				sb.WriteByte('0' + n)
+			case track && n == nibble('='):
+				sb.WriteByte('=')
+			default:
+				return "", fmt.Errorf("invalid BCD digit %X in %X", n, b)
+			}
+		}
+	}
+	return sb.String(), nil
+}
+
+func nibble(c byte) byte {
+	return (c - '0') & 0x0f
+}
+
+func bitSet(bits []byte, field int) bool {
+	i := field - 1
+	return bits[i/8]&(0x80>>uint(i%8)) != 0
+}
+
+func setBit(bits []byte, field int) {
+	i := field - 1
+	bits[i/8] |= 0x80 >> uint(i%8)
+}
+
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// isTrack checks track 2 data, digits plus the '=' separator
+func isTrack(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if (s[i] < '0' || s[i] > '9') && s[i] != '=' {
+			return false
+		}
+	}
+	return true
+}
+
+// reader is a simple cursor over the raw message
+type reader struct {
+	buf []byte
+	pos int
+}
+
+func (r *reader) next(n int) ([]byte, error) {
+	if n < 0 || r.pos+n > len(r.buf) {
+		return nil, fmt.Errorf("unexpected end of message, need %d bytes at offset %d", n, r.pos)
+	}
+	b := r.buf[r.pos : r.pos+n]
+	r.pos += n
+	return b, nil
+}
+
+func (r *reader) remaining() int {
+	return len(r.buf) - r.pos
+}
+
+// ResponseCode is a version independent outcome which is rendered into field 39
+type ResponseCode int
+
+const (
+	RespApproved ResponseCode = iota
+	RespDoNotHonor
+	RespInvalidTransaction
+	RespInvalidAmount
+	RespInsufficientFunds
+	RespFormatError
+	RespDuplicateTransmission
+	RespSystemError
+)
+
+// responseCodes maps an outcome to its 1987 response code and 1993 action code
+var responseCodes = map[ResponseCode][2]string{
+	RespApproved:              {"00", "000"},
+	RespDoNotHonor:            {"05", "100"},
+	RespInvalidTransaction:    {"12", "902"},
+	RespInvalidAmount:         {"13", "110"},
+	RespInsufficientFunds:     {"51", "116"},
+	RespFormatError:           {"30", "904"},
+	RespDuplicateTransmission: {"94", "913"},
+	RespSystemError:           {"96", "909"},
+}
+
+// Code renders the response code for the given ISO8583 version
+func (r ResponseCode) Code(version Version) string {
+	return responseCodes[r][version]
+}
+
+// echoedFields are copied from a request into its response
+var echoedFields = []int{
+	FieldPAN, FieldProcessingCode, FieldAmount, FieldTransmissionDateTime, FieldSTAN,
+	FieldLocalTime, FieldLocalDate, FieldAcquirerID, FieldRRN, FieldTerminalID,
+	FieldMerchantID, FieldCurrency, FieldNetworkManagementCode, FieldAccountID,
+}
+
+// responseMTI derives the response MTI, e.g. 0200 -> 0210, 0100 -> 0110
+func responseMTI(mti string) string {
+	if len(mti) != 4 {
+		return mti
+	}
+	class := mti[2]
+	if class%2 == 0 {
+		class++
+	}
+	return mti[:2] + string(class) + mti[3:]
+}
+
+// newResponse builds the response for a request with the outcome in field 39
+func newResponse(req *Message, code ResponseCode) *Message {
+	resp := NewMessage(responseMTI(req.MTI))
+	for _, f := range echoedFields {
+		if v, ok := req.Get(f); ok {
+			resp.Set(f, v)
+		}
+	}
+	resp.Set(FieldResponseCode, code.Code(req.Version()))
+	return resp
+}
+
+// toPaymentRequest extracts the payment details from a financial message
+func toPaymentRequest(msg *Message) (*model.PaymentRequest, error) {
+	userID, ok := msg.Get(FieldAccountID)
+	if !ok || strings.TrimSpace(userID) == "" {
+		userID, _ = msg.Get(FieldPAN)
+	}
+
+	request := &model.PaymentRequest{UserID: strings.TrimSpace(userID)}
+	request.ProcessingCode, _ = msg.Get(FieldProcessingCode)
+	request.STAN, _ = msg.Get(FieldSTAN)
+
+	if amount, ok := msg.Get(FieldAmount); ok {
+		amt, err := strconv.ParseInt(amount, 10, 64)
+		if err != nil {
+			return nil, model.ErrInvalidAmount
+		}
+		request.Amount = amt
+	}
+
+	// field 49 carries the ISO 4217 numeric code
+	if code, ok := msg.Get(FieldCurrency); ok {
+		if c, found := currency.Default().LookupNumeric(code); found {
+			code = c.Code
+		}
+		request.Currency = code
+	}
+
+	return request, nil
+}
+
+// parseISO8583Message parses a raw ISO8583 message and extracts the payment request
+func parseISO8583Message(codec *Codec, rawMessage []byte) (*Message, *model.PaymentRequest, error) {
+	msg, err := codec.Unpack(rawMessage)
+	if err != nil {
+		return msg, nil, err
+	}
+	request, err := toPaymentRequest(msg)
+	if err != nil {
+		return msg, nil, err
+	}
+	return msg, request, nil
 }
@@ -0,0 +1,146 @@
+package tcp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newDepositMessage builds a 0200 cash-in request used across the tests.
+func newDepositMessage() *Message {
+	msg := NewMessage("0200")
+	msg.Set(FieldPAN, "4761739001010010")
+	msg.Set(FieldProcessingCode, "210000")
+	msg.Set(FieldAmount, "000000010000")
+	msg.Set(FieldSTAN, "000123")
+	msg.Set(FieldTerminalID, "TERM0001")
+	msg.Set(FieldCurrency, "840")
+	return msg
+}
+
+// TestCodec_RoundTrip verifies that packing and unpacking a message yields the same fields
+// for both ASCII and BCD encodings.
+func TestCodec_RoundTrip(t *testing.T) {
+	for _, encoding := range []Encoding{EncodingASCII, EncodingBCD} {
+		codec := NewCodec(encoding)
+		msg := newDepositMessage()
+		msg.Set(35, "4761739001010010=22122011143804400000")
+
+		raw, err := codec.Pack(msg)
+		assert.NoError(t, err)
+
+		decoded, err := codec.Unpack(raw)
+		assert.NoError(t, err)
+		assert.Equal(t, msg.MTI, decoded.MTI)
+		assert.Equal(t, msg.Fields, decoded.Fields)
+	}
+}
+
+// TestCodec_BCDLayout verifies the wire layout of a BCD packed message.
+func TestCodec_BCDLayout(t *testing.T) {
+	msg := NewMessage("0800")
+	msg.Set(FieldSTAN, "123")
+
+	raw, err := NewCodec(EncodingBCD).Pack(msg)
+	assert.NoError(t, err)
+	// MTI (2 bytes), primary bitmap (8 bytes) with bit 11 set, STAN zero padded to 6 digits (3 bytes)
+	assert.Equal(t, []byte{0x08, 0x00, 0x00, 0x20, 0, 0, 0, 0, 0, 0, 0x00, 0x01, 0x23}, raw)
+}
+
+// TestCodec_SecondaryBitmap verifies that fields above 64 produce a secondary bitmap.
+func TestCodec_SecondaryBitmap(t *testing.T) {
+	codec := NewCodec(EncodingASCII)
+	msg := newDepositMessage()
+	msg.Set(FieldAccountID, "user-42")
+
+	raw, err := codec.Pack(msg)
+	assert.NoError(t, err)
+	assert.Equal(t, byte(0x80), raw[4]&0x80, "Expected the secondary bitmap indicator to be set")
+
+	decoded, err := codec.Unpack(raw)
+	assert.NoError(t, err)
+	assert.Equal(t, "user-42", decoded.Fields[FieldAccountID])
+}
+
+// TestCodec_Unpack_Malformed verifies truncated and oversized messages are rejected.
+func TestCodec_Unpack_Malformed(t *testing.T) {
+	codec := NewCodec(EncodingASCII)
+	raw, err := codec.Pack(newDepositMessage())
+	assert.NoError(t, err)
+
+	msg, err := codec.Unpack(raw[:len(raw)-2])
+	assert.ErrorIs(t, err, ErrMalformedMessage)
+	if assert.NotNil(t, msg) {
+		assert.Equal(t, "0200", msg.MTI)
+		assert.Equal(t, "000123", msg.Fields[FieldSTAN])
+	}
+
+	_, err = codec.Unpack(append(raw, '0'))
+	assert.ErrorIs(t, err, ErrMalformedMessage)
+}
+
+// TestCodec_Unpack_InvalidDigits verifies that an MTI or a length prefix which is not made of
+// digits is a format error in both encodings.
+func TestCodec_Unpack_InvalidDigits(t *testing.T) {
+	// a primary bitmap with only field 2, an LLVAR, set
+	bitmap := string([]byte{0x40, 0, 0, 0, 0, 0, 0, 0})
+	tests := []struct {
+		name     string
+		encoding Encoding
+		raw      string
+	}{
+		{"hex length prefix", EncodingASCII, "0200" + bitmap + "0A" + "1234567890"},
+		{"separator in length prefix", EncodingASCII, "0200" + bitmap + "=1"},
+		{"separator in mti", EncodingASCII, "02=0" + bitmap + "01" + "1"},
+		{"bcd nibble above 9 in length prefix", EncodingBCD, "\x02\x00" + bitmap + "\xAF"},
+		{"bcd nibble above 9 in mti", EncodingBCD, "\x02\x0D" + bitmap + "\x01" + "\x01"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewCodec(tt.encoding).Unpack([]byte(tt.raw))
+			assert.ErrorIs(t, err, ErrMalformedMessage)
+		})
+	}
+
+	// the separator is still accepted in track data
+	codec := NewCodec(EncodingBCD)
+	msg := newDepositMessage()
+	msg.Set(35, "4761739001010010=2212")
+	raw, err := codec.Pack(msg)
+	assert.NoError(t, err)
+	decoded, err := codec.Unpack(raw)
+	assert.NoError(t, err)
+	assert.Equal(t, "4761739001010010=2212", decoded.Fields[35])
+}
+
+// TestParseISO8583Message verifies the payment request extracted from a financial message.
+func TestParseISO8583Message(t *testing.T) {
+	codec := NewCodec(EncodingASCII)
+	raw, err := codec.Pack(newDepositMessage())
+	assert.NoError(t, err)
+
+	_, request, err := parseISO8583Message(codec, raw)
+	assert.NoError(t, err)
+	assert.Equal(t, "4761739001010010", request.UserID)
+	assert.Equal(t, int64(10000), request.Amount)
+	assert.Equal(t, "USD", request.Currency)
+	assert.Equal(t, "210000", request.ProcessingCode)
+	assert.Equal(t, "000123", request.STAN)
+}
+
+// TestNewResponse verifies the response MTI and the version specific response code.
+func TestNewResponse(t *testing.T) {
+	resp := newResponse(newDepositMessage(), RespInsufficientFunds)
+	assert.Equal(t, "0210", resp.MTI)
+	assert.Equal(t, "51", resp.Fields[FieldResponseCode])
+	assert.Equal(t, "000123", resp.Fields[FieldSTAN])
+
+	req := NewMessage("1100")
+	req.Set(FieldSTAN, "000001")
+	resp = newResponse(req, RespApproved)
+	assert.Equal(t, "1110", resp.MTI)
+	assert.Equal(t, "000", resp.Fields[FieldResponseCode])
+
+	_, err := NewCodec(EncodingBCD).Pack(resp)
+	assert.NoError(t, err)
+}
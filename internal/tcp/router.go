@@ -0,0 +1,243 @@
+package tcp
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/wajidp/micro-payment-gateway/internal/logger"
+	"github.com/wajidp/micro-payment-gateway/internal/service"
+	"github.com/wajidp/micro-payment-gateway/internal/service/model"
+)
+
+// Message classes, the second MTI digit
+const (
+	ClassAuthorization     = '1'
+	ClassFinancial         = '2'
+	ClassReversal          = '4'
+	ClassNetworkManagement = '8'
+)
+
+// Transaction types, the first two digits of the processing code (field 3)
+const (
+	ProcWithdraw       = "01"
+	ProcDeposit        = "21"
+	ProcBalanceInquiry = "31"
+)
+
+// Network management information codes (field 70)
+const (
+	NetSignOn  = "001"
+	NetSignOff = "002"
+	NetEcho    = "301"
+)
+
+// dispatch routes a request to the matching service operation based on the MTI
+// and the processing code, and returns the response message
+func (s *TCPServer) dispatch(msg *Message, request *model.PaymentRequest) *Message {
+	if len(msg.MTI) != 4 || (msg.MTI[2]-'0')%2 != 0 {
+		// responses and acknowledgements are not expected by the server
+		return newResponse(msg, RespInvalidTransaction)
+	}
+
+	switch msg.MTI[1] {
+	case ClassAuthorization, ClassFinancial:
+		return s.handleFinancial(msg, request)
+	case ClassReversal:
+		return s.handleReversal(msg)
+	case ClassNetworkManagement:
+		return s.handleNetworkManagement(msg)
+	default:
+		return newResponse(msg, RespInvalidTransaction)
+	}
+}
+
+// handleFinancial handles cash-in, cash-out and balance inquiry
+func (s *TCPServer) handleFinancial(msg *Message, request *model.PaymentRequest) *Message {
+	if len(request.ProcessingCode) != 6 {
+		return newResponse(msg, RespFormatError)
+	}
+
+	var (
+		response *model.PaymentResponse
+		err      error
+	)
+	// a retransmission of the same STAN and transmission time from the terminal is answered once
+	request.IdempotencyKey = idempotencyKey(transmissionKey(msg))
+	switch request.ProcessingCode[:2] {
+	case ProcDeposit:
+		request.Type = model.Deposit
+		response, err = s.service.Deposit(request)
+	case ProcWithdraw:
+		request.Type = model.Withdraw
+		response, err = s.service.Withdraw(request)
+	case ProcBalanceInquiry:
+		return s.handleBalanceInquiry(msg, request)
+	default:
+		logger.Infof("Unsupported processing code %s", request.ProcessingCode)
+		return newResponse(msg, RespInvalidTransaction)
+	}
+
+	if err != nil {
+		logger.Infof("Failed to process payment: %v", err)
+		if errors.Is(err, model.ErrConflict) || errors.Is(err, model.ErrIdempotencyMismatch) {
+			return newResponse(msg, RespDuplicateTransmission)
+		}
+		return newResponse(msg, responseCodeFor(err))
+	}
+
+	logger.Infof("Payment processed successfully: %v", response)
+	s.remember(msg, response.TransactionID)
+	return newResponse(msg, RespApproved)
+}
+
+// handleBalanceInquiry returns the ledger and available balance of the wallet in
+// the currency of field 49 in field 54
+func (s *TCPServer) handleBalanceInquiry(msg *Message, request *model.PaymentRequest) *Message {
+	wallet, err := s.service.GetBalance(request.UserID, request.Currency)
+	if err != nil {
+		logger.Infof("Failed to get balance: %v", err)
+		return newResponse(msg, responseCodeFor(err))
+	}
+
+	currency, _ := msg.Get(FieldCurrency)
+	accountType := request.ProcessingCode[2:4]
+	resp := newResponse(msg, RespApproved)
+	resp.Set(54, additionalAmount(accountType, "01", currency, wallet.Balance)+
+		additionalAmount(accountType, "02", currency, wallet.Available()))
+	return resp
+}
+
+// additionalAmount formats one field 54 entry: account type, amount type, currency, sign and amount
+func additionalAmount(accountType, amountType, currency string, amount int64) string {
+	sign := "C"
+	if amount < 0 {
+		sign = "D"
+		amount = -amount
+	}
+	return fmt.Sprintf("%s%s%3s%s%012d", accountType, amountType, currency, sign, amount)
+}
+
+// handleReversal voids the original transaction identified by its original data elements,
+// the STAN and transmission date and time in field 90 or, in ISO8583:1993, the STAN and
+// local date and time in field 56. Without them fields 11 and 7 or 12 of the reversal
+// itself are used. Transactions not remembered since the server started are looked up
+// by the idempotency key their request was stored with.
+func (s *TCPServer) handleReversal(msg *Message) *Message {
+	stan, _ := msg.Get(FieldSTAN)
+	timeField, originalField, timeLength := FieldTransmissionDateTime, FieldOriginalData, 10
+	if msg.Version() == Version1993 {
+		timeField, originalField, timeLength = FieldLocalTime, FieldOriginalData1993, 12
+	}
+	transmitted, _ := msg.Get(timeField)
+	if original, ok := msg.Get(originalField); ok && len(original) >= 10+timeLength {
+		stan = original[4:10]
+		transmitted = original[10 : 10+timeLength]
+	}
+	terminal, _ := msg.Get(FieldTerminalID)
+
+	key := reversalKey(terminal, stan, transmitted)
+	txnID, ok := s.lookup(key)
+	if !ok {
+		txnID, ok = s.lookupStored(key)
+	}
+	if !ok {
+		logger.Infof("Reversal for unknown transaction %s", key)
+		return newResponse(msg, RespInvalidTransaction)
+	}
+
+	if _, err := s.service.Void(txnID, service.SourceAPI); err != nil {
+		logger.Infof("Failed to void transaction %s: %v", txnID, err)
+		return newResponse(msg, responseCodeFor(err))
+	}
+	return newResponse(msg, RespApproved)
+}
+
+// handleNetworkManagement answers echo, sign-on and sign-off messages
+func (s *TCPServer) handleNetworkManagement(msg *Message) *Message {
+	code, _ := msg.Get(FieldNetworkManagementCode)
+	switch code {
+	case NetSignOn, NetSignOff, NetEcho, "":
+		logger.Infof("Network management request %s code %s", msg.MTI, code)
+		return newResponse(msg, RespApproved)
+	default:
+		return newResponse(msg, RespInvalidTransaction)
+	}
+}
+
+// pruneInterval is how often expired reversal entries are dropped
+const pruneInterval = time.Minute
+
+// reversible is a transaction which can still be reversed until it expires
+type reversible struct {
+	txnID   string
+	expires time.Time
+}
+
+// reversalKey identifies the original request of a reversal, the STAN is only unique per
+// terminal and wraps around, so the transmission date and time is part of the key
+func reversalKey(terminal, stan, transmitted string) string {
+	return strings.TrimSpace(terminal) + "/" + stan + "/" + transmitted
+}
+
+// transmissionKey identifies a request by its terminal, STAN and transmission date and time,
+// or local date and time in ISO8583:1993 where the original data elements carry that one
+func transmissionKey(msg *Message) string {
+	terminal, _ := msg.Get(FieldTerminalID)
+	stan, _ := msg.Get(FieldSTAN)
+	timeField := FieldTransmissionDateTime
+	if msg.Version() == Version1993 {
+		timeField = FieldLocalTime
+	}
+	transmitted, _ := msg.Get(timeField)
+	return reversalKey(terminal, stan, transmitted)
+}
+
+// idempotencyKey is the idempotency key of the request with the transmission key
+func idempotencyKey(key string) string {
+	return "iso8583:" + key
+}
+
+// remember records the transaction created for a request so a reversal can void it later
+func (s *TCPServer) remember(msg *Message, txnID string) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now.Sub(s.lastPrune) >= pruneInterval {
+		for key, entry := range s.transactions {
+			if now.After(entry.expires) {
+				delete(s.transactions, key)
+			}
+		}
+		s.lastPrune = now
+	}
+	s.transactions[transmissionKey(msg)] = reversible{txnID: txnID, expires: now.Add(s.reversalWindow)}
+}
+
+// lookupStored finds the stored transaction created for a reversal key within the
+// reversal window, for transactions created before the server started
+func (s *TCPServer) lookupStored(key string) (string, bool) {
+	txn, err := s.service.TransactionByIdempotencyKey(idempotencyKey(key))
+	if err != nil {
+		if !errors.Is(err, model.ErrNotFound) {
+			logger.Infof("Failed to look up transaction %s: %v", key, err)
+		}
+		return "", false
+	}
+	if time.Since(txn.CreatedAt) > s.reversalWindow {
+		return "", false
+	}
+	return txn.ID, true
+}
+
+// lookup finds the transaction created for a reversal key which has not expired
+func (s *TCPServer) lookup(key string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.transactions[key]
+	if !ok || time.Now().After(entry.expires) {
+		return "", false
+	}
+	return entry.txnID, true
+}
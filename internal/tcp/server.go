@@ -1,21 +1,96 @@
 package tcp
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/wajidp/micro-payment-gateway/internal/logger"
 	"github.com/wajidp/micro-payment-gateway/internal/service"
 	"github.com/wajidp/micro-payment-gateway/internal/service/model"
 )
 
+// Options configures the wire format of the TCP server
+type Options struct {
+	// Framing is the length header mode, one of binary2, ascii4 or none
+	Framing string
+	// Encoding is the ISO8583 encoding, either ascii or bcd
+	Encoding string
+	// MaxMessageSize is the largest accepted message in bytes
+	MaxMessageSize int
+	// MaxConcurrent is the number of messages of one connection processed at
+	// the same time, further frames are not read until one completes
+	MaxConcurrent int
+	// IdleTimeout closes a connection on which no frame arrives for this long
+	IdleTimeout time.Duration
+	// ReversalWindow is how long a transaction can be reversed by its original data elements
+	ReversalWindow time.Duration
+}
+
+const (
+	defaultMaxConcurrent  = 16
+	defaultIdleTimeout    = 5 * time.Minute
+	defaultReversalWindow = 24 * time.Hour
+)
+
 //TCPServer which wraps the service
 type TCPServer struct {
 	service service.PaymentProcessorRepo
+	codec   *Codec
+	framer  Framer
+
+	maxConcurrent  int
+	idleTimeout    time.Duration
+	reversalWindow time.Duration
+
+	// transactions maps terminal/STAN/transmission time to the transaction ID for
+	// reversals, entries expire after reversalWindow
+	mu           sync.Mutex
+	transactions map[string]reversible
+	lastPrune    time.Time
 }
 
-func NewTCPServer(_service service.PaymentProcessorRepo) *TCPServer {
-	return &TCPServer{service: _service}
+// NewTCPServer creates the server, returns an error for unsupported options
+func NewTCPServer(_service service.PaymentProcessorRepo, opts Options) (*TCPServer, error) {
+	framer, err := NewFramer(opts.Framing, opts.MaxMessageSize)
+	if err != nil {
+		return nil, err
+	}
+
+	var encoding Encoding
+	switch strings.ToLower(opts.Encoding) {
+	case "", "ascii":
+		encoding = EncodingASCII
+	case "bcd":
+		encoding = EncodingBCD
+	default:
+		return nil, fmt.Errorf("unsupported ISO8583 encoding %q", opts.Encoding)
+	}
+
+	if opts.MaxConcurrent <= 0 {
+		opts.MaxConcurrent = defaultMaxConcurrent
+	}
+	if opts.IdleTimeout <= 0 {
+		opts.IdleTimeout = defaultIdleTimeout
+	}
+	if opts.ReversalWindow <= 0 {
+		opts.ReversalWindow = defaultReversalWindow
+	}
+
+	return &TCPServer{
+		service:        _service,
+		codec:          NewCodec(encoding),
+		framer:         framer,
+		maxConcurrent:  opts.MaxConcurrent,
+		idleTimeout:    opts.IdleTimeout,
+		reversalWindow: opts.ReversalWindow,
+		transactions:   make(map[string]reversible),
+	}, nil
 }
 
 // StartTCPServer starts the TCP server to accept ISO8583 messages
@@ -39,36 +114,134 @@ func (s *TCPServer) Start(port string) error {
 	}
 }
 
+// connection holds the per connection state, writes are serialised and
+// in-flight requests are tracked by terminal and STAN
+type connection struct {
+	net.Conn
+	writeMu  sync.Mutex
+	mu       sync.Mutex
+	inflight map[string]bool
+	wg       sync.WaitGroup
+}
+
+// handleConnection runs the read loop, up to maxConcurrent messages are processed
+// concurrently and each response is written back as soon as it is ready
 func (s *TCPServer) handleConnection(conn net.Conn) {
+	c := &connection{Conn: conn, inflight: make(map[string]bool)}
 	defer conn.Close()
+	// wait for in-flight requests so their responses can still be written
+	defer c.wg.Wait()
+
+	slots := make(chan struct{}, s.maxConcurrent)
+	reader := bufio.NewReader(conn)
+	for {
+		// stop reading while the connection has maxConcurrent messages in progress
+		slots <- struct{}{}
 
-	// Read incoming message
-	buf := make([]byte, 1024)
-	n, err := conn.Read(buf)
+		if err := conn.SetReadDeadline(time.Now().Add(s.idleTimeout)); err != nil {
+			logger.Infof("failed to set read deadline on connection %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+		rawMessage, err := s.framer.ReadFrame(reader)
+		if err != nil {
+			var netErr net.Error
+			switch {
+			case errors.Is(err, io.EOF):
+			case errors.As(err, &netErr) && netErr.Timeout():
+				logger.Infof("closing idle connection %s", conn.RemoteAddr())
+			default:
+				logger.Infof("failed to read from connection %s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+
+		c.wg.Add(1)
+		go func() {
+			defer func() {
+				<-slots
+				c.wg.Done()
+			}()
+			s.handleMessage(c, rawMessage)
+		}()
+	}
+}
+
+// handleMessage processes a single framed message
+func (s *TCPServer) handleMessage(c *connection, rawMessage []byte) {
+	logger.Infof("Received message: %x", rawMessage)
+
+	msg, paymentReq, err := parseISO8583Message(s.codec, rawMessage)
 	if err != nil {
-		logger.Infof("failed to read from connection: %v", err)
+		logger.Infof("Failed to parse ISO8583 message: %v", err)
+		if msg != nil {
+			s.reply(c, newResponse(msg, RespFormatError))
+		}
+		return
+	}
+
+	key := stanKey(msg)
+	if !c.begin(key) {
+		logger.Infof("Duplicate in-flight request %s", key)
+		s.reply(c, newResponse(msg, RespDuplicateTransmission))
 		return
 	}
+	defer c.end(key)
 
-	rawMessage := buf[:n]
-	logger.Infof("Received message: %s", rawMessage)
+	s.reply(c, s.dispatch(msg, paymentReq))
+}
 
-	user, amt, err := parseISO8583Message(rawMessage)
-	// Create a PaymentRequest based on the ISO8583 message
-	paymentReq := &model.PaymentRequest{
-		UserID:   user,
-		Currency: "USD",
-		Amount:   amt,
+// begin marks a request as in-flight, returns false if it already is
+func (c *connection) begin(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.inflight[key] {
+		return false
 	}
-	// Call the service layer to process the payment
-	response, err := s.service.Deposit(paymentReq)
+	c.inflight[key] = true
+	return true
+}
+
+// end clears the in-flight marker
+func (c *connection) end(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.inflight, key)
+}
+
+// reply packs and writes a response message to the connection
+func (s *TCPServer) reply(c *connection, msg *Message) {
+	raw, err := s.codec.Pack(msg)
 	if err != nil {
-		logger.Infof("Failed to process payment: %v", err)
-		conn.Write([]byte("Payment processing failed"))
+		logger.Infof("failed to pack response: %v", err)
 		return
 	}
 
-	logger.Infof("Payment processed successfully: %v", response)
-	conn.Write([]byte("Payment processed successfully"))
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if err := s.framer.WriteFrame(c, raw); err != nil {
+		logger.Infof("failed to write response: %v", err)
+	}
+}
 
+// stanKey is used to match in-flight requests, STAN is only unique per terminal
+func stanKey(msg *Message) string {
+	terminal, _ := msg.Get(FieldTerminalID)
+	stan, _ := msg.Get(FieldSTAN)
+	return strings.TrimSpace(terminal) + "/" + stan
+}
+
+// responseCodeFor maps a service error onto an ISO8583 response code
+func responseCodeFor(err error) ResponseCode {
+	switch {
+	case errors.Is(err, model.ErrInsufficientFunds):
+		return RespInsufficientFunds
+	case errors.Is(err, model.ErrInvalidAmount):
+		return RespInvalidAmount
+	case errors.Is(err, model.ErrDeclined):
+		return RespDoNotHonor
+	case errors.Is(err, model.ErrValidation):
+		return RespInvalidTransaction
+	default:
+		return RespSystemError
+	}
 }
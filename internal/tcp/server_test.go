@@ -0,0 +1,358 @@
+package tcp
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wajidp/micro-payment-gateway/internal/service/ledger"
+	"github.com/wajidp/micro-payment-gateway/internal/service/model"
+)
+
+// stubProcessor is a PaymentProcessorRepo which records requests and can delay responses.
+type stubProcessor struct {
+	delay   map[string]time.Duration
+	balance int64
+	voided  []string
+	// stored holds the transactions found by idempotency key
+	stored map[string]*model.Transaction
+}
+
+func (s *stubProcessor) Deposit(request *model.PaymentRequest) (*model.PaymentResponse, error) {
+	time.Sleep(s.delay[request.STAN])
+	return &model.PaymentResponse{Status: "success", TransactionID: "txn-" + request.STAN}, nil
+}
+
+func (s *stubProcessor) Withdraw(request *model.PaymentRequest) (*model.PaymentResponse, error) {
+	if s.balance < request.Amount {
+		return nil, model.ErrInsufficientFunds
+	}
+	return &model.PaymentResponse{Status: "success", TransactionID: "txn-" + request.STAN}, nil
+}
+
+func (s *stubProcessor) HandleCallback(callback *model.CallbackRequest) error {
+	return nil
+}
+
+func (s *stubProcessor) GetBalance(userID, currency string) (*model.Wallet, error) {
+	return &model.Wallet{UserID: userID, Currency: currency, Balance: s.balance}, nil
+}
+
+func (s *stubProcessor) ListWallets(userID string) ([]*model.Wallet, error) {
+	return []*model.Wallet{{UserID: userID, Currency: "USD", Balance: s.balance}}, nil
+}
+
+func (s *stubProcessor) LedgerEntries(account string) ([]ledger.Entry, error) {
+	return nil, nil
+}
+
+func (s *stubProcessor) TransactionByIdempotencyKey(key string) (*model.Transaction, error) {
+	txn, ok := s.stored[key]
+	if !ok {
+		return nil, model.ErrNotFound
+	}
+	return txn, nil
+}
+
+func (s *stubProcessor) Void(txnID, source string) (*model.Transaction, error) {
+	s.voided = append(s.voided, txnID)
+	return &model.Transaction{ID: txnID, State: model.StateVoided}, nil
+}
+
+func (s *stubProcessor) Refund(request *model.RefundRequest) (*model.PaymentResponse, error) {
+	return &model.PaymentResponse{Status: "success", TransactionID: "refund-" + request.TransactionID}, nil
+}
+
+// roundTrip sends a message on a fresh connection and returns the decoded response.
+func roundTrip(t *testing.T, server *TCPServer, msg *Message) *Message {
+	client, conn := net.Pipe()
+	defer client.Close()
+	go server.handleConnection(conn)
+
+	raw, err := server.codec.Pack(msg)
+	assert.NoError(t, err)
+	assert.NoError(t, server.framer.WriteFrame(client, raw))
+
+	frame, err := server.framer.ReadFrame(bufio.NewReader(client))
+	assert.NoError(t, err)
+	resp, err := server.codec.Unpack(frame)
+	assert.NoError(t, err)
+	return resp
+}
+
+// TestFramers verifies that each framing mode reads back what it writes.
+func TestFramers(t *testing.T) {
+	for _, mode := range []string{FramingBinary2, FramingASCII4} {
+		framer, err := NewFramer(mode, 64)
+		assert.NoError(t, err)
+
+		var buf bytes.Buffer
+		assert.NoError(t, framer.WriteFrame(&buf, []byte("first")))
+		assert.NoError(t, framer.WriteFrame(&buf, []byte("second")))
+
+		r := bufio.NewReader(&buf)
+		frame, err := framer.ReadFrame(r)
+		assert.NoError(t, err)
+		assert.Equal(t, "first", string(frame))
+		frame, err = framer.ReadFrame(r)
+		assert.NoError(t, err)
+		assert.Equal(t, "second", string(frame))
+	}
+
+	_, err := NewFramer("unknown", 0)
+	assert.Error(t, err)
+}
+
+// TestFramers_MaxMessageSize verifies that oversized frames are rejected.
+func TestFramers_MaxMessageSize(t *testing.T) {
+	framer, err := NewFramer(FramingASCII4, 4)
+	assert.NoError(t, err)
+
+	_, err = framer.ReadFrame(bufio.NewReader(bytes.NewBufferString("0010abcdefghij")))
+	assert.ErrorIs(t, err, ErrFrameTooLarge)
+	assert.ErrorIs(t, framer.WriteFrame(&bytes.Buffer{}, []byte("abcdef")), ErrFrameTooLarge)
+}
+
+// TestTCPServer_PersistentConnection sends several messages back to back on one connection
+// and verifies that every response arrives, matched by STAN, even when they complete out of order.
+func TestTCPServer_PersistentConnection(t *testing.T) {
+	processor := &stubProcessor{delay: map[string]time.Duration{"000001": 100 * time.Millisecond}}
+	server, err := NewTCPServer(processor, Options{Framing: FramingBinary2})
+	assert.NoError(t, err)
+
+	client, conn := net.Pipe()
+	defer client.Close()
+	go server.handleConnection(conn)
+
+	for _, stan := range []string{"000001", "000002", "000003"} {
+		msg := newDepositMessage()
+		msg.Set(FieldSTAN, stan)
+		raw, err := server.codec.Pack(msg)
+		assert.NoError(t, err)
+		assert.NoError(t, server.framer.WriteFrame(client, raw))
+	}
+
+	reader := bufio.NewReader(client)
+	var order []string
+	for i := 0; i < 3; i++ {
+		frame, err := server.framer.ReadFrame(reader)
+		assert.NoError(t, err)
+		resp, err := server.codec.Unpack(frame)
+		assert.NoError(t, err)
+		assert.Equal(t, "0210", resp.MTI)
+		assert.Equal(t, "00", resp.Fields[FieldResponseCode])
+		order = append(order, resp.Fields[FieldSTAN])
+	}
+	assert.ElementsMatch(t, []string{"000001", "000002", "000003"}, order)
+	assert.Equal(t, "000001", order[2], "Expected the delayed request to be answered last")
+}
+
+// TestTCPServer_ConnectionLimits verifies that a connection processes at most MaxConcurrent
+// messages at a time and is closed once it stays idle for IdleTimeout.
+func TestTCPServer_ConnectionLimits(t *testing.T) {
+	processor := &stubProcessor{delay: map[string]time.Duration{"000001": 200 * time.Millisecond}}
+	server, err := NewTCPServer(processor, Options{MaxConcurrent: 1, IdleTimeout: 300 * time.Millisecond})
+	assert.NoError(t, err)
+
+	client, conn := net.Pipe()
+	defer client.Close()
+	go server.handleConnection(conn)
+
+	// the delayed message holds the only slot, the second frame is not read until it completes
+	for _, stan := range []string{"000001", "000002"} {
+		msg := newDepositMessage()
+		msg.Set(FieldSTAN, stan)
+		raw, err := server.codec.Pack(msg)
+		assert.NoError(t, err)
+		go server.framer.WriteFrame(client, raw)
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	reader := bufio.NewReader(client)
+	var order []string
+	for i := 0; i < 2; i++ {
+		frame, err := server.framer.ReadFrame(reader)
+		assert.NoError(t, err)
+		resp, err := server.codec.Unpack(frame)
+		assert.NoError(t, err)
+		order = append(order, resp.Fields[FieldSTAN])
+	}
+	assert.Equal(t, []string{"000001", "000002"}, order)
+
+	// nothing more is sent, the server closes the connection
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = server.framer.ReadFrame(reader)
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+// TestTCPServer_Routing verifies that the MTI and processing code select the service operation
+// and the response MTI and code.
+func TestTCPServer_Routing(t *testing.T) {
+	processor := &stubProcessor{balance: 5000}
+	server, err := NewTCPServer(processor, Options{})
+	assert.NoError(t, err)
+
+	// cash-out above the balance is declined with insufficient funds
+	withdraw := newDepositMessage()
+	withdraw.Set(FieldProcessingCode, "010000")
+	resp := roundTrip(t, server, withdraw)
+	assert.Equal(t, "0210", resp.MTI)
+	assert.Equal(t, "51", resp.Fields[FieldResponseCode])
+
+	// balance inquiry returns ledger and available balance in field 54
+	inquiry := newDepositMessage()
+	inquiry.MTI = "0100"
+	inquiry.Set(FieldProcessingCode, "310000")
+	resp = roundTrip(t, server, inquiry)
+	assert.Equal(t, "0110", resp.MTI)
+	assert.Equal(t, "00", resp.Fields[FieldResponseCode])
+	assert.Equal(t, "0001840C0000000050000002840C000000005000", resp.Fields[54])
+
+	// unknown processing code
+	unknown := newDepositMessage()
+	unknown.Set(FieldProcessingCode, "990000")
+	resp = roundTrip(t, server, unknown)
+	assert.Equal(t, "12", resp.Fields[FieldResponseCode])
+
+	// echo test
+	echo := NewMessage("0800")
+	echo.Set(FieldSTAN, "000009")
+	echo.Set(FieldNetworkManagementCode, NetEcho)
+	resp = roundTrip(t, server, echo)
+	assert.Equal(t, "0810", resp.MTI)
+	assert.Equal(t, "00", resp.Fields[FieldResponseCode])
+}
+
+// TestTCPServer_MalformedMessage verifies that a message which cannot be decoded is answered
+// with a format error instead of being dropped.
+func TestTCPServer_MalformedMessage(t *testing.T) {
+	server, err := NewTCPServer(&stubProcessor{}, Options{})
+	assert.NoError(t, err)
+
+	client, conn := net.Pipe()
+	defer client.Close()
+	go server.handleConnection(conn)
+
+	raw, err := server.codec.Pack(newDepositMessage())
+	assert.NoError(t, err)
+	assert.NoError(t, server.framer.WriteFrame(client, raw[:len(raw)-2]))
+
+	frame, err := server.framer.ReadFrame(bufio.NewReader(client))
+	assert.NoError(t, err)
+	resp, err := server.codec.Unpack(frame)
+	assert.NoError(t, err)
+	assert.Equal(t, "0210", resp.MTI)
+	assert.Equal(t, "30", resp.Fields[FieldResponseCode])
+	assert.Equal(t, "000123", resp.Fields[FieldSTAN])
+}
+
+// TestTCPServer_Reversal verifies that a 0400 voids the transaction created for the original
+// terminal, STAN and transmission date and time.
+func TestTCPServer_Reversal(t *testing.T) {
+	processor := &stubProcessor{}
+	server, err := NewTCPServer(processor, Options{})
+	assert.NoError(t, err)
+
+	deposit := newDepositMessage()
+	deposit.Set(FieldTransmissionDateTime, "1016120000")
+	resp := roundTrip(t, server, deposit)
+	assert.Equal(t, "00", resp.Fields[FieldResponseCode])
+
+	// the same STAN sent at another time is a different transaction
+	reversal := newDepositMessage()
+	reversal.MTI = "0400"
+	reversal.Set(FieldSTAN, "000124")
+	reversal.Set(FieldOriginalData, "0200000123"+"1015120000"+strings.Repeat("0", 22))
+	resp = roundTrip(t, server, reversal)
+	assert.Equal(t, "12", resp.Fields[FieldResponseCode])
+	assert.Empty(t, processor.voided)
+
+	reversal.Set(FieldOriginalData, "0200000123"+"1016120000"+strings.Repeat("0", 22))
+	resp = roundTrip(t, server, reversal)
+	assert.Equal(t, "0410", resp.MTI)
+	assert.Equal(t, "00", resp.Fields[FieldResponseCode])
+	assert.Equal(t, []string{"txn-000123"}, processor.voided)
+
+	// reversal of an unknown transaction
+	reversal.Set(FieldOriginalData, "0200999999"+"1016120000"+strings.Repeat("0", 22))
+	resp = roundTrip(t, server, reversal)
+	assert.Equal(t, "12", resp.Fields[FieldResponseCode])
+}
+
+// TestTCPServer_Reversal1993 verifies that an ISO8583:1993 reversal finds the original
+// by the STAN and local date and time in field 56.
+func TestTCPServer_Reversal1993(t *testing.T) {
+	processor := &stubProcessor{}
+	server, err := NewTCPServer(processor, Options{})
+	assert.NoError(t, err)
+
+	deposit := newDepositMessage()
+	deposit.MTI = "1200"
+	deposit.Set(FieldLocalTime, "261016120000")
+	resp := roundTrip(t, server, deposit)
+	assert.Equal(t, "000", resp.Fields[FieldResponseCode])
+
+	reversal := newDepositMessage()
+	reversal.MTI = "1420"
+	reversal.Set(FieldSTAN, "000124")
+	reversal.Set(FieldLocalTime, "261016120500")
+	reversal.Set(FieldOriginalData1993, "1200000123"+"261016120000"+"06123456")
+	resp = roundTrip(t, server, reversal)
+	assert.Equal(t, "1430", resp.MTI)
+	assert.Equal(t, "000", resp.Fields[FieldResponseCode])
+	assert.Equal(t, []string{"txn-000123"}, processor.voided)
+}
+
+// TestTCPServer_ReversalAfterRestart verifies that a transaction the server does not remember
+// is found by the idempotency key its request was stored with, within the reversal window.
+func TestTCPServer_ReversalAfterRestart(t *testing.T) {
+	processor := &stubProcessor{stored: map[string]*model.Transaction{
+		"iso8583:TERM0001/000123/1016120000": {ID: "txn-stored", CreatedAt: time.Now()},
+		"iso8583:TERM0001/000200/1016120000": {ID: "txn-old", CreatedAt: time.Now().Add(-48 * time.Hour)},
+	}}
+	server, err := NewTCPServer(processor, Options{})
+	assert.NoError(t, err)
+
+	reversal := newDepositMessage()
+	reversal.MTI = "0400"
+	reversal.Set(FieldOriginalData, "0200000123"+"1016120000"+strings.Repeat("0", 22))
+	resp := roundTrip(t, server, reversal)
+	assert.Equal(t, "00", resp.Fields[FieldResponseCode])
+	assert.Equal(t, []string{"txn-stored"}, processor.voided)
+
+	// past the reversal window
+	reversal.Set(FieldOriginalData, "0200000200"+"1016120000"+strings.Repeat("0", 22))
+	resp = roundTrip(t, server, reversal)
+	assert.Equal(t, "12", resp.Fields[FieldResponseCode])
+	assert.Equal(t, []string{"txn-stored"}, processor.voided)
+}
+
+// TestTCPServer_ReversalWindow verifies that transactions can no longer be reversed once the
+// reversal window passed and that expired entries are dropped.
+func TestTCPServer_ReversalWindow(t *testing.T) {
+	processor := &stubProcessor{}
+	server, err := NewTCPServer(processor, Options{ReversalWindow: 50 * time.Millisecond})
+	assert.NoError(t, err)
+
+	resp := roundTrip(t, server, newDepositMessage())
+	assert.Equal(t, "00", resp.Fields[FieldResponseCode])
+	time.Sleep(100 * time.Millisecond)
+
+	// without field 90 the reversal carries the STAN of the original
+	reversal := newDepositMessage()
+	reversal.MTI = "0400"
+	resp = roundTrip(t, server, reversal)
+	assert.Equal(t, "12", resp.Fields[FieldResponseCode])
+	assert.Empty(t, processor.voided)
+
+	server.lastPrune = time.Time{}
+	next := newDepositMessage()
+	next.Set(FieldSTAN, "000124")
+	roundTrip(t, server, next)
+	assert.Len(t, server.transactions, 1)
+}